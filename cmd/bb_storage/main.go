@@ -4,17 +4,27 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/buildbarn/bb-storage/pkg/ac"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/circular"
 	"github.com/buildbarn/bb-storage/pkg/blobstore/completenesschecking"
 	blobstore_configuration "github.com/buildbarn/bb-storage/pkg/blobstore/configuration"
 	"github.com/buildbarn/bb-storage/pkg/builder"
 	"github.com/buildbarn/bb-storage/pkg/cas"
+	"github.com/buildbarn/bb-storage/pkg/clock"
 	bb_grpc "github.com/buildbarn/bb-storage/pkg/grpc"
 	"github.com/buildbarn/bb-storage/pkg/opencensus"
+	"github.com/buildbarn/bb-storage/pkg/opentelemetry"
+	"github.com/buildbarn/bb-storage/pkg/proto/blobdeleter"
+	"github.com/buildbarn/bb-storage/pkg/proto/blobpresence"
+	"github.com/buildbarn/bb-storage/pkg/proto/circularadmin"
 	"github.com/buildbarn/bb-storage/pkg/proto/configuration/bb_storage"
+	"github.com/buildbarn/bb-storage/pkg/proto/referenceindex"
 	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/gorilla/mux"
 
 	"google.golang.org/genproto/googleapis/bytestream"
@@ -35,15 +45,40 @@ func main() {
 	if configuration.Jaeger != nil {
 		opencensus.Initialize(configuration.Jaeger)
 	}
+	if configuration.OpenTelemetry != nil {
+		flush := opentelemetry.Initialize(configuration.OpenTelemetry)
+		defer flush()
+	}
+
+	// Normalization of instance names provided by clients. Instance
+	// names that are part of the configuration are normalized as
+	// well, so that they match.
+	normalization := configuration.InstanceNameNormalization
+	instanceNameNormalizer := util.NewInstanceNameNormalizer(
+		normalization.GetLowercase(),
+		normalization.GetTrimSlashes(),
+		normalization.GetAliases())
 
 	// Storage access.
 	contentAddressableStorageBlobAccess, actionCache, err := blobstore_configuration.CreateBlobAccessObjectsFromConfig(
 		configuration.Blobstore,
-		int(configuration.MaximumMessageSizeBytes))
+		int(configuration.MaximumMessageSizeBytes),
+		instanceNameNormalizer)
 	if err != nil {
 		log.Fatal("Failed to create blob access: ", err)
 	}
 
+	// Optionally permit removing individual objects. This needs to
+	// be set up before decorators that don't support removal are
+	// applied.
+	var blobDeleterServer blobdeleter.BlobDeleterServer
+	if configuration.EnableBlobDeleter {
+		if len(configuration.AdminGrpcServers) == 0 {
+			log.Fatal("The BlobDeleter service can only be enabled if administrative gRPC servers are configured")
+		}
+		blobDeleterServer = blobstore.NewBlobDeleterServer(contentAddressableStorageBlobAccess, actionCache, instanceNameNormalizer)
+	}
+
 	// If this instance of bb-storage has access to all data (as in,
 	// it's not a single shard within a distributed setup), it can
 	// be configured to verify that all objects referenced by
@@ -65,9 +100,9 @@ func main() {
 	// scheduler. This ensures that GetCapabilities() works for
 	// those instances.
 	schedulers := map[string]builder.BuildQueue{}
-	nonExecutableScheduler := builder.NewNonExecutableBuildQueue()
+	nonExecutableScheduler := builder.NewNonExecutableBuildQueue(int(configuration.MaximumMessageSizeBytes))
 	for _, instance := range configuration.AllowAcUpdatesForInstances {
-		schedulers[instance] = nonExecutableScheduler
+		schedulers[instanceNameNormalizer(instance)] = nonExecutableScheduler
 	}
 
 	// Register schedulers for instances capable of compiling.
@@ -76,10 +111,10 @@ func main() {
 		if err != nil {
 			log.Fatal("Failed to create scheduler RPC client: ", err)
 		}
-		schedulers[name] = builder.NewForwardingBuildQueue(scheduler)
+		schedulers[instanceNameNormalizer(name)] = builder.NewForwardingBuildQueue(scheduler)
 	}
 	buildQueue := builder.NewDemultiplexingBuildQueue(func(instance string) (builder.BuildQueue, error) {
-		scheduler, ok := schedulers[instance]
+		scheduler, ok := schedulers[instanceNameNormalizer(instance)]
 		if !ok {
 			return nil, status.Errorf(codes.InvalidArgument, "Unknown instance name")
 		}
@@ -90,8 +125,50 @@ func main() {
 	// announce this through GetCapabilities().
 	allowActionCacheUpdatesForInstances := map[string]bool{}
 	for _, instance := range configuration.AllowAcUpdatesForInstances {
-		schedulers[instance] = builder.NewUpdatableActionCacheBuildQueue(schedulers[instance])
-		allowActionCacheUpdatesForInstances[instance] = true
+		normalizedInstance := instanceNameNormalizer(instance)
+		if !allowActionCacheUpdatesForInstances[normalizedInstance] {
+			schedulers[normalizedInstance] = builder.NewUpdatableActionCacheBuildQueue(schedulers[normalizedInstance])
+			allowActionCacheUpdatesForInstances[normalizedInstance] = true
+		}
+	}
+
+	maximumByteStreamReadDuration := time.Hour
+	if configuration.MaximumByteStreamReadDuration != nil {
+		maximumByteStreamReadDuration, err = ptypes.Duration(configuration.MaximumByteStreamReadDuration)
+		if err != nil {
+			log.Fatal("Failed to parse maximum ByteStream read duration: ", err)
+		}
+	}
+	maximumByteStreamReadDurationPerInstance := map[string]time.Duration{}
+	for instance, duration := range configuration.MaximumByteStreamReadDurationPerInstance {
+		maximumByteStreamReadDurationPerInstance[instanceNameNormalizer(instance)], err = ptypes.Duration(duration)
+		if err != nil {
+			log.Fatalf("Failed to parse maximum ByteStream read duration for instance %#v: %s", instance, err)
+		}
+	}
+	byteStreamReadTransformsPerInstance := map[string]blobstore.GetTransformingBlobAccess{}
+	for instance, transform := range configuration.ByteStreamReadTransformsPerInstance {
+		switch transform {
+		case bb_storage.ByteStreamReadTransform_NONE:
+		case bb_storage.ByteStreamReadTransform_GZIP:
+			byteStreamReadTransformsPerInstance[instanceNameNormalizer(instance)] = blobstore.NewGetTransformingBlobAccess(contentAddressableStorageBlobAccess, blobstore.GzipGetTransform)
+		case bb_storage.ByteStreamReadTransform_BASE64:
+			byteStreamReadTransformsPerInstance[instanceNameNormalizer(instance)] = blobstore.NewGetTransformingBlobAccess(contentAddressableStorageBlobAccess, blobstore.Base64GetTransform)
+		default:
+			log.Fatalf("Unknown ByteStream read transform for instance %#v", instance)
+		}
+	}
+
+	// Optionally record which objects in the Content Addressable
+	// Storage are referenced by ActionResults.
+	actionCacheServer := ac.NewActionCacheServer(actionCache, allowActionCacheUpdatesForInstances, int(configuration.MaximumMessageSizeBytes), instanceNameNormalizer)
+	var referenceIndex ac.ReferenceIndex
+	if configuration.ReferenceIndexPath != "" {
+		referenceIndex, err = ac.NewFileReferenceIndex(configuration.ReferenceIndexPath, 1<<20)
+		if err != nil {
+			log.Fatal("Failed to create reference index: ", err)
+		}
+		actionCacheServer = ac.NewReferenceIndexingActionCacheServer(actionCacheServer, referenceIndex, allowActionCacheUpdatesForInstances, instanceNameNormalizer)
 	}
 
 	go func() {
@@ -100,16 +177,55 @@ func main() {
 			bb_grpc.NewGRPCServersFromConfigurationAndServe(
 				configuration.GrpcServers,
 				func(s *grpc.Server) {
-					remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(actionCache, allowActionCacheUpdatesForInstances, int(configuration.MaximumMessageSizeBytes)))
-					remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess))
-					bytestream.RegisterByteStreamServer(s, cas.NewByteStreamServer(contentAddressableStorageBlobAccess, 1<<16))
+					remoteexecution.RegisterActionCacheServer(s, actionCacheServer)
+					remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess, int(configuration.MaximumMessageSizeBytes), instanceNameNormalizer))
+					bytestream.RegisterByteStreamServer(s, cas.NewByteStreamServer(
+						contentAddressableStorageBlobAccess,
+						1<<16,
+						clock.SystemClock,
+						maximumByteStreamReadDuration,
+						maximumByteStreamReadDurationPerInstance,
+						configuration.ByteStreamSkipExistingWrites,
+						instanceNameNormalizer,
+						byteStreamReadTransformsPerInstance))
+					if configuration.BlobPresenceMaximumDigestsPerRequest > 0 {
+						blobpresence.RegisterBlobPresenceServer(s, cas.NewBlobPresenceServer(
+							contentAddressableStorageBlobAccess,
+							int(configuration.BlobPresenceMaximumDigestsPerRequest),
+							instanceNameNormalizer))
+					}
 					remoteexecution.RegisterCapabilitiesServer(s, buildQueue)
 					remoteexecution.RegisterExecutionServer(s, buildQueue)
-				}))
+				},
+				bb_grpc.NewMessageSizeServerOptions(int(configuration.MaximumMessageSizeBytes))...))
 	}()
 
+	// Administrative services are served separately, so that they
+	// are not reachable by regular clients.
+	if len(configuration.AdminGrpcServers) > 0 {
+		go func() {
+			log.Fatal(
+				"Administrative gRPC server failure: ",
+				bb_grpc.NewGRPCServersFromConfigurationAndServe(
+					configuration.AdminGrpcServers,
+					func(s *grpc.Server) {
+						if blobDeleterServer != nil {
+							blobdeleter.RegisterBlobDeleterServer(s, blobDeleterServer)
+						}
+						if referenceIndex != nil {
+							referenceindex.RegisterReferenceIndexServer(s, ac.NewReferenceIndexServer(referenceIndex, instanceNameNormalizer))
+						}
+						circularadmin.RegisterCircularAdminServer(s, circular.NewAdminServer())
+					},
+					bb_grpc.NewMessageSizeServerOptions(int(configuration.MaximumMessageSizeBytes))...))
+		}()
+	}
+
 	// Web server for metrics and profiling.
 	router := mux.NewRouter()
 	util.RegisterAdministrativeHTTPEndpoints(router)
+	router.HandleFunc("/-/ready", blobstore.ServeReadiness)
+	router.HandleFunc("/-/storage_stats", blobstore.ServeStorageStats)
+	router.HandleFunc("/-/fsck", circular.ServeFsck)
 	log.Fatal(http.ListenAndServe(configuration.HttpListenAddress, router))
 }
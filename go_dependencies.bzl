@@ -171,6 +171,24 @@ def bb_storage_go_dependencies():
         strip_prefix = "opencensus-go-0.21.0",
     )
 
+    go_repository(
+        name = "io_opentelemetry_go_otel",
+        importpath = "go.opentelemetry.io/otel",
+        tag = "v0.4.3",
+    )
+
+    go_repository(
+        name = "io_opentelemetry_go_otel_exporters_trace_jaeger",
+        importpath = "go.opentelemetry.io/otel/exporters/trace/jaeger",
+        tag = "v0.4.3",
+    )
+
+    go_repository(
+        name = "com_github_apache_thrift",
+        importpath = "github.com/apache/thrift",
+        tag = "v0.13.0",
+    )
+
     go_repository(
         name = "com_google_cloud_go",
         commit = "09ad026a62f0561b7f7e276569eda11a6afc9773",
@@ -183,6 +201,12 @@ def bb_storage_go_dependencies():
         importpath = "golang.org/x/xerrors",
     )
 
+    go_repository(
+        name = "com_github_klauspost_compress",
+        importpath = "github.com/klauspost/compress",
+        tag = "v1.10.3",
+    )
+
     go_repository(
         name = "com_github_hashicorp_golang_lru",
         importpath = "github.com/hashicorp/golang-lru",
@@ -16,20 +16,32 @@ type actionCacheServer struct {
 	blobAccess               blobstore.BlobAccess
 	allowUpdatesForInstances map[string]bool
 	maximumMessageSizeBytes  int
+	instanceNameNormalizer   util.InstanceNameNormalizer
 }
 
 // NewActionCacheServer creates a GRPC service for serving the contents
 // of a Bazel Action Cache (AC) to Bazel.
-func NewActionCacheServer(blobAccess blobstore.BlobAccess, allowUpdatesForInstances map[string]bool, maximumMessageSizeBytes int) remoteexecution.ActionCacheServer {
+//
+// Updates are only permitted for the instance names provided in
+// allowUpdatesForInstances. For other instance names the Action Cache
+// is read-only, causing UpdateActionResult() to fail with
+// PERMISSION_DENIED. This makes it possible to run replicas that only
+// serve cache hits.
+//
+// Instance names provided by clients are normalized using
+// instanceNameNormalizer. Keys of allowUpdatesForInstances should
+// already be normalized.
+func NewActionCacheServer(blobAccess blobstore.BlobAccess, allowUpdatesForInstances map[string]bool, maximumMessageSizeBytes int, instanceNameNormalizer util.InstanceNameNormalizer) remoteexecution.ActionCacheServer {
 	return &actionCacheServer{
 		blobAccess:               blobAccess,
 		allowUpdatesForInstances: allowUpdatesForInstances,
 		maximumMessageSizeBytes:  maximumMessageSizeBytes,
+		instanceNameNormalizer:   instanceNameNormalizer,
 	}
 }
 
 func (s *actionCacheServer) GetActionResult(ctx context.Context, in *remoteexecution.GetActionResultRequest) (*remoteexecution.ActionResult, error) {
-	digest, err := util.NewDigest(in.InstanceName, in.ActionDigest)
+	digest, err := util.NewDigest(s.instanceNameNormalizer(in.InstanceName), in.ActionDigest)
 	if err != nil {
 		return nil, err
 	}
@@ -37,12 +49,12 @@ func (s *actionCacheServer) GetActionResult(ctx context.Context, in *remoteexecu
 }
 
 func (s *actionCacheServer) UpdateActionResult(ctx context.Context, in *remoteexecution.UpdateActionResultRequest) (*remoteexecution.ActionResult, error) {
-	digest, err := util.NewDigest(in.InstanceName, in.ActionDigest)
+	digest, err := util.NewDigest(s.instanceNameNormalizer(in.InstanceName), in.ActionDigest)
 	if err != nil {
 		return nil, err
 	}
 	if instance := digest.GetInstance(); !s.allowUpdatesForInstances[instance] {
-		return nil, status.Errorf(codes.Unimplemented, "This service can only be used to get action results for instance %#v", instance)
+		return nil, status.Errorf(codes.PermissionDenied, "This service can only be used to get action results for instance %#v", instance)
 	}
 	return in.ActionResult, s.blobAccess.Put(
 		ctx,
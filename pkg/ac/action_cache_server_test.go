@@ -0,0 +1,114 @@
+package ac_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/ac"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestActionCacheServerGetActionResult(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	actionCacheServer := ac.NewActionCacheServer(blobAccess, map[string]bool{}, 1000, util.IdentityInstanceNameNormalizer)
+	partialDigest := &remoteexecution.Digest{
+		Hash:      "ba8b67f7b7a2e9ca0ab9bd8bc5ff4a26",
+		SizeBytes: 123,
+	}
+	actionDigest := util.MustNewDigest("debian8", partialDigest)
+
+	t.Run("NotFound", func(t *testing.T) {
+		blobAccess.EXPECT().Get(ctx, actionDigest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+
+		_, err := actionCacheServer.GetActionResult(ctx, &remoteexecution.GetActionResultRequest{
+			InstanceName: "debian8",
+			ActionDigest: partialDigest,
+		})
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		actionResult := &remoteexecution.ActionResult{
+			ExitCode: 42,
+		}
+		blobAccess.EXPECT().Get(ctx, actionDigest).Return(buffer.NewACBufferFromActionResult(actionResult, buffer.Irreparable))
+
+		response, err := actionCacheServer.GetActionResult(ctx, &remoteexecution.GetActionResultRequest{
+			InstanceName: "debian8",
+			ActionDigest: partialDigest,
+		})
+		require.NoError(t, err)
+		require.Equal(t, int32(42), response.ExitCode)
+	})
+}
+
+func TestActionCacheServerUpdateActionResult(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	actionCacheServer := ac.NewActionCacheServer(blobAccess, map[string]bool{"debian8": true}, 1000, util.NewInstanceNameNormalizer(true, false, nil))
+	partialDigest := &remoteexecution.Digest{
+		Hash:      "ba8b67f7b7a2e9ca0ab9bd8bc5ff4a26",
+		SizeBytes: 123,
+	}
+	actionResult := &remoteexecution.ActionResult{
+		ExitCode: 42,
+	}
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		// Instances for which updates are not permitted should
+		// be read-only.
+		_, err := actionCacheServer.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+			InstanceName: "ubuntu1804",
+			ActionDigest: partialDigest,
+			ActionResult: actionResult,
+		})
+		require.Equal(t, status.Error(codes.PermissionDenied, "This service can only be used to get action results for instance \"ubuntu1804\""), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		blobAccess.EXPECT().Put(ctx, util.MustNewDigest("debian8", partialDigest), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				storedActionResult, err := b.ToActionResult(1000)
+				require.NoError(t, err)
+				require.Equal(t, int32(42), storedActionResult.ExitCode)
+				return nil
+			})
+
+		_, err := actionCacheServer.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+			InstanceName: "debian8",
+			ActionDigest: partialDigest,
+			ActionResult: actionResult,
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("Normalized", func(t *testing.T) {
+		// Instance names should be normalized before checking
+		// whether updates are permitted.
+		blobAccess.EXPECT().Put(ctx, util.MustNewDigest("debian8", partialDigest), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+
+		_, err := actionCacheServer.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+			InstanceName: "Debian8",
+			ActionDigest: partialDigest,
+			ActionResult: actionResult,
+		})
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,412 @@
+package ac
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The file backing the reference index consists of a sequence of
+// records, each having the following layout:
+//
+// - Payload length: uvarint, followed by the payload.
+// - Checksum: CRC-32 (Castagnoli) of the payload, little endian.
+//
+// The payload of a record contains the following fields:
+//
+// - Instance name of the action: uvarint length, followed by the name.
+// - Hash of the action: uvarint length, followed by the hash.
+// - Size of the action: uvarint.
+// - Number of referenced objects: uvarint, followed by the hash (uvarint
+//   length, followed by the hash) and size (uvarint) of every object.
+
+var fileReferenceIndexChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+type fileReferenceIndex struct {
+	*inMemoryReferenceIndex
+
+	path                       string
+	minimumCompactionSizeBytes int64
+
+	// syncLock is held in shared mode while appending and
+	// synchronizing records, and in exclusive mode while compacting,
+	// so that the file is never replaced while records are pending.
+	syncLock sync.RWMutex
+
+	lock               sync.Mutex
+	file               *os.File
+	sizeBytes          int64
+	compactedSizeBytes int64
+	err                error
+}
+
+// NewFileReferenceIndex creates a ReferenceIndex that persists
+// references by appending them to a file. Upon startup, all references
+// stored in the file are loaded into memory.
+//
+// AddReferences() only returns after references have been synchronized
+// to disk. Records that were written partially due to a crash are
+// discarded while loading. As the corresponding call to
+// AddReferences() never completed, no ActionResult can have been
+// stored that depends on them.
+//
+// As actions tend to be uploaded repeatedly, the file is compacted
+// once it has grown to at least minimumCompactionSizeBytes and twice
+// its size after the previous compaction. Compaction rewrites the file,
+// so that it contains a single record per action. The new file is
+// synchronized and atomically renamed over the old one, meaning that
+// a crash during compaction never causes references to be lost.
+func NewFileReferenceIndex(path string, minimumCompactionSizeBytes int64) (ReferenceIndex, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to open reference index %#v", path)
+	}
+	ri, err := loadFileReferenceIndex(file)
+	if err != nil {
+		file.Close()
+		return nil, util.StatusWrapf(err, "Failed to load reference index %#v", path)
+	}
+	ri.path = path
+	ri.minimumCompactionSizeBytes = minimumCompactionSizeBytes
+	return ri, nil
+}
+
+func loadFileReferenceIndex(file *os.File) (*fileReferenceIndex, error) {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to read records")
+	}
+
+	// Replay all complete records.
+	ctx := context.Background()
+	index := newInMemoryReferenceIndex()
+	offset := 0
+	for {
+		payload, recordSizeBytes, ok := parseFileReferenceIndexRecord(data[offset:])
+		if !ok {
+			break
+		}
+		actionDigest, blobDigests, err := parseFileReferenceIndexPayload(payload)
+		if err != nil {
+			return nil, util.StatusWrapfWithCode(err, codes.DataLoss, "Malformed record at offset %d", offset)
+		}
+		if err := index.AddReferences(ctx, actionDigest, blobDigests); err != nil {
+			return nil, err
+		}
+		offset += recordSizeBytes
+	}
+
+	// Discard any trailing partially written record, so that new
+	// records are appended directly after the last complete one.
+	if offset != len(data) {
+		if err := file.Truncate(int64(offset)); err != nil {
+			return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to truncate partially written record")
+		}
+	}
+	if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to seek to end of records")
+	}
+	return &fileReferenceIndex{
+		inMemoryReferenceIndex: index,
+		file:                   file,
+		sizeBytes:              int64(offset),
+	}, nil
+}
+
+// parseFileReferenceIndexRecord extracts the payload of the record
+// stored at the start of a byte slice. It returns false if the record
+// is incomplete or its checksum does not match.
+func parseFileReferenceIndexRecord(data []byte) ([]byte, int, bool) {
+	payloadSizeBytes, n := binary.Uvarint(data)
+	if n <= 0 || payloadSizeBytes > uint64(len(data)-n) || uint64(len(data)-n)-payloadSizeBytes < 4 {
+		return nil, 0, false
+	}
+	payload := data[n : n+int(payloadSizeBytes)]
+	checksum := binary.LittleEndian.Uint32(data[n+len(payload):])
+	if crc32.Checksum(payload, fileReferenceIndexChecksumTable) != checksum {
+		return nil, 0, false
+	}
+	return payload, n + len(payload) + 4, true
+}
+
+// fileReferenceIndexPayloadReader is a helper for parsing the fields
+// stored in the payload of a record.
+type fileReferenceIndexPayloadReader struct {
+	data []byte
+	err  error
+}
+
+func (r *fileReferenceIndexPayloadReader) readUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = status.Error(codes.InvalidArgument, "Invalid variable length integer")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *fileReferenceIndexPayloadReader) readString() string {
+	length := r.readUvarint()
+	if r.err != nil {
+		return ""
+	}
+	if length > uint64(len(r.data)) {
+		r.err = status.Errorf(codes.InvalidArgument, "String of %d bytes exceeds record boundary", length)
+		return ""
+	}
+	s := string(r.data[:length])
+	r.data = r.data[length:]
+	return s
+}
+
+func parseFileReferenceIndexPayload(payload []byte) (*util.Digest, []*util.Digest, error) {
+	r := fileReferenceIndexPayloadReader{data: payload}
+	instance := r.readString()
+	actionHash := r.readString()
+	actionSizeBytes := r.readUvarint()
+	blobCount := r.readUvarint()
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	actionDigest, err := util.NewDigest(instance, &remoteexecution.Digest{
+		Hash:      actionHash,
+		SizeBytes: int64(actionSizeBytes),
+	})
+	if err != nil {
+		return nil, nil, util.StatusWrap(err, "Invalid action digest")
+	}
+
+	var blobDigests []*util.Digest
+	for i := uint64(0); i < blobCount; i++ {
+		blobHash := r.readString()
+		blobSizeBytes := r.readUvarint()
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+		blobDigest, err := actionDigest.NewDerivedDigest(&remoteexecution.Digest{
+			Hash:      blobHash,
+			SizeBytes: int64(blobSizeBytes),
+		})
+		if err != nil {
+			return nil, nil, util.StatusWrap(err, "Invalid object digest")
+		}
+		blobDigests = append(blobDigests, blobDigest)
+	}
+	if len(r.data) != 0 {
+		return nil, nil, status.Error(codes.InvalidArgument, "Record contains trailing data")
+	}
+	return actionDigest, blobDigests, nil
+}
+
+func appendFileReferenceIndexUvarint(b []byte, v uint64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	return append(b, encoded[:binary.PutUvarint(encoded[:], v)]...)
+}
+
+func appendFileReferenceIndexString(b []byte, s string) []byte {
+	return append(appendFileReferenceIndexUvarint(b, uint64(len(s))), s...)
+}
+
+func newFileReferenceIndexRecord(actionDigest *util.Digest, blobDigests []*util.Digest) []byte {
+	payload := appendFileReferenceIndexString(nil, actionDigest.GetInstance())
+	payload = appendFileReferenceIndexString(payload, actionDigest.GetHashString())
+	payload = appendFileReferenceIndexUvarint(payload, uint64(actionDigest.GetSizeBytes()))
+	payload = appendFileReferenceIndexUvarint(payload, uint64(len(blobDigests)))
+	for _, blobDigest := range blobDigests {
+		payload = appendFileReferenceIndexString(payload, blobDigest.GetHashString())
+		payload = appendFileReferenceIndexUvarint(payload, uint64(blobDigest.GetSizeBytes()))
+	}
+	record := appendFileReferenceIndexUvarint(nil, uint64(len(payload)))
+	record = append(record, payload...)
+	var checksum [4]byte
+	binary.LittleEndian.PutUint32(checksum[:], crc32.Checksum(payload, fileReferenceIndexChecksumTable))
+	return append(record, checksum[:]...)
+}
+
+func (ri *fileReferenceIndex) AddReferences(ctx context.Context, actionDigest *util.Digest, blobDigests []*util.Digest) error {
+	record := newFileReferenceIndexRecord(actionDigest, blobDigests)
+	ri.syncLock.RLock()
+	err := ri.appendRecord(record)
+	if err == nil {
+		err = ri.inMemoryReferenceIndex.AddReferences(ctx, actionDigest, blobDigests)
+	}
+	ri.syncLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	ri.maybeCompact()
+	return nil
+}
+
+// appendRecord writes a single record to the end of the file and
+// synchronizes it to disk. The caller must hold syncLock in shared
+// mode.
+func (ri *fileReferenceIndex) appendRecord(record []byte) error {
+	ri.lock.Lock()
+	if ri.err != nil {
+		ri.lock.Unlock()
+		return ri.err
+	}
+	if _, err := ri.file.Write(record); err != nil {
+		// Remove the partially written record. Records
+		// appended after it would otherwise be discarded
+		// while loading.
+		if truncateErr := ri.file.Truncate(ri.sizeBytes); truncateErr != nil {
+			ri.err = util.StatusWrapWithCode(truncateErr, codes.Internal, "Failed to truncate partially written record")
+		} else if _, seekErr := ri.file.Seek(ri.sizeBytes, io.SeekStart); seekErr != nil {
+			ri.err = util.StatusWrapWithCode(seekErr, codes.Internal, "Failed to seek to end of records")
+		}
+		ri.lock.Unlock()
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to write record")
+	}
+	ri.sizeBytes += int64(len(record))
+	ri.lock.Unlock()
+
+	// Synchronize outside the lock, so that concurrent calls may
+	// share the cost of a single synchronization. Once
+	// synchronization fails, it is unknown which records have been
+	// persisted, so refuse to add any further references.
+	if err := ri.file.Sync(); err != nil {
+		err = util.StatusWrapWithCode(err, codes.Internal, "Failed to synchronize records")
+		ri.lock.Lock()
+		if ri.err == nil {
+			ri.err = err
+		}
+		ri.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// maybeCompact rewrites the file if it has grown sufficiently since
+// the previous compaction. Failures are only logged, as the references
+// have already been persisted in the existing file.
+func (ri *fileReferenceIndex) maybeCompact() {
+	// Only acquire syncLock in exclusive mode if compaction is
+	// due, as doing so blocks concurrent calls to AddReferences().
+	ri.lock.Lock()
+	compactionDue := ri.isCompactionDue()
+	ri.lock.Unlock()
+	if !compactionDue {
+		return
+	}
+
+	ri.syncLock.Lock()
+	defer ri.syncLock.Unlock()
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+
+	// Another call may have compacted the file in the meantime.
+	if !ri.isCompactionDue() {
+		return
+	}
+	if err := ri.compact(); err != nil {
+		log.Printf("Failed to compact reference index %#v: %s", ri.path, err)
+	}
+}
+
+// isCompactionDue returns whether the file has grown sufficiently
+// since the previous compaction. The caller must hold lock.
+func (ri *fileReferenceIndex) isCompactionDue() bool {
+	return ri.err == nil && ri.sizeBytes >= ri.minimumCompactionSizeBytes && ri.sizeBytes >= 2*ri.compactedSizeBytes
+}
+
+// compact replaces the file with one that contains a single record
+// per action. The caller must hold syncLock in exclusive mode and lock.
+func (ri *fileReferenceIndex) compact() error {
+	// Invert the in-memory index, so that all objects referenced
+	// by an action can be written as a single record.
+	type action struct {
+		actionDigest *util.Digest
+		blobDigests  []*util.Digest
+	}
+	actions := map[string]*action{}
+	var actionKeys []string
+	ri.inMemoryReferenceIndex.lock.RLock()
+	for _, entry := range ri.inMemoryReferenceIndex.entries {
+		for actionKey, actionDigest := range entry.referencers {
+			a, ok := actions[actionKey]
+			if !ok {
+				a = &action{actionDigest: actionDigest}
+				actions[actionKey] = a
+				actionKeys = append(actionKeys, actionKey)
+			}
+			a.blobDigests = append(a.blobDigests, entry.blobDigest)
+		}
+	}
+	ri.inMemoryReferenceIndex.lock.RUnlock()
+	sort.Strings(actionKeys)
+
+	temporaryPath := ri.path + ".tmp"
+	file, err := os.OpenFile(temporaryPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return util.StatusWrapfWithCode(err, codes.Internal, "Failed to create %#v", temporaryPath)
+	}
+	w := bufio.NewWriter(file)
+	sizeBytes := int64(0)
+	for _, actionKey := range actionKeys {
+		a := actions[actionKey]
+		record := newFileReferenceIndexRecord(a.actionDigest, a.blobDigests)
+		if _, err := w.Write(record); err != nil {
+			file.Close()
+			os.Remove(temporaryPath)
+			return util.StatusWrapWithCode(err, codes.Internal, "Failed to write record")
+		}
+		sizeBytes += int64(len(record))
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		os.Remove(temporaryPath)
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to write records")
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(temporaryPath)
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to synchronize records")
+	}
+	if err := os.Rename(temporaryPath, ri.path); err != nil {
+		file.Close()
+		os.Remove(temporaryPath)
+		return util.StatusWrapfWithCode(err, codes.Internal, "Failed to rename %#v", temporaryPath)
+	}
+
+	// The compacted file is now in place, meaning that records
+	// must no longer be appended to the old one.
+	ri.file.Close()
+	ri.file = file
+	ri.sizeBytes = sizeBytes
+	ri.compactedSizeBytes = sizeBytes
+
+	// Ensure that the rename itself is persisted. If this fails,
+	// it is unknown which version of the file is retained upon
+	// restart, so refuse to add any further references.
+	directory, err := os.Open(filepath.Dir(ri.path))
+	if err != nil {
+		ri.err = util.StatusWrapWithCode(err, codes.Internal, "Failed to open directory containing reference index")
+		return ri.err
+	}
+	defer directory.Close()
+	if err := directory.Sync(); err != nil {
+		ri.err = util.StatusWrapWithCode(err, codes.Internal, "Failed to synchronize directory containing reference index")
+		return ri.err
+	}
+	return nil
+}
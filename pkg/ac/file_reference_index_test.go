@@ -0,0 +1,121 @@
+package ac_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/ac"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileReferenceIndex(t *testing.T) {
+	ctx := context.Background()
+
+	directory, err := ioutil.TempDir("", "reference_index")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "references")
+
+	actionDigest1 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "ba8b67f7b7a2e9ca0ab9bd8bc5ff4a26",
+		SizeBytes: 123,
+	})
+	actionDigest2 := util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "c4ca4238a0b923820dcc509a6f75849b",
+		SizeBytes: 456,
+	})
+	blobDigest1 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+		SizeBytes: 11,
+	})
+	blobDigest2 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+
+	index, err := ac.NewFileReferenceIndex(path, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, index.AddReferences(ctx, actionDigest1, []*util.Digest{blobDigest1, blobDigest2}))
+	require.NoError(t, index.AddReferences(ctx, actionDigest2, []*util.Digest{
+		util.MustNewDigest("ubuntu1804", blobDigest1.GetPartialDigest()),
+	}))
+
+	t.Run("Reload", func(t *testing.T) {
+		// References should be retained across restarts.
+		index, err := ac.NewFileReferenceIndex(path, 1<<20)
+		require.NoError(t, err)
+
+		referencers, err := index.GetReferencers(ctx, blobDigest1)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{actionDigest1, actionDigest2}, referencers)
+
+		referencers, err = index.GetReferencers(ctx, blobDigest2)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{actionDigest1}, referencers)
+	})
+
+	t.Run("PartiallyWrittenRecord", func(t *testing.T) {
+		// Simulate a crash while appending a record. The
+		// incomplete record should be discarded, while records
+		// appended afterwards should be retained.
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte{0x40, 0x01, 0x02})
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		index, err := ac.NewFileReferenceIndex(path, 1<<20)
+		require.NoError(t, err)
+		info2, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, info.Size(), info2.Size())
+
+		actionDigest3 := util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "c81e728d9d4c2f636f067f89cc14862c",
+			SizeBytes: 789,
+		})
+		require.NoError(t, index.AddReferences(ctx, actionDigest3, []*util.Digest{blobDigest2}))
+
+		index, err = ac.NewFileReferenceIndex(path, 1<<20)
+		require.NoError(t, err)
+		referencers, err := index.GetReferencers(ctx, blobDigest2)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{actionDigest1, actionDigest3}, referencers)
+	})
+
+	t.Run("Compaction", func(t *testing.T) {
+		// Repeatedly adding the same references should cause
+		// the file to be compacted once it grows beyond the
+		// configured size.
+		index, err := ac.NewFileReferenceIndex(path, 1)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			require.NoError(t, index.AddReferences(ctx, actionDigest1, []*util.Digest{blobDigest1}))
+		}
+		info1, err := os.Stat(path)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			require.NoError(t, index.AddReferences(ctx, actionDigest1, []*util.Digest{blobDigest1}))
+		}
+		info2, err := os.Stat(path)
+		require.NoError(t, err)
+		require.LessOrEqual(t, info2.Size(), 2*info1.Size())
+
+		// All references should be retained after compaction.
+		index, err = ac.NewFileReferenceIndex(path, 1<<20)
+		require.NoError(t, err)
+		referencers, err := index.GetReferencers(ctx, blobDigest1)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{actionDigest1, actionDigest2}, referencers)
+		referencers, err = index.GetReferencers(ctx, blobDigest2)
+		require.NoError(t, err)
+		require.Len(t, referencers, 2)
+	})
+}
@@ -0,0 +1,90 @@
+package ac
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+// ReferenceIndex keeps track of which actions reference objects stored
+// in the Content Addressable Storage through their ActionResults.
+//
+// Only implementations that persist references may be used to
+// determine whether objects in the Content Addressable Storage can
+// safely be garbage collected. Implementations that lose references
+// upon restart can only be used as a cache.
+type ReferenceIndex interface {
+	// AddReferences records that an action references a set of
+	// objects in the Content Addressable Storage.
+	AddReferences(ctx context.Context, actionDigest *util.Digest, blobDigests []*util.Digest) error
+	// GetReferencers returns the digests of all actions that are
+	// known to reference an object.
+	GetReferencers(ctx context.Context, blobDigest *util.Digest) ([]*util.Digest, error)
+}
+
+type inMemoryReferenceIndexEntry struct {
+	blobDigest  *util.Digest
+	referencers map[string]*util.Digest
+}
+
+type inMemoryReferenceIndex struct {
+	lock    sync.RWMutex
+	entries map[string]*inMemoryReferenceIndexEntry
+}
+
+// NewInMemoryReferenceIndex creates a ReferenceIndex that stores all
+// references in memory. References are lost upon restart, meaning that
+// this index can only be used as a cache. It must not be used to
+// decide whether objects may be garbage collected.
+func NewInMemoryReferenceIndex() ReferenceIndex {
+	return newInMemoryReferenceIndex()
+}
+
+func newInMemoryReferenceIndex() *inMemoryReferenceIndex {
+	return &inMemoryReferenceIndex{
+		entries: map[string]*inMemoryReferenceIndexEntry{},
+	}
+}
+
+func (ri *inMemoryReferenceIndex) AddReferences(ctx context.Context, actionDigest *util.Digest, blobDigests []*util.Digest) error {
+	actionKey := actionDigest.GetKey(util.DigestKeyWithInstance)
+
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	for _, blobDigest := range blobDigests {
+		// Objects in the Content Addressable Storage are shared
+		// between instances. Index them without instance name.
+		blobKey := blobDigest.GetKey(util.DigestKeyWithoutInstance)
+		entry, ok := ri.entries[blobKey]
+		if !ok {
+			entry = &inMemoryReferenceIndexEntry{
+				blobDigest:  blobDigest,
+				referencers: map[string]*util.Digest{},
+			}
+			ri.entries[blobKey] = entry
+		}
+		entry.referencers[actionKey] = actionDigest
+	}
+	return nil
+}
+
+func (ri *inMemoryReferenceIndex) GetReferencers(ctx context.Context, blobDigest *util.Digest) ([]*util.Digest, error) {
+	ri.lock.RLock()
+	var referencers map[string]*util.Digest
+	if entry, ok := ri.entries[blobDigest.GetKey(util.DigestKeyWithoutInstance)]; ok {
+		referencers = entry.referencers
+	}
+	actionKeys := make([]string, 0, len(referencers))
+	for actionKey := range referencers {
+		actionKeys = append(actionKeys, actionKey)
+	}
+	sort.Strings(actionKeys)
+	actionDigests := make([]*util.Digest, 0, len(actionKeys))
+	for _, actionKey := range actionKeys {
+		actionDigests = append(actionDigests, referencers[actionKey])
+	}
+	ri.lock.RUnlock()
+	return actionDigests, nil
+}
@@ -0,0 +1,46 @@
+package ac
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/proto/referenceindex"
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+type referenceIndexServer struct {
+	index                  ReferenceIndex
+	instanceNameNormalizer util.InstanceNameNormalizer
+}
+
+// NewReferenceIndexServer creates a gRPC service that allows clients
+// to query which actions reference an object stored in the Content
+// Addressable Storage, according to a ReferenceIndex. Instance names
+// provided by clients are normalized using instanceNameNormalizer.
+func NewReferenceIndexServer(index ReferenceIndex, instanceNameNormalizer util.InstanceNameNormalizer) referenceindex.ReferenceIndexServer {
+	return &referenceIndexServer{
+		index:                  index,
+		instanceNameNormalizer: instanceNameNormalizer,
+	}
+}
+
+func (s *referenceIndexServer) GetReferencers(ctx context.Context, in *referenceindex.GetReferencersRequest) (*referenceindex.GetReferencersResponse, error) {
+	blobDigest, err := util.NewDigest(s.instanceNameNormalizer(in.InstanceName), in.BlobDigest)
+	if err != nil {
+		return nil, err
+	}
+	actionDigests, err := s.index.GetReferencers(ctx, blobDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	referencers := make([]*referenceindex.Referencer, 0, len(actionDigests))
+	for _, actionDigest := range actionDigests {
+		referencers = append(referencers, &referenceindex.Referencer{
+			InstanceName: actionDigest.GetInstance(),
+			ActionDigest: actionDigest.GetPartialDigest(),
+		})
+	}
+	return &referenceindex.GetReferencersResponse{
+		Referencers: referencers,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package ac_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/ac"
+	"github.com/buildbarn/bb-storage/pkg/proto/referenceindex"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReferenceIndexServerGetReferencers(t *testing.T) {
+	ctx := context.Background()
+
+	index := ac.NewInMemoryReferenceIndex()
+	server := ac.NewReferenceIndexServer(index, util.IdentityInstanceNameNormalizer)
+	actionDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "ba8b67f7b7a2e9ca0ab9bd8bc5ff4a26",
+		SizeBytes: 123,
+	})
+	blobDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+		SizeBytes: 11,
+	})
+	require.NoError(t, index.AddReferences(ctx, actionDigest, []*util.Digest{blobDigest}))
+
+	t.Run("MalformedDigest", func(t *testing.T) {
+		_, err := server.GetReferencers(ctx, &referenceindex.GetReferencersRequest{
+			InstanceName: "ubuntu1804",
+			BlobDigest: &remoteexecution.Digest{
+				Hash:      "cafebabe",
+				SizeBytes: 12,
+			},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Unknown digest hash length: 8 characters"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		// Referencers should be returned regardless of the
+		// instance name provided in the request.
+		response, err := server.GetReferencers(ctx, &referenceindex.GetReferencersRequest{
+			InstanceName: "ubuntu1804",
+			BlobDigest:   blobDigest.GetPartialDigest(),
+		})
+		require.NoError(t, err)
+		require.True(t, proto.Equal(&referenceindex.GetReferencersResponse{
+			Referencers: []*referenceindex.Referencer{
+				{
+					InstanceName: "debian8",
+					ActionDigest: actionDigest.GetPartialDigest(),
+				},
+			},
+		}, response))
+	})
+}
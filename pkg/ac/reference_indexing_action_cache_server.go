@@ -0,0 +1,96 @@
+package ac
+
+import (
+	"context"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type referenceIndexingActionCacheServer struct {
+	remoteexecution.ActionCacheServer
+	index                    ReferenceIndex
+	allowUpdatesForInstances map[string]bool
+	instanceNameNormalizer   util.InstanceNameNormalizer
+}
+
+// NewReferenceIndexingActionCacheServer creates a decorator for
+// ActionCacheServer that records all objects in the Content
+// Addressable Storage referenced by ActionResults in a ReferenceIndex
+// upon update.
+//
+// References are only recorded for instance names provided in
+// allowUpdatesForInstances, and only after all digests contained in
+// the ActionResult have been validated. This prevents clients from
+// adding references for ActionResults that would be rejected by the
+// backing ActionCacheServer.
+//
+// References are recorded before the ActionResult is stored. If the
+// process crashes in between, or if storing the ActionResult fails, the
+// index may contain references that have no corresponding
+// ActionResult. This may cause garbage collection to retain objects
+// longer than needed. Provided that the ReferenceIndex is persistent,
+// it never causes objects that are still referenced to be deleted
+// prematurely.
+//
+// Instance names provided by clients are normalized using
+// instanceNameNormalizer, so that references are recorded under the
+// same instance name as the ActionResult.
+func NewReferenceIndexingActionCacheServer(base remoteexecution.ActionCacheServer, index ReferenceIndex, allowUpdatesForInstances map[string]bool, instanceNameNormalizer util.InstanceNameNormalizer) remoteexecution.ActionCacheServer {
+	return &referenceIndexingActionCacheServer{
+		ActionCacheServer:        base,
+		index:                    index,
+		allowUpdatesForInstances: allowUpdatesForInstances,
+		instanceNameNormalizer:   instanceNameNormalizer,
+	}
+}
+
+func (s *referenceIndexingActionCacheServer) UpdateActionResult(ctx context.Context, in *remoteexecution.UpdateActionResultRequest) (*remoteexecution.ActionResult, error) {
+	actionDigest, err := util.NewDigest(s.instanceNameNormalizer(in.InstanceName), in.ActionDigest)
+	if err != nil {
+		return nil, err
+	}
+	if instance := actionDigest.GetInstance(); !s.allowUpdatesForInstances[instance] {
+		return nil, status.Errorf(codes.PermissionDenied, "This service can only be used to get action results for instance %#v", instance)
+	}
+
+	// Gather all digests referenced by the ActionResult.
+	var blobDigests []*util.Digest
+	addDigest := func(partialDigest *remoteexecution.Digest) error {
+		if partialDigest == nil {
+			return nil
+		}
+		blobDigest, err := actionDigest.NewDerivedDigest(partialDigest)
+		if err != nil {
+			return util.StatusWrap(err, "Action result contained malformed digest")
+		}
+		blobDigests = append(blobDigests, blobDigest)
+		return nil
+	}
+	if actionResult := in.ActionResult; actionResult != nil {
+		for _, outputFile := range actionResult.OutputFiles {
+			if err := addDigest(outputFile.Digest); err != nil {
+				return nil, err
+			}
+		}
+		for _, outputDirectory := range actionResult.OutputDirectories {
+			if err := addDigest(outputDirectory.TreeDigest); err != nil {
+				return nil, err
+			}
+		}
+		if err := addDigest(actionResult.StdoutDigest); err != nil {
+			return nil, err
+		}
+		if err := addDigest(actionResult.StderrDigest); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.index.AddReferences(ctx, actionDigest, blobDigests); err != nil {
+		return nil, util.StatusWrap(err, "Failed to record references of action result")
+	}
+	return s.ActionCacheServer.UpdateActionResult(ctx, in)
+}
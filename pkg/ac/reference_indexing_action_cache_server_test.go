@@ -0,0 +1,116 @@
+package ac_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/ac"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReferenceIndexingActionCacheServerUpdateActionResult(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	index := ac.NewInMemoryReferenceIndex()
+	actionCacheServer := ac.NewReferenceIndexingActionCacheServer(
+		ac.NewActionCacheServer(blobAccess, map[string]bool{"debian8": true}, 1000, util.IdentityInstanceNameNormalizer),
+		index,
+		map[string]bool{"debian8": true},
+		util.IdentityInstanceNameNormalizer)
+	actionDigest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "ba8b67f7b7a2e9ca0ab9bd8bc5ff4a26",
+		SizeBytes: 123,
+	})
+	fileDigest := util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+		SizeBytes: 11,
+	})
+
+	t.Run("PermissionDenied", func(t *testing.T) {
+		// References should not be recorded for instance names
+		// for which the Action Cache is read-only.
+		_, err := actionCacheServer.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+			InstanceName: "ubuntu1804",
+			ActionDigest: actionDigest.GetPartialDigest(),
+			ActionResult: &remoteexecution.ActionResult{
+				StdoutDigest: fileDigest.GetPartialDigest(),
+			},
+		})
+		require.Equal(t, status.Error(codes.PermissionDenied, "This service can only be used to get action results for instance \"ubuntu1804\""), err)
+
+		referencers, err := index.GetReferencers(ctx, fileDigest)
+		require.NoError(t, err)
+		require.Empty(t, referencers)
+	})
+
+	t.Run("StorageFailure", func(t *testing.T) {
+		// References should be retained, even if storing the
+		// action result fails. Retaining objects for too long
+		// is harmless, whereas deleting them is not.
+		blobAccess.EXPECT().Put(ctx, actionDigest, gomock.Any()).Return(status.Error(codes.Internal, "Disk on fire"))
+
+		_, err := actionCacheServer.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+			InstanceName: "debian8",
+			ActionDigest: actionDigest.GetPartialDigest(),
+			ActionResult: &remoteexecution.ActionResult{
+				OutputFiles: []*remoteexecution.OutputFile{
+					{Path: "hello.txt", Digest: fileDigest.GetPartialDigest()},
+				},
+			},
+		})
+		require.Equal(t, status.Error(codes.Internal, "Disk on fire"), err)
+
+		referencers, err := index.GetReferencers(ctx, fileDigest)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{actionDigest}, referencers)
+	})
+
+	t.Run("MalformedDigest", func(t *testing.T) {
+		_, err := actionCacheServer.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+			InstanceName: "debian8",
+			ActionDigest: actionDigest.GetPartialDigest(),
+			ActionResult: &remoteexecution.ActionResult{
+				StdoutDigest: &remoteexecution.Digest{
+					Hash:      "cafebabe",
+					SizeBytes: 12,
+				},
+			},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Action result contained malformed digest: Unknown digest hash length: 8 characters"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		blobAccess.EXPECT().Put(ctx, actionDigest, gomock.Any()).Return(nil)
+
+		_, err := actionCacheServer.UpdateActionResult(ctx, &remoteexecution.UpdateActionResultRequest{
+			InstanceName: "debian8",
+			ActionDigest: actionDigest.GetPartialDigest(),
+			ActionResult: &remoteexecution.ActionResult{
+				StdoutDigest: fileDigest.GetPartialDigest(),
+			},
+		})
+		require.NoError(t, err)
+
+		// References should be shared across instance names,
+		// as objects in the CAS are not partitioned by them.
+		referencers, err := index.GetReferencers(ctx, fileDigest)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{actionDigest}, referencers)
+
+		referencers, err = index.GetReferencers(ctx, util.MustNewDigest("", &remoteexecution.Digest{
+			Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+			SizeBytes: 7,
+		}))
+		require.NoError(t, err)
+		require.Empty(t, referencers)
+	})
+}
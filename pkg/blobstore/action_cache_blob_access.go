@@ -9,11 +9,13 @@ import (
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 )
 
 type actionCacheBlobAccess struct {
 	actionCacheClient       remoteexecution.ActionCacheClient
+	healthClient            grpc_health_v1.HealthClient
 	maximumMessageSizeBytes int
 }
 
@@ -24,6 +26,7 @@ type actionCacheBlobAccess struct {
 func NewActionCacheBlobAccess(client *grpc.ClientConn, maximumMessageSizeBytes int) BlobAccess {
 	return &actionCacheBlobAccess{
 		actionCacheClient:       remoteexecution.NewActionCacheClient(client),
+		healthClient:            grpc_health_v1.NewHealthClient(client),
 		maximumMessageSizeBytes: maximumMessageSizeBytes,
 	}
 }
@@ -55,3 +58,7 @@ func (ba *actionCacheBlobAccess) Put(ctx context.Context, digest *util.Digest, b
 func (ba *actionCacheBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
 	return nil, status.Error(codes.Unimplemented, "Bazel action cache does not support bulk existence checking")
 }
+
+func (ba *actionCacheBlobAccess) CheckReadiness(ctx context.Context) error {
+	return checkGRPCReadiness(ctx, ba.healthClient)
+}
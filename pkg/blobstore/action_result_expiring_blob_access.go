@@ -0,0 +1,133 @@
+package blobstore
+
+import (
+	"context"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/proto/actioncache"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type actionResultExpiringBlobAccess struct {
+	BlobAccess
+	clock                   clock.Clock
+	maximumAge              time.Duration
+	maximumMessageSizeBytes int
+}
+
+// NewActionResultExpiringBlobAccess creates a decorator for an Action
+// Cache backed BlobAccess that causes ActionResults to expire. This
+// prevents the Action Cache from returning ActionResults that
+// reference outputs that have long been removed from the Content
+// Addressable Storage.
+//
+// Upon Put(), the current time is stored in the ActionResult, in the
+// form of a StorageMetadata message that is added to the auxiliary
+// metadata of the ActionResult's ExecutedActionMetadata. Any
+// StorageMetadata provided by the client is discarded. Get() returns
+// NOT_FOUND for ActionResults that are older than maximumAge. As the
+// StorageMetadata message is an implementation detail of this
+// decorator, it is removed from ActionResults returned by Get().
+// ActionResults that don't contain a StorageMetadata message (e.g.,
+// because they were written before this decorator was enabled) are
+// treated as being expired.
+//
+// Expired ActionResults are not removed from the backend by this
+// decorator. They remain present until they are overwritten or
+// evicted, or until they are removed through the BlobDeleter service.
+//
+// ActionResults are copied before being modified, as the messages
+// returned by the backend and provided by the caller may be shared
+// with others (e.g., in-memory caches).
+func NewActionResultExpiringBlobAccess(blobAccess BlobAccess, clock clock.Clock, maximumAge time.Duration, maximumMessageSizeBytes int) BlobAccess {
+	return &actionResultExpiringBlobAccess{
+		BlobAccess:              blobAccess,
+		clock:                   clock,
+		maximumAge:              maximumAge,
+		maximumMessageSizeBytes: maximumMessageSizeBytes,
+	}
+}
+
+// getInsertionTime extracts the time at which an ActionResult was
+// written from its auxiliary metadata.
+func getInsertionTime(actionResult *remoteexecution.ActionResult) (time.Time, bool) {
+	if executionMetadata := actionResult.ExecutionMetadata; executionMetadata != nil {
+		for _, auxiliaryMetadata := range executionMetadata.AuxiliaryMetadata {
+			var storageMetadata actioncache.StorageMetadata
+			if ptypes.Is(auxiliaryMetadata, &storageMetadata) {
+				if err := ptypes.UnmarshalAny(auxiliaryMetadata, &storageMetadata); err != nil {
+					return time.Time{}, false
+				}
+				insertionTime, err := ptypes.Timestamp(storageMetadata.InsertionTime)
+				if err != nil {
+					return time.Time{}, false
+				}
+				return insertionTime, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// removeStorageMetadata removes all StorageMetadata messages from the
+// auxiliary metadata of an ActionResult's ExecutedActionMetadata.
+func removeStorageMetadata(executionMetadata *remoteexecution.ExecutedActionMetadata) {
+	auxiliaryMetadata := executionMetadata.AuxiliaryMetadata[:0]
+	for _, m := range executionMetadata.AuxiliaryMetadata {
+		if !ptypes.Is(m, &actioncache.StorageMetadata{}) {
+			auxiliaryMetadata = append(auxiliaryMetadata, m)
+		}
+	}
+	executionMetadata.AuxiliaryMetadata = auxiliaryMetadata
+}
+
+func (ba *actionResultExpiringBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	actionResult, err := ba.BlobAccess.Get(ctx, digest).ToActionResult(ba.maximumMessageSizeBytes)
+	if err != nil {
+		return buffer.NewBufferFromError(err)
+	}
+	if insertionTime, ok := getInsertionTime(actionResult); !ok {
+		return buffer.NewBufferFromError(status.Error(codes.NotFound, "Action result does not contain an insertion time"))
+	} else if age := ba.clock.Now().Sub(insertionTime); age > ba.maximumAge {
+		return buffer.NewBufferFromError(status.Errorf(codes.NotFound, "Action result expired %s ago", age-ba.maximumAge))
+	}
+	actionResult = proto.Clone(actionResult).(*remoteexecution.ActionResult)
+	removeStorageMetadata(actionResult.ExecutionMetadata)
+	return buffer.NewACBufferFromActionResult(actionResult, buffer.Irreparable)
+}
+
+func (ba *actionResultExpiringBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	actionResult, err := b.ToActionResult(ba.maximumMessageSizeBytes)
+	if err != nil {
+		return err
+	}
+	insertionTime, err := ptypes.TimestampProto(ba.clock.Now())
+	if err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to convert insertion time")
+	}
+	storageMetadata, err := ptypes.MarshalAny(&actioncache.StorageMetadata{
+		InsertionTime: insertionTime,
+	})
+	if err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to marshal storage metadata")
+	}
+
+	// Replace any storage metadata provided by the client, so that
+	// clients cannot extend the lifetime of ActionResults.
+	actionResult = proto.Clone(actionResult).(*remoteexecution.ActionResult)
+	if actionResult.ExecutionMetadata == nil {
+		actionResult.ExecutionMetadata = &remoteexecution.ExecutedActionMetadata{}
+	}
+	removeStorageMetadata(actionResult.ExecutionMetadata)
+	actionResult.ExecutionMetadata.AuxiliaryMetadata = append(actionResult.ExecutionMetadata.AuxiliaryMetadata, storageMetadata)
+
+	return ba.BlobAccess.Put(ctx, digest, buffer.NewACBufferFromActionResult(actionResult, buffer.UserProvided))
+}
@@ -0,0 +1,149 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/proto/actioncache"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newInsertedActionResult creates an ActionResult that contains a
+// StorageMetadata message with a given insertion time.
+func newInsertedActionResult(t *testing.T, insertionTime time.Time) *remoteexecution.ActionResult {
+	timestamp, err := ptypes.TimestampProto(insertionTime)
+	require.NoError(t, err)
+	storageMetadata, err := ptypes.MarshalAny(&actioncache.StorageMetadata{
+		InsertionTime: timestamp,
+	})
+	require.NoError(t, err)
+	actionResult := &remoteexecution.ActionResult{
+		ExitCode: 1,
+		ExecutionMetadata: &remoteexecution.ExecutedActionMetadata{
+			Worker: "builder",
+		},
+	}
+	actionResult.ExecutionMetadata.AuxiliaryMetadata = append(actionResult.ExecutionMetadata.AuxiliaryMetadata, storageMetadata)
+	return actionResult
+}
+
+func TestActionResultExpiringBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	blobAccess := blobstore.NewActionResultExpiringBlobAccess(baseBlobAccess, clock, time.Hour, 1000)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 123,
+		})
+
+	t.Run("PutReplacesInsertionTime", func(t *testing.T) {
+		// Insertion times provided by clients should be
+		// overwritten, as they would otherwise be able to extend
+		// the lifetime of action results.
+		clock.EXPECT().Now().Return(time.Unix(1000, 0))
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				actionResult, err := b.ToActionResult(1000)
+				require.NoError(t, err)
+				require.True(t, proto.Equal(newInsertedActionResult(t, time.Unix(1000, 0)), actionResult))
+				return nil
+			})
+
+		require.NoError(t, blobAccess.Put(
+			ctx,
+			digest,
+			buffer.NewACBufferFromActionResult(newInsertedActionResult(t, time.Unix(5000, 0)), buffer.UserProvided)))
+	})
+
+	t.Run("PutWithoutExecutionMetadata", func(t *testing.T) {
+		clock.EXPECT().Now().Return(time.Unix(1000, 0))
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				actionResult, err := b.ToActionResult(1000)
+				require.NoError(t, err)
+				insertionTime, err := ptypes.TimestampProto(time.Unix(1000, 0))
+				require.NoError(t, err)
+				storageMetadata, err := ptypes.MarshalAny(&actioncache.StorageMetadata{
+					InsertionTime: insertionTime,
+				})
+				require.NoError(t, err)
+				expectedActionResult := &remoteexecution.ActionResult{
+					ExecutionMetadata: &remoteexecution.ExecutedActionMetadata{},
+				}
+				expectedActionResult.ExecutionMetadata.AuxiliaryMetadata = append(expectedActionResult.ExecutionMetadata.AuxiliaryMetadata, storageMetadata)
+				require.True(t, proto.Equal(expectedActionResult, actionResult))
+				return nil
+			})
+
+		require.NoError(t, blobAccess.Put(
+			ctx,
+			digest,
+			buffer.NewACBufferFromActionResult(&remoteexecution.ActionResult{}, buffer.UserProvided)))
+	})
+
+	t.Run("GetBackendFailure", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Get(ctx, digest).
+			Return(buffer.NewBufferFromError(status.Error(codes.Unavailable, "Server offline")))
+
+		_, err := blobAccess.Get(ctx, digest).ToActionResult(1000)
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	})
+
+	t.Run("GetWithoutInsertionTime", func(t *testing.T) {
+		// Action results written without this decorator should
+		// be treated as being expired.
+		baseBlobAccess.EXPECT().Get(ctx, digest).
+			Return(buffer.NewACBufferFromActionResult(&remoteexecution.ActionResult{ExitCode: 1}, buffer.Irreparable))
+
+		_, err := blobAccess.Get(ctx, digest).ToActionResult(1000)
+		require.Equal(t, status.Error(codes.NotFound, "Action result does not contain an insertion time"), err)
+	})
+
+	t.Run("GetValid", func(t *testing.T) {
+		storedActionResult := newInsertedActionResult(t, time.Unix(1000, 0))
+		baseBlobAccess.EXPECT().Get(ctx, digest).
+			Return(buffer.NewACBufferFromActionResult(storedActionResult, buffer.Irreparable))
+		clock.EXPECT().Now().Return(time.Unix(4600, 0))
+
+		// The StorageMetadata message should not be returned,
+		// as it is only used internally.
+		actionResult, err := blobAccess.Get(ctx, digest).ToActionResult(1000)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(&remoteexecution.ActionResult{
+			ExitCode: 1,
+			ExecutionMetadata: &remoteexecution.ExecutedActionMetadata{
+				Worker: "builder",
+			},
+		}, actionResult))
+
+		// The message returned by the backend may be shared
+		// with others, meaning it should be left intact.
+		require.True(t, proto.Equal(newInsertedActionResult(t, time.Unix(1000, 0)), storedActionResult))
+	})
+
+	t.Run("GetExpired", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Get(ctx, digest).
+			Return(buffer.NewACBufferFromActionResult(newInsertedActionResult(t, time.Unix(1000, 0)), buffer.Irreparable))
+		clock.EXPECT().Now().Return(time.Unix(4630, 0))
+
+		_, err := blobAccess.Get(ctx, digest).ToActionResult(1000)
+		require.Equal(t, status.Error(codes.NotFound, "Action result expired 30s ago"), err)
+	})
+}
@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// PutRecord is an entry in the audit log, describing a single object
+// that was written into storage.
+type PutRecord struct {
+	// Sequence number of the record. Sequence numbers are assigned
+	// contiguously, starting at one. Gaps in the sequence indicate
+	// that records have been lost or removed.
+	Sequence uint64 `json:"sequence"`
+	// Hexadecimal SHA-256 hash of the previous record in the log,
+	// excluding its trailing newline. This chains records together,
+	// meaning that records cannot be altered without invalidating
+	// all records that follow. This field is omitted for the first
+	// record.
+	PreviousRecordHash string `json:"previous_record_hash,omitempty"`
+	// Time at which the write completed.
+	Timestamp time.Time `json:"timestamp"`
+	// Properties of the object that was written.
+	Instance  string `json:"instance"`
+	Hash      string `json:"hash"`
+	SizeBytes int64  `json:"size_bytes"`
+	// Identity of the client that wrote the object. This contains
+	// the address of the peer and the subject of its TLS client
+	// certificate, if any.
+	ClientAddress string `json:"client_address,omitempty"`
+	ClientSubject string `json:"client_subject,omitempty"`
+}
+
+// Sink is a destination to which audit records are written (e.g., a
+// file or a remote logging service).
+type Sink interface {
+	// Append a record to the audit log, filling in its sequence
+	// number and the hash of the previous record. Calls to this
+	// function must be serialized by the caller.
+	Append(record *PutRecord) error
+	// Sync blocks until all records appended previously have been
+	// written to stable storage. This function may be called
+	// concurrently with Append().
+	Sync() error
+	// Close the audit log. No calls to Append() or Sync() may be
+	// made afterwards.
+	Close() error
+}
+
+type auditLoggingBlobAccess struct {
+	blobstore.BlobAccess
+	sink   Sink
+	clock  clock.Clock
+	strict bool
+
+	lock sync.Mutex
+}
+
+// NewAuditLoggingBlobAccess creates a decorator for BlobAccess that
+// appends a record to an audit log for every object written through
+// Put(). Records are appended after the write to the backend completes.
+//
+// In strict mode, Put() only succeeds after the record has been
+// written to stable storage. Failures to write records are propagated
+// to the client. Otherwise, failures are merely logged.
+func NewAuditLoggingBlobAccess(blobAccess blobstore.BlobAccess, sink Sink, clock clock.Clock, strict bool) blobstore.BlobAccess {
+	return &auditLoggingBlobAccess{
+		BlobAccess: blobAccess,
+		sink:       sink,
+		clock:      clock,
+		strict:     strict,
+	}
+}
+
+func (ba *auditLoggingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	if err := ba.BlobAccess.Put(ctx, digest, b); err != nil {
+		return err
+	}
+
+	record := PutRecord{
+		Instance:  digest.GetInstance(),
+		Hash:      digest.GetHashString(),
+		SizeBytes: digest.GetSizeBytes(),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			record.ClientAddress = p.Addr.String()
+		}
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if certs := tlsInfo.State.PeerCertificates; len(certs) > 0 {
+				record.ClientSubject = certs[0].Subject.String()
+			}
+		}
+	}
+
+	// Append records while holding the lock, so that timestamps
+	// are increasing. Synchronize outside the lock, so that
+	// concurrent calls may share the cost of a single
+	// synchronization.
+	ba.lock.Lock()
+	record.Timestamp = ba.clock.Now()
+	err := ba.sink.Append(&record)
+	ba.lock.Unlock()
+	if err == nil && ba.strict {
+		err = ba.sink.Sync()
+	}
+	if err != nil {
+		if ba.strict {
+			return util.StatusWrapf(err, "Failed to write audit record for blob %s", digest)
+		}
+		log.Printf("Failed to write audit record for blob %s: %s", digest, err)
+	}
+	return nil
+}
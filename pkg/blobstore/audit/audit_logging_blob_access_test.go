@@ -0,0 +1,141 @@
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/audit"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuditLoggingBlobAccessPut(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	var log bytes.Buffer
+	blobAccess := audit.NewAuditLoggingBlobAccess(baseBlobAccess, audit.NewWriterSink(&log), clock, false)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("BackendFailure", func(t *testing.T) {
+		// Failed writes should not be logged.
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).Return(status.Error(codes.Internal, "Disk on fire"))
+
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Disk on fire"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		require.Empty(t, log.String())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		// Successful writes should be logged with increasing
+		// sequence numbers.
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).Return(nil).Times(2)
+		clock.EXPECT().Now().Return(time.Unix(1000, 0).UTC())
+		clock.EXPECT().Now().Return(time.Unix(1001, 0).UTC())
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		// The second record should contain the hash of the
+		// first record.
+		firstRecord := "{\"sequence\":1,\"timestamp\":\"1970-01-01T00:16:40Z\",\"instance\":\"default\",\"hash\":\"3e25960a79dbc69b674cd4ec67a72c62\",\"size_bytes\":11}"
+		firstRecordHash := sha256.Sum256([]byte(firstRecord))
+		require.Equal(
+			t,
+			firstRecord+"\n"+
+				"{\"sequence\":2,\"previous_record_hash\":\""+hex.EncodeToString(firstRecordHash[:])+"\",\"timestamp\":\"1970-01-01T00:16:41Z\",\"instance\":\"default\",\"hash\":\"3e25960a79dbc69b674cd4ec67a72c62\",\"size_bytes\":11}\n",
+			log.String())
+	})
+}
+
+func TestAuditLoggingBlobAccessPutStrict(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	writer := mock.NewMockWriter(ctrl)
+	blobAccess := audit.NewAuditLoggingBlobAccess(baseBlobAccess, audit.NewWriterSink(writer), clock, true)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("WriteFailure", func(t *testing.T) {
+		// In strict mode, failures to write audit records
+		// should be propagated to the client.
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).Return(nil)
+		clock.EXPECT().Now().Return(time.Unix(1000, 0).UTC())
+		writer.EXPECT().Write(gomock.Any()).Return(0, status.Error(codes.Unavailable, "Log server offline"))
+
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Failed to write audit record for blob 3e25960a79dbc69b674cd4ec67a72c62-11-default: Log server offline"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+}
+
+func TestAuditLoggingBlobAccessPutSync(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	sink := mock.NewMockSink(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("Strict", func(t *testing.T) {
+		// In strict mode, records should be synchronized
+		// before acknowledging the write.
+		blobAccess := audit.NewAuditLoggingBlobAccess(baseBlobAccess, sink, clock, true)
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).Return(nil).Times(2)
+		clock.EXPECT().Now().Return(time.Unix(1000, 0).UTC()).Times(2)
+		sink.EXPECT().Append(gomock.Any()).Return(nil).Times(2)
+		sink.EXPECT().Sync().Return(nil)
+		sink.EXPECT().Sync().Return(status.Error(codes.Internal, "Disk on fire"))
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Failed to write audit record for blob 3e25960a79dbc69b674cd4ec67a72c62-11-default: Disk on fire"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("NonStrict", func(t *testing.T) {
+		// In non-strict mode, records should not be
+		// synchronized explicitly.
+		blobAccess := audit.NewAuditLoggingBlobAccess(baseBlobAccess, sink, clock, false)
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).Return(nil)
+		clock.EXPECT().Now().Return(time.Unix(1000, 0).UTC())
+		sink.EXPECT().Append(gomock.Any()).Return(nil)
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+}
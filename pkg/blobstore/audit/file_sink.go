@@ -0,0 +1,123 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+)
+
+// fileSinkReadChunkSizeBytes is the size of the chunks in which the
+// tail of an existing audit log is read.
+const fileSinkReadChunkSizeBytes = 64 * 1024
+
+type fileSink struct {
+	file      *os.File
+	sizeBytes int64
+	chain     recordChain
+	err       error
+}
+
+// NewFileSink creates a Sink that appends audit records to a file,
+// using one JSON object per line. When the file already contains
+// records, sequence numbers and record hashes continue where the last
+// record left off. A trailing partially written record, caused by a
+// crash, is discarded.
+func NewFileSink(path string) (Sink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to open audit log %#v", path)
+	}
+	s, err := loadFileSink(file)
+	if err != nil {
+		file.Close()
+		return nil, util.StatusWrapf(err, "Failed to load audit log %#v", path)
+	}
+	return s, nil
+}
+
+func loadFileSink(file *os.File) (Sink, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to obtain file size")
+	}
+
+	// Read the tail of the file, until it contains the last
+	// complete record in its entirety.
+	offset := info.Size()
+	var tail []byte
+	lastNewline, previousNewline := -1, -1
+	for offset > 0 && previousNewline < 0 {
+		chunkSizeBytes := int64(fileSinkReadChunkSizeBytes)
+		if chunkSizeBytes > offset {
+			chunkSizeBytes = offset
+		}
+		offset -= chunkSizeBytes
+		chunk := make([]byte, chunkSizeBytes, chunkSizeBytes+int64(len(tail)))
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to read records")
+		}
+		tail = append(chunk, tail...)
+		lastNewline = bytes.LastIndexByte(tail, '\n')
+		if lastNewline >= 0 {
+			previousNewline = bytes.LastIndexByte(tail[:lastNewline], '\n')
+		}
+	}
+
+	s := &fileSink{
+		file:      file,
+		sizeBytes: offset + int64(lastNewline) + 1,
+	}
+	if lastNewline >= 0 {
+		line := tail[previousNewline+1 : lastNewline+1]
+		var record PutRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, util.StatusWrapfWithCode(err, codes.DataLoss, "Malformed record at offset %d", offset+int64(previousNewline)+1)
+		}
+		s.chain.advance(record.Sequence, line)
+	}
+
+	// Discard any trailing partially written record, so that new
+	// records are appended directly after the last complete one.
+	if s.sizeBytes != info.Size() {
+		if err := file.Truncate(s.sizeBytes); err != nil {
+			return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to truncate partially written record")
+		}
+	}
+	return s, nil
+}
+
+func (s *fileSink) Append(record *PutRecord) error {
+	if s.err != nil {
+		return s.err
+	}
+	line, err := s.chain.marshal(record)
+	if err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to marshal record")
+	}
+	if _, err := s.file.Write(line); err != nil {
+		// Remove the partially written record, so that
+		// subsequent records are not appended to it.
+		if truncateErr := s.file.Truncate(s.sizeBytes); truncateErr != nil {
+			s.err = util.StatusWrapWithCode(truncateErr, codes.Internal, "Failed to truncate partially written record")
+		}
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to write record")
+	}
+	s.sizeBytes += int64(len(line))
+	s.chain.advance(record.Sequence, line)
+	return nil
+}
+
+func (s *fileSink) Sync() error {
+	if err := s.file.Sync(); err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to synchronize records")
+	}
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,96 @@
+package audit_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/audit"
+	"github.com/stretchr/testify/require"
+)
+
+func readAuditRecords(t *testing.T, path string) ([]string, []audit.PutRecord) {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(string(data), "\n")
+	require.Equal(t, "", lines[len(lines)-1])
+	lines = lines[:len(lines)-1]
+	records := make([]audit.PutRecord, 0, len(lines))
+	for _, line := range lines {
+		var record audit.PutRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return lines, records
+}
+
+func TestFileSink(t *testing.T) {
+	directory, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "audit.log")
+
+	newRecord := func(hash string) *audit.PutRecord {
+		return &audit.PutRecord{
+			Timestamp: time.Unix(1000, 0).UTC(),
+			Instance:  "default",
+			Hash:      hash,
+			SizeBytes: 11,
+		}
+	}
+
+	sink, err := audit.NewFileSink(path)
+	require.NoError(t, err)
+	require.NoError(t, sink.Append(newRecord("3e25960a79dbc69b674cd4ec67a72c62")))
+	require.NoError(t, sink.Append(newRecord("6fc422233a40a75a1f028e11c3cd1140")))
+	require.NoError(t, sink.Sync())
+	require.NoError(t, sink.Close())
+
+	t.Run("Reopen", func(t *testing.T) {
+		// After reopening the audit log, sequence numbers and
+		// record hashes should continue where they left off.
+		sink, err := audit.NewFileSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Append(newRecord("8b1a9953c4611296a827abf8c47804d7")))
+		require.NoError(t, sink.Close())
+
+		lines, records := readAuditRecords(t, path)
+		require.Len(t, records, 3)
+		for i, record := range records {
+			require.Equal(t, uint64(i+1), record.Sequence)
+			if i == 0 {
+				require.Equal(t, "", record.PreviousRecordHash)
+			} else {
+				hash := sha256.Sum256([]byte(strings.TrimSuffix(lines[i-1], "\n")))
+				require.Equal(t, hex.EncodeToString(hash[:]), record.PreviousRecordHash)
+			}
+		}
+	})
+
+	t.Run("PartiallyWrittenRecord", func(t *testing.T) {
+		// Records that were written partially due to a crash
+		// should be discarded upon reopening.
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("{\"sequence\":4,\"time"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		sink, err := audit.NewFileSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Append(newRecord("c4ca4238a0b923820dcc509a6f75849b")))
+		require.NoError(t, sink.Close())
+
+		lines, records := readAuditRecords(t, path)
+		require.Len(t, records, 4)
+		require.Equal(t, uint64(4), records[3].Sequence)
+		hash := sha256.Sum256([]byte(strings.TrimSuffix(lines[2], "\n")))
+		require.Equal(t, hex.EncodeToString(hash[:]), records[3].PreviousRecordHash)
+	})
+}
@@ -0,0 +1,34 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// recordChain keeps track of the last record that was written to an
+// audit log, so that the sequence number and the previous record hash
+// of the next record can be computed.
+type recordChain struct {
+	lastSequence   uint64
+	lastRecordHash string
+}
+
+// marshal a record as a single line of JSON, filling in its sequence
+// number and the hash of the previous record.
+func (c *recordChain) marshal(record *PutRecord) ([]byte, error) {
+	record.Sequence = c.lastSequence + 1
+	record.PreviousRecordHash = c.lastRecordHash
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// advance the chain after a record has been written successfully.
+func (c *recordChain) advance(sequence uint64, line []byte) {
+	c.lastSequence = sequence
+	hash := sha256.Sum256(line[:len(line)-1])
+	c.lastRecordHash = hex.EncodeToString(hash[:])
+}
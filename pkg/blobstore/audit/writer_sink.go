@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"io"
+)
+
+type writerSink struct {
+	w     io.Writer
+	chain recordChain
+}
+
+// NewWriterSink creates a Sink that writes audit records to an
+// io.Writer, using one JSON object per line. Sequence numbers start at
+// one, meaning that the io.Writer should initially be empty. If the
+// io.Writer provides Sync() or Close() methods (e.g., *os.File), they
+// are called when records need to be written durably or when the Sink
+// is closed, respectively.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{
+		w: w,
+	}
+}
+
+func (s *writerSink) Append(record *PutRecord) error {
+	line, err := s.chain.marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(line); err != nil {
+		return err
+	}
+	s.chain.advance(record.Sequence, line)
+	return nil
+}
+
+func (s *writerSink) Sync() error {
+	if syncer, ok := s.w.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (s *writerSink) Close() error {
+	if closer, ok := s.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
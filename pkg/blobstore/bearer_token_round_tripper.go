@@ -0,0 +1,62 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+// BearerTokenSource is called to obtain the token that is attached to
+// outgoing HTTP requests. It is called for every request, permitting
+// tokens to be rotated.
+type BearerTokenSource func(ctx context.Context) (string, error)
+
+// NewBearerTokenSourceFromFile creates a BearerTokenSource that reads
+// a token from a file. The file is read for every request, so that
+// tokens that are rotated by an external process are picked up.
+func NewBearerTokenSourceFromFile(path string) BearerTokenSource {
+	return func(ctx context.Context) (string, error) {
+		token, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", util.StatusWrapf(err, "Failed to read bearer token from %#v", path)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+}
+
+type bearerTokenRoundTripper struct {
+	base        http.RoundTripper
+	tokenSource BearerTokenSource
+}
+
+// NewBearerTokenRoundTripper creates an adapter for http.RoundTripper
+// that attaches an "Authorization: Bearer" header to all requests.
+func NewBearerTokenRoundTripper(base http.RoundTripper, tokenSource BearerTokenSource) http.RoundTripper {
+	return &bearerTokenRoundTripper{
+		base:        base,
+		tokenSource: tokenSource,
+	}
+}
+
+func (rt *bearerTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := rt.tokenSource(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	// RoundTrippers may not modify the original request. Only
+	// copy the headers, as those are the only part that changes.
+	newReq := *req
+	newReq.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		newReq.Header[key] = values
+	}
+	newReq.Header.Set("Authorization", "Bearer "+token)
+	return rt.base.RoundTrip(&newReq)
+}
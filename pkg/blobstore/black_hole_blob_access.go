@@ -0,0 +1,35 @@
+package blobstore
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type blackHoleBlobAccess struct{}
+
+// NewBlackHoleBlobAccess creates a BlobAccess that discards all data
+// written to it. Objects are never found. Such an implementation is
+// useful for measuring the overhead of the layers placed on top of
+// storage (e.g., gRPC servers) without being influenced by the
+// performance of an actual storage backend.
+func NewBlackHoleBlobAccess() BlobAccess {
+	return blackHoleBlobAccess{}
+}
+
+func (ba blackHoleBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	return buffer.NewBufferFromError(status.Error(codes.NotFound, "Object not found"))
+}
+
+func (ba blackHoleBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	b.Discard()
+	return nil
+}
+
+func (ba blackHoleBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	return digests, nil
+}
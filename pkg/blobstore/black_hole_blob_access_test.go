@@ -0,0 +1,59 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBlackHoleBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := blobstore.NewBlackHoleBlobAccess()
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("Get", func(t *testing.T) {
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Object not found"), err)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		// Data should be discarded without being read.
+		reader := mock.NewMockReadCloser(ctrl)
+		reader.EXPECT().Close().Return(nil)
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewCASBufferFromReader(digest, reader, buffer.UserProvided)))
+	})
+
+	t.Run("FindMissing", func(t *testing.T) {
+		// All objects should be reported as missing.
+		digests := []*util.Digest{
+			digest,
+			util.MustNewDigest(
+				"default",
+				&remoteexecution.Digest{
+					Hash:      "d41d8cd98f00b204e9800998ecf8427e",
+					SizeBytes: 0,
+				}),
+		}
+		missing, err := blobAccess.FindMissing(ctx, digests)
+		require.NoError(t, err)
+		require.Equal(t, digests, missing)
+	})
+}
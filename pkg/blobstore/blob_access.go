@@ -5,6 +5,9 @@ import (
 
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
 	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // BlobAccess is an abstraction for a data store that can be used to
@@ -15,3 +18,19 @@ type BlobAccess interface {
 	Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error
 	FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error)
 }
+
+// GetInto reads a blob into a slice of bytes provided by the caller,
+// returning the number of bytes read. This permits callers that
+// repeatedly read small blobs of known size (e.g., Command messages) to
+// reuse allocations. Blobs that don't fit in the provided slice are not
+// requested from the backend at all.
+//
+// This function may only be used against the Content Addressable
+// Storage, as the size stored in digests of Action Cache entries does
+// not correspond with the size of the ActionResult message.
+func GetInto(ctx context.Context, blobAccess BlobAccess, digest *util.Digest, dst []byte) (int, error) {
+	if sizeBytes := digest.GetSizeBytes(); sizeBytes > int64(len(dst)) {
+		return 0, status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while the provided slice is only %d bytes in size", sizeBytes, len(dst))
+	}
+	return buffer.IntoByteSlice(blobAccess.Get(ctx, digest), dst)
+}
@@ -0,0 +1,35 @@
+package blobstore
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BlobDeleter is implemented by storage backends that are capable of
+// removing individual objects. This interface is optional, as some
+// backends (e.g., the circular storage backend) can only evict data in
+// bulk.
+//
+// Deleting objects is not needed for regular operation. It may be used
+// for administrative purposes, such as removing a poisoned entry from
+// the Action Cache.
+type BlobDeleter interface {
+	// Delete removes an object from the backend. Subsequent calls
+	// to Get() return NOT_FOUND. Deleting an object that is not
+	// present is not an error.
+	Delete(ctx context.Context, digest *util.Digest) error
+}
+
+// Delete removes an object from a BlobAccess. UNIMPLEMENTED is returned
+// if the BlobAccess does not implement BlobDeleter.
+func Delete(ctx context.Context, blobAccess BlobAccess, digest *util.Digest) error {
+	blobDeleter, ok := blobAccess.(BlobDeleter)
+	if !ok {
+		return status.Error(codes.Unimplemented, "Backend does not support deleting objects")
+	}
+	return blobDeleter.Delete(ctx, digest)
+}
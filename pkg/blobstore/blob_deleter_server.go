@@ -0,0 +1,50 @@
+package blobstore
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/proto/blobdeleter"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type blobDeleterServer struct {
+	contentAddressableStorage BlobAccess
+	actionCache               BlobAccess
+	instanceNameNormalizer    util.InstanceNameNormalizer
+}
+
+// NewBlobDeleterServer creates a gRPC service that allows
+// administrators to remove individual objects from the Content
+// Addressable Storage and the Action Cache. Removal is forwarded to
+// the storage backends through Delete(). Instance names provided by
+// clients are normalized using instanceNameNormalizer.
+func NewBlobDeleterServer(contentAddressableStorage BlobAccess, actionCache BlobAccess, instanceNameNormalizer util.InstanceNameNormalizer) blobdeleter.BlobDeleterServer {
+	return &blobDeleterServer{
+		contentAddressableStorage: contentAddressableStorage,
+		actionCache:               actionCache,
+		instanceNameNormalizer:    instanceNameNormalizer,
+	}
+}
+
+func (s *blobDeleterServer) DeleteBlob(ctx context.Context, in *blobdeleter.DeleteBlobRequest) (*blobdeleter.DeleteBlobResponse, error) {
+	digest, err := util.NewDigest(s.instanceNameNormalizer(in.InstanceName), in.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var blobAccess BlobAccess
+	switch in.StorageType {
+	case blobdeleter.DeleteBlobRequest_CONTENT_ADDRESSABLE_STORAGE:
+		blobAccess = s.contentAddressableStorage
+	case blobdeleter.DeleteBlobRequest_ACTION_CACHE:
+		blobAccess = s.actionCache
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "Unknown storage type %d", in.StorageType)
+	}
+	if err := Delete(ctx, blobAccess, digest); err != nil {
+		return nil, err
+	}
+	return &blobdeleter.DeleteBlobResponse{}, nil
+}
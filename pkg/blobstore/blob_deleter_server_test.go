@@ -0,0 +1,111 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/proto/blobdeleter"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// blobAccessDeleter is a BlobAccess that also implements BlobDeleter,
+// backed by separate mocks.
+type blobAccessDeleter struct {
+	*mock.MockBlobAccess
+	*mock.MockBlobDeleter
+}
+
+func TestBlobDeleterServer(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := &blobAccessDeleter{
+		MockBlobAccess:  mock.NewMockBlobAccess(ctrl),
+		MockBlobDeleter: mock.NewMockBlobDeleter(ctrl),
+	}
+	actionCache := mock.NewMockBlobAccess(ctrl)
+	server := blobstore.NewBlobDeleterServer(contentAddressableStorage, actionCache, util.IdentityInstanceNameNormalizer)
+
+	t.Run("InvalidDigest", func(t *testing.T) {
+		_, err := server.DeleteBlob(ctx, &blobdeleter.DeleteBlobRequest{
+			InstanceName: "default",
+			StorageType:  blobdeleter.DeleteBlobRequest_CONTENT_ADDRESSABLE_STORAGE,
+			Digest: &remoteexecution.Digest{
+				Hash:      "This is not a hash",
+				SizeBytes: 11,
+			},
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("UnknownStorageType", func(t *testing.T) {
+		_, err := server.DeleteBlob(ctx, &blobdeleter.DeleteBlobRequest{
+			InstanceName: "default",
+			StorageType:  42,
+			Digest: &remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Unknown storage type 42"), err)
+	})
+
+	t.Run("ContentAddressableStorage", func(t *testing.T) {
+		contentAddressableStorage.MockBlobDeleter.EXPECT().Delete(
+			ctx,
+			util.MustNewDigest(
+				"default",
+				&remoteexecution.Digest{
+					Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+					SizeBytes: 11,
+				}))
+
+		response, err := server.DeleteBlob(ctx, &blobdeleter.DeleteBlobRequest{
+			InstanceName: "default",
+			StorageType:  blobdeleter.DeleteBlobRequest_CONTENT_ADDRESSABLE_STORAGE,
+			Digest: &remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &blobdeleter.DeleteBlobResponse{}, response)
+	})
+
+	t.Run("ContentAddressableStorageFailure", func(t *testing.T) {
+		contentAddressableStorage.MockBlobDeleter.EXPECT().Delete(ctx, gomock.Any()).
+			Return(status.Error(codes.Internal, "Disk on fire"))
+
+		_, err := server.DeleteBlob(ctx, &blobdeleter.DeleteBlobRequest{
+			InstanceName: "default",
+			StorageType:  blobdeleter.DeleteBlobRequest_CONTENT_ADDRESSABLE_STORAGE,
+			Digest: &remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			},
+		})
+		require.Equal(t, status.Error(codes.Internal, "Disk on fire"), err)
+	})
+
+	t.Run("ActionCacheUnimplemented", func(t *testing.T) {
+		// Backends that don't support removing objects should
+		// cause UNIMPLEMENTED to be returned.
+		_, err := server.DeleteBlob(ctx, &blobdeleter.DeleteBlobRequest{
+			InstanceName: "default",
+			StorageType:  blobdeleter.DeleteBlobRequest_ACTION_CACHE,
+			Digest: &remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			},
+		})
+		require.Equal(t, status.Error(codes.Unimplemented, "Backend does not support deleting objects"), err)
+	})
+}
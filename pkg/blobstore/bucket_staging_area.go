@@ -0,0 +1,97 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gocloud.dev/blob"
+)
+
+type bucketStagingArea struct {
+	bucket     *blob.Bucket
+	keyPrefix  string
+	usageBytes prometheus.Gauge
+}
+
+// NewBucketStagingArea creates a StagingArea that holds data in a
+// cloud storage bucket, under a temporary key. This permits staging
+// data without consuming local memory or disk space, at the cost of
+// transferring the data twice.
+//
+// Staged data is removed from the bucket once it has been consumed.
+// Data may be left behind in case of crashes. It is therefore
+// recommended to configure a lifecycle rule on the bucket that expires
+// objects stored under keyPrefix after a short amount of time.
+func NewBucketStagingArea(bucket *blob.Bucket, keyPrefix string) StagingArea {
+	registerStagingAreaMetrics()
+
+	return &bucketStagingArea{
+		bucket:     bucket,
+		keyPrefix:  keyPrefix,
+		usageBytes: stagingAreaUsageBytes.WithLabelValues("Bucket"),
+	}
+}
+
+func (sa *bucketStagingArea) Stage(ctx context.Context, r io.Reader, maximumSizeBytes int64) (StagedData, error) {
+	key := sa.keyPrefix + uuid.New().String()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w, err := sa.bucket.NewWriter(ctx, key, nil)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to create staging object %#v", key)
+	}
+	sizeBytes, err := copyToStagingArea(w, r, maximumSizeBytes)
+	if err != nil {
+		// Canceling the context prior to closing the writer
+		// causes the object not to be created.
+		cancel()
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, util.StatusWrapf(err, "Failed to create staging object %#v", key)
+	}
+
+	sa.usageBytes.Add(float64(sizeBytes))
+	return &bucketStagedData{
+		stagingArea: sa,
+		key:         key,
+		sizeBytes:   sizeBytes,
+	}, nil
+}
+
+type bucketStagedData struct {
+	stagingArea *bucketStagingArea
+	key         string
+	sizeBytes   int64
+}
+
+func (sd *bucketStagedData) GetSizeBytes() int64 {
+	return sd.sizeBytes
+}
+
+func (sd *bucketStagedData) Open(ctx context.Context) (io.ReadCloser, error) {
+	r, err := sd.stagingArea.bucket.NewReader(ctx, sd.key, nil)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to open staging object %#v", sd.key)
+	}
+	return &stagedDataReader{
+		Reader:     r,
+		closer:     r,
+		stagedData: sd,
+	}, nil
+}
+
+func (sd *bucketStagedData) Release() {
+	// Use a separate context, as the data also needs to be
+	// removed when the request has been canceled.
+	if err := sd.stagingArea.bucket.Delete(context.Background(), sd.key); err != nil {
+		log.Printf("Failed to remove staging object %#v: %s", sd.key, err)
+	}
+	sd.stagingArea.usageBytes.Sub(float64(sd.sizeBytes))
+}
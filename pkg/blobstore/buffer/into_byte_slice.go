@@ -0,0 +1,28 @@
+package buffer
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// IntoByteSlice reads the full contents of a buffer into a slice of
+// bytes provided by the caller, returning the number of bytes read.
+// Unlike ToByteSlice(), this permits callers to reuse allocations
+// (e.g., using a sync.Pool) when repeatedly reading small objects.
+//
+// Contents of the buffer are validated in the same way as ToByteSlice()
+// does. This function fails if the slice is too small to hold the
+// contents of the buffer. In case of failure, the contents of the slice
+// are undefined.
+func IntoByteSlice(b Buffer, dst []byte) (int, error) {
+	sizeBytes, err := b.GetSizeBytes()
+	if err != nil {
+		b.Discard()
+		return 0, err
+	}
+	if sizeBytes > int64(len(dst)) {
+		b.Discard()
+		return 0, status.Errorf(codes.InvalidArgument, "Buffer is %d bytes in size, while the provided slice is only %d bytes in size", sizeBytes, len(dst))
+	}
+	return b.ReadAt(dst[:sizeBytes], 0)
+}
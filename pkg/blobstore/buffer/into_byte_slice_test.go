@@ -0,0 +1,68 @@
+package buffer_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIntoByteSlice(t *testing.T) {
+	helloDigest := util.MustNewDigest(
+		"foo",
+		&remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		})
+
+	t.Run("Success", func(t *testing.T) {
+		// The contents should be written into the provided
+		// slice, leaving the remainder untouched.
+		dst := []byte("XXXXXXXX")
+		n, err := buffer.IntoByteSlice(
+			buffer.NewCASBufferFromReader(
+				helloDigest,
+				ioutil.NopCloser(bytes.NewBufferString("Hello")),
+				buffer.Irreparable),
+			dst)
+		require.NoError(t, err)
+		require.Equal(t, 5, n)
+		require.Equal(t, []byte("HelloXXX"), dst)
+	})
+
+	t.Run("SliceTooSmall", func(t *testing.T) {
+		_, err := buffer.IntoByteSlice(
+			buffer.NewCASBufferFromReader(
+				helloDigest,
+				ioutil.NopCloser(bytes.NewBufferString("Hello")),
+				buffer.Irreparable),
+			make([]byte, 4))
+		require.Equal(t, status.Error(codes.InvalidArgument, "Buffer is 5 bytes in size, while the provided slice is only 4 bytes in size"), err)
+	})
+
+	t.Run("ChecksumMismatch", func(t *testing.T) {
+		// Integrity checking should still be performed on the
+		// data that is read into the slice.
+		_, err := buffer.IntoByteSlice(
+			buffer.NewCASBufferFromReader(
+				helloDigest,
+				ioutil.NopCloser(bytes.NewBufferString("Jello")),
+				buffer.Irreparable),
+			make([]byte, 5))
+		require.Equal(t, status.Error(codes.Internal, "Buffer has checksum bedad9eef4de4b391cc5aeb8ddbe6387, while 8b1a9953c4611296a827abf8c47804d7 was expected"), err)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := buffer.IntoByteSlice(
+			buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")),
+			make([]byte, 5))
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+}
@@ -0,0 +1,136 @@
+package buffer_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newPartiallyFailingReader creates a ReadCloser that returns "Hel",
+// followed by an I/O error.
+func newPartiallyFailingReader(ctrl *gomock.Controller) *mock.MockReadCloser {
+	reader := mock.NewMockReadCloser(ctrl)
+	gomock.InOrder(
+		reader.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+			return copy(p, "Hel"), nil
+		}),
+		reader.EXPECT().Read(gomock.Any()).Return(0, status.Error(codes.Internal, "Storage backend on fire")))
+	reader.EXPECT().Close()
+	return reader
+}
+
+func TestNewUnsizedBufferFromReaderGetSizeBytes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	reader := mock.NewMockReadCloser(ctrl)
+	reader.EXPECT().Close()
+
+	b := buffer.NewUnsizedBufferFromReader(reader)
+	_, err := b.GetSizeBytes()
+	require.Equal(t, buffer.ErrSizeUnknown, err)
+	b.Discard()
+}
+
+func TestNewUnsizedBufferFromReaderToByteSlice(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	t.Run("Success", func(t *testing.T) {
+		data, err := buffer.NewUnsizedBufferFromReader(
+			ioutil.NopCloser(bytes.NewBufferString("Hello"))).ToByteSlice(5)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+	})
+
+	t.Run("TooBig", func(t *testing.T) {
+		// As the size is not known in advance, only one byte
+		// more than permitted should be read to detect that the
+		// buffer is too large.
+		_, err := buffer.NewUnsizedBufferFromReader(
+			ioutil.NopCloser(bytes.NewBufferString("Hello world"))).ToByteSlice(4)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Buffer is at least 5 bytes in size, while a maximum of 4 bytes is permitted"), err)
+	})
+
+	t.Run("IOError", func(t *testing.T) {
+		_, err := buffer.NewUnsizedBufferFromReader(
+			newPartiallyFailingReader(ctrl)).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Internal, "Storage backend on fire"), err)
+	})
+}
+
+func TestNewUnsizedBufferFromReaderToReader(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	t.Run("Success", func(t *testing.T) {
+		r := buffer.NewUnsizedBufferFromReader(
+			ioutil.NopCloser(bytes.NewBufferString("Hello"))).ToReader()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("IOError", func(t *testing.T) {
+		// Data that was read prior to the error should be
+		// returned, as the buffer is not validated.
+		r := buffer.NewUnsizedBufferFromReader(
+			newPartiallyFailingReader(ctrl)).ToReader()
+		data, err := ioutil.ReadAll(r)
+		require.Equal(t, status.Error(codes.Internal, "Storage backend on fire"), err)
+		require.Equal(t, []byte("Hel"), data)
+		r.Close()
+	})
+}
+
+func TestNewUnsizedBufferFromReaderCloneCopy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	t.Run("Success", func(t *testing.T) {
+		b1, b2 := buffer.NewUnsizedBufferFromReader(
+			ioutil.NopCloser(bytes.NewBufferString("Hello"))).CloneCopy(10)
+
+		data1, err := b1.ToByteSlice(10)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data1)
+
+		// Both buffers should report a known size, as the
+		// contents have been loaded into memory.
+		n, err := b2.GetSizeBytes()
+		require.NoError(t, err)
+		require.Equal(t, int64(5), n)
+		data2, err := b2.ToByteSlice(10)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data2)
+	})
+
+	t.Run("TooBig", func(t *testing.T) {
+		b1, b2 := buffer.NewUnsizedBufferFromReader(
+			ioutil.NopCloser(bytes.NewBufferString("Hello world"))).CloneCopy(4)
+
+		_, err := b1.ToByteSlice(100)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Buffer is at least 5 bytes in size, while a maximum of 4 bytes is permitted"), err)
+		_, err = b2.ToByteSlice(100)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Buffer is at least 5 bytes in size, while a maximum of 4 bytes is permitted"), err)
+	})
+
+	t.Run("IOError", func(t *testing.T) {
+		b1, b2 := buffer.NewUnsizedBufferFromReader(
+			newPartiallyFailingReader(ctrl)).CloneCopy(100)
+
+		_, err := b1.ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Internal, "Storage backend on fire"), err)
+		_, err = b2.ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Internal, "Storage backend on fire"), err)
+	})
+}
@@ -0,0 +1,111 @@
+package buffer
+
+import (
+	"io"
+	"sync"
+)
+
+// ChunkPool is a pool of fixed size byte slices that may be used as
+// storage for chunks returned by ChunkReaders. Reusing chunks reduces
+// the amount of garbage generated when streaming large blobs.
+type ChunkPool struct {
+	pool           sync.Pool
+	chunkSizeBytes int
+}
+
+// NewChunkPool creates a ChunkPool that hands out chunks of a given
+// size.
+func NewChunkPool(chunkSizeBytes int) *ChunkPool {
+	p := &ChunkPool{
+		chunkSizeBytes: chunkSizeBytes,
+	}
+	p.pool.New = func() interface{} {
+		b := make([]byte, chunkSizeBytes)
+		return &b
+	}
+	return p
+}
+
+func (p *ChunkPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *ChunkPool) put(b *[]byte) {
+	p.pool.Put(b)
+}
+
+type pooledChunkReader struct {
+	r              io.ReadCloser
+	pool           *ChunkPool
+	chunk          *[]byte
+	chunkSizeBytes int
+	err            error
+}
+
+// ToPooledChunkReader is similar to Buffer.ToChunkReader(), except that
+// chunks are backed by storage obtained from a ChunkPool. The size of
+// the chunks returned is bounded by chunkSizeBytes, which is capped to
+// the chunk size of the pool.
+//
+// Unlike regular ChunkReaders, the slices returned by Read() are only
+// valid until the next call to Read() or Close(). Callers must
+// therefore not retain them. Upon Close(), storage is returned to the
+// pool.
+//
+// Buffers that are backed by validated byte slices already yield
+// chunks without copying. For these, the pool is not used.
+func ToPooledChunkReader(b Buffer, off int64, pool *ChunkPool, chunkSizeBytes int) ChunkReader {
+	if chunkSizeBytes <= 0 || chunkSizeBytes > pool.chunkSizeBytes {
+		chunkSizeBytes = pool.chunkSizeBytes
+	}
+	if _, ok := b.(*validatedByteSliceBuffer); ok {
+		return b.ToChunkReader(off, chunkSizeBytes)
+	}
+
+	if sizeBytes, err := b.GetSizeBytes(); err == nil {
+		if err := validateReaderOffset(sizeBytes, off); err != nil {
+			b.Discard()
+			return newErrorChunkReader(err)
+		}
+	} else if err != ErrSizeUnknown {
+		b.Discard()
+		return newErrorChunkReader(err)
+	}
+
+	r := b.ToReader()
+	if err := discardFromReader(r, off); err != nil {
+		r.Close()
+		return newErrorChunkReader(err)
+	}
+	return &pooledChunkReader{
+		r:              r,
+		pool:           pool,
+		chunk:          pool.get(),
+		chunkSizeBytes: chunkSizeBytes,
+	}
+}
+
+func (r *pooledChunkReader) Read() ([]byte, error) {
+	// Return errors that were encountered while reading the
+	// previous chunk.
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	b := (*r.chunk)[:r.chunkSizeBytes]
+	n, err := io.ReadFull(r.r, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if n > 0 {
+		r.err = err
+		return b[:n], nil
+	}
+	return nil, err
+}
+
+func (r *pooledChunkReader) Close() {
+	r.r.Close()
+	r.pool.put(r.chunk)
+	r.chunk = nil
+}
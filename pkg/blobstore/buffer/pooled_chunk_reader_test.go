@@ -0,0 +1,225 @@
+package buffer_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToPooledChunkReader(t *testing.T) {
+	helloDigest := util.MustNewDigest(
+		"foo",
+		&remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		})
+	pool := buffer.NewChunkPool(2)
+
+	t.Run("NegativeOffset", func(t *testing.T) {
+		r := buffer.ToPooledChunkReader(
+			buffer.NewCASBufferFromReader(helloDigest, ioutil.NopCloser(bytes.NewBufferString("Hello")), buffer.Irreparable),
+			-1,
+			pool,
+			2)
+		_, err := r.Read()
+		require.Equal(t, status.Error(codes.InvalidArgument, "Negative read offset: -1"), err)
+		r.Close()
+	})
+
+	t.Run("OffsetBeyondEnd", func(t *testing.T) {
+		r := buffer.ToPooledChunkReader(
+			buffer.NewCASBufferFromReader(helloDigest, ioutil.NopCloser(bytes.NewBufferString("Hello")), buffer.Irreparable),
+			6,
+			pool,
+			2)
+		_, err := r.Read()
+		require.Equal(t, status.Error(codes.InvalidArgument, "Buffer is 5 bytes in size, while a read at offset 6 was requested"), err)
+		r.Close()
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		r := buffer.ToPooledChunkReader(
+			buffer.NewCASBufferFromReader(helloDigest, ioutil.NopCloser(bytes.NewBufferString("Hello")), buffer.Irreparable),
+			1,
+			pool,
+			2)
+		chunk, err := r.Read()
+		require.NoError(t, err)
+		require.Equal(t, []byte("el"), chunk)
+		chunk, err = r.Read()
+		require.NoError(t, err)
+		require.Equal(t, []byte("lo"), chunk)
+		_, err = r.Read()
+		require.Equal(t, io.EOF, err)
+		r.Close()
+	})
+
+	t.Run("ChunkSizeCapped", func(t *testing.T) {
+		// Chunks may not exceed the chunk size of the pool.
+		r := buffer.ToPooledChunkReader(
+			buffer.NewCASBufferFromReader(helloDigest, ioutil.NopCloser(bytes.NewBufferString("Hello")), buffer.Irreparable),
+			2,
+			pool,
+			100)
+		chunk, err := r.Read()
+		require.NoError(t, err)
+		require.Equal(t, []byte("ll"), chunk)
+		chunk, err = r.Read()
+		require.NoError(t, err)
+		require.Equal(t, []byte("o"), chunk)
+		_, err = r.Read()
+		require.Equal(t, io.EOF, err)
+		r.Close()
+	})
+
+	t.Run("SmallerChunkSize", func(t *testing.T) {
+		r := buffer.ToPooledChunkReader(
+			buffer.NewCASBufferFromReader(helloDigest, ioutil.NopCloser(bytes.NewBufferString("Hello")), buffer.Irreparable),
+			2,
+			pool,
+			1)
+		for _, expected := range []string{"l", "l", "o"} {
+			chunk, err := r.Read()
+			require.NoError(t, err)
+			require.Equal(t, []byte(expected), chunk)
+		}
+		_, err := r.Read()
+		require.Equal(t, io.EOF, err)
+		r.Close()
+	})
+
+	t.Run("ValidatedByteSlice", func(t *testing.T) {
+		// Buffers backed by byte slices should yield chunks
+		// that refer to the original data, as copying them
+		// into pooled storage would be wasteful.
+		data := []byte("Hello")
+		r := buffer.ToPooledChunkReader(
+			buffer.NewValidatedBufferFromByteSlice(data),
+			1,
+			pool,
+			100)
+		chunk, err := r.Read()
+		require.NoError(t, err)
+		require.Equal(t, []byte("el"), chunk)
+		require.Same(t, &data[1], &chunk[0])
+		chunk, err = r.Read()
+		require.NoError(t, err)
+		require.Equal(t, []byte("lo"), chunk)
+		require.Same(t, &data[3], &chunk[0])
+		_, err = r.Read()
+		require.Equal(t, io.EOF, err)
+		r.Close()
+	})
+
+	t.Run("ChecksumFailure", func(t *testing.T) {
+		r := buffer.ToPooledChunkReader(
+			buffer.NewCASBufferFromReader(helloDigest, ioutil.NopCloser(bytes.NewBufferString("Hallo")), buffer.Irreparable),
+			0,
+			pool,
+			2)
+		chunk, err := r.Read()
+		require.NoError(t, err)
+		require.Equal(t, []byte("Ha"), chunk)
+		chunk, err = r.Read()
+		require.NoError(t, err)
+		require.Equal(t, []byte("ll"), chunk)
+		_, err = r.Read()
+		require.Equal(t, status.Error(codes.Internal, "Buffer has checksum d1bf93299de1b68e6d382c893bf1215f, while 8b1a9953c4611296a827abf8c47804d7 was expected"), err)
+		r.Close()
+	})
+
+	t.Run("ErrorAfterData", func(t *testing.T) {
+		// Errors returned together with a partial chunk should
+		// not be lost, even if the underlying reader does not
+		// return them again.
+		r := buffer.ToPooledChunkReader(
+			buffer.NewUnsizedBufferFromReader(ioutil.NopCloser(&flakyReader{
+				chunks: []string{"H", "", "ello"},
+				errs:   []error{nil, status.Error(codes.Unavailable, "Connection reset"), nil},
+			})),
+			0,
+			pool,
+			2)
+		chunk, err := r.Read()
+		require.NoError(t, err)
+		require.Equal(t, []byte("H"), chunk)
+		_, err = r.Read()
+		require.Equal(t, status.Error(codes.Unavailable, "Connection reset"), err)
+		_, err = r.Read()
+		require.Equal(t, status.Error(codes.Unavailable, "Connection reset"), err)
+		r.Close()
+	})
+}
+
+// flakyReader is an io.Reader that yields a sequence of results, after
+// which it returns io.EOF. Unlike most readers, it does not return the
+// same error repeatedly.
+type flakyReader struct {
+	chunks []string
+	errs   []error
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	err := r.errs[0]
+	r.chunks, r.errs = r.chunks[1:], r.errs[1:]
+	return n, err
+}
+
+// benchmarkChunkReader streams a 1 MiB blob through a ChunkReader,
+// reporting the number of allocations per blob streamed.
+func benchmarkChunkReader(b *testing.B, newChunkReader func(buffer.Buffer) buffer.ChunkReader) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	hash := md5.Sum(data)
+	digest := util.MustNewDigest(
+		"foo",
+		&remoteexecution.Digest{
+			Hash:      hex.EncodeToString(hash[:]),
+			SizeBytes: int64(len(data)),
+		})
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := newChunkReader(buffer.NewCASBufferFromReader(digest, ioutil.NopCloser(bytes.NewReader(data)), buffer.Irreparable))
+		for {
+			if _, err := r.Read(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkToChunkReader(b *testing.B) {
+	benchmarkChunkReader(b, func(buf buffer.Buffer) buffer.ChunkReader {
+		return buf.ToChunkReader(0, 64*1024)
+	})
+}
+
+func BenchmarkToPooledChunkReader(b *testing.B) {
+	pool := buffer.NewChunkPool(64 * 1024)
+	benchmarkChunkReader(b, func(buf buffer.Buffer) buffer.ChunkReader {
+		return buffer.ToPooledChunkReader(buf, 0, pool, 64*1024)
+	})
+}
@@ -0,0 +1,136 @@
+package buffer
+
+import (
+	"io"
+	"io/ioutil"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrSizeUnknown is returned by GetSizeBytes() on buffers created
+// through NewUnsizedBufferFromReader(). Consumers that need to know the
+// size of a buffer up front may use this error to determine that the
+// contents of the buffer need to be staged first.
+var ErrSizeUnknown = status.Error(codes.FailedPrecondition, "Size of the buffer is not known in advance")
+
+type unsizedReaderBuffer struct {
+	r io.ReadCloser
+}
+
+// NewUnsizedBufferFromReader creates a buffer whose contents may be
+// obtained through a ReadCloser of which the length is not known in
+// advance. As no digest is provided, the contents of the buffer are not
+// validated. It is the responsibility of the consumer to do so.
+//
+// Because it cannot be determined in advance how much data needs to be
+// processed, buffers of unknown size cannot be multiplexed, nor can I/O
+// errors be retried by an ErrorHandler. Buffers should be converted to
+// ones of known size (e.g., using ToByteSlice()) before being passed to
+// BlobAccess implementations that require such features.
+func NewUnsizedBufferFromReader(r io.ReadCloser) Buffer {
+	return &unsizedReaderBuffer{
+		r: r,
+	}
+}
+
+func (b *unsizedReaderBuffer) GetSizeBytes() (int64, error) {
+	return 0, ErrSizeUnknown
+}
+
+func (b *unsizedReaderBuffer) IntoWriter(w io.Writer) error {
+	defer b.r.Close()
+
+	_, err := io.Copy(w, b.r)
+	return err
+}
+
+func (b *unsizedReaderBuffer) ReadAt(p []byte, off int64) (int, error) {
+	defer b.r.Close()
+
+	if err := b.discard(off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(b.r, p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, io.EOF
+	} else if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (b *unsizedReaderBuffer) ToActionResult(maximumSizeBytes int) (*remoteexecution.ActionResult, error) {
+	return toActionResultViaByteSlice(b, maximumSizeBytes)
+}
+
+func (b *unsizedReaderBuffer) ToByteSlice(maximumSizeBytes int) ([]byte, error) {
+	defer b.r.Close()
+
+	// Attempt to read one byte more than permitted, so that
+	// oversized buffers can be detected.
+	data, err := ioutil.ReadAll(io.LimitReader(b.r, int64(maximumSizeBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maximumSizeBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "Buffer is at least %d bytes in size, while a maximum of %d bytes is permitted", len(data), maximumSizeBytes)
+	}
+	return data, nil
+}
+
+func (b *unsizedReaderBuffer) ToChunkReader(off int64, maximumChunkSizeBytes int) ChunkReader {
+	return b.toUnvalidatedChunkReader(off, maximumChunkSizeBytes)
+}
+
+func (b *unsizedReaderBuffer) ToReader() io.ReadCloser {
+	return b.toUnvalidatedReader(0)
+}
+
+func (b *unsizedReaderBuffer) CloneCopy(maximumSizeBytes int) (Buffer, Buffer) {
+	return cloneCopyViaByteSlice(b, maximumSizeBytes)
+}
+
+func (b *unsizedReaderBuffer) CloneStream() (Buffer, Buffer) {
+	b.r.Close()
+	err := status.Error(codes.Unimplemented, "Buffers of unknown size cannot be cloned")
+	return NewBufferFromError(err), NewBufferFromError(err)
+}
+
+func (b *unsizedReaderBuffer) Discard() {
+	b.r.Close()
+}
+
+func (b *unsizedReaderBuffer) applyErrorHandler(errorHandler ErrorHandler) (Buffer, bool) {
+	// Switching to another buffer is not possible, as there is no
+	// way to validate that both buffers have identical contents.
+	errorHandler.Done()
+	return b, false
+}
+
+func (b *unsizedReaderBuffer) discard(off int64) error {
+	if err := discardFromReader(b.r, off); err == io.EOF {
+		return status.Errorf(codes.InvalidArgument, "Buffer is smaller than read offset %d", off)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *unsizedReaderBuffer) toUnvalidatedChunkReader(off int64, maximumChunkSizeBytes int) ChunkReader {
+	if err := b.discard(off); err != nil {
+		b.r.Close()
+		return newErrorChunkReader(err)
+	}
+	return newReaderBackedChunkReader(b.r, maximumChunkSizeBytes)
+}
+
+func (b *unsizedReaderBuffer) toUnvalidatedReader(off int64) io.ReadCloser {
+	if err := b.discard(off); err != nil {
+		b.r.Close()
+		return newErrorReader(err)
+	}
+	return b.r
+}
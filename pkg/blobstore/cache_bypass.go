@@ -0,0 +1,40 @@
+package blobstore
+
+import (
+	"context"
+)
+
+// CacheBypassMode indicates whether requests should bypass caches
+// (e.g., the fast backend of ReadCachingBlobAccess) and be sent to the
+// authoritative backend directly.
+type CacheBypassMode int
+
+const (
+	// CacheBypassNone causes caches to be used as usual.
+	CacheBypassNone CacheBypassMode = iota
+	// CacheBypassRead causes caches to be skipped, leaving their
+	// contents unmodified.
+	CacheBypassRead
+	// CacheBypassReadAndRepopulate causes caches to be skipped,
+	// while storing the freshly obtained data in the caches.
+	CacheBypassReadAndRepopulate
+)
+
+type cacheBypassModeKey struct{}
+
+// NewContextWithCacheBypassMode returns a context that causes caching
+// decorators to bypass their caches for requests made with it. This
+// can be used to force reading from the authoritative backend, e.g. to
+// validate entries that are suspected to be stale.
+func NewContextWithCacheBypassMode(ctx context.Context, mode CacheBypassMode) context.Context {
+	return context.WithValue(ctx, cacheBypassModeKey{}, mode)
+}
+
+// GetCacheBypassModeFromContext returns the cache bypass mode that was
+// attached to a context using NewContextWithCacheBypassMode().
+func GetCacheBypassModeFromContext(ctx context.Context) CacheBypassMode {
+	if mode, ok := ctx.Value(cacheBypassModeKey{}).(CacheBypassMode); ok {
+		return mode
+	}
+	return CacheBypassNone
+}
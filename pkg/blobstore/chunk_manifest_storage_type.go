@@ -0,0 +1,51 @@
+package blobstore
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type chunkManifestStorageType struct {
+	maximumSizeBytes int
+}
+
+// NewChunkManifestStorageType creates a StorageType that is capable of
+// creating identifiers and buffers for chunk manifests stored by
+// ChunkingBlobAccess. Manifests are stored under the digest of the
+// blob they describe, but their contents do not match that digest.
+// They are therefore not validated. Manifests larger than
+// maximumSizeBytes are rejected without loading them into memory.
+func NewChunkManifestStorageType(maximumSizeBytes int) StorageType {
+	return chunkManifestStorageType{
+		maximumSizeBytes: maximumSizeBytes,
+	}
+}
+
+func (f chunkManifestStorageType) GetDigestKey(digest *util.Digest) string {
+	return digest.GetKey(util.DigestKeyWithoutInstance)
+}
+
+func (f chunkManifestStorageType) NewBufferFromByteSlice(digest *util.Digest, data []byte, repairStrategy buffer.RepairStrategy) buffer.Buffer {
+	return buffer.NewValidatedBufferFromByteSlice(data)
+}
+
+func (f chunkManifestStorageType) NewBufferFromReader(digest *util.Digest, r io.ReadCloser, repairStrategy buffer.RepairStrategy) buffer.Buffer {
+	// Manifests are small. Simply load them into memory. Attempt
+	// to read one byte more than permitted, so that oversized
+	// manifests can be detected.
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(f.maximumSizeBytes)+1))
+	r.Close()
+	if err != nil {
+		return buffer.NewBufferFromError(err)
+	}
+	if len(data) > f.maximumSizeBytes {
+		return buffer.NewBufferFromError(status.Errorf(codes.InvalidArgument, "Chunk manifest is at least %d bytes in size, while a maximum of %d bytes is permitted", len(data), f.maximumSizeBytes))
+	}
+	return buffer.NewValidatedBufferFromByteSlice(data)
+}
@@ -0,0 +1,295 @@
+package chunking
+
+import (
+	"context"
+	"io"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	cas_proto "github.com/buildbarn/bb-storage/pkg/proto/cas"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunkBatchSize is the maximum number of chunks for which existence
+// is determined using a single call to FindMissing() during Put().
+// Chunks are kept in memory until processed, meaning that the memory
+// usage of Put() is bounded by chunkBatchSize times the maximum chunk
+// size.
+const chunkBatchSize = 64
+
+type chunkingBlobAccess struct {
+	chunks                   blobstore.BlobAccess
+	manifests                blobstore.BlobAccess
+	minimumChunkSizeBytes    int
+	averageChunkSizeBytes    int
+	maximumChunkSizeBytes    int
+	maximumManifestSizeBytes int
+}
+
+// NewChunkingBlobAccess creates an adapter for the Content Addressable
+// Storage that splits up blobs into content-defined chunks. Chunks are
+// stored in a separate backend, so that identical chunks shared by
+// multiple blobs (e.g., successive versions of the same large file)
+// only need to be stored once. For every blob, a ChunkManifest is
+// stored in the manifests backend that lists the chunks of which the
+// blob consists.
+//
+// Existence of a blob is determined by the presence of its manifest
+// and all of its chunks. As this requires loading the manifests of all
+// blobs that are present, FindMissing() is more expensive than for
+// other backends. Checking the chunks ensures that blobs are reported
+// as missing if the chunks backend evicts chunks independently of the
+// manifests backend. Manifests may not exceed
+// maximumManifestSizeBytes, which bounds the size of blobs that can be
+// stored.
+func NewChunkingBlobAccess(chunks blobstore.BlobAccess, manifests blobstore.BlobAccess, minimumChunkSizeBytes int, averageChunkSizeBytes int, maximumChunkSizeBytes int, maximumManifestSizeBytes int) blobstore.BlobAccess {
+	return &chunkingBlobAccess{
+		chunks:                   chunks,
+		manifests:                manifests,
+		minimumChunkSizeBytes:    minimumChunkSizeBytes,
+		averageChunkSizeBytes:    averageChunkSizeBytes,
+		maximumChunkSizeBytes:    maximumChunkSizeBytes,
+		maximumManifestSizeBytes: maximumManifestSizeBytes,
+	}
+}
+
+// getChunkDigests loads the manifest of a blob and returns the digests
+// of the chunks of which it consists.
+func (ba *chunkingBlobAccess) getChunkDigests(ctx context.Context, digest *util.Digest) ([]*util.Digest, error) {
+	data, err := ba.manifests.Get(ctx, digest).ToByteSlice(ba.maximumManifestSizeBytes)
+	if err != nil {
+		return nil, err
+	}
+	var manifest cas_proto.ChunkManifest
+	if err := proto.Unmarshal(data, &manifest); err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to unmarshal chunk manifest")
+	}
+
+	chunkDigests := make([]*util.Digest, 0, len(manifest.ChunkDigests))
+	totalSizeBytes := int64(0)
+	for _, partialChunkDigest := range manifest.ChunkDigests {
+		chunkDigest, err := digest.NewDerivedDigest(partialChunkDigest)
+		if err != nil {
+			return nil, util.StatusWrapWithCode(err, codes.Internal, "Chunk manifest contains an invalid chunk digest")
+		}
+		chunkDigests = append(chunkDigests, chunkDigest)
+		totalSizeBytes += chunkDigest.GetSizeBytes()
+	}
+	if totalSizeBytes != digest.GetSizeBytes() {
+		return nil, status.Errorf(codes.Internal, "Chunk manifest describes a blob of %d bytes, while %d bytes were expected", totalSizeBytes, digest.GetSizeBytes())
+	}
+	return chunkDigests, nil
+}
+
+func (ba *chunkingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	// Validate the manifest before returning any data.
+	chunkDigests, err := ba.getChunkDigests(ctx, digest)
+	if err != nil {
+		return buffer.NewBufferFromError(err)
+	}
+
+	return buffer.NewCASBufferFromReader(
+		digest,
+		&chunkReassemblingReader{
+			context:      ctx,
+			chunks:       ba.chunks,
+			chunkDigests: chunkDigests,
+		},
+		buffer.Irreparable)
+}
+
+// storeChunks stores all chunks that are not present yet. Existence
+// of chunks is determined using a single call to FindMissing().
+func (ba *chunkingBlobAccess) storeChunks(ctx context.Context, chunkDigests []*util.Digest, chunks [][]byte) error {
+	missing, err := ba.chunks.FindMissing(ctx, chunkDigests)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to determine existence of chunks")
+	}
+	missingKeys := make(map[string]struct{}, len(missing))
+	for _, chunkDigest := range missing {
+		missingKeys[chunkDigest.GetKey(util.DigestKeyWithoutInstance)] = struct{}{}
+	}
+	for i, chunkDigest := range chunkDigests {
+		if _, ok := missingKeys[chunkDigest.GetKey(util.DigestKeyWithoutInstance)]; ok {
+			if err := ba.chunks.Put(ctx, chunkDigest, buffer.NewValidatedBufferFromByteSlice(chunks[i])); err != nil {
+				return util.StatusWrapf(err, "Failed to store chunk %s", chunkDigest)
+			}
+			// Don't store chunks that occur multiple
+			// times within the same batch more than once.
+			delete(missingKeys, chunkDigest.GetKey(util.DigestKeyWithoutInstance))
+		}
+	}
+	return nil
+}
+
+func (ba *chunkingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	r := b.ToReader()
+	defer r.Close()
+
+	chunker := NewContentDefinedChunker(r, ba.minimumChunkSizeBytes, ba.averageChunkSizeBytes, ba.maximumChunkSizeBytes)
+	var manifest cas_proto.ChunkManifest
+	manifestSizeBytes := 0
+	var pendingChunkDigests []*util.Digest
+	var pendingChunks [][]byte
+	for {
+		chunk, err := chunker.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		digestGenerator, err := digest.NewDigestGenerator()
+		if err != nil {
+			return err
+		}
+		if _, err := digestGenerator.Write(chunk); err != nil {
+			panic(err)
+		}
+		chunkDigest := digestGenerator.Sum()
+
+		// Prevent storing manifests that are too large to be
+		// read back by Get(). Check this before storing any
+		// further chunks, as they would remain unreferenced.
+		partialChunkDigest := chunkDigest.GetPartialDigest()
+		entrySizeBytes := proto.Size(partialChunkDigest)
+		manifestSizeBytes += 1 + proto.SizeVarint(uint64(entrySizeBytes)) + entrySizeBytes
+		if manifestSizeBytes > ba.maximumManifestSizeBytes {
+			return status.Errorf(codes.InvalidArgument, "Chunk manifest would exceed the maximum size of %d bytes", ba.maximumManifestSizeBytes)
+		}
+		manifest.ChunkDigests = append(manifest.ChunkDigests, partialChunkDigest)
+
+		// Only upload chunks that are not present yet. Chunks
+		// are processed in batches, so that their existence
+		// can be determined without a round trip per chunk.
+		// The chunker returns slices that remain valid, so
+		// the chunks may be retained until the batch is full.
+		pendingChunkDigests = append(pendingChunkDigests, chunkDigest)
+		pendingChunks = append(pendingChunks, chunk)
+		if len(pendingChunkDigests) >= chunkBatchSize {
+			if err := ba.storeChunks(ctx, pendingChunkDigests, pendingChunks); err != nil {
+				return err
+			}
+			pendingChunkDigests = pendingChunkDigests[:0]
+			pendingChunks = pendingChunks[:0]
+		}
+	}
+	if len(pendingChunkDigests) > 0 {
+		if err := ba.storeChunks(ctx, pendingChunkDigests, pendingChunks); err != nil {
+			return err
+		}
+	}
+
+	// Only store the manifest after all chunks have been stored, so
+	// that the blob never becomes visible partially.
+	data, err := proto.Marshal(&manifest)
+	if err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to marshal chunk manifest")
+	}
+	return ba.manifests.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice(data))
+}
+
+func (ba *chunkingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	missing, err := ba.manifests.FindMissing(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+
+	// The chunks backend may discard chunks independently of the
+	// manifests referencing them. Load the manifests of all blobs
+	// that are present, and check for the existence of their
+	// chunks using a single call. This also ensures that chunks are
+	// refreshed by backends that evict data based on usage.
+	missingKeys := make(map[string]struct{}, len(missing))
+	for _, blobDigest := range missing {
+		missingKeys[blobDigest.GetKey(util.DigestKeyWithInstance)] = struct{}{}
+	}
+	var allChunkDigests []*util.Digest
+	blobsByChunk := map[string][]*util.Digest{}
+	for _, blobDigest := range util.RemoveDuplicateDigests(digests) {
+		if _, ok := missingKeys[blobDigest.GetKey(util.DigestKeyWithInstance)]; ok {
+			continue
+		}
+		chunkDigests, err := ba.getChunkDigests(ctx, blobDigest)
+		if status.Code(err) == codes.NotFound {
+			// Manifest disappeared in the meantime.
+			missing = append(missing, blobDigest)
+			missingKeys[blobDigest.GetKey(util.DigestKeyWithInstance)] = struct{}{}
+			continue
+		} else if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to load chunk manifest of blob %s", blobDigest)
+		}
+		for _, chunkDigest := range chunkDigests {
+			chunkKey := chunkDigest.GetKey(util.DigestKeyWithoutInstance)
+			if _, ok := blobsByChunk[chunkKey]; !ok {
+				allChunkDigests = append(allChunkDigests, chunkDigest)
+			}
+			blobsByChunk[chunkKey] = append(blobsByChunk[chunkKey], blobDigest)
+		}
+	}
+	if len(allChunkDigests) == 0 {
+		return missing, nil
+	}
+
+	missingChunks, err := ba.chunks.FindMissing(ctx, allChunkDigests)
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to determine existence of chunks")
+	}
+	for _, chunkDigest := range missingChunks {
+		for _, blobDigest := range blobsByChunk[chunkDigest.GetKey(util.DigestKeyWithoutInstance)] {
+			blobKey := blobDigest.GetKey(util.DigestKeyWithInstance)
+			if _, ok := missingKeys[blobKey]; !ok {
+				missing = append(missing, blobDigest)
+				missingKeys[blobKey] = struct{}{}
+			}
+		}
+	}
+	return missing, nil
+}
+
+// chunkReassemblingReader is an io.ReadCloser that concatenates the
+// contents of a sequence of chunks. Chunks are only fetched from
+// storage when needed.
+type chunkReassemblingReader struct {
+	context      context.Context
+	chunks       blobstore.BlobAccess
+	chunkDigests []*util.Digest
+
+	current io.ReadCloser
+}
+
+func (r *chunkReassemblingReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunkDigests) == 0 {
+				return 0, io.EOF
+			}
+			r.current = r.chunks.Get(r.context, r.chunkDigests[0]).ToReader()
+			r.chunkDigests = r.chunkDigests[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReassemblingReader) Close() error {
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	r.chunkDigests = nil
+	return nil
+}
@@ -0,0 +1,206 @@
+package chunking_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/chunking"
+	cas_proto "github.com/buildbarn/bb-storage/pkg/proto/cas"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestChunkingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	chunks := mock.NewMockBlobAccess(ctrl)
+	manifests := mock.NewMockBlobAccess(ctrl)
+
+	// Use identical minimum and maximum chunk sizes, so that blobs
+	// are split up into chunks of a fixed size.
+	blobAccess := chunking.NewChunkingBlobAccess(chunks, manifests, 4, 4, 4, 1000)
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	chunkDigests := []*util.Digest{
+		util.MustNewDigest(
+			"default",
+			&remoteexecution.Digest{
+				Hash:      "1824e8e0307cbfdd1993511ab040075c",
+				SizeBytes: 4,
+			}),
+		util.MustNewDigest(
+			"default",
+			&remoteexecution.Digest{
+				Hash:      "e7c52a655c23270552b9bf9ea01b1483",
+				SizeBytes: 4,
+			}),
+		util.MustNewDigest(
+			"default",
+			&remoteexecution.Digest{
+				Hash:      "e90c8e1edb39b713d0675837a44d40d7",
+				SizeBytes: 3,
+			}),
+	}
+	manifest, err := proto.Marshal(&cas_proto.ChunkManifest{
+		ChunkDigests: []*remoteexecution.Digest{
+			chunkDigests[0].GetPartialDigest(),
+			chunkDigests[1].GetPartialDigest(),
+			chunkDigests[2].GetPartialDigest(),
+		},
+	})
+	require.NoError(t, err)
+
+	expectChunkPut := func(chunkDigest *util.Digest, data string) {
+		chunks.EXPECT().Put(ctx, chunkDigest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				chunkData, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, []byte(data), chunkData)
+				return nil
+			})
+	}
+
+	t.Run("PutSuccess", func(t *testing.T) {
+		// Chunks that are already present should not be
+		// uploaded once more. Existence of all chunks should be
+		// determined using a single call. The manifest should
+		// be stored after all chunks have been stored.
+		gomock.InOrder(
+			chunks.EXPECT().FindMissing(ctx, chunkDigests).Return([]*util.Digest{chunkDigests[0], chunkDigests[2]}, nil),
+			manifests.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+				func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+					data, err := b.ToByteSlice(1000)
+					require.NoError(t, err)
+					require.Equal(t, manifest, data)
+					return nil
+				}))
+		expectChunkPut(chunkDigests[0], "Hell")
+		expectChunkPut(chunkDigests[2], "rld")
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("PutChunkFailure", func(t *testing.T) {
+		chunks.EXPECT().FindMissing(ctx, chunkDigests).Return([]*util.Digest{chunkDigests[0]}, nil)
+		chunks.EXPECT().Put(ctx, chunkDigests[0], gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return status.Error(codes.Unavailable, "Server offline")
+			})
+
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Failed to store chunk 1824e8e0307cbfdd1993511ab040075c-4-default: Server offline"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("PutManifestTooLarge", func(t *testing.T) {
+		// Each entry in the manifest is 38 bytes in size. A
+		// limit of 100 bytes permits storing two chunks, after
+		// which the upload should be aborted. Neither the
+		// chunks nor the manifest should be stored.
+		blobAccess := chunking.NewChunkingBlobAccess(chunks, manifests, 4, 4, 4, 100)
+
+		require.Equal(
+			t,
+			status.Error(codes.InvalidArgument, "Chunk manifest would exceed the maximum size of 100 bytes"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("GetSuccess", func(t *testing.T) {
+		manifests.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice(manifest))
+		chunks.EXPECT().Get(ctx, chunkDigests[0]).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hell")))
+		chunks.EXPECT().Get(ctx, chunkDigests[1]).Return(buffer.NewValidatedBufferFromByteSlice([]byte("o wo")))
+		chunks.EXPECT().Get(ctx, chunkDigests[2]).Return(buffer.NewValidatedBufferFromByteSlice([]byte("rld")))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("GetManifestTooLarge", func(t *testing.T) {
+		// Manifests exceeding the maximum size should not be
+		// loaded into memory.
+		blobAccess := chunking.NewChunkingBlobAccess(chunks, manifests, 4, 4, 4, 100)
+		manifests.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice(manifest))
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("GetManifestSizeMismatch", func(t *testing.T) {
+		// Manifests that describe a blob of the wrong size
+		// should be rejected before any chunks are read.
+		badManifest, err := proto.Marshal(&cas_proto.ChunkManifest{
+			ChunkDigests: []*remoteexecution.Digest{
+				chunkDigests[0].GetPartialDigest(),
+				chunkDigests[1].GetPartialDigest(),
+			},
+		})
+		require.NoError(t, err)
+		manifests.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice(badManifest))
+
+		_, err = blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Internal, "Chunk manifest describes a blob of 8 bytes, while 11 bytes were expected"), err)
+	})
+
+	t.Run("GetChunkCorrupted", func(t *testing.T) {
+		// The reassembled blob is validated against the digest
+		// of the original blob.
+		manifests.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice(manifest))
+		chunks.EXPECT().Get(ctx, chunkDigests[0]).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hell")))
+		chunks.EXPECT().Get(ctx, chunkDigests[1]).Return(buffer.NewValidatedBufferFromByteSlice([]byte("O WO")))
+		chunks.EXPECT().Get(ctx, chunkDigests[2]).Return(buffer.NewValidatedBufferFromByteSlice([]byte("rld")))
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, codes.Internal, status.Code(err))
+	})
+
+	t.Run("FindMissingManifestMissing", func(t *testing.T) {
+		// Blobs without a manifest are missing. There is no
+		// need to check for the existence of chunks.
+		manifests.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return([]*util.Digest{digest}, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest}, missing)
+	})
+
+	t.Run("FindMissingChunkMissing", func(t *testing.T) {
+		// The chunks backend may have evicted chunks
+		// independently of the manifest. The blob should then
+		// be reported as missing, so that clients upload it
+		// once more.
+		manifests.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+		manifests.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice(manifest))
+		chunks.EXPECT().FindMissing(ctx, chunkDigests).Return([]*util.Digest{chunkDigests[1]}, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest}, missing)
+	})
+
+	t.Run("FindMissingPresent", func(t *testing.T) {
+		manifests.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+		manifests.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice(manifest))
+		chunks.EXPECT().FindMissing(ctx, chunkDigests).Return(nil, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+}
@@ -0,0 +1,109 @@
+package chunking
+
+import (
+	"io"
+)
+
+// gearTable contains the random values that are mixed into the rolling
+// hash for every byte of input. The table is generated
+// deterministically, as chunk boundaries must be identical across
+// processes for deduplication to work.
+var gearTable [256]uint64
+
+func init() {
+	// Fill the table using SplitMix64.
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range gearTable {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// ContentDefinedChunker splits a stream of data into chunks whose
+// boundaries are determined by the data itself, as opposed to being
+// placed at fixed offsets. This means that inserting or removing bytes
+// in the middle of a stream only affects the chunks surrounding the
+// modification. Other chunks remain identical, allowing them to be
+// deduplicated.
+//
+// Boundaries are computed using a Gear-based rolling hash, similar to
+// the one used by FastCDC. A boundary is placed at every position where
+// the lower bits of the rolling hash are all zero, subject to a minimum
+// and maximum chunk size.
+type ContentDefinedChunker struct {
+	r                     io.Reader
+	minimumChunkSizeBytes int
+	maximumChunkSizeBytes int
+	mask                  uint64
+
+	data []byte
+	err  error
+}
+
+// NewContentDefinedChunker creates a ContentDefinedChunker that reads
+// data from a Reader. The average chunk size is rounded down to a power
+// of two.
+func NewContentDefinedChunker(r io.Reader, minimumChunkSizeBytes int, averageChunkSizeBytes int, maximumChunkSizeBytes int) *ContentDefinedChunker {
+	mask := uint64(1)
+	for mask*2 <= uint64(averageChunkSizeBytes) {
+		mask *= 2
+	}
+	return &ContentDefinedChunker{
+		r:                     r,
+		minimumChunkSizeBytes: minimumChunkSizeBytes,
+		maximumChunkSizeBytes: maximumChunkSizeBytes,
+		mask:                  mask - 1,
+		data:                  make([]byte, 0, maximumChunkSizeBytes),
+	}
+}
+
+// fill reads data from the underlying Reader until the internal buffer
+// contains a full maximum sized chunk, or until the end of the stream
+// is reached.
+func (c *ContentDefinedChunker) fill() {
+	for c.err == nil && len(c.data) < c.maximumChunkSizeBytes {
+		n, err := c.r.Read(c.data[len(c.data):c.maximumChunkSizeBytes])
+		c.data = c.data[:len(c.data)+n]
+		c.err = err
+	}
+}
+
+// findBoundary returns the length of the chunk stored at the start of
+// the internal buffer.
+func (c *ContentDefinedChunker) findBoundary() int {
+	if len(c.data) <= c.minimumChunkSizeBytes {
+		return len(c.data)
+	}
+	h := uint64(0)
+	for i, b := range c.data {
+		h = (h << 1) + gearTable[b]
+		if i+1 >= c.minimumChunkSizeBytes && h&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return len(c.data)
+}
+
+// Read the next chunk of data. The returned slice is not reused by
+// subsequent calls to Read(), meaning that callers may retain it.
+// io.EOF is returned after the last chunk has
+// been returned.
+func (c *ContentDefinedChunker) Read() ([]byte, error) {
+	c.fill()
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	if len(c.data) == 0 {
+		return nil, io.EOF
+	}
+
+	// Move the chunk out of the internal buffer, so that the
+	// internal buffer can be refilled on the next call.
+	n := c.findBoundary()
+	chunk := append([]byte(nil), c.data[:n]...)
+	c.data = c.data[:copy(c.data, c.data[n:])]
+	return chunk, nil
+}
@@ -0,0 +1,67 @@
+package chunking_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/chunking"
+	"github.com/stretchr/testify/require"
+)
+
+func readAllChunks(t *testing.T, data []byte) [][]byte {
+	chunker := chunking.NewContentDefinedChunker(bytes.NewReader(data), 64, 256, 1024)
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Read()
+		if err == io.EOF {
+			return chunks
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestContentDefinedChunker(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(123)).Read(data)
+
+	t.Run("Empty", func(t *testing.T) {
+		require.Empty(t, readAllChunks(t, nil))
+	})
+
+	t.Run("ChunkSizes", func(t *testing.T) {
+		// Concatenating all chunks should yield the original
+		// data. All chunks except the last one should respect
+		// the minimum and maximum chunk size.
+		chunks := readAllChunks(t, data)
+		require.Equal(t, data, bytes.Join(chunks, nil))
+		for i, chunk := range chunks {
+			if i != len(chunks)-1 {
+				require.True(t, len(chunk) >= 64)
+			}
+			require.True(t, len(chunk) <= 1024)
+		}
+	})
+
+	t.Run("Insertion", func(t *testing.T) {
+		// Inserting data at the start of the stream should
+		// only affect the first chunks. Boundaries should
+		// resynchronize afterwards.
+		chunks1 := readAllChunks(t, data)
+		chunks2 := readAllChunks(t, append([]byte("Hello world"), data...))
+
+		known := map[string]bool{}
+		for _, chunk := range chunks1 {
+			known[string(chunk)] = true
+		}
+		shared := 0
+		for _, chunk := range chunks2 {
+			if known[string(chunk)] {
+				shared++
+			}
+		}
+		require.True(t, shared >= len(chunks1)-5)
+	})
+}
@@ -0,0 +1,207 @@
+package blobstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	circuitBreakingBlobAccessPrometheusMetrics sync.Once
+
+	circuitBreakingBlobAccessRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "circuit_breaking_blob_access_rejections_total",
+			Help:      "Number of operations that failed immediately, due to the circuit breaker being open.",
+		},
+		[]string{"name"})
+	circuitBreakingBlobAccessTrips = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "circuit_breaking_blob_access_trips_total",
+			Help:      "Number of times the circuit breaker was opened.",
+		},
+		[]string{"name"})
+	circuitBreakingBlobAccessOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "circuit_breaking_blob_access_open",
+			Help:      "Whether the circuit breaker is currently open.",
+		},
+		[]string{"name"})
+)
+
+type circuitBreakingBlobAccess struct {
+	BlobAccess
+	clock            clock.Clock
+	failureThreshold int
+	resetTimeout     time.Duration
+
+	rejections prometheus.Counter
+	trips      prometheus.Counter
+	open       prometheus.Gauge
+
+	lock                sync.Mutex
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+// NewCircuitBreakingBlobAccess creates a decorator for BlobAccess
+// that stops forwarding requests to a backend that is unavailable.
+// Without it, every request against a backend that is down would have
+// to wait for a timeout to occur, causing requests to pile up.
+//
+// The circuit breaker opens after failureThreshold consecutive
+// operations fail with UNAVAILABLE or DEADLINE_EXCEEDED. Other errors
+// (e.g., NOT_FOUND) indicate that the backend is reachable, and are
+// treated as successes. DEADLINE_EXCEEDED errors caused by the
+// caller's own deadline expiring are ignored, as they say nothing
+// about the health of the backend. While open, operations fail
+// immediately with UNAVAILABLE. Once resetTimeout has passed, a single
+// operation is forwarded to the backend to probe whether it has
+// recovered. If the probe succeeds, the circuit breaker closes. If it
+// fails or does not complete within resetTimeout, the circuit breaker
+// remains open for another resetTimeout.
+func NewCircuitBreakingBlobAccess(blobAccess BlobAccess, clock clock.Clock, failureThreshold int, resetTimeout time.Duration, name string) BlobAccess {
+	circuitBreakingBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(circuitBreakingBlobAccessRejections)
+		prometheus.MustRegister(circuitBreakingBlobAccessTrips)
+		prometheus.MustRegister(circuitBreakingBlobAccessOpen)
+	})
+
+	ba := &circuitBreakingBlobAccess{
+		BlobAccess:       blobAccess,
+		clock:            clock,
+		failureThreshold: failureThreshold,
+		resetTimeout:     resetTimeout,
+
+		rejections: circuitBreakingBlobAccessRejections.WithLabelValues(name),
+		trips:      circuitBreakingBlobAccessTrips.WithLabelValues(name),
+		open:       circuitBreakingBlobAccessOpen.WithLabelValues(name),
+	}
+	ba.open.Set(0)
+	return ba
+}
+
+// startOperation determines whether an operation may be forwarded to
+// the backend. It returns whether the operation acts as a probe for a
+// circuit breaker that is open.
+func (ba *circuitBreakingBlobAccess) startOperation() (bool, error) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if ba.consecutiveFailures < ba.failureThreshold {
+		return false, nil
+	}
+	now := ba.clock.Now()
+	if now.Before(ba.openUntil) {
+		ba.rejections.Inc()
+		return false, status.Errorf(codes.Unavailable, "Circuit breaker is open, as the backend failed %d consecutive times", ba.consecutiveFailures)
+	}
+
+	// Keep the circuit breaker open while the probe is in flight.
+	// Instead of tracking the probe explicitly, let it expire after
+	// resetTimeout. This ensures that another probe is permitted
+	// eventually, even if the outcome of this probe is never
+	// reported (e.g., due to a buffer never being consumed).
+	ba.openUntil = now.Add(ba.resetTimeout)
+	return true, nil
+}
+
+// finishOperation updates the state of the circuit breaker based on
+// the outcome of an operation.
+func (ba *circuitBreakingBlobAccess) finishOperation(ctx context.Context, isProbe bool, err error) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	code := status.Code(err)
+	if code == codes.Canceled || (code == codes.DeadlineExceeded && ctx.Err() != nil) {
+		// The caller gave up on the operation, meaning it says
+		// nothing about the health of the backend. Permit
+		// another probe immediately.
+		if isProbe {
+			ba.openUntil = time.Time{}
+		}
+		return
+	}
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		ba.consecutiveFailures++
+		if ba.consecutiveFailures >= ba.failureThreshold {
+			if ba.consecutiveFailures == ba.failureThreshold {
+				ba.trips.Inc()
+				ba.open.Set(1)
+			}
+			ba.openUntil = ba.clock.Now().Add(ba.resetTimeout)
+		}
+	default:
+		ba.consecutiveFailures = 0
+		ba.open.Set(0)
+	}
+}
+
+func (ba *circuitBreakingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	isProbe, err := ba.startOperation()
+	if err != nil {
+		return buffer.NewBufferFromError(err)
+	}
+	return buffer.WithErrorHandler(
+		ba.BlobAccess.Get(ctx, digest),
+		&circuitBreakingErrorHandler{
+			blobAccess: ba,
+			context:    ctx,
+			isProbe:    isProbe,
+		})
+}
+
+func (ba *circuitBreakingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	isProbe, err := ba.startOperation()
+	if err != nil {
+		b.Discard()
+		return err
+	}
+	err = ba.BlobAccess.Put(ctx, digest, b)
+	ba.finishOperation(ctx, isProbe, err)
+	return err
+}
+
+func (ba *circuitBreakingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	isProbe, err := ba.startOperation()
+	if err != nil {
+		return nil, err
+	}
+	missing, err := ba.BlobAccess.FindMissing(ctx, digests)
+	ba.finishOperation(ctx, isProbe, err)
+	return missing, err
+}
+
+// circuitBreakingErrorHandler is used by Get() to capture the outcome
+// of reading a buffer, so that it can be reported to the circuit
+// breaker.
+type circuitBreakingErrorHandler struct {
+	blobAccess *circuitBreakingBlobAccess
+	context    context.Context
+	isProbe    bool
+	err        error
+}
+
+func (eh *circuitBreakingErrorHandler) OnError(err error) (buffer.Buffer, error) {
+	eh.err = err
+	return nil, err
+}
+
+func (eh *circuitBreakingErrorHandler) Done() {
+	eh.blobAccess.finishOperation(eh.context, eh.isProbe, eh.err)
+}
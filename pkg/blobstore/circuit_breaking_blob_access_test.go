@@ -0,0 +1,183 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func getCircuitBreakerOpen(t *testing.T, name string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "buildbarn_blobstore_circuit_breaking_blob_access_open" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "name" && label.GetValue() == name {
+					return metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	t.Fatalf("No metric found for circuit breaker %#v", name)
+	return 0
+}
+
+func TestCircuitBreakingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	blobAccess := blobstore.NewCircuitBreakingBlobAccess(baseBlobAccess, clock, 2, time.Minute, "circuit_breaking_test")
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	// NOT_FOUND errors indicate that the backend is reachable.
+	// They should not cause the circuit breaker to open.
+	baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found"))).Times(3)
+	for i := 0; i < 3; i++ {
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	}
+
+	// Two consecutive UNAVAILABLE errors should cause the circuit
+	// breaker to open.
+	baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, status.Error(codes.Unavailable, "Server offline")).Times(2)
+	clock.EXPECT().Now().Return(time.Unix(1000, 0))
+	for i := 0; i < 2; i++ {
+		_, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	}
+	require.Equal(t, 1.0, getCircuitBreakerOpen(t, "circuit_breaking_test"))
+
+	// While open, operations should fail without being forwarded.
+	clock.EXPECT().Now().Return(time.Unix(1030, 0))
+	require.Equal(
+		t,
+		status.Error(codes.Unavailable, "Circuit breaker is open, as the backend failed 2 consecutive times"),
+		blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+	// After the reset timeout, a single probe is permitted. If it
+	// fails, the circuit breaker should remain open.
+	clock.EXPECT().Now().Return(time.Unix(1060, 0))
+	baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, status.Error(codes.DeadlineExceeded, "Request timed out"))
+	clock.EXPECT().Now().Return(time.Unix(1061, 0))
+	_, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.Equal(t, status.Error(codes.DeadlineExceeded, "Request timed out"), err)
+
+	clock.EXPECT().Now().Return(time.Unix(1090, 0))
+	_, err = blobAccess.Get(ctx, digest).ToByteSlice(100)
+	require.Equal(t, status.Error(codes.Unavailable, "Circuit breaker is open, as the backend failed 3 consecutive times"), err)
+
+	// A successful probe should cause the circuit breaker to close.
+	clock.EXPECT().Now().Return(time.Unix(1121, 0))
+	baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+	data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello world"), data)
+	require.Equal(t, 0.0, getCircuitBreakerOpen(t, "circuit_breaking_test"))
+
+	baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
+
+func TestCircuitBreakingBlobAccessCallerDeadline(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	blobAccess := blobstore.NewCircuitBreakingBlobAccess(baseBlobAccess, clock, 1, time.Minute, "circuit_breaking_caller_deadline_test")
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	// DEADLINE_EXCEEDED errors caused by the caller's own deadline
+	// expiring should not cause the circuit breaker to open.
+	expiredCtx, cancel := context.WithDeadline(ctx, time.Unix(0, 0))
+	defer cancel()
+	baseBlobAccess.EXPECT().FindMissing(expiredCtx, []*util.Digest{digest}).
+		Return(nil, status.Error(codes.DeadlineExceeded, "Request timed out"))
+	_, err := blobAccess.FindMissing(expiredCtx, []*util.Digest{digest})
+	require.Equal(t, status.Error(codes.DeadlineExceeded, "Request timed out"), err)
+	require.Equal(t, 0.0, getCircuitBreakerOpen(t, "circuit_breaking_caller_deadline_test"))
+
+	baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// DEADLINE_EXCEEDED errors returned while the caller's
+	// deadline has not expired indicate that the backend is slow.
+	baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).
+		Return(nil, status.Error(codes.DeadlineExceeded, "Request timed out"))
+	clock.EXPECT().Now().Return(time.Unix(1000, 0))
+	_, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.Equal(t, status.Error(codes.DeadlineExceeded, "Request timed out"), err)
+	require.Equal(t, 1.0, getCircuitBreakerOpen(t, "circuit_breaking_caller_deadline_test"))
+}
+
+func TestCircuitBreakingBlobAccessUnconsumedProbe(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	blobAccess := blobstore.NewCircuitBreakingBlobAccess(baseBlobAccess, clock, 1, time.Minute, "circuit_breaking_unconsumed_probe_test")
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, status.Error(codes.Unavailable, "Server offline"))
+	clock.EXPECT().Now().Return(time.Unix(1000, 0))
+	_, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+
+	// Perform a probe using Get(), but never consume the buffer.
+	// This means the outcome of the probe is never reported.
+	clock.EXPECT().Now().Return(time.Unix(1060, 0))
+	baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+	blobAccess.Get(ctx, digest)
+
+	// While the probe is in flight, other operations should be
+	// rejected.
+	clock.EXPECT().Now().Return(time.Unix(1090, 0))
+	_, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.Equal(t, status.Error(codes.Unavailable, "Circuit breaker is open, as the backend failed 1 consecutive times"), err)
+
+	// Once the reset timeout has passed, the probe should be
+	// considered lost, and another probe should be permitted.
+	clock.EXPECT().Now().Return(time.Unix(1120, 0))
+	baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Equal(t, 0.0, getCircuitBreakerOpen(t, "circuit_breaking_unconsumed_probe_test"))
+}
@@ -0,0 +1,117 @@
+package circular
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/proto/circularadmin"
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+type adminServer struct{}
+
+// NewAdminServer creates a gRPC service that permits administrators to
+// start and inspect calls to Fsck(), and to pin and unpin blobs in
+// backends registered through RegisterFsck(). As runs may cause data
+// to be removed, this service should only be exposed on administrative
+// gRPC servers.
+func NewAdminServer() circularadmin.CircularAdminServer {
+	return adminServer{}
+}
+
+func (s adminServer) StartFsck(ctx context.Context, in *circularadmin.StartFsckRequest) (*circularadmin.StartFsckResponse, error) {
+	if err := startFsck(in.BackendName, in.Repair, in.MaximumBytesPerSecond); err != nil {
+		return nil, err
+	}
+	return &circularadmin.StartFsckResponse{}, nil
+}
+
+func (s adminServer) GetFsckStatus(ctx context.Context, in *circularadmin.GetFsckStatusRequest) (*circularadmin.GetFsckStatusResponse, error) {
+	var response circularadmin.GetFsckStatusResponse
+	for _, targetStatus := range getFsckTargetStatuses() {
+		response.Backends = append(response.Backends, &circularadmin.FsckStatus{
+			BackendName:      targetStatus.Name,
+			Running:          targetStatus.Running,
+			LastReport:       newFsckReportMessage(targetStatus.LastReport),
+			LastError:        targetStatus.LastError,
+			Progress:         newFsckProgressMessage(targetStatus.Progress),
+			PeriodicProgress: newFsckProgressMessage(targetStatus.PeriodicProgress),
+		})
+	}
+	return &response, nil
+}
+
+func (s adminServer) PinBlob(ctx context.Context, in *circularadmin.PinBlobRequest) (*circularadmin.PinBlobResponse, error) {
+	blobAccess, err := getRegisteredBlobAccess(in.BackendName)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := util.NewDigest("", in.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := blobAccess.Pin(digest); err != nil {
+		return nil, err
+	}
+	return &circularadmin.PinBlobResponse{}, nil
+}
+
+func (s adminServer) UnpinBlob(ctx context.Context, in *circularadmin.UnpinBlobRequest) (*circularadmin.UnpinBlobResponse, error) {
+	blobAccess, err := getRegisteredBlobAccess(in.BackendName)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := util.NewDigest("", in.Digest)
+	if err != nil {
+		return nil, err
+	}
+	blobAccess.Unpin(digest)
+	return &circularadmin.UnpinBlobResponse{}, nil
+}
+
+// newFsckProgressMessage converts a FsckProgress to its Protobuf
+// equivalent.
+func newFsckProgressMessage(progress *FsckProgress) *circularadmin.FsckProgress {
+	if progress == nil {
+		return nil
+	}
+	message := &circularadmin.FsckProgress{
+		SlotCount:            progress.SlotCount,
+		NextSlot:             progress.NextSlot,
+		EntriesChecked:       progress.EntriesChecked,
+		BytesVerified:        progress.BytesVerified,
+		EntriesSkipped:       progress.EntriesSkipped,
+		InconsistenciesFound: progress.InconsistenciesFound,
+		EntriesUnverifiable:  progress.EntriesUnverifiable,
+	}
+	if progress.SlotCount > 0 {
+		message.PercentComplete = 100 * float64(progress.NextSlot) / float64(progress.SlotCount)
+	}
+	return message
+}
+
+// newFsckReportMessage converts a FsckReport to its Protobuf
+// equivalent.
+func newFsckReportMessage(report *FsckReport) *circularadmin.FsckReport {
+	if report == nil {
+		return nil
+	}
+	message := &circularadmin.FsckReport{
+		SlotsScanned:          report.SlotsScanned,
+		EntriesChecked:        report.EntriesChecked,
+		BytesVerified:         report.BytesVerified,
+		EntriesSkipped:        report.EntriesSkipped,
+		EntriesUnverifiable:   report.EntriesUnverifiable,
+		CursorInconsistencies: report.CursorInconsistencies,
+	}
+	for _, inconsistency := range report.EntryInconsistencies {
+		message.EntryInconsistencies = append(message.EntryInconsistencies, &circularadmin.FsckInconsistency{
+			Hash:      inconsistency.Hash,
+			SizeBytes: inconsistency.SizeBytes,
+			Offset:    inconsistency.Offset,
+			Length:    inconsistency.Length,
+			Reason:    inconsistency.Reason,
+			Repaired:  inconsistency.Repaired,
+		})
+	}
+	return message
+}
@@ -0,0 +1,113 @@
+package circular_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/circular"
+	"github.com/buildbarn/bb-storage/pkg/proto/circularadmin"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// waitForAdminFsck polls the status of a backend until the run
+// triggered through StartFsck() has completed.
+func waitForAdminFsck(t *testing.T, server circularadmin.CircularAdminServer, name string) *circularadmin.FsckStatus {
+	for {
+		response, err := server.GetFsckStatus(context.Background(), &circularadmin.GetFsckStatusRequest{})
+		require.NoError(t, err)
+		for _, s := range response.Backends {
+			if s.BackendName == name && !s.Running {
+				return s
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAdminServerFsck(t *testing.T) {
+	ctx := context.Background()
+	e := newFsckTestEnvironment(t)
+	digest := e.put(t, remoteexecution.DigestFunction_SHA256, "Hello world")
+	e.dataFile[0] = 'J'
+	circular.RegisterFsck("admin_server_fsck_test", e.blobAccess)
+	server := circular.NewAdminServer()
+
+	t.Run("UnknownName", func(t *testing.T) {
+		_, err := server.StartFsck(ctx, &circularadmin.StartFsckRequest{
+			BackendName: "nonexistent",
+		})
+		require.Equal(t, status.Error(codes.NotFound, "Unknown backend \"nonexistent\""), err)
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		// Without repairing, the inconsistency should only be
+		// reported.
+		_, err := server.StartFsck(ctx, &circularadmin.StartFsckRequest{
+			BackendName: "admin_server_fsck_test",
+		})
+		require.NoError(t, err)
+
+		s := waitForAdminFsck(t, server, "admin_server_fsck_test")
+		require.Empty(t, s.LastError)
+		require.Len(t, s.LastReport.EntryInconsistencies, 1)
+		require.False(t, s.LastReport.EntryInconsistencies[0].Repaired)
+		require.Equal(t, uint64(1), s.LastReport.EntriesChecked)
+
+		// The progress of the run should be reported as well.
+		require.True(t, proto.Equal(&circularadmin.FsckProgress{
+			SlotCount:            fsckTestSlotCount,
+			NextSlot:             fsckTestSlotCount,
+			PercentComplete:      100,
+			EntriesChecked:       1,
+			BytesVerified:        11,
+			InconsistenciesFound: 1,
+		}, s.Progress))
+	})
+
+	t.Run("Repair", func(t *testing.T) {
+		_, err := server.StartFsck(ctx, &circularadmin.StartFsckRequest{
+			BackendName: "admin_server_fsck_test",
+			Repair:      true,
+		})
+		require.NoError(t, err)
+
+		s := waitForAdminFsck(t, server, "admin_server_fsck_test")
+		require.Empty(t, s.LastError)
+		require.Len(t, s.LastReport.EntryInconsistencies, 1)
+		require.True(t, s.LastReport.EntryInconsistencies[0].Repaired)
+
+		_, err = e.blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+}
+
+func TestAdminServerPin(t *testing.T) {
+	ctx := context.Background()
+	server := circular.NewAdminServer()
+
+	t.Run("UnknownName", func(t *testing.T) {
+		_, err := server.PinBlob(ctx, &circularadmin.PinBlobRequest{
+			BackendName: "nonexistent",
+			Digest: &remoteexecution.Digest{
+				Hash:      "8b1a9953c4611296a827abf8c47804d7",
+				SizeBytes: 5,
+			},
+		})
+		require.Equal(t, status.Error(codes.NotFound, "Unknown backend \"nonexistent\""), err)
+
+		_, err = server.UnpinBlob(ctx, &circularadmin.UnpinBlobRequest{
+			BackendName: "nonexistent",
+			Digest: &remoteexecution.Digest{
+				Hash:      "8b1a9953c4611296a827abf8c47804d7",
+				SizeBytes: 5,
+			},
+		})
+		require.Equal(t, status.Error(codes.NotFound, "Unknown backend \"nonexistent\""), err)
+	})
+}
@@ -66,3 +66,14 @@ func (os *cachingOffsetStore) Put(digest *util.Digest, offset uint64, length int
 	}
 	return nil
 }
+
+func (os *cachingOffsetStore) getSlotCount() uint64 {
+	if backend, ok := os.backend.(walkableOffsetStore); ok {
+		return backend.getSlotCount()
+	}
+	return 0
+}
+
+func (os *cachingOffsetStore) getEntryAtSlot(index uint64, cursors Cursors) (simpleDigest, uint64, int64, bool, error) {
+	return os.backend.(walkableOffsetStore).getEntryAtSlot(index, cursors)
+}
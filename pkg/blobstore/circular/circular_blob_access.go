@@ -1,20 +1,22 @@
 package circular
 
 import (
+	"bytes"
 	"context"
-	"errors"
 	"io"
 	"io/ioutil"
+	"log"
+	"runtime"
 	"sync"
 
 	"github.com/buildbarn/bb-storage/pkg/blobstore"
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/tracing"
 	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/klauspost/compress/zstd"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-
-	"go.opencensus.io/trace"
 )
 
 // OffsetStore maps a digest to an offset within the data file. This is
@@ -41,107 +43,295 @@ type StateStore interface {
 	Invalidate(offset uint64, sizeBytes int64) error
 }
 
+// PinningBlobAccess is a BlobAccess that permits protecting individual
+// blobs from eviction.
+type PinningBlobAccess interface {
+	blobstore.BlobAccess
+
+	// Pin a blob, so that it is not evicted from storage. Pinning
+	// fails with RESOURCE_EXHAUSTED in case the total size of all
+	// pinned blobs would exceed the configured limit.
+	Pin(digest *util.Digest) error
+
+	// Unpin a blob, so that it may be evicted from storage again.
+	Unpin(digest *util.Digest)
+
+	// Close waits for pinned blobs that are being copied in the
+	// background to be written, and prevents further copies from
+	// being started. It must be called before closing the
+	// underlying storage files.
+	Close()
+}
+
 type circularBlobAccess struct {
 	// Fields that are constant or lockless.
-	dataStore   DataStore
-	storageType blobstore.StorageType
+	dataStore                DataStore
+	storageType              blobstore.StorageType
+	dataSizeBytes            uint64
+	maximumPinnedSizeBytes   int64
+	maximumInMemorySizeBytes int64
+	compressData             bool
+	maximumPutAttempts       int
+	zstdEncoders             chan *zstd.Encoder
+	zstdDecoders             chan *zstd.Decoder
+
+	// Fields protected by stateLock. Allocations only need to
+	// acquire this lock, meaning they don't contend with lookups
+	// and updates of the offset store.
+	stateLock                 sync.Mutex
+	stateStore                StateStore
+	pinnedDigests             map[string]*util.Digest
+	pinnedSizeBytes           int64
+	lastPinRefreshWriteCursor uint64
+	pinRefreshInProgress      bool
+	closed                    bool
 
-	// Fields protected by the lock.
-	lock        sync.Mutex
+	// Keeps track of pinned blobs being copied in the background.
+	// Additions are made while holding stateLock, so that Close()
+	// can wait for it without racing with Put().
+	pinRefreshes sync.WaitGroup
+
+	// Fields protected by offsetLock. When both locks need to be
+	// held, stateLock must be acquired first.
+	offsetLock  sync.Mutex
 	offsetStore OffsetStore
-	stateStore  StateStore
 }
 
 // NewCircularBlobAccess creates a new circular storage backend. Instead
 // of writing data to storage directly, all three storage files are
 // injected through separate interfaces.
-func NewCircularBlobAccess(offsetStore OffsetStore, dataStore DataStore, stateStore StateStore, storageType blobstore.StorageType) blobstore.BlobAccess {
+//
+// Blobs may be pinned to protect them from eviction. Because the data
+// file is written sequentially, pinned blobs cannot be skipped by the
+// write cursor. Instead, pinned blobs are copied to the write cursor
+// once they end up in the oldest quarter of the data file. The total
+// size of pinned blobs is bounded by maximumPinnedSizeBytes, which
+// should be well below a quarter of the data file size. Otherwise,
+// copying pinned blobs starves the space available for other blobs.
+// To keep the overhead of Put() low, pinned blobs are only inspected
+// each time an eighth of the data file has been written. Copying is
+// performed in the background, so that it neither delays Put() nor
+// causes it to fail.
+//
+// Space in the data file is reserved while holding a lock, but data is
+// written without holding any locks. This permits many concurrent
+// Put() operations to make progress in parallel.
+//
+// If compressData is set, blobs are stored in the data file as
+// Zstandard frames. The length stored in the offset store is then that
+// of the compressed data, while the original size of the blob remains
+// available through the digest that is part of the offset store's
+// entries. As the compressed size must be known before space can be
+// allocated, blobs are compressed in memory. To bound memory usage,
+// only blobs whose digest size is at most maximumInMemorySizeBytes are
+// compressed. Larger blobs are stored uncompressed. For storage types
+// other than the Content Addressable Storage, the size stored in the
+// digest does not correspond to that of the blob (e.g., it is the size
+// of the Action for the Action Cache). All of these blobs are
+// therefore compressed, regardless of their size. Data is validated
+// against the digest after decompression. Blobs that cannot be
+// decompressed are treated as being corrupted. Because the data file
+// does not record whether blobs are compressed, changing these options
+// requires discarding the existing contents of the storage files.
+//
+// Heavy concurrent writes may cause the write cursor to wrap around
+// the data file while a blob is being written, causing the blob to
+// become stale before it is committed. As this is a transient
+// condition, Put() reallocates space and writes the blob once again,
+// up to maximumPutAttempts times in total. This requires blobs to be
+// held in memory while being written, meaning that it is only done for
+// blobs that are at most maximumInMemorySizeBytes in size. Larger
+// blobs are streamed into the data file and written once. Every
+// attempt allocates new space in the data file, meaning that retries
+// cause additional data to be evicted. Values of maximumPutAttempts
+// below two disable retrying altogether.
+func NewCircularBlobAccess(offsetStore OffsetStore, dataStore DataStore, stateStore StateStore, storageType blobstore.StorageType, dataSizeBytes uint64, maximumPinnedSizeBytes int64, maximumInMemorySizeBytes int64, compressData bool, maximumPutAttempts int) CircularBlobAccess {
 	return &circularBlobAccess{
-		offsetStore: offsetStore,
-		dataStore:   dataStore,
-		stateStore:  stateStore,
-		storageType: storageType,
+		offsetStore:              offsetStore,
+		dataStore:                dataStore,
+		stateStore:               stateStore,
+		storageType:              storageType,
+		dataSizeBytes:            dataSizeBytes,
+		maximumPinnedSizeBytes:   maximumPinnedSizeBytes,
+		maximumInMemorySizeBytes: maximumInMemorySizeBytes,
+		compressData:             compressData,
+		maximumPutAttempts:       maximumPutAttempts,
+		zstdEncoders:             make(chan *zstd.Encoder, runtime.GOMAXPROCS(0)),
+		zstdDecoders:             make(chan *zstd.Decoder, runtime.GOMAXPROCS(0)),
+		pinnedDigests:            map[string]*util.Digest{},
 	}
 }
 
+// isCompressed returns whether a blob is stored in the data file in
+// compressed form. This is decided based on the size stored in the
+// digest, so that it yields the same result while reading and writing.
+// Only for the Content Addressable Storage does this size correspond
+// to that of the blob. Blobs stored in other storage types (e.g.,
+// ActionResults) are bounded by the maximum message size, and are
+// always compressed.
+func (ba *circularBlobAccess) isCompressed(sizeBytes int64) bool {
+	return ba.compressData && (ba.storageType != blobstore.CASStorageType || sizeBytes <= ba.maximumInMemorySizeBytes)
+}
+
 func (ba *circularBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
-	ctx, span := trace.StartSpan(ctx, "circularBlobAccess.Get")
+	ctx, span := tracing.StartSpan(ctx, "circularBlobAccess.Get")
 	defer span.End()
 
-	ba.lock.Lock()
-	span.Annotate(nil, "Lock obtained, calling GetCursors")
-	cursors := ba.stateStore.GetCursors()
+	cursors := ba.getCursors()
+	ba.offsetLock.Lock()
+	span.Annotate(nil, "Lock obtained, calling offsetStore.Get")
 	offset, length, ok, err := ba.offsetStore.Get(digest, cursors)
-	span.Annotate([]trace.Attribute{
-		trace.Int64Attribute("offset", int64(offset)),
-		trace.Int64Attribute("length", length),
-		trace.BoolAttribute("object_found", ok),
+	ba.offsetLock.Unlock()
+	span.Annotate([]tracing.Attribute{
+		tracing.Int64Attribute("offset", int64(offset)),
+		tracing.Int64Attribute("length", length),
+		tracing.BoolAttribute("object_found", ok),
 	}, "offsetStore.Get completed")
-	ba.lock.Unlock()
 	if err != nil {
 		return buffer.NewBufferFromError(err)
 	} else if ok {
-		return ba.storageType.NewBufferFromReader(
-			digest,
-			ioutil.NopCloser(ba.dataStore.Get(offset, length)),
-			buffer.Reparable(digest, func() error {
-				ba.lock.Lock()
-				defer ba.lock.Unlock()
-				return ba.stateStore.Invalidate(offset, length)
-			}))
+		// The data file may have been corrupted, for example
+		// due to bit rot. Data is validated against the digest
+		// while being read. Upon mismatch the blob's space is
+		// invalidated, causing it to be reported as missing.
+		invalidate := func() error {
+			ba.stateLock.Lock()
+			defer ba.stateLock.Unlock()
+			return ba.stateStore.Invalidate(offset, length)
+		}
+		r, err := ba.getData(digest, offset, length, ba.isCompressed(digest.GetSizeBytes()), invalidate)
+		if err != nil {
+			return buffer.NewBufferFromError(err)
+		}
+		return ba.storageType.NewBufferFromReader(digest, r, buffer.Reparable(digest, invalidate))
 	}
 	return buffer.NewBufferFromError(status.Errorf(codes.NotFound, "Blob not found"))
 }
 
 func (ba *circularBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	if err := ba.put(ctx, digest, b); err != nil {
+		return err
+	}
+	if blobs := ba.getPinnedBlobsToRefresh(); len(blobs) > 0 {
+		go func() {
+			defer ba.pinRefreshes.Done()
+			ba.refreshPinnedBlobs(blobs)
+		}()
+	}
+	return nil
+}
+
+func (ba *circularBlobAccess) put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
 	sizeBytes, err := b.GetSizeBytes()
 	if err != nil {
 		b.Discard()
 		return err
 	}
+	if uint64(sizeBytes) > ba.dataSizeBytes {
+		// Such blobs can never be stored, regardless of how
+		// often the client retries. Report this as a client
+		// error, so that misconfigured size limits are obvious.
+		b.Discard()
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while the data store is only %d bytes in size", sizeBytes, ba.dataSizeBytes)
+	}
 
 	// TODO: This would be more efficient if it passed the buffer
 	// down, so IntoWriter() could be used.
-	r := b.ToReader()
-	defer r.Close()
+	//
+	// Blobs that are held in memory may be written once again if
+	// they become stale. Blobs that are streamed are written once.
+	var data []byte
+	var r io.Reader
+	maximumPutAttempts := ba.maximumPutAttempts
+	if ba.isCompressed(digest.GetSizeBytes()) {
+		data, err = ba.compress(b, sizeBytes)
+		if err != nil {
+			return err
+		}
+		sizeBytes = int64(len(data))
+		if uint64(sizeBytes) > ba.dataSizeBytes {
+			return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size after compression, while the data store is only %d bytes in size", sizeBytes, ba.dataSizeBytes)
+		}
+	} else if ba.maximumPutAttempts > 1 && sizeBytes <= ba.maximumInMemorySizeBytes {
+		// Load the blob into memory, so that it can be written
+		// once again if it becomes stale.
+		data, err = b.ToByteSlice(int(sizeBytes))
+		if err != nil {
+			return err
+		}
+	} else {
+		rc := b.ToReader()
+		defer rc.Close()
+		r = rc
+		maximumPutAttempts = 1
+	}
 
-	ctx, span := trace.StartSpan(ctx, "circularBlobAccess.Put")
+	ctx, span := tracing.StartSpan(ctx, "circularBlobAccess.Put")
 	defer span.End()
 
+	for attempt := 1; ; attempt++ {
+		if r == nil || attempt > 1 {
+			r = bytes.NewReader(data)
+		}
+		offset, cursors, err := ba.write(span, r, sizeBytes)
+		if err != nil {
+			return err
+		}
+		if cursors.Contains(offset, sizeBytes) {
+			span.Annotate(nil, "Obtaining lock")
+			ba.offsetLock.Lock()
+			span.Annotate(nil, "Lock obtained, updating offsetStore")
+			err = ba.offsetStore.Put(digest, offset, sizeBytes, cursors)
+			ba.offsetLock.Unlock()
+			return err
+		}
+
+		// The write cursor wrapped around the data store while
+		// data was being written. This is a transient condition
+		// caused by heavy concurrent writes, meaning the write
+		// may be retried.
+		err = status.Errorf(codes.Unavailable, "Data became stale before write completed: %d bytes were written at offset %d, while the valid window is [%d, %d)", sizeBytes, offset, cursors.Read, cursors.Write)
+		if attempt >= maximumPutAttempts {
+			if attempt > 1 {
+				return util.StatusWrapf(err, "Giving up after %d attempts", attempt)
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return util.StatusFromContext(ctx)
+		}
+		span.Annotate(nil, "Data became stale, retrying write")
+	}
+}
+
+// write allocates space in the data store and writes data into it. It
+// returns the offset at which the data was written, and the cursors
+// after writing completed. The caller must check whether the data is
+// still contained within the cursors before committing it.
+func (ba *circularBlobAccess) write(span tracing.Span, r io.Reader, sizeBytes int64) (uint64, Cursors, error) {
 	// Allocate space in the data store.
-	ba.lock.Lock()
+	ba.stateLock.Lock()
 	span.Annotatef(nil, "Lock obtained, allocating %d bytes", sizeBytes)
 	offset, err := ba.stateStore.Allocate(sizeBytes)
-	ba.lock.Unlock()
+	ba.stateLock.Unlock()
 	if err != nil {
-		return err
+		return 0, Cursors{}, util.StatusWrapf(err, "Failed to allocate %d bytes in data store", sizeBytes)
 	}
 	span.Annotatef(nil, "Store allocated, offset %d", offset)
 
-	// Write the data to storage.
+	// Write the data to storage. The allocated region is owned by
+	// this call, so no locking is needed.
 	if err := ba.dataStore.Put(r, offset); err != nil {
-		return err
-	}
-
-	span.Annotate(nil, "Obtaining lock")
-	ba.lock.Lock()
-	span.Annotate(nil, "Lock obtained, calling GetCursors")
-	cursors := ba.stateStore.GetCursors()
-	if cursors.Contains(offset, sizeBytes) {
-		span.Annotate(nil, "Updating offsetStore")
-		err = ba.offsetStore.Put(digest, offset, sizeBytes, cursors)
-	} else {
-		err = errors.New("Data became stale before write completed")
+		return 0, Cursors{}, err
 	}
-	ba.lock.Unlock()
-	return err
+	return offset, ba.getCursors(), nil
 }
 
 func (ba *circularBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
-	ba.lock.Lock()
-	defer ba.lock.Unlock()
+	cursors := ba.getCursors()
+	ba.offsetLock.Lock()
+	defer ba.offsetLock.Unlock()
 
-	cursors := ba.stateStore.GetCursors()
 	var missingDigests []*util.Digest
 	for _, digest := range digests {
 		if _, _, ok, err := ba.offsetStore.Get(digest, cursors); err != nil {
@@ -152,3 +342,247 @@ func (ba *circularBlobAccess) FindMissing(ctx context.Context, digests []*util.D
 	}
 	return missingDigests, nil
 }
+
+func (ba *circularBlobAccess) GetStats(ctx context.Context) (int64, int64, int64, error) {
+	cursors := ba.getCursors()
+	capacity := int64(ba.dataSizeBytes)
+	used := int64(cursors.Write - cursors.Read)
+	if used > capacity {
+		used = capacity
+	}
+	return capacity, used, capacity - used, nil
+}
+
+// CheckReadiness reports whether the cursors stored in the state store
+// are sane. Corrupted cursors would cause reads and writes to access
+// invalid regions of the data file.
+func (ba *circularBlobAccess) CheckReadiness(ctx context.Context) error {
+	cursors := ba.getCursors()
+	if cursors.Read > cursors.Write {
+		return status.Errorf(codes.Internal, "Read cursor %d exceeds write cursor %d", cursors.Read, cursors.Write)
+	}
+	if cursors.Write-cursors.Read > ba.dataSizeBytes {
+		return status.Errorf(codes.Internal, "Distance between read cursor %d and write cursor %d exceeds data size %d", cursors.Read, cursors.Write, ba.dataSizeBytes)
+	}
+	return nil
+}
+
+func (ba *circularBlobAccess) Pin(digest *util.Digest) error {
+	ba.stateLock.Lock()
+	defer ba.stateLock.Unlock()
+
+	key := ba.storageType.GetDigestKey(digest)
+	if _, ok := ba.pinnedDigests[key]; ok {
+		return nil
+	}
+	if ba.pinnedSizeBytes+digest.GetSizeBytes() > ba.maximumPinnedSizeBytes {
+		return status.Errorf(codes.ResourceExhausted, "Pinning this blob would cause the total size of pinned blobs to exceed %d bytes", ba.maximumPinnedSizeBytes)
+	}
+	ba.pinnedDigests[key] = digest
+	ba.pinnedSizeBytes += digest.GetSizeBytes()
+
+	// The blob may already be close to being evicted. Force the
+	// next call to Put() to inspect all pinned blobs.
+	ba.lastPinRefreshWriteCursor = 0
+	return nil
+}
+
+func (ba *circularBlobAccess) Unpin(digest *util.Digest) {
+	ba.stateLock.Lock()
+	defer ba.stateLock.Unlock()
+
+	key := ba.storageType.GetDigestKey(digest)
+	if _, ok := ba.pinnedDigests[key]; ok {
+		delete(ba.pinnedDigests, key)
+		ba.pinnedSizeBytes -= digest.GetSizeBytes()
+	}
+}
+
+func (ba *circularBlobAccess) Close() {
+	ba.stateLock.Lock()
+	ba.closed = true
+	ba.stateLock.Unlock()
+	ba.pinRefreshes.Wait()
+}
+
+// pinnedBlob is the location of a pinned blob in the data file that
+// needs to be copied to the write cursor.
+type pinnedBlob struct {
+	digest *util.Digest
+	offset uint64
+	length int64
+}
+
+// getPinnedBlobsToRefresh returns the locations of pinned blobs that
+// are about to be evicted, and therefore need to be copied to the write
+// cursor of the data file.
+//
+// Inspecting all pinned blobs is only done once the write cursor has
+// advanced by an eighth of the data file since the last inspection.
+// As blobs are copied once they end up in the oldest quarter of the
+// data file, this still leaves enough time to copy them before they
+// are overwritten. If blobs are returned, the caller must call
+// refreshPinnedBlobs() to copy them and mark pinRefreshes as done. No
+// further blobs are returned until that call completes.
+func (ba *circularBlobAccess) getPinnedBlobsToRefresh() []pinnedBlob {
+	ba.stateLock.Lock()
+	defer ba.stateLock.Unlock()
+	if len(ba.pinnedDigests) == 0 || ba.pinRefreshInProgress || ba.closed {
+		return nil
+	}
+	cursors := ba.stateStore.GetCursors()
+	if cursors.Write-ba.lastPinRefreshWriteCursor < ba.dataSizeBytes/8 {
+		return nil
+	}
+	ba.lastPinRefreshWriteCursor = cursors.Write
+	var blobs []pinnedBlob
+	ba.offsetLock.Lock()
+	for _, digest := range ba.pinnedDigests {
+		offset, length, ok, err := ba.offsetStore.Get(digest, cursors)
+		if err != nil {
+			log.Printf("Failed to look up pinned blob %s: %s", digest, err)
+			continue
+		}
+		if ok && cursors.Write-offset > ba.dataSizeBytes-ba.dataSizeBytes/4 {
+			blobs = append(blobs, pinnedBlob{
+				digest: digest,
+				offset: offset,
+				length: length,
+			})
+		}
+	}
+	ba.offsetLock.Unlock()
+	if len(blobs) > 0 {
+		ba.pinRefreshInProgress = true
+		ba.pinRefreshes.Add(1)
+	}
+	return blobs
+}
+
+// refreshPinnedBlobs copies pinned blobs that are about to be evicted
+// to the write cursor of the data file. As this is not performed on
+// behalf of any client, failures are only logged.
+func (ba *circularBlobAccess) refreshPinnedBlobs(blobs []pinnedBlob) {
+	ctx := context.Background()
+	for _, blob := range blobs {
+		r, err := ba.getData(blob.digest, blob.offset, blob.length, ba.isCompressed(blob.digest.GetSizeBytes()), nil)
+		if err == nil {
+			err = ba.put(
+				ctx,
+				blob.digest,
+				ba.storageType.NewBufferFromReader(blob.digest, r, buffer.Irreparable))
+		}
+		if err != nil {
+			log.Printf("Failed to refresh pinned blob %s: %s", blob.digest, err)
+		}
+	}
+
+	ba.stateLock.Lock()
+	ba.pinRefreshInProgress = false
+	ba.stateLock.Unlock()
+}
+
+// compress the contents of a buffer, so that it may be written into
+// the data store.
+func (ba *circularBlobAccess) compress(b buffer.Buffer, sizeBytes int64) ([]byte, error) {
+	data, err := b.ToByteSlice(int(sizeBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Creating encoders is expensive. Reuse them.
+	var encoder *zstd.Encoder
+	select {
+	case encoder = <-ba.zstdEncoders:
+	default:
+		encoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to create Zstandard encoder: %s", err)
+		}
+	}
+	compressed := encoder.EncodeAll(data, nil)
+	select {
+	case ba.zstdEncoders <- encoder:
+	default:
+		encoder.Close()
+	}
+	return compressed, nil
+}
+
+// getData returns a reader for the contents of a blob stored in the
+// data store, decompressing it if needed. If decompression fails, the
+// data is considered to be corrupted and invalidate is called, if
+// provided.
+func (ba *circularBlobAccess) getData(digest *util.Digest, offset uint64, length int64, compressed bool, invalidate func() error) (io.ReadCloser, error) {
+	r := ba.dataStore.Get(offset, length)
+	if !compressed {
+		return ioutil.NopCloser(r), nil
+	}
+
+	// Creating decoders is expensive. Reuse them.
+	var decoder *zstd.Decoder
+	select {
+	case decoder = <-ba.zstdDecoders:
+		if err := decoder.Reset(r); err != nil {
+			decoder.Close()
+			return nil, status.Errorf(codes.Internal, "Failed to reset Zstandard decoder: %s", err)
+		}
+	default:
+		var err error
+		decoder, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to create Zstandard decoder: %s", err)
+		}
+	}
+	return &zstdDecompressingReader{
+		decoder:    decoder,
+		decoders:   ba.zstdDecoders,
+		digest:     digest,
+		invalidate: invalidate,
+	}, nil
+}
+
+// zstdDecompressingReader decompresses blobs stored in the data store.
+// Decompression errors are caused by corrupted data, which is
+// invalidated in the same way as data whose checksum does not match.
+type zstdDecompressingReader struct {
+	decoder    *zstd.Decoder
+	decoders   chan<- *zstd.Decoder
+	digest     *util.Digest
+	invalidate func() error
+}
+
+func (r *zstdDecompressingReader) Read(p []byte) (int, error) {
+	n, err := r.decoder.Read(p)
+	if err != nil && err != io.EOF {
+		if r.invalidate != nil {
+			if invalidateErr := r.invalidate(); invalidateErr == nil {
+				log.Printf("Successfully repaired corrupted blob %s", r.digest)
+			} else {
+				log.Printf("Failed to repair corrupted blob %s: %s", r.digest, invalidateErr)
+			}
+			r.invalidate = nil
+		}
+		return n, status.Errorf(codes.Internal, "Failed to decompress blob: %s", err)
+	}
+	return n, err
+}
+
+func (r *zstdDecompressingReader) Close() error {
+	// Return the decoder to the pool. Decoders in excess of the
+	// pool's capacity are closed, so that their goroutines are
+	// terminated.
+	select {
+	case r.decoders <- r.decoder:
+	default:
+		r.decoder.Close()
+	}
+	return nil
+}
+
+// getCursors returns the current read/write cursors of the data file.
+func (ba *circularBlobAccess) getCursors() Cursors {
+	ba.stateLock.Lock()
+	defer ba.stateLock.Unlock()
+	return ba.stateStore.GetCursors()
+}
@@ -0,0 +1,555 @@
+package circular_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/circular"
+	"github.com/buildbarn/bb-storage/pkg/proto/circularadmin"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircularBlobAccessPut(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	offsetStore := mock.NewMockOffsetStore(ctrl)
+	dataStore := mock.NewMockDataStore(ctrl)
+	stateStore := mock.NewMockStateStore(ctrl)
+	blobAccess := circular.NewCircularBlobAccess(offsetStore, dataStore, stateStore, blobstore.CASStorageType, 100, 0, 0, false, 1)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// Blobs that are larger than the data store can never
+		// be stored. There is no point in retrying.
+		smallBlobAccess := circular.NewCircularBlobAccess(offsetStore, dataStore, stateStore, blobstore.CASStorageType, 10, 0, 0, false, 1)
+
+		require.Equal(
+			t,
+			status.Error(codes.InvalidArgument, "Blob is 11 bytes in size, while the data store is only 10 bytes in size"),
+			smallBlobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("AllocationFailure", func(t *testing.T) {
+		// The code of the error returned by the state store
+		// should be preserved.
+		stateStore.EXPECT().Allocate(int64(11)).Return(uint64(0), status.Error(codes.Internal, "Failed to write cursors: Disk on fire"))
+
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Failed to allocate 11 bytes in data store: Failed to write cursors: Disk on fire"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		// Concurrent writes caused the write cursor to wrap
+		// around the data store while data was being written.
+		// This should be reported as a transient error.
+		stateStore.EXPECT().Allocate(int64(11)).Return(uint64(123), nil)
+		dataStore.EXPECT().Put(gomock.Any(), uint64(123)).Return(nil)
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 200, Write: 300})
+
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Data became stale before write completed: 11 bytes were written at offset 123, while the valid window is [200, 300)"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		stateStore.EXPECT().Allocate(int64(11)).Return(uint64(123), nil)
+		dataStore.EXPECT().Put(gomock.Any(), uint64(123)).Return(nil)
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+		offsetStore.EXPECT().Put(digest, uint64(123), int64(11), circular.Cursors{Read: 100, Write: 200})
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	retryingBlobAccess := circular.NewCircularBlobAccess(offsetStore, dataStore, stateStore, blobstore.CASStorageType, 100, 0, 11, false, 2)
+	expectStaleWrite := func(offset uint64, cursors circular.Cursors) {
+		stateStore.EXPECT().Allocate(int64(11)).Return(offset, nil)
+		dataStore.EXPECT().Put(gomock.Any(), offset).DoAndReturn(
+			func(r io.Reader, offset uint64) error {
+				data, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello world"), data)
+				return nil
+			})
+		stateStore.EXPECT().GetCursors().Return(cursors)
+	}
+
+	t.Run("StaleRetrySuccess", func(t *testing.T) {
+		// If the data became stale, the blob should be written
+		// once again at a newly allocated offset.
+		expectStaleWrite(123, circular.Cursors{Read: 200, Write: 300})
+		expectStaleWrite(300, circular.Cursors{Read: 250, Write: 350})
+		offsetStore.EXPECT().Put(digest, uint64(300), int64(11), circular.Cursors{Read: 250, Write: 350})
+
+		require.NoError(t, retryingBlobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("StaleRetryExhausted", func(t *testing.T) {
+		expectStaleWrite(123, circular.Cursors{Read: 200, Write: 300})
+		expectStaleWrite(300, circular.Cursors{Read: 400, Write: 500})
+
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Giving up after 2 attempts: Data became stale before write completed: 11 bytes were written at offset 300, while the valid window is [400, 500)"),
+			retryingBlobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("StaleRetryContextCanceled", func(t *testing.T) {
+		// Retrying should stop once the context is canceled.
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		expectStaleWrite(123, circular.Cursors{Read: 200, Write: 300})
+
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "context canceled"),
+			retryingBlobAccess.Put(canceledCtx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("StaleTooLargeToRetry", func(t *testing.T) {
+		// Blobs that exceed the maximum in-memory size are
+		// streamed into the data store. They cannot be written
+		// once again.
+		smallRetryingBlobAccess := circular.NewCircularBlobAccess(offsetStore, dataStore, stateStore, blobstore.CASStorageType, 100, 0, 10, false, 2)
+		expectStaleWrite(123, circular.Cursors{Read: 200, Write: 300})
+
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Data became stale before write completed: 11 bytes were written at offset 123, while the valid window is [200, 300)"),
+			smallRetryingBlobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+}
+
+func TestCircularBlobAccessGet(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	offsetStore := mock.NewMockOffsetStore(ctrl)
+	dataStore := mock.NewMockDataStore(ctrl)
+	stateStore := mock.NewMockStateStore(ctrl)
+	blobAccess := circular.NewCircularBlobAccess(offsetStore, dataStore, stateStore, blobstore.CASStorageType, 100, 0, 0, false, 1)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("NotFound", func(t *testing.T) {
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+		offsetStore.EXPECT().Get(digest, circular.Cursors{Read: 100, Write: 200}).Return(uint64(0), int64(0), false, nil)
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+		offsetStore.EXPECT().Get(digest, circular.Cursors{Read: 100, Write: 200}).Return(uint64(123), int64(11), true, nil)
+		dataStore.EXPECT().Get(uint64(123), int64(11)).Return(strings.NewReader("Hello world"))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		// The data file contains bytes that don't match the
+		// digest, for example due to bit rot. Instead of
+		// returning the corrupted data, an error should be
+		// returned and the blob should be invalidated, so that
+		// it may be uploaded once again.
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+		offsetStore.EXPECT().Get(digest, circular.Cursors{Read: 100, Write: 200}).Return(uint64(123), int64(11), true, nil)
+		dataStore.EXPECT().Get(uint64(123), int64(11)).Return(strings.NewReader("Hello World"))
+		stateStore.EXPECT().Invalidate(uint64(123), int64(11))
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Internal, "Buffer has checksum b10a8db164e0754105b7a99be72e3fe5, while 3e25960a79dbc69b674cd4ec67a72c62 was expected"), err)
+	})
+}
+
+func TestCircularBlobAccessCompressData(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	offsetStore := mock.NewMockOffsetStore(ctrl)
+	dataStore := mock.NewMockDataStore(ctrl)
+	stateStore := mock.NewMockStateStore(ctrl)
+	blobAccess := circular.NewCircularBlobAccess(offsetStore, dataStore, stateStore, blobstore.CASStorageType, 1000, 0, 1000, true, 1)
+	data := []byte(strings.Repeat("Hello world ", 50))
+	hash := sha256.Sum256(data)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      hex.EncodeToString(hash[:]),
+			SizeBytes: int64(len(data)),
+		})
+
+	// Data should be compressed before being written. The offset
+	// store should record the length of the compressed data.
+	var compressed []byte
+	stateStore.EXPECT().Allocate(gomock.Any()).DoAndReturn(func(sizeBytes int64) (uint64, error) {
+		require.Less(t, sizeBytes, int64(len(data)))
+		return 123, nil
+	})
+	dataStore.EXPECT().Put(gomock.Any(), uint64(123)).DoAndReturn(func(r io.Reader, offset uint64) error {
+		var err error
+		compressed, err = ioutil.ReadAll(r)
+		return err
+	})
+	stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+	offsetStore.EXPECT().Put(digest, uint64(123), gomock.Any(), circular.Cursors{Read: 100, Write: 200}).DoAndReturn(
+		func(digest *util.Digest, offset uint64, length int64, cursors circular.Cursors) error {
+			require.Equal(t, int64(len(compressed)), length)
+			return nil
+		})
+	require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice(data)))
+
+	t.Run("Success", func(t *testing.T) {
+		// Data should be decompressed and validated against the
+		// original digest when read.
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+		offsetStore.EXPECT().Get(digest, circular.Cursors{Read: 100, Write: 200}).Return(uint64(123), int64(len(compressed)), true, nil)
+		dataStore.EXPECT().Get(uint64(123), int64(len(compressed))).Return(bytes.NewReader(compressed))
+
+		readData, err := blobAccess.Get(ctx, digest).ToByteSlice(1000)
+		require.NoError(t, err)
+		require.Equal(t, data, readData)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		// Data that cannot be decompressed should be
+		// invalidated, just like data whose checksum does not
+		// match.
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+		offsetStore.EXPECT().Get(digest, circular.Cursors{Read: 100, Write: 200}).Return(uint64(123), int64(11), true, nil)
+		dataStore.EXPECT().Get(uint64(123), int64(11)).Return(strings.NewReader("Hello world"))
+		stateStore.EXPECT().Invalidate(uint64(123), int64(11))
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(1000)
+		require.Equal(t, codes.Internal, status.Code(err))
+		require.Contains(t, status.Convert(err).Message(), "Failed to decompress blob")
+	})
+}
+
+func TestCircularBlobAccessCompressDataTooLarge(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Blobs that exceed the maximum in-memory size should be
+	// stored without being compressed.
+	offsetStore := mock.NewMockOffsetStore(ctrl)
+	dataStore := mock.NewMockDataStore(ctrl)
+	stateStore := mock.NewMockStateStore(ctrl)
+	blobAccess := circular.NewCircularBlobAccess(offsetStore, dataStore, stateStore, blobstore.CASStorageType, 1000, 0, 10, true, 1)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	stateStore.EXPECT().Allocate(int64(11)).Return(uint64(123), nil)
+	dataStore.EXPECT().Put(gomock.Any(), uint64(123)).DoAndReturn(func(r io.Reader, offset uint64) error {
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		return nil
+	})
+	stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+	offsetStore.EXPECT().Put(digest, uint64(123), int64(11), circular.Cursors{Read: 100, Write: 200})
+	require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+	stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+	offsetStore.EXPECT().Get(digest, circular.Cursors{Read: 100, Write: 200}).Return(uint64(123), int64(11), true, nil)
+	dataStore.EXPECT().Get(uint64(123), int64(11)).Return(strings.NewReader("Hello world"))
+
+	data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello world"), data)
+}
+
+func TestCircularBlobAccessCompressDataActionCache(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// For the Action Cache, the size stored in the digest is that
+	// of the Action. Whether entries are compressed should not
+	// depend on it, as it is unrelated to the size of the
+	// ActionResult.
+	offsetStore := mock.NewMockOffsetStore(ctrl)
+	dataStore := mock.NewMockDataStore(ctrl)
+	stateStore := mock.NewMockStateStore(ctrl)
+	blobAccess := circular.NewCircularBlobAccess(offsetStore, dataStore, stateStore, blobstore.ACStorageType, 1000, 0, 10, true, 1)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 5,
+		})
+	actionResult := &remoteexecution.ActionResult{
+		StdoutRaw: []byte(strings.Repeat("Hello world ", 50)),
+	}
+
+	var compressed []byte
+	stateStore.EXPECT().Allocate(gomock.Any()).DoAndReturn(func(sizeBytes int64) (uint64, error) {
+		require.Less(t, sizeBytes, int64(len(actionResult.StdoutRaw)))
+		return 123, nil
+	})
+	dataStore.EXPECT().Put(gomock.Any(), uint64(123)).DoAndReturn(func(r io.Reader, offset uint64) error {
+		var err error
+		compressed, err = ioutil.ReadAll(r)
+		return err
+	})
+	stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+	offsetStore.EXPECT().Put(digest, uint64(123), gomock.Any(), circular.Cursors{Read: 100, Write: 200})
+	require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewACBufferFromActionResult(actionResult, buffer.UserProvided)))
+
+	stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 200})
+	offsetStore.EXPECT().Get(digest, circular.Cursors{Read: 100, Write: 200}).Return(uint64(123), int64(len(compressed)), true, nil)
+	dataStore.EXPECT().Get(uint64(123), int64(len(compressed))).Return(bytes.NewReader(compressed))
+
+	readActionResult, err := blobAccess.Get(ctx, digest).ToActionResult(1000)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(actionResult, readActionResult))
+}
+
+func TestCircularBlobAccessCheckReadiness(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	offsetStore := mock.NewMockOffsetStore(ctrl)
+	dataStore := mock.NewMockDataStore(ctrl)
+	stateStore := mock.NewMockStateStore(ctrl)
+	blobAccess := circular.NewCircularBlobAccess(offsetStore, dataStore, stateStore, blobstore.CASStorageType, 1000, 0, 0, false, 1)
+	readinessChecker := blobAccess.(blobstore.ReadinessChecker)
+
+	t.Run("Ready", func(t *testing.T) {
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 1100})
+
+		require.NoError(t, readinessChecker.CheckReadiness(ctx))
+	})
+
+	t.Run("ReadCursorExceedsWriteCursor", func(t *testing.T) {
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 200, Write: 100})
+
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Read cursor 200 exceeds write cursor 100"),
+			readinessChecker.CheckReadiness(ctx))
+	})
+
+	t.Run("DistanceExceedsDataSize", func(t *testing.T) {
+		stateStore.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 1101})
+
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Distance between read cursor 100 and write cursor 1101 exceeds data size 1000"),
+			readinessChecker.CheckReadiness(ctx))
+	})
+}
+
+func TestCircularBlobAccessPin(t *testing.T) {
+	ctx := context.Background()
+
+	const dataSizeBytes = 4096
+	stateStore, err := circular.NewFileStateStore(make(memoryFile, 16), dataSizeBytes)
+	require.NoError(t, err)
+	blobAccess := circular.NewCircularBlobAccess(
+		circular.NewFileOffsetStore(make(memoryFile, 64*1024), 64*1024),
+		circular.NewFileDataStore(make(memoryFile, dataSizeBytes), dataSizeBytes),
+		stateStore,
+		blobstore.CASStorageType,
+		dataSizeBytes,
+		1024,
+		0,
+		false,
+		1)
+	defer blobAccess.Close()
+
+	// Pins should also be manageable through the CircularAdmin
+	// gRPC service.
+	circular.RegisterFsck("circular_blob_access_pin_test", blobAccess)
+	server := circular.NewAdminServer()
+
+	newBlob := func(data []byte) *util.Digest {
+		hash := sha256.Sum256(data)
+		return util.MustNewDigest("default", &remoteexecution.Digest{
+			Hash:      hex.EncodeToString(hash[:]),
+			SizeBytes: int64(len(data)),
+		})
+	}
+	pinnedData := []byte("Hello world")
+	pinnedDigest := newBlob(pinnedData)
+	unpinnedData := []byte("Goodbye world")
+	unpinnedDigest := newBlob(unpinnedData)
+
+	// Write a large amount of data, causing the data file to wrap
+	// around multiple times.
+	fillDataFile := func(seed uint64) {
+		for i := uint64(0); i < 100; i++ {
+			data := make([]byte, 100)
+			binary.LittleEndian.PutUint64(data, seed+i)
+			require.NoError(t, blobAccess.Put(ctx, newBlob(data), buffer.NewValidatedBufferFromByteSlice(data)))
+			circular.WaitForPinnedBlobRefreshes(blobAccess)
+		}
+	}
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// Pinning should fail if it causes the total size of
+		// pinned blobs to exceed the configured limit.
+		err := blobAccess.Pin(util.MustNewDigest("default", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 1025,
+		}))
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+
+	t.Run("PinnedBlobSurvivesWraparound", func(t *testing.T) {
+		_, err := server.PinBlob(ctx, &circularadmin.PinBlobRequest{
+			BackendName: "circular_blob_access_pin_test",
+			Digest:      pinnedDigest.GetPartialDigest(),
+		})
+		require.NoError(t, err)
+		require.NoError(t, blobAccess.Put(ctx, pinnedDigest, buffer.NewValidatedBufferFromByteSlice(pinnedData)))
+		require.NoError(t, blobAccess.Put(ctx, unpinnedDigest, buffer.NewValidatedBufferFromByteSlice(unpinnedData)))
+		fillDataFile(0)
+
+		data, err := blobAccess.Get(ctx, pinnedDigest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, pinnedData, data)
+
+		_, err = blobAccess.Get(ctx, unpinnedDigest).ToByteSlice(100)
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("UnpinnedBlobEvicted", func(t *testing.T) {
+		// After unpinning, the blob should be evicted like
+		// any other.
+		_, err := server.UnpinBlob(ctx, &circularadmin.UnpinBlobRequest{
+			BackendName: "circular_blob_access_pin_test",
+			Digest:      pinnedDigest.GetPartialDigest(),
+		})
+		require.NoError(t, err)
+		fillDataFile(1000)
+
+		_, err = blobAccess.Get(ctx, pinnedDigest).ToByteSlice(100)
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
+// memoryFile is an in-memory implementation of ReadWriterAt, used to
+// benchmark circularBlobAccess without being limited by disk I/O.
+type memoryFile []byte
+
+func (f memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(f)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(f[off:], p), nil
+}
+
+func BenchmarkCircularBlobAccessConcurrentPut(b *testing.B) {
+	const (
+		concurrency   = 64
+		blobSizeBytes = 64 * 1024
+		dataSizeBytes = 256 * 1024 * 1024
+	)
+
+	stateStore, err := circular.NewFileStateStore(make(memoryFile, 16), dataSizeBytes)
+	require.NoError(b, err)
+	blobAccess := circular.NewCircularBlobAccess(
+		circular.NewFileOffsetStore(make(memoryFile, 16*1024*1024), 16*1024*1024),
+		circular.NewFileDataStore(make(memoryFile, dataSizeBytes), dataSizeBytes),
+		stateStore,
+		blobstore.CASStorageType,
+		dataSizeBytes,
+		0,
+		0,
+		false,
+		1)
+
+	// Generate a set of distinct blobs up front, so that hashing
+	// doesn't contribute to the measurements.
+	type blob struct {
+		digest *util.Digest
+		data   []byte
+	}
+	blobs := make([]blob, 1024)
+	for i := range blobs {
+		data := make([]byte, blobSizeBytes)
+		binary.LittleEndian.PutUint64(data, uint64(i))
+		hash := sha256.Sum256(data)
+		blobs[i] = blob{
+			digest: util.MustNewDigest("default", &remoteexecution.Digest{
+				Hash:      hex.EncodeToString(hash[:]),
+				SizeBytes: blobSizeBytes,
+			}),
+			data: data,
+		}
+	}
+
+	ctx := context.Background()
+	b.SetBytes(blobSizeBytes)
+	b.ResetTimer()
+
+	var next int64
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := atomic.AddInt64(&next, 1) - 1
+				if n >= int64(b.N) {
+					return
+				}
+				blob := blobs[n%int64(len(blobs))]
+				if err := blobAccess.Put(ctx, blob.digest, buffer.NewValidatedBufferFromByteSlice(blob.data)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
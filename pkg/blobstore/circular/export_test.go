@@ -0,0 +1,8 @@
+package circular
+
+// WaitForPinnedBlobRefreshes blocks until all pinned blobs that are
+// being copied in the background by Put() have been copied. This
+// permits tests to observe the effects of refreshing deterministically.
+func WaitForPinnedBlobRefreshes(blobAccess CircularBlobAccess) {
+	blobAccess.(*circularBlobAccess).pinRefreshes.Wait()
+}
@@ -234,3 +234,26 @@ func (os *fileOffsetStore) Put(digest *util.Digest, offset uint64, length int64,
 		}
 	}
 }
+
+func (os *fileOffsetStore) getSlotCount() uint64 {
+	return os.size / uint64(len(offsetRecord{}))
+}
+
+func (os *fileOffsetStore) getEntryAtSlot(index uint64, cursors Cursors) (simpleDigest, uint64, int64, bool, error) {
+	position := int64(index * uint64(len(offsetRecord{})))
+	record, err := os.getRecordAtPosition(position)
+	if err != nil {
+		return simpleDigest{}, 0, 0, false, err
+	}
+
+	// Ignore records that are outdated, or that could not have
+	// been stored in this slot in the first place.
+	if !cursors.Contains(record.getOffset(), record.getLength()) ||
+		record.getAttempt() >= maximumIterations ||
+		os.getPositionOfSlot(record.getSlot()) != position {
+		return simpleDigest{}, 0, 0, false, nil
+	}
+	var digest simpleDigest
+	copy(digest[:], record[:])
+	return digest, record.getOffset(), record.getLength(), true, nil
+}
@@ -0,0 +1,324 @@
+package circular
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// walkableOffsetStore is implemented by OffsetStores whose entries can
+// be enumerated. This is used by Fsck() to visit all entries.
+type walkableOffsetStore interface {
+	// Return the number of slots in the offset store.
+	getSlotCount() uint64
+	// Return the entry stored in a slot, if it is valid and refers
+	// to data contained within the cursors.
+	getEntryAtSlot(index uint64, cursors Cursors) (simpleDigest, uint64, int64, bool, error)
+}
+
+// FsckInconsistency describes an entry in the offset store that does
+// not correspond with the contents of the data store.
+type FsckInconsistency struct {
+	// The hash of the blob, as stored in the offset store. Hashes
+	// shorter than SHA-256 are padded with zeroes.
+	Hash      string `json:"hash"`
+	SizeBytes int64  `json:"size_bytes"`
+	Offset    uint64 `json:"offset"`
+	Length    int64  `json:"length"`
+	Reason    string `json:"reason"`
+	// Whether the data referenced by the entry has been invalidated.
+	Repaired bool `json:"repaired"`
+}
+
+// FsckReport contains the results of a call to Fsck().
+type FsckReport struct {
+	SlotsScanned   uint64 `json:"slots_scanned"`
+	EntriesChecked uint64 `json:"entries_checked"`
+	BytesVerified  int64  `json:"bytes_verified"`
+	// Number of entries that were skipped, because the data they
+	// referred to got overwritten while being checked.
+	EntriesSkipped uint64 `json:"entries_skipped"`
+	// Number of entries whose contents could not be verified,
+	// because they may have been created using a digest function
+	// for which no hashing algorithm is available. These entries
+	// are never repaired.
+	EntriesUnverifiable uint64 `json:"entries_unverifiable"`
+
+	// Inconsistencies found. When Fsck() is resumed, these only
+	// include the inconsistencies found since it was resumed.
+	CursorInconsistencies []string            `json:"cursor_inconsistencies,omitempty"`
+	EntryInconsistencies  []FsckInconsistency `json:"entry_inconsistencies,omitempty"`
+}
+
+// CircularBlobAccess is the BlobAccess returned by
+// NewCircularBlobAccess(). In addition to pinning, it permits verifying
+// the consistency of the underlying storage files.
+type CircularBlobAccess interface {
+	PinningBlobAccess
+
+	// Fsck walks all entries in the offset store and checks that
+	// the data they refer to is present in the data store and
+	// hashes to the expected digest. It also checks that the
+	// cursors stored in the state store are sane.
+	//
+	// Contents of blobs can only be verified for the Content
+	// Addressable Storage. Verification may be performed while
+	// the storage backend is in use. The rate at which data is read
+	// from the data store is bounded by maximumBytesPerSecond, if
+	// positive. If repair is set, data belonging to inconsistent
+	// entries is invalidated, causing it to be removed from
+	// storage.
+	//
+	// Progress is periodically written to progressStore, if
+	// provided. Calls to Fsck() resume where a previous call
+	// left off, making it possible to check large stores
+	// across restarts. When the context is canceled, progress
+	// is saved before returning.
+	Fsck(ctx context.Context, clock clock.Clock, maximumBytesPerSecond int64, repair bool, progressStore FsckProgressStore) (*FsckReport, error)
+}
+
+// newFsckHashers creates the hashers with which the contents of blobs
+// are compared. As the offset store does not keep track of the digest
+// function of a blob, all supported digest functions are attempted.
+// It also returns whether a hasher could be created for every
+// supported digest function. If not, data not matching any of the
+// hashers cannot be considered to be corrupted.
+func newFsckHashers() ([]hash.Hash, bool) {
+	hashers := make([]hash.Hash, 0, len(util.SupportedDigestFunctions))
+	complete := true
+	for _, digestFunction := range util.SupportedDigestFunctions {
+		if hasher, ok := util.NewHasherForDigestFunction(digestFunction); ok {
+			hashers = append(hashers, hasher)
+		} else {
+			complete = false
+		}
+	}
+	return hashers, complete
+}
+
+// fsckProgressSaveInterval is the number of slots of the offset store
+// that are scanned between writes of progress to the FsckProgressStore.
+const fsckProgressSaveInterval = 1024
+
+func (ba *circularBlobAccess) Fsck(ctx context.Context, clock clock.Clock, maximumBytesPerSecond int64, repair bool, progressStore FsckProgressStore) (*FsckReport, error) {
+	offsetStore, ok := ba.offsetStore.(walkableOffsetStore)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "Offset store does not support enumerating its entries")
+	}
+	verifyContents := ba.storageType == blobstore.CASStorageType
+	slotCount := offsetStore.getSlotCount()
+
+	// Resume from where a previous call left off, unless it
+	// completed or the offset store got resized in the meantime.
+	var progress FsckProgress
+	if progressStore != nil {
+		var err error
+		if progress, err = progressStore.Get(); err != nil {
+			return nil, util.StatusWrap(err, "Failed to load progress")
+		}
+	}
+	if progress.SlotCount != slotCount || progress.NextSlot >= slotCount {
+		progress = FsckProgress{SlotCount: slotCount}
+	}
+	saveProgress := func() error {
+		if progressStore == nil {
+			return nil
+		}
+		if err := progressStore.Put(progress); err != nil {
+			return util.StatusWrap(err, "Failed to save progress")
+		}
+		return nil
+	}
+
+	report := &FsckReport{}
+	cursors := ba.getCursors()
+	if cursors.Read > cursors.Write {
+		report.CursorInconsistencies = append(
+			report.CursorInconsistencies,
+			fmt.Sprintf("Read cursor %d exceeds write cursor %d", cursors.Read, cursors.Write))
+	} else if cursors.Write-cursors.Read > ba.dataSizeBytes {
+		report.CursorInconsistencies = append(
+			report.CursorInconsistencies,
+			fmt.Sprintf("Distance between read cursor %d and write cursor %d exceeds data size %d", cursors.Read, cursors.Write, ba.dataSizeBytes))
+	}
+
+	startTime := clock.Now()
+	var bytesVerifiedSinceStart int64
+	for ; progress.NextSlot < slotCount; progress.NextSlot++ {
+		index := progress.NextSlot
+		if index%fsckProgressSaveInterval == 0 {
+			if err := saveProgress(); err != nil {
+				return nil, err
+			}
+		}
+		if ctx.Err() != nil {
+			if err := saveProgress(); err != nil {
+				return nil, err
+			}
+			return nil, util.StatusFromContext(ctx)
+		}
+
+		bytesVerified, err := ba.fsckSlot(offsetStore, index, verifyContents, repair, report, &progress)
+		if err != nil {
+			return nil, err
+		}
+		bytesVerifiedSinceStart += bytesVerified
+
+		// Limit the rate at which data is read by sleeping until
+		// the amount of data read so far is within budget.
+		if maximumBytesPerSecond > 0 {
+			expectedDuration := time.Duration(bytesVerifiedSinceStart * int64(time.Second) / maximumBytesPerSecond)
+			if delay := expectedDuration - clock.Now().Sub(startTime); delay > 0 {
+				timer, t := clock.NewTimer(delay)
+				select {
+				case <-t:
+				case <-ctx.Done():
+					timer.Stop()
+					progress.NextSlot++
+					if err := saveProgress(); err != nil {
+						return nil, err
+					}
+					return nil, util.StatusFromContext(ctx)
+				}
+			}
+		}
+	}
+	if err := saveProgress(); err != nil {
+		return nil, err
+	}
+
+	report.SlotsScanned = progress.NextSlot
+	report.EntriesChecked = progress.EntriesChecked
+	report.BytesVerified = progress.BytesVerified
+	report.EntriesSkipped = progress.EntriesSkipped
+	report.EntriesUnverifiable = progress.EntriesUnverifiable
+	return report, nil
+}
+
+// fsckSlot checks a single slot of the offset store, returning the
+// number of bytes of data that were read.
+func (ba *circularBlobAccess) fsckSlot(offsetStore walkableOffsetStore, index uint64, verifyContents bool, repair bool, report *FsckReport, progress *FsckProgress) (int64, error) {
+	// Obtain the entry, while holding the lock to prevent
+	// concurrent modifications to the offset store.
+	cursors := ba.getCursors()
+	ba.offsetLock.Lock()
+	digest, offset, length, ok, err := offsetStore.getEntryAtSlot(index, cursors)
+	ba.offsetLock.Unlock()
+	if err != nil {
+		return 0, util.StatusWrapf(err, "Failed to read offset store slot %d", index)
+	}
+	if !ok {
+		return 0, nil
+	}
+
+	progress.EntriesChecked++
+	if !verifyContents {
+		return 0, nil
+	}
+	reason, verifiable, err := ba.fsckEntry(digest, offset, length)
+	if err != nil {
+		return 0, util.StatusWrapf(err, "Failed to read data at offset %d", offset)
+	}
+	if !verifiable {
+		// Never report or invalidate data that may be valid,
+		// but could not be checked.
+		progress.EntriesUnverifiable++
+		return length, nil
+	}
+	progress.BytesVerified += length
+
+	// Data may have been overwritten while it was being read.
+	// Don't report such entries as inconsistent.
+	ba.stateLock.Lock()
+	defer ba.stateLock.Unlock()
+	cursors = ba.stateStore.GetCursors()
+	if !cursors.Contains(offset, length) {
+		progress.EntriesSkipped++
+		return length, nil
+	}
+	if reason != "" {
+		inconsistency := FsckInconsistency{
+			Hash:      hex.EncodeToString(digest[:sha256.Size]),
+			SizeBytes: int64(binary.LittleEndian.Uint32(digest[sha256.Size:])),
+			Offset:    offset,
+			Length:    length,
+			Reason:    reason,
+		}
+		if repair {
+			if err := ba.stateStore.Invalidate(offset, length); err != nil {
+				return 0, util.StatusWrapf(err, "Failed to invalidate data at offset %d", offset)
+			}
+			inconsistency.Repaired = true
+		}
+		report.EntryInconsistencies = append(report.EntryInconsistencies, inconsistency)
+		progress.InconsistenciesFound++
+	}
+	return length, nil
+}
+
+// fsckEntry checks whether the data referenced by an entry in the
+// offset store matches the digest of the entry. It returns a non-empty
+// string describing the inconsistency if this is not the case. If the
+// data does not match any of the hashers, but hashers for some of the
+// supported digest functions are unavailable, the entry is reported as
+// not being verifiable.
+func (ba *circularBlobAccess) fsckEntry(digest simpleDigest, offset uint64, length int64) (string, bool, error) {
+	// The length of compressed data does not correspond with the
+	// size of the blob. For compressed data, the size is validated
+	// after decompression.
+	sizeBytes := int64(binary.LittleEndian.Uint32(digest[sha256.Size:]))
+	compressed := ba.isCompressed(sizeBytes)
+	if !compressed && uint32(length) != uint32(sizeBytes) {
+		return fmt.Sprintf("Length %d does not match size stored in digest", length), true, nil
+	}
+
+	hashers, complete := newFsckHashers()
+	writers := make([]io.Writer, 0, len(hashers))
+	for _, hasher := range hashers {
+		writers = append(writers, hasher)
+	}
+	r, err := ba.getData(nil, offset, length, compressed, nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer r.Close()
+	// Bound the amount of data read, as corrupted compressed data
+	// may decompress to an arbitrary size.
+	n, err := io.Copy(io.MultiWriter(writers...), io.LimitReader(r, sizeBytes+1))
+	if err != nil {
+		if compressed {
+			return err.Error(), true, nil
+		}
+		return "", false, err
+	}
+	if compressed && uint32(n) != uint32(sizeBytes) {
+		return fmt.Sprintf("Decompressed size %d does not match size stored in digest", n), true, nil
+	}
+	for _, hasher := range hashers {
+		// Hashes are stored in the offset store in the same way
+		// as newSimpleDigest() does: truncated or padded to
+		// the size of a SHA-256 sum.
+		var expected [sha256.Size]byte
+		copy(expected[:], hasher.Sum(nil))
+		if bytes.Equal(expected[:], digest[:sha256.Size]) {
+			return "", true, nil
+		}
+	}
+	if !complete {
+		return "", false, nil
+	}
+	return "Data does not match hash stored in digest", true, nil
+}
@@ -0,0 +1,220 @@
+package circular
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/buildbarn/bb-storage/pkg/clock"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	fsckTargetsLock sync.Mutex
+	fsckTargets     = map[string]*fsckTarget{}
+)
+
+// fsckTarget keeps track of the progress of periodic and on-demand
+// Fsck() runs of a single circular storage backend.
+type fsckTarget struct {
+	lock             sync.Mutex
+	blobAccess       CircularBlobAccess
+	periodicProgress *FsckProgress
+	running          bool
+	progress         *FsckProgress
+	lastReport       *FsckReport
+	lastError        string
+}
+
+// fsckTargetStatus is the representation of a fsckTarget that is
+// returned by ServeFsck() and the CircularAdmin gRPC service.
+type fsckTargetStatus struct {
+	Name             string        `json:"name"`
+	PeriodicProgress *FsckProgress `json:"periodic_progress,omitempty"`
+	Running          bool          `json:"running"`
+	Progress         *FsckProgress `json:"progress,omitempty"`
+	LastReport       *FsckReport   `json:"last_report,omitempty"`
+	LastError        string        `json:"last_error,omitempty"`
+}
+
+// RegisterFsck registers a CircularBlobAccess, so that calls to Fsck(),
+// Pin() and Unpin() may be performed on demand through the
+// CircularAdmin gRPC service. Backends are identified by name, which
+// should be unique (e.g., the directory in which the backend stores
+// its data).
+func RegisterFsck(name string, blobAccess CircularBlobAccess) {
+	target := getOrCreateFsckTarget(name)
+	target.lock.Lock()
+	target.blobAccess = blobAccess
+	target.lock.Unlock()
+}
+
+func getOrCreateFsckTarget(name string) *fsckTarget {
+	fsckTargetsLock.Lock()
+	defer fsckTargetsLock.Unlock()
+	target, ok := fsckTargets[name]
+	if !ok {
+		target = &fsckTarget{}
+		fsckTargets[name] = target
+	}
+	return target
+}
+
+func getFsckTarget(name string) (*fsckTarget, bool) {
+	fsckTargetsLock.Lock()
+	defer fsckTargetsLock.Unlock()
+	target, ok := fsckTargets[name]
+	return target, ok
+}
+
+// getRegisteredBlobAccess returns the backend registered through
+// RegisterFsck() under a given name.
+func getRegisteredBlobAccess(name string) (CircularBlobAccess, error) {
+	if target, ok := getFsckTarget(name); ok {
+		target.lock.Lock()
+		blobAccess := target.blobAccess
+		target.lock.Unlock()
+		if blobAccess != nil {
+			return blobAccess, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "Unknown backend %#v", name)
+}
+
+type reportingFsckProgressStore struct {
+	FsckProgressStore
+
+	target *fsckTarget
+}
+
+// NewReportingFsckProgressStore creates an adapter for
+// FsckProgressStore that retains the progress that was saved most
+// recently, so that ServeFsck() and the CircularAdmin gRPC service can
+// report the progress of periodic runs against the backend registered
+// under the given name.
+func NewReportingFsckProgressStore(progressStore FsckProgressStore, name string) FsckProgressStore {
+	return &reportingFsckProgressStore{
+		FsckProgressStore: progressStore,
+		target:            getOrCreateFsckTarget(name),
+	}
+}
+
+func (ps *reportingFsckProgressStore) Put(progress FsckProgress) error {
+	ps.target.lock.Lock()
+	ps.target.periodicProgress = &progress
+	ps.target.lock.Unlock()
+	return ps.FsckProgressStore.Put(progress)
+}
+
+// onDemandFsckProgressStore is used by runs triggered through the
+// CircularAdmin gRPC service. These always start from the beginning, and only retain
+// their progress in memory.
+type onDemandFsckProgressStore struct {
+	target *fsckTarget
+}
+
+func (ps onDemandFsckProgressStore) Get() (FsckProgress, error) {
+	return FsckProgress{}, nil
+}
+
+func (ps onDemandFsckProgressStore) Put(progress FsckProgress) error {
+	ps.target.lock.Lock()
+	ps.target.progress = &progress
+	ps.target.lock.Unlock()
+	return nil
+}
+
+// getFsckTargetStatuses returns the status of all backends registered
+// through RegisterFsck(), sorted by name.
+func getFsckTargetStatuses() []fsckTargetStatus {
+	fsckTargetsLock.Lock()
+	names := make([]string, 0, len(fsckTargets))
+	for name := range fsckTargets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	targets := make([]*fsckTarget, 0, len(names))
+	for _, name := range names {
+		targets = append(targets, fsckTargets[name])
+	}
+	fsckTargetsLock.Unlock()
+
+	statuses := make([]fsckTargetStatus, 0, len(names))
+	for i, target := range targets {
+		target.lock.Lock()
+		statuses = append(statuses, fsckTargetStatus{
+			Name:             names[i],
+			PeriodicProgress: target.periodicProgress,
+			Running:          target.running,
+			Progress:         target.progress,
+			LastReport:       target.lastReport,
+			LastError:        target.lastError,
+		})
+		target.lock.Unlock()
+	}
+	return statuses
+}
+
+// startFsck starts a single run of Fsck() against a backend registered
+// through RegisterFsck(). The run continues in the background.
+func startFsck(name string, repair bool, maximumBytesPerSecond int64) error {
+	target, ok := getFsckTarget(name)
+	if !ok {
+		return status.Errorf(codes.NotFound, "Unknown backend %#v", name)
+	}
+
+	target.lock.Lock()
+	defer target.lock.Unlock()
+	blobAccess := target.blobAccess
+	if blobAccess == nil {
+		return status.Errorf(codes.NotFound, "Unknown backend %#v", name)
+	}
+	if target.running {
+		return status.Errorf(codes.FailedPrecondition, "Fsck is already running for backend %#v", name)
+	}
+	target.running = true
+	target.progress = nil
+
+	// Don't use the context of the caller, as the run should
+	// continue after the call completes.
+	go func() {
+		report, err := blobAccess.Fsck(context.Background(), clock.SystemClock, maximumBytesPerSecond, repair, onDemandFsckProgressStore{target: target})
+		if err != nil {
+			log.Printf("Fsck of backend %#v failed: %s", name, err)
+		}
+
+		target.lock.Lock()
+		defer target.lock.Unlock()
+		target.running = false
+		if err == nil {
+			target.lastReport = report
+			target.lastError = ""
+		} else {
+			target.lastError = err.Error()
+		}
+	}()
+	return nil
+}
+
+// ServeFsck is an HTTP handler that returns the status of calls to
+// Fsck() against backends registered through RegisterFsck() in JSON
+// form, including the progress of periodic and on-demand runs.
+//
+// As runs may cause data to be removed, they cannot be started
+// through this handler. They can only be started through the
+// CircularAdmin gRPC service, which is only exposed on administrative
+// gRPC servers.
+func ServeFsck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Only GET requests are supported. Use the CircularAdmin gRPC service to start runs", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getFsckTargetStatuses())
+}
@@ -0,0 +1,106 @@
+package circular_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/circular"
+	"github.com/buildbarn/bb-storage/pkg/proto/circularadmin"
+	"github.com/stretchr/testify/require"
+)
+
+type fsckHTTPTestStatus struct {
+	Name             string                 `json:"name"`
+	PeriodicProgress *circular.FsckProgress `json:"periodic_progress"`
+	Running          bool                   `json:"running"`
+	Progress         *circular.FsckProgress `json:"progress"`
+	LastReport       *circular.FsckReport   `json:"last_report"`
+	LastError        string                 `json:"last_error"`
+}
+
+// waitForFsck polls the status of a backend until the run triggered
+// through the CircularAdmin gRPC service has completed.
+func waitForFsck(t *testing.T, name string) fsckHTTPTestStatus {
+	for {
+		w := httptest.NewRecorder()
+		circular.ServeFsck(w, httptest.NewRequest(http.MethodGet, "/-/fsck", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var statuses []fsckHTTPTestStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+		for _, s := range statuses {
+			if s.Name == name && !s.Running {
+				return s
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeFsck(t *testing.T) {
+	ctx := context.Background()
+	e := newFsckTestEnvironment(t)
+	e.put(t, remoteexecution.DigestFunction_SHA256, "Hello world")
+	e.dataFile[0] = 'J'
+	circular.RegisterFsck("serve_fsck_test", e.blobAccess)
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		// Runs may cause data to be removed. They should not
+		// be startable through the HTTP endpoint, as it is
+		// exposed to anyone who can scrape metrics.
+		r := httptest.NewRequest(http.MethodPost, "/-/fsck", strings.NewReader(url.Values{
+			"name":   {"serve_fsck_test"},
+			"repair": {"true"},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		circular.ServeFsck(w, r)
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		_, err := circular.NewAdminServer().StartFsck(ctx, &circularadmin.StartFsckRequest{
+			BackendName: "serve_fsck_test",
+		})
+		require.NoError(t, err)
+
+		s := waitForFsck(t, "serve_fsck_test")
+		require.Empty(t, s.LastError)
+		require.Len(t, s.LastReport.EntryInconsistencies, 1)
+		require.False(t, s.LastReport.EntryInconsistencies[0].Repaired)
+
+		// The progress of the run should be reported as well.
+		require.Equal(t, &circular.FsckProgress{
+			SlotCount:            fsckTestSlotCount,
+			NextSlot:             fsckTestSlotCount,
+			EntriesChecked:       1,
+			BytesVerified:        11,
+			InconsistenciesFound: 1,
+		}, s.Progress)
+	})
+
+	t.Run("PeriodicProgress", func(t *testing.T) {
+		// Progress of periodic runs is saved through a
+		// FsckProgressStore, which should retain it for
+		// reporting.
+		progressStore := circular.NewReportingFsckProgressStore(
+			circular.NewFileFsckProgressStore(make(memoryFile, 56)),
+			"serve_fsck_test")
+		require.NoError(t, progressStore.Put(circular.FsckProgress{
+			SlotCount: fsckTestSlotCount,
+			NextSlot:  3,
+		}))
+
+		s := waitForFsck(t, "serve_fsck_test")
+		require.Equal(t, &circular.FsckProgress{
+			SlotCount: fsckTestSlotCount,
+			NextSlot:  3,
+		}, s.PeriodicProgress)
+	})
+}
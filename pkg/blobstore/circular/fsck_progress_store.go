@@ -0,0 +1,170 @@
+package circular
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	fsckProgressPrometheusMetrics sync.Once
+
+	fsckProgressSlotsScannedRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore_circular",
+			Name:      "fsck_slots_scanned_ratio",
+			Help:      "Fraction of offset store slots scanned by the current Fsck run.",
+		},
+		[]string{"name"})
+	fsckProgressEntriesChecked = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore_circular",
+			Name:      "fsck_entries_checked",
+			Help:      "Number of entries checked by the current Fsck run.",
+		},
+		[]string{"name"})
+	fsckProgressInconsistenciesFound = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore_circular",
+			Name:      "fsck_inconsistencies_found",
+			Help:      "Number of inconsistent entries found by the current Fsck run.",
+		},
+		[]string{"name"})
+)
+
+// FsckProgress is the state of a call to Fsck() that is persisted,
+// permitting it to be resumed.
+type FsckProgress struct {
+	// Number of slots in the offset store at the time the run
+	// started. Progress is discarded if the offset store is
+	// resized.
+	SlotCount uint64 `json:"slot_count"`
+	// Index of the next slot in the offset store to check.
+	NextSlot uint64 `json:"next_slot"`
+
+	EntriesChecked       uint64 `json:"entries_checked"`
+	BytesVerified        int64  `json:"bytes_verified"`
+	EntriesSkipped       uint64 `json:"entries_skipped"`
+	InconsistenciesFound uint64 `json:"inconsistencies_found"`
+	EntriesUnverifiable  uint64 `json:"entries_unverifiable"`
+}
+
+// FsckProgressStore is where the progress of Fsck() is persisted.
+type FsckProgressStore interface {
+	Get() (FsckProgress, error)
+	Put(progress FsckProgress) error
+}
+
+type fileFsckProgressStore struct {
+	file ReadWriterAt
+}
+
+// NewFileFsckProgressStore creates a FsckProgressStore that writes
+// progress to a file. An empty file corresponds to no progress being
+// made.
+func NewFileFsckProgressStore(file ReadWriterAt) FsckProgressStore {
+	return &fileFsckProgressStore{
+		file: file,
+	}
+}
+
+func (ps *fileFsckProgressStore) Get() (FsckProgress, error) {
+	var data [56]byte
+	if _, err := ps.file.ReadAt(data[:], 0); err == io.EOF {
+		return FsckProgress{}, nil
+	} else if err != nil {
+		return FsckProgress{}, err
+	}
+	return FsckProgress{
+		SlotCount:            binary.LittleEndian.Uint64(data[:]),
+		NextSlot:             binary.LittleEndian.Uint64(data[8:]),
+		EntriesChecked:       binary.LittleEndian.Uint64(data[16:]),
+		BytesVerified:        int64(binary.LittleEndian.Uint64(data[24:])),
+		EntriesSkipped:       binary.LittleEndian.Uint64(data[32:]),
+		InconsistenciesFound: binary.LittleEndian.Uint64(data[40:]),
+		EntriesUnverifiable:  binary.LittleEndian.Uint64(data[48:]),
+	}, nil
+}
+
+func (ps *fileFsckProgressStore) Put(progress FsckProgress) error {
+	var data [56]byte
+	binary.LittleEndian.PutUint64(data[:], progress.SlotCount)
+	binary.LittleEndian.PutUint64(data[8:], progress.NextSlot)
+	binary.LittleEndian.PutUint64(data[16:], progress.EntriesChecked)
+	binary.LittleEndian.PutUint64(data[24:], uint64(progress.BytesVerified))
+	binary.LittleEndian.PutUint64(data[32:], progress.EntriesSkipped)
+	binary.LittleEndian.PutUint64(data[40:], progress.InconsistenciesFound)
+	binary.LittleEndian.PutUint64(data[48:], progress.EntriesUnverifiable)
+	_, err := ps.file.WriteAt(data[:], 0)
+	return err
+}
+
+type metricsFsckProgressStore struct {
+	FsckProgressStore
+
+	slotsScannedRatio    prometheus.Gauge
+	entriesChecked       prometheus.Gauge
+	inconsistenciesFound prometheus.Gauge
+}
+
+// NewMetricsFsckProgressStore creates an adapter for FsckProgressStore
+// that exposes the progress of Fsck() as Prometheus metrics.
+func NewMetricsFsckProgressStore(progressStore FsckProgressStore, name string) FsckProgressStore {
+	fsckProgressPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(fsckProgressSlotsScannedRatio)
+		prometheus.MustRegister(fsckProgressEntriesChecked)
+		prometheus.MustRegister(fsckProgressInconsistenciesFound)
+	})
+
+	return &metricsFsckProgressStore{
+		FsckProgressStore: progressStore,
+
+		slotsScannedRatio:    fsckProgressSlotsScannedRatio.WithLabelValues(name),
+		entriesChecked:       fsckProgressEntriesChecked.WithLabelValues(name),
+		inconsistenciesFound: fsckProgressInconsistenciesFound.WithLabelValues(name),
+	}
+}
+
+func (ps *metricsFsckProgressStore) Put(progress FsckProgress) error {
+	if progress.SlotCount > 0 {
+		ps.slotsScannedRatio.Set(float64(progress.NextSlot) / float64(progress.SlotCount))
+	}
+	ps.entriesChecked.Set(float64(progress.EntriesChecked))
+	ps.inconsistenciesFound.Set(float64(progress.InconsistenciesFound))
+	return ps.FsckProgressStore.Put(progress)
+}
+
+// RunFsckPeriodically calls Fsck() repeatedly, waiting for a given
+// interval between completed runs. Failed runs are retried after the
+// same interval. As progress is persisted, runs that are interrupted by
+// a restart of the process are resumed. This function returns when the
+// context is canceled.
+func RunFsckPeriodically(ctx context.Context, blobAccess CircularBlobAccess, clock clock.Clock, interval time.Duration, maximumBytesPerSecond int64, repair bool, progressStore FsckProgressStore) {
+	for {
+		if report, err := blobAccess.Fsck(ctx, clock, maximumBytesPerSecond, repair, progressStore); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Print("Fsck failed: ", err)
+		} else if len(report.CursorInconsistencies) > 0 || len(report.EntryInconsistencies) > 0 {
+			log.Printf("Fsck completed with %d cursor inconsistencies and %d entry inconsistencies", len(report.CursorInconsistencies), len(report.EntryInconsistencies))
+		}
+
+		timer, t := clock.NewTimer(interval)
+		select {
+		case <-t:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
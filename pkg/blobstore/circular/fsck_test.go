@@ -0,0 +1,223 @@
+package circular_test
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/circular"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	fsckTestOffsetRecordSizeBytes = 60
+	fsckTestSlotCount             = 16
+	fsckTestDataSizeBytes         = 1024
+)
+
+// fsckTestEnvironment is a circular storage backend that is backed by
+// in-memory files, so that tests can corrupt their contents.
+type fsckTestEnvironment struct {
+	offsetFile memoryFile
+	dataFile   memoryFile
+	blobAccess circular.CircularBlobAccess
+}
+
+func newFsckTestEnvironment(t *testing.T) *fsckTestEnvironment {
+	offsetFile := make(memoryFile, fsckTestOffsetRecordSizeBytes*fsckTestSlotCount)
+	dataFile := make(memoryFile, fsckTestDataSizeBytes)
+	stateStore, err := circular.NewFileStateStore(make(memoryFile, 16), fsckTestDataSizeBytes)
+	require.NoError(t, err)
+	return &fsckTestEnvironment{
+		offsetFile: offsetFile,
+		dataFile:   dataFile,
+		blobAccess: circular.NewCircularBlobAccess(
+			circular.NewFileOffsetStore(offsetFile, uint64(len(offsetFile))),
+			circular.NewFileDataStore(dataFile, fsckTestDataSizeBytes),
+			stateStore,
+			blobstore.CASStorageType,
+			fsckTestDataSizeBytes,
+			0,
+			0,
+			false,
+			1),
+	}
+}
+
+// put stores a blob, using a digest computed using the given digest
+// function.
+func (e *fsckTestEnvironment) put(t *testing.T, digestFunction remoteexecution.DigestFunction_Value, data string) *util.Digest {
+	hasher, ok := util.NewHasherForDigestFunction(digestFunction)
+	require.True(t, ok)
+	hasher.Write([]byte(data))
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      hex.EncodeToString(hasher.Sum(nil)),
+			SizeBytes: int64(len(data)),
+		})
+	require.NoError(t, e.blobAccess.Put(context.Background(), digest, buffer.NewValidatedBufferFromByteSlice([]byte(data))))
+	return digest
+}
+
+// getOccupiedSlots returns the indices of the slots in the offset
+// store that contain a record.
+func (e *fsckTestEnvironment) getOccupiedSlots() []uint64 {
+	var slots []uint64
+	for i := uint64(0); i < fsckTestSlotCount; i++ {
+		for _, b := range e.offsetFile[i*fsckTestOffsetRecordSizeBytes : (i+1)*fsckTestOffsetRecordSizeBytes] {
+			if b != 0 {
+				slots = append(slots, i)
+				break
+			}
+		}
+	}
+	return slots
+}
+
+func TestCircularBlobAccessFsck(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("ValidEntry", func(t *testing.T) {
+		e := newFsckTestEnvironment(t)
+		digest := e.put(t, remoteexecution.DigestFunction_SHA256, "Hello world")
+
+		report, err := e.blobAccess.Fsck(ctx, clock.SystemClock, 0, true, nil)
+		require.NoError(t, err)
+		require.Equal(t, &circular.FsckReport{
+			SlotsScanned:   fsckTestSlotCount,
+			EntriesChecked: 1,
+			BytesVerified:  11,
+		}, report)
+
+		data, err := e.blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("CorruptEntry", func(t *testing.T) {
+		e := newFsckTestEnvironment(t)
+		corruptDigest := e.put(t, remoteexecution.DigestFunction_SHA256, "Hello world")
+		validDigest := e.put(t, remoteexecution.DigestFunction_SHA256, "Goodbye")
+		e.dataFile[0] = 'J'
+
+		// Without repairing, the inconsistency should only be
+		// reported.
+		report, err := e.blobAccess.Fsck(ctx, clock.SystemClock, 0, false, nil)
+		require.NoError(t, err)
+		require.Len(t, report.EntryInconsistencies, 1)
+		require.Equal(t, circular.FsckInconsistency{
+			Hash:      corruptDigest.GetHashString(),
+			SizeBytes: 11,
+			Offset:    0,
+			Length:    11,
+			Reason:    "Data does not match hash stored in digest",
+		}, report.EntryInconsistencies[0])
+
+		// When repairing, the corrupted data should be
+		// invalidated. Data stored after it should remain
+		// available.
+		report, err = e.blobAccess.Fsck(ctx, clock.SystemClock, 0, true, nil)
+		require.NoError(t, err)
+		require.Len(t, report.EntryInconsistencies, 1)
+		require.True(t, report.EntryInconsistencies[0].Repaired)
+
+		_, err = e.blobAccess.Get(ctx, corruptDigest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+		data, err := e.blobAccess.Get(ctx, validDigest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Goodbye"), data)
+
+		// Entries referring to invalidated data should no
+		// longer be visited.
+		report, err = e.blobAccess.Fsck(ctx, clock.SystemClock, 0, true, nil)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), report.EntriesChecked)
+		require.Empty(t, report.EntryInconsistencies)
+	})
+
+	t.Run("VSOHash", func(t *testing.T) {
+		// The offset store does not record the digest function
+		// of entries. Blobs stored using any of the supported
+		// digest functions, including VSO, should be verified
+		// successfully and never be invalidated.
+		e := newFsckTestEnvironment(t)
+		digest := e.put(t, remoteexecution.DigestFunction_VSO, "Hello world")
+
+		report, err := e.blobAccess.Fsck(ctx, clock.SystemClock, 0, true, nil)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), report.EntriesChecked)
+		require.Equal(t, uint64(0), report.EntriesUnverifiable)
+		require.Empty(t, report.EntryInconsistencies)
+
+		data, err := e.blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("ProgressResume", func(t *testing.T) {
+		e := newFsckTestEnvironment(t)
+		e.put(t, remoteexecution.DigestFunction_SHA256, "Hello world")
+		e.dataFile[0] = 'J'
+		slots := e.getOccupiedSlots()
+		require.Len(t, slots, 1)
+		progressStore := circular.NewFileFsckProgressStore(make(memoryFile, 56))
+
+		// Resume a run that already scanned the corrupted
+		// entry. It should not be reported once more, while
+		// statistics of the previous run are retained.
+		require.NoError(t, progressStore.Put(circular.FsckProgress{
+			SlotCount:      fsckTestSlotCount,
+			NextSlot:       slots[0] + 1,
+			EntriesChecked: 5,
+		}))
+		report, err := e.blobAccess.Fsck(ctx, clock.SystemClock, 0, false, progressStore)
+		require.NoError(t, err)
+		require.Equal(t, uint64(fsckTestSlotCount), report.SlotsScanned)
+		require.Equal(t, uint64(5), report.EntriesChecked)
+		require.Empty(t, report.EntryInconsistencies)
+
+		// The completed run should cause the next run to start
+		// from the beginning.
+		progress, err := progressStore.Get()
+		require.NoError(t, err)
+		require.Equal(t, uint64(fsckTestSlotCount), progress.NextSlot)
+		report, err = e.blobAccess.Fsck(ctx, clock.SystemClock, 0, false, progressStore)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), report.EntriesChecked)
+		require.Len(t, report.EntryInconsistencies, 1)
+
+		// Progress of an offset store with a different size
+		// should be discarded.
+		require.NoError(t, progressStore.Put(circular.FsckProgress{
+			SlotCount:      fsckTestSlotCount * 2,
+			NextSlot:       fsckTestSlotCount,
+			EntriesChecked: 5,
+		}))
+		report, err = e.blobAccess.Fsck(ctx, clock.SystemClock, 0, false, progressStore)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), report.EntriesChecked)
+		require.Len(t, report.EntryInconsistencies, 1)
+	})
+
+	t.Run("ProgressSavedOnCancelation", func(t *testing.T) {
+		e := newFsckTestEnvironment(t)
+		progressStore := circular.NewFileFsckProgressStore(make(memoryFile, 56))
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := e.blobAccess.Fsck(canceledCtx, clock.SystemClock, 0, false, progressStore)
+		require.Equal(t, status.Error(codes.Canceled, "context canceled"), err)
+		progress, err := progressStore.Get()
+		require.NoError(t, err)
+		require.Equal(t, circular.FsckProgress{SlotCount: fsckTestSlotCount}, progress)
+	})
+}
@@ -0,0 +1,101 @@
+package circular
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	stateStorePrometheusMetrics sync.Once
+
+	stateStoreReadCursor = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore_circular",
+			Name:      "state_store_read_cursor_bytes",
+			Help:      "Position of the read cursor of the data file. This value increases monotonically and is not truncated to the size of the data file.",
+		},
+		[]string{"storage_type", "directory"})
+	stateStoreWriteCursor = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore_circular",
+			Name:      "state_store_write_cursor_bytes",
+			Help:      "Position of the write cursor of the data file. This value increases monotonically and is not truncated to the size of the data file.",
+		},
+		[]string{"storage_type", "directory"})
+	stateStoreCursorDistance = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore_circular",
+			Name:      "state_store_cursor_distance_bytes",
+			Help:      "Distance between the read and write cursors of the data file, corresponding to the amount of data that is valid.",
+		},
+		[]string{"storage_type", "directory"})
+	stateStoreInvalidations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore_circular",
+			Name:      "state_store_invalidations_total",
+			Help:      "Number of times data in the data file was invalidated.",
+		},
+		[]string{"storage_type", "directory"})
+)
+
+type metricsStateStore struct {
+	StateStore
+
+	readCursor     prometheus.Gauge
+	writeCursor    prometheus.Gauge
+	cursorDistance prometheus.Gauge
+	invalidations  prometheus.Counter
+}
+
+// NewMetricsStateStore creates an adapter for StateStore that exposes
+// the positions of the read and write cursors as Prometheus metrics.
+// The rate at which the write cursor increases can be used to
+// determine how quickly the data file wraps around. Metrics are
+// labeled by the directory containing the data file, so that multiple
+// circular storage backends can be distinguished.
+func NewMetricsStateStore(stateStore StateStore, storageTypeName string, directory string) StateStore {
+	stateStorePrometheusMetrics.Do(func() {
+		prometheus.MustRegister(stateStoreReadCursor)
+		prometheus.MustRegister(stateStoreWriteCursor)
+		prometheus.MustRegister(stateStoreCursorDistance)
+		prometheus.MustRegister(stateStoreInvalidations)
+	})
+
+	ss := &metricsStateStore{
+		StateStore: stateStore,
+
+		readCursor:     stateStoreReadCursor.WithLabelValues(storageTypeName, directory),
+		writeCursor:    stateStoreWriteCursor.WithLabelValues(storageTypeName, directory),
+		cursorDistance: stateStoreCursorDistance.WithLabelValues(storageTypeName, directory),
+		invalidations:  stateStoreInvalidations.WithLabelValues(storageTypeName, directory),
+	}
+	ss.updateCursors()
+	return ss
+}
+
+func (ss *metricsStateStore) updateCursors() {
+	cursors := ss.StateStore.GetCursors()
+	ss.readCursor.Set(float64(cursors.Read))
+	ss.writeCursor.Set(float64(cursors.Write))
+	ss.cursorDistance.Set(float64(cursors.Write - cursors.Read))
+}
+
+func (ss *metricsStateStore) Allocate(sizeBytes int64) (uint64, error) {
+	offset, err := ss.StateStore.Allocate(sizeBytes)
+	ss.updateCursors()
+	return offset, err
+}
+
+func (ss *metricsStateStore) Invalidate(offset uint64, sizeBytes int64) error {
+	if err := ss.StateStore.Invalidate(offset, sizeBytes); err != nil {
+		return err
+	}
+	ss.invalidations.Inc()
+	ss.updateCursors()
+	return nil
+}
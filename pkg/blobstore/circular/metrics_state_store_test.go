@@ -0,0 +1,95 @@
+package circular_test
+
+import (
+	"testing"
+
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/circular"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsStateStore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	getValue := func(name string, directory string) float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				if labels["storage_type"] == "cas" && labels["directory"] == directory {
+					if counter := metric.GetCounter(); counter != nil {
+						return counter.GetValue()
+					}
+					return metric.GetGauge().GetValue()
+				}
+			}
+		}
+		return 0
+	}
+
+	// Create two state stores for the same storage type. Their
+	// metrics should not overwrite each other.
+	baseStateStore1 := mock.NewMockStateStore(ctrl)
+	baseStateStore1.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 300})
+	stateStore1 := circular.NewMetricsStateStore(baseStateStore1, "cas", "/storage1")
+	baseStateStore2 := mock.NewMockStateStore(ctrl)
+	baseStateStore2.EXPECT().GetCursors().Return(circular.Cursors{Read: 1000, Write: 1500})
+	stateStore2 := circular.NewMetricsStateStore(baseStateStore2, "cas", "/storage2")
+
+	t.Run("Initial", func(t *testing.T) {
+		require.Equal(t, 100.0, getValue("buildbarn_blobstore_circular_state_store_read_cursor_bytes", "/storage1"))
+		require.Equal(t, 300.0, getValue("buildbarn_blobstore_circular_state_store_write_cursor_bytes", "/storage1"))
+		require.Equal(t, 200.0, getValue("buildbarn_blobstore_circular_state_store_cursor_distance_bytes", "/storage1"))
+		require.Equal(t, 1000.0, getValue("buildbarn_blobstore_circular_state_store_read_cursor_bytes", "/storage2"))
+		require.Equal(t, 1500.0, getValue("buildbarn_blobstore_circular_state_store_write_cursor_bytes", "/storage2"))
+		require.Equal(t, 500.0, getValue("buildbarn_blobstore_circular_state_store_cursor_distance_bytes", "/storage2"))
+	})
+
+	t.Run("Allocate", func(t *testing.T) {
+		baseStateStore1.EXPECT().Allocate(int64(50)).Return(uint64(300), nil)
+		baseStateStore1.EXPECT().GetCursors().Return(circular.Cursors{Read: 100, Write: 350})
+
+		offset, err := stateStore1.Allocate(50)
+		require.NoError(t, err)
+		require.Equal(t, uint64(300), offset)
+		require.Equal(t, 350.0, getValue("buildbarn_blobstore_circular_state_store_write_cursor_bytes", "/storage1"))
+		require.Equal(t, 250.0, getValue("buildbarn_blobstore_circular_state_store_cursor_distance_bytes", "/storage1"))
+		require.Equal(t, 1500.0, getValue("buildbarn_blobstore_circular_state_store_write_cursor_bytes", "/storage2"))
+	})
+
+	t.Run("InvalidateSuccess", func(t *testing.T) {
+		baseStateStore2.EXPECT().Invalidate(uint64(1000), int64(200))
+		baseStateStore2.EXPECT().GetCursors().Return(circular.Cursors{Read: 1200, Write: 1500})
+
+		require.NoError(t, stateStore2.Invalidate(1000, 200))
+		require.Equal(t, 1.0, getValue("buildbarn_blobstore_circular_state_store_invalidations_total", "/storage2"))
+		require.Equal(t, 1200.0, getValue("buildbarn_blobstore_circular_state_store_read_cursor_bytes", "/storage2"))
+		require.Equal(t, 300.0, getValue("buildbarn_blobstore_circular_state_store_cursor_distance_bytes", "/storage2"))
+		require.Equal(t, 0.0, getValue("buildbarn_blobstore_circular_state_store_invalidations_total", "/storage1"))
+	})
+
+	t.Run("InvalidateFailure", func(t *testing.T) {
+		// Failed invalidations should not be counted.
+		baseStateStore2.EXPECT().Invalidate(uint64(2000), int64(200)).
+			Return(status.Error(codes.InvalidArgument, "Cannot invalidate data beyond the write cursor"))
+
+		require.Equal(
+			t,
+			status.Error(codes.InvalidArgument, "Cannot invalidate data beyond the write cursor"),
+			stateStore2.Invalidate(2000, 200))
+		require.Equal(t, 1.0, getValue("buildbarn_blobstore_circular_state_store_invalidations_total", "/storage2"))
+	})
+}
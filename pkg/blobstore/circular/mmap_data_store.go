@@ -0,0 +1,159 @@
+package circular
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/clock"
+
+	"golang.org/x/sys/unix"
+)
+
+// MmapDataStore is a DataStore that is backed by a memory mapping of a
+// file.
+type MmapDataStore interface {
+	DataStore
+
+	// Sync synchronizes all modified pages of the memory mapping
+	// to disk.
+	Sync() error
+
+	// Close synchronizes all modified pages to disk and removes
+	// the memory mapping. The data store may no longer be used
+	// afterwards.
+	Close() error
+}
+
+type mmapDataStore struct {
+	data      []byte
+	syncOnPut bool
+}
+
+// NewMmapDataStore creates a new store for blob contents that is
+// backed by a memory mapping of a file. Like NewFileDataStore(), all
+// blobs are concatenated directly and the file pointer wraps around at
+// the configured size. Because data is accessed through the memory
+// mapping, reads don't require any system calls. This is beneficial
+// for workloads consisting of many small random reads.
+//
+// The file is extended to the configured size if it is smaller. If
+// syncOnPut is set, data written through Put() is synchronized to disk
+// before returning. Otherwise, synchronization is left to the
+// operating system, and may be triggered explicitly by calling Sync()
+// (e.g., through RunMmapDataStoreSyncPeriodically()).
+func NewMmapDataStore(fd int, size uint64, syncOnPut bool) (MmapDataStore, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return nil, err
+	}
+	if uint64(stat.Size) < size {
+		if err := unix.Ftruncate(fd, int64(size)); err != nil {
+			return nil, err
+		}
+	}
+	data, err := unix.Mmap(fd, 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapDataStore{
+		data:      data,
+		syncOnPut: syncOnPut,
+	}, nil
+}
+
+func (ds *mmapDataStore) Put(r io.Reader, offset uint64) error {
+	// Read data directly into the memory mapping. If at the end of
+	// the mapping, limit the size to ensure proper wrap-around.
+	size := uint64(len(ds.data))
+	startOffset := offset
+	for {
+		n, err := r.Read(ds.data[offset%size:])
+		offset += uint64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Synchronize the modified pages to disk. The region may need
+	// to be split in two in case it wraps around.
+	if !ds.syncOnPut {
+		return nil
+	}
+	length := offset - startOffset
+	if length >= size {
+		return ds.sync(0, size)
+	}
+	start := startOffset % size
+	end := start + length
+	if end <= size {
+		return ds.sync(start, end)
+	}
+	if err := ds.sync(start, size); err != nil {
+		return err
+	}
+	return ds.sync(0, end-size)
+}
+
+// sync flushes a region of the memory mapping to disk. msync() requires
+// the address to be page aligned, so the start of the region is
+// rounded down.
+func (ds *mmapDataStore) sync(start uint64, end uint64) error {
+	if start == end {
+		return nil
+	}
+	pageSize := uint64(os.Getpagesize())
+	start -= start % pageSize
+	return unix.Msync(ds.data[start:end], unix.MS_SYNC)
+}
+
+func (ds *mmapDataStore) Sync() error {
+	return ds.sync(0, uint64(len(ds.data)))
+}
+
+func (ds *mmapDataStore) Close() error {
+	if err := ds.Sync(); err != nil {
+		return err
+	}
+	err := unix.Munmap(ds.data)
+	ds.data = nil
+	return err
+}
+
+func (ds *mmapDataStore) Get(offset uint64, size int64) io.Reader {
+	dataSize := uint64(len(ds.data))
+	start := offset % dataSize
+	end := start + uint64(size)
+	if end <= dataSize {
+		return bytes.NewReader(ds.data[start:end])
+	}
+	return io.MultiReader(
+		bytes.NewReader(ds.data[start:]),
+		bytes.NewReader(ds.data[:end-dataSize]))
+}
+
+// RunMmapDataStoreSyncPeriodically calls Sync() on an MmapDataStore
+// repeatedly, waiting for a given interval between calls. This bounds
+// the amount of data that is lost when the system crashes, without
+// requiring every call to Put() to wait for data to be written to
+// disk. This function returns when the context is canceled.
+func RunMmapDataStoreSyncPeriodically(ctx context.Context, dataStore MmapDataStore, clock clock.Clock, interval time.Duration) {
+	for {
+		timer, t := clock.NewTimer(interval)
+		select {
+		case <-t:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		if err := dataStore.Sync(); err != nil {
+			log.Print("Failed to synchronize data file: ", err)
+		}
+	}
+}
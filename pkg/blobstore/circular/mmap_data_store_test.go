@@ -0,0 +1,155 @@
+package circular_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/circular"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMmapDataStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "mmap_data_store")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "data")
+
+	// Use a data file spanning multiple pages, so that regions
+	// that need to be synchronized are not page aligned.
+	size := uint64(3 * os.Getpagesize())
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	dataStore, err := circular.NewMmapDataStore(int(f.Fd()), size, true)
+	require.NoError(t, err)
+
+	t.Run("FileExtended", func(t *testing.T) {
+		// The file should have been extended to the size of
+		// the data store.
+		info, err := f.Stat()
+		require.NoError(t, err)
+		require.Equal(t, int64(size), info.Size())
+	})
+
+	t.Run("WithinBounds", func(t *testing.T) {
+		// Offsets should be taken modulo the size of the data
+		// store.
+		offset := 2*size + 5000
+		require.NoError(t, dataStore.Put(strings.NewReader("Hello world"), offset))
+
+		data, err := ioutil.ReadAll(dataStore.Get(offset, 11))
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+
+		// Data should have been written to the file.
+		fileData := make([]byte, 11)
+		_, err = f.ReadAt(fileData, 5000)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), fileData)
+	})
+
+	t.Run("Wraparound", func(t *testing.T) {
+		// Blobs written at the end of the data store should
+		// continue at the start.
+		offset := size - 5
+		require.NoError(t, dataStore.Put(strings.NewReader("Hello world"), offset))
+
+		data, err := ioutil.ReadAll(dataStore.Get(offset, 11))
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+
+		// Both halves should have been written to the file.
+		fileData := make([]byte, 5)
+		_, err = f.ReadAt(fileData, int64(size-5))
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), fileData)
+		fileData = make([]byte, 6)
+		_, err = f.ReadAt(fileData, 0)
+		require.NoError(t, err)
+		require.Equal(t, []byte(" world"), fileData)
+	})
+
+	t.Run("EntireDataStore", func(t *testing.T) {
+		// Blobs that span the entire data store should cause
+		// all pages to be synchronized.
+		blob := strings.Repeat("0123456789", int(size)/10+1)[:size]
+		require.NoError(t, dataStore.Put(strings.NewReader(blob), 7))
+
+		data, err := ioutil.ReadAll(dataStore.Get(7, int64(size)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(blob), data)
+
+		fileData := make([]byte, size)
+		_, err = f.ReadAt(fileData, 0)
+		require.NoError(t, err)
+		require.Equal(t, []byte(blob[size-7:]+blob[:size-7]), fileData)
+
+		// Restore the blob that is read after reopening.
+		require.NoError(t, dataStore.Put(strings.NewReader("Hello world"), size-5))
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		// Data should remain available when the file is mapped
+		// once again.
+		require.NoError(t, dataStore.Close())
+		f, err := os.OpenFile(path, os.O_RDWR, 0644)
+		require.NoError(t, err)
+		defer f.Close()
+		dataStore, err := circular.NewMmapDataStore(int(f.Fd()), size, false)
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(dataStore.Get(size-5, 11))
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+
+		// Without synchronization upon writes, data should
+		// still be written to the file when synchronized
+		// explicitly.
+		require.NoError(t, dataStore.Put(strings.NewReader("Goodbye"), 100))
+		require.NoError(t, dataStore.Sync())
+		fileData := make([]byte, 7)
+		_, err = f.ReadAt(fileData, 100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Goodbye"), fileData)
+		require.NoError(t, dataStore.Close())
+	})
+}
+
+func TestRunMmapDataStoreSyncPeriodically(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	directory, err := ioutil.TempDir("", "mmap_data_store")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+	f, err := os.OpenFile(filepath.Join(directory, "data"), os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	dataStore, err := circular.NewMmapDataStore(int(f.Fd()), uint64(os.Getpagesize()), false)
+	require.NoError(t, err)
+	defer dataStore.Close()
+
+	// Let the first timer expire, causing the data store to be
+	// synchronized. Cancel the context while waiting for the
+	// second timer, which should cause the function to return.
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := mock.NewMockClock(ctrl)
+	ch1 := make(chan time.Time, 1)
+	ch1 <- time.Unix(1000, 0)
+	clock.EXPECT().NewTimer(time.Minute).Return(mock.NewMockTimer(ctrl), ch1)
+	timer2 := mock.NewMockTimer(ctrl)
+	clock.EXPECT().NewTimer(time.Minute).DoAndReturn(func(d time.Duration) (*mock.MockTimer, <-chan time.Time) {
+		cancel()
+		return timer2, make(chan time.Time)
+	})
+	timer2.EXPECT().Stop().Return(true)
+
+	circular.RunMmapDataStoreSyncPeriodically(ctx, dataStore, clock, time.Minute)
+}
@@ -0,0 +1,88 @@
+package circular
+
+import (
+	"io"
+)
+
+type segmentedReadWriterAt struct {
+	segments         []ReadWriterAt
+	segmentSizeBytes int64
+}
+
+// NewSegmentedReadWriterAt creates a ReadWriterAt that concatenates a
+// sequence of fixed size segments (e.g., files). Offsets are translated
+// to a segment index and an offset within that segment. Reads and
+// writes spanning segment boundaries are split up.
+//
+// This may be used to let the data store of the circular storage
+// backend span multiple files, so that its capacity is not limited by
+// the size of a single file. Multiple smaller files are also easier to
+// manage (e.g., to back up) than a single large file.
+func NewSegmentedReadWriterAt(segments []ReadWriterAt, segmentSizeBytes int64) ReadWriterAt {
+	return &segmentedReadWriterAt{
+		segments:         segments,
+		segmentSizeBytes: segmentSizeBytes,
+	}
+}
+
+// getSegment returns the segment containing a given offset, the
+// offset within that segment and the amount of space remaining in the
+// segment starting at that offset.
+func (rw *segmentedReadWriterAt) getSegment(off int64) (ReadWriterAt, int64, int64, bool) {
+	if off < 0 {
+		return nil, 0, 0, false
+	}
+	index := off / rw.segmentSizeBytes
+	if index >= int64(len(rw.segments)) {
+		return nil, 0, 0, false
+	}
+	offWithinSegment := off % rw.segmentSizeBytes
+	return rw.segments[index], offWithinSegment, rw.segmentSizeBytes - offWithinSegment, true
+}
+
+func (rw *segmentedReadWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	nTotal := 0
+	for len(p) > 0 {
+		segment, offWithinSegment, remaining, ok := rw.getSegment(off)
+		if !ok {
+			return nTotal, io.EOF
+		}
+		chunk := p
+		if int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := segment.ReadAt(chunk, offWithinSegment)
+		nTotal += n
+		if n < len(chunk) {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return nTotal, err
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+	return nTotal, nil
+}
+
+func (rw *segmentedReadWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	nTotal := 0
+	for len(p) > 0 {
+		segment, offWithinSegment, remaining, ok := rw.getSegment(off)
+		if !ok {
+			return nTotal, io.ErrShortWrite
+		}
+		chunk := p
+		if int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := segment.WriteAt(chunk, offWithinSegment)
+		nTotal += n
+		if err != nil {
+			return nTotal, err
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+	return nTotal, nil
+}
@@ -0,0 +1,56 @@
+package circular_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/circular"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentedReadWriterAt(t *testing.T) {
+	segments := []circular.ReadWriterAt{make(memoryFile, 4), make(memoryFile, 4), make(memoryFile, 4)}
+	rw := circular.NewSegmentedReadWriterAt(segments, 4)
+
+	t.Run("WithinSegment", func(t *testing.T) {
+		n, err := rw.WriteAt([]byte("ab"), 1)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+		require.Equal(t, memoryFile("\x00ab\x00"), segments[0])
+
+		var p [2]byte
+		n, err = rw.ReadAt(p[:], 1)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+		require.Equal(t, []byte("ab"), p[:])
+	})
+
+	t.Run("AcrossSegments", func(t *testing.T) {
+		// Writes and reads spanning segment boundaries should
+		// be split up.
+		n, err := rw.WriteAt([]byte("Hello world"), 1)
+		require.NoError(t, err)
+		require.Equal(t, 11, n)
+		require.Equal(t, memoryFile("\x00Hel"), segments[0])
+		require.Equal(t, memoryFile("lo w"), segments[1])
+		require.Equal(t, memoryFile("orld"), segments[2])
+
+		var p [11]byte
+		n, err = rw.ReadAt(p[:], 1)
+		require.NoError(t, err)
+		require.Equal(t, 11, n)
+		require.Equal(t, []byte("Hello world"), p[:])
+	})
+
+	t.Run("BeyondEnd", func(t *testing.T) {
+		var p [4]byte
+		n, err := rw.ReadAt(p[:], 10)
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, 2, n)
+		require.Equal(t, []byte("ld"), p[:2])
+
+		n, err = rw.WriteAt([]byte("Hello"), 10)
+		require.Equal(t, io.ErrShortWrite, err)
+		require.Equal(t, 2, n)
+	})
+}
@@ -3,6 +3,7 @@ package blobstore
 import (
 	"context"
 	"io"
+	"strings"
 
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
 	"github.com/buildbarn/bb-storage/pkg/util"
@@ -15,18 +16,34 @@ import (
 )
 
 type cloudBlobAccess struct {
-	bucket      *blob.Bucket
-	keyPrefix   string
-	storageType StorageType
+	bucket                    *blob.Bucket
+	keyPrefix                 string
+	storageType               StorageType
+	partitionByDigestFunction bool
+	writeBufferSizeBytes      int
 }
 
 // NewCloudBlobAccess creates a BlobAccess that uses a cloud-based blob storage
 // as a backend.
-func NewCloudBlobAccess(bucket *blob.Bucket, keyPrefix string, storageType StorageType) BlobAccess {
+//
+// If partitionByDigestFunction is set, keys are prefixed with the name
+// of the digest function (e.g., "sha256/"). This ensures that objects
+// created using different digest functions are stored separately,
+// which permits managing their lifecycle independently.
+//
+// Put() streams the contents of blobs to the bucket, sending at most
+// writeBufferSizeBytes of data per request. For S3, blobs exceeding
+// this size are uploaded using multipart uploads, while smaller blobs
+// are uploaded using a single PutObject request. Incomplete uploads
+// are aborted when Put() fails. A size of zero causes the default of
+// the driver to be used.
+func NewCloudBlobAccess(bucket *blob.Bucket, keyPrefix string, storageType StorageType, partitionByDigestFunction bool, writeBufferSizeBytes int) BlobAccess {
 	return &cloudBlobAccess{
-		bucket:      bucket,
-		keyPrefix:   keyPrefix,
-		storageType: storageType,
+		bucket:                    bucket,
+		keyPrefix:                 keyPrefix,
+		storageType:               storageType,
+		partitionByDigestFunction: partitionByDigestFunction,
+		writeBufferSizeBytes:      writeBufferSizeBytes,
 	}
 }
 
@@ -52,21 +69,25 @@ func (ba *cloudBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffe
 	defer r.Close()
 
 	ctx, cancel := context.WithCancel(ctx)
-	w, err := ba.bucket.NewWriter(ctx, ba.getKey(digest), nil)
+	defer cancel()
+	w, err := ba.bucket.NewWriter(ctx, ba.getKey(digest), &blob.WriterOptions{
+		BufferSize: ba.writeBufferSizeBytes,
+	})
 	if err != nil {
-		cancel()
 		return err
 	}
 	// In case of an error (e.g. network failure), we cancel before closing to
-	// request the write to be aborted.
+	// request the write to be aborted. This also causes multipart
+	// uploads to be aborted, so that no incomplete uploads are left
+	// behind.
 	if _, err = io.Copy(w, r); err != nil {
 		cancel()
 		w.Close()
 		return err
 	}
-	w.Close()
-	cancel()
-	return nil
+	// Uploading the final part and completing a multipart upload
+	// happen as part of Close(), meaning its error must be checked.
+	return w.Close()
 }
 
 func (ba *cloudBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
@@ -81,6 +102,22 @@ func (ba *cloudBlobAccess) FindMissing(ctx context.Context, digests []*util.Dige
 	return missing, nil
 }
 
+func (ba *cloudBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	if err := ba.bucket.Delete(ctx, ba.getKey(digest)); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return err
+	}
+	return nil
+}
+
+func (ba *cloudBlobAccess) GetStats(ctx context.Context) (int64, int64, int64, error) {
+	// Cloud-based object stores are effectively unbounded. Their
+	// usage cannot be determined without listing all objects.
+	return UnknownStorageSize, UnknownStorageSize, UnknownStorageSize, nil
+}
+
 func (ba *cloudBlobAccess) getKey(digest *util.Digest) string {
+	if ba.partitionByDigestFunction {
+		return ba.keyPrefix + strings.ToLower(digest.GetDigestFunction().String()) + "/" + ba.storageType.GetDigestKey(digest)
+	}
 	return ba.keyPrefix + ba.storageType.GetDigestKey(digest)
 }
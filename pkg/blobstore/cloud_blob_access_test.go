@@ -0,0 +1,141 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+
+	"gocloud.dev/blob/memblob"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCloudBlobAccessPartitionByDigestFunction(t *testing.T) {
+	ctx := context.Background()
+
+	// A SHA-1 and a SHA-256 digest whose hashes share a common
+	// prefix and whose sizes are identical.
+	digestSHA1 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "0a4d55a8d778e5022fab701977c5d840bbc486d0",
+			SizeBytes: 11,
+		})
+	digestSHA256 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "0a4d55a8d778e5022fab701977c5d840bbc486d0dfc6dac9f43d9b0e9e89b0e7",
+			SizeBytes: 11,
+		})
+
+	t.Run("Partitioned", func(t *testing.T) {
+		bucket := memblob.OpenBucket(nil)
+		defer bucket.Close()
+		blobAccess := blobstore.NewCloudBlobAccess(bucket, "cas/", blobstore.CASStorageType, true, 0)
+
+		require.NoError(t, blobAccess.Put(ctx, digestSHA1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		// The object should be stored under a key containing
+		// the name of the digest function.
+		exists, err := bucket.Exists(ctx, "cas/sha1/0a4d55a8d778e5022fab701977c5d840bbc486d0-11")
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		// The SHA-256 digest should not collide with the SHA-1
+		// digest.
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestSHA1, digestSHA256})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestSHA256}, missing)
+
+		require.NoError(t, blobAccess.Put(ctx, digestSHA256, buffer.NewValidatedBufferFromByteSlice([]byte("Goodbye wld"))))
+		exists, err = bucket.Exists(ctx, "cas/sha256/0a4d55a8d778e5022fab701977c5d840bbc486d0dfc6dac9f43d9b0e9e89b0e7-11")
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digestSHA1, digestSHA256})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("Unpartitioned", func(t *testing.T) {
+		bucket := memblob.OpenBucket(nil)
+		defer bucket.Close()
+		blobAccess := blobstore.NewCloudBlobAccess(bucket, "cas/", blobstore.CASStorageType, false, 0)
+
+		require.NoError(t, blobAccess.Put(ctx, digestSHA1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		exists, err := bucket.Exists(ctx, "cas/0a4d55a8d778e5022fab701977c5d840bbc486d0-11")
+		require.NoError(t, err)
+		require.True(t, exists)
+	})
+}
+
+func TestCloudBlobAccessDelete(t *testing.T) {
+	ctx := context.Background()
+
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	blobAccess := blobstore.NewCloudBlobAccess(bucket, "cas/", blobstore.CASStorageType, false, 0)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	require.NoError(t, blobstore.Delete(ctx, blobAccess, digest))
+
+	_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{digest}, missing)
+
+	// Deleting objects that are absent should not be an error.
+	require.NoError(t, blobstore.Delete(ctx, blobAccess, digest))
+}
+
+func TestCloudBlobAccessPutFailure(t *testing.T) {
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	blobAccess := blobstore.NewCloudBlobAccess(bucket, "cas/", blobstore.CASStorageType, false, 0)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("ContextCanceled", func(t *testing.T) {
+		// Failures to finalize the upload should be reported,
+		// as opposed to letting Put() succeed.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.Error(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		exists, err := bucket.Exists(context.Background(), "cas/3e25960a79dbc69b674cd4ec67a72c62-11")
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+
+	t.Run("ReadFailure", func(t *testing.T) {
+		// Uploads should be aborted if the contents of the blob
+		// cannot be read in their entirety.
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Storage backend on fire"),
+			blobAccess.Put(context.Background(), digest, buffer.NewBufferFromError(status.Error(codes.Internal, "Storage backend on fire"))))
+
+		exists, err := bucket.Exists(context.Background(), "cas/3e25960a79dbc69b674cd4ec67a72c62-11")
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+}
@@ -0,0 +1,247 @@
+package blobstore
+
+import (
+	"container/heap"
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// PriorityMetadataKey is the gRPC metadata key through which clients
+// may provide a priority hint for their requests. The value must be an
+// integer. Requests with higher values are admitted by
+// ConcurrencyLimitingBlobAccess ahead of ones with lower values.
+const PriorityMetadataKey = "bb-priority"
+
+var (
+	concurrencyLimitingBlobAccessPrometheusMetrics sync.Once
+
+	concurrencyLimitingBlobAccessWaitDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "concurrency_limiting_blob_access_wait_duration_seconds",
+			Help:      "Amount of time operations waited to be admitted, in seconds.",
+			Buckets:   util.DecimalExponentialBuckets(-3, 6, 2),
+		},
+		[]string{"priority"})
+	concurrencyLimitingBlobAccessWaitDurationSecondsLow     = concurrencyLimitingBlobAccessWaitDurationSeconds.WithLabelValues("Low")
+	concurrencyLimitingBlobAccessWaitDurationSecondsDefault = concurrencyLimitingBlobAccessWaitDurationSeconds.WithLabelValues("Default")
+	concurrencyLimitingBlobAccessWaitDurationSecondsHigh    = concurrencyLimitingBlobAccessWaitDurationSeconds.WithLabelValues("High")
+)
+
+type requestPriorityKey struct{}
+
+// NewContextWithRequestPriority attaches a priority hint to a Context
+// object. This overrides any priority provided by the client through
+// gRPC metadata.
+func NewContextWithRequestPriority(ctx context.Context, priority int32) context.Context {
+	return context.WithValue(ctx, requestPriorityKey{}, priority)
+}
+
+// getRequestPriority extracts the priority hint from a Context object.
+// Requests without a priority hint have priority zero.
+func getRequestPriority(ctx context.Context) int32 {
+	if priority, ok := ctx.Value(requestPriorityKey{}).(int32); ok {
+		return priority
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(PriorityMetadataKey); len(values) > 0 {
+			if priority, err := strconv.ParseInt(values[0], 10, 32); err == nil {
+				return int32(priority)
+			}
+		}
+	}
+	return 0
+}
+
+// concurrencyWaiter is an operation that is waiting to be admitted.
+type concurrencyWaiter struct {
+	priority int32
+	sequence uint64
+	index    int
+	admitted chan struct{}
+}
+
+// concurrencyWaiterHeap is a priority queue of waiting operations.
+// Operations with a higher priority are admitted first. Operations
+// with the same priority are admitted in FIFO order.
+type concurrencyWaiterHeap []*concurrencyWaiter
+
+func (h concurrencyWaiterHeap) Len() int {
+	return len(h)
+}
+
+func (h concurrencyWaiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].sequence < h[j].sequence
+}
+
+func (h concurrencyWaiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *concurrencyWaiterHeap) Push(x interface{}) {
+	w := x.(*concurrencyWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *concurrencyWaiterHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+type concurrencyLimitingBlobAccess struct {
+	BlobAccess
+	clock              clock.Clock
+	maximumConcurrency int
+
+	lock         sync.Mutex
+	inFlight     int
+	waiters      concurrencyWaiterHeap
+	nextSequence uint64
+}
+
+// NewConcurrencyLimitingBlobAccess creates a decorator for BlobAccess
+// that limits the number of operations that may be performed against
+// the backend concurrently. For Get(), the slot is held until the
+// returned buffer has been consumed.
+//
+// When all slots are in use, operations are admitted in order of the
+// priority hint attached to their Context, either through
+// NewContextWithRequestPriority() or the PriorityMetadataKey gRPC
+// metadata key. This allows interactive builds to take precedence
+// over batch jobs when the storage backend is saturated. The amount of
+// time spent waiting is exposed for negative, zero and positive
+// priorities separately, so that the number of metrics remains bounded
+// regardless of the priorities provided by clients.
+func NewConcurrencyLimitingBlobAccess(blobAccess BlobAccess, clock clock.Clock, maximumConcurrency int) BlobAccess {
+	concurrencyLimitingBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(concurrencyLimitingBlobAccessWaitDurationSeconds)
+	})
+
+	return &concurrencyLimitingBlobAccess{
+		BlobAccess:         blobAccess,
+		clock:              clock,
+		maximumConcurrency: maximumConcurrency,
+	}
+}
+
+// acquire blocks until the operation is admitted, or until the
+// Context is canceled.
+func (ba *concurrencyLimitingBlobAccess) acquire(ctx context.Context) error {
+	priority := getRequestPriority(ctx)
+	waitDurationSeconds := concurrencyLimitingBlobAccessWaitDurationSecondsDefault
+	if priority < 0 {
+		waitDurationSeconds = concurrencyLimitingBlobAccessWaitDurationSecondsLow
+	} else if priority > 0 {
+		waitDurationSeconds = concurrencyLimitingBlobAccessWaitDurationSecondsHigh
+	}
+	timeStart := ba.clock.Now()
+	defer func() {
+		waitDurationSeconds.Observe(ba.clock.Now().Sub(timeStart).Seconds())
+	}()
+
+	ba.lock.Lock()
+	if ba.inFlight < ba.maximumConcurrency && len(ba.waiters) == 0 {
+		ba.inFlight++
+		ba.lock.Unlock()
+		return nil
+	}
+	w := &concurrencyWaiter{
+		priority: priority,
+		sequence: ba.nextSequence,
+		admitted: make(chan struct{}),
+	}
+	ba.nextSequence++
+	heap.Push(&ba.waiters, w)
+	ba.lock.Unlock()
+
+	select {
+	case <-w.admitted:
+		return nil
+	case <-ctx.Done():
+		ba.lock.Lock()
+		if w.index >= 0 {
+			heap.Remove(&ba.waiters, w.index)
+			ba.lock.Unlock()
+		} else {
+			// Admission raced with cancelation. Hand the
+			// slot to the next operation.
+			ba.lock.Unlock()
+			ba.release()
+		}
+		return util.StatusFromContext(ctx)
+	}
+}
+
+// release the slot held by an operation, admitting the waiting
+// operation with the highest priority, if any.
+func (ba *concurrencyLimitingBlobAccess) release() {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if len(ba.waiters) > 0 {
+		close(heap.Pop(&ba.waiters).(*concurrencyWaiter).admitted)
+	} else {
+		ba.inFlight--
+	}
+}
+
+func (ba *concurrencyLimitingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	if err := ba.acquire(ctx); err != nil {
+		return buffer.NewBufferFromError(err)
+	}
+	return buffer.WithErrorHandler(
+		ba.BlobAccess.Get(ctx, digest),
+		&concurrencyLimitingErrorHandler{
+			blobAccess: ba,
+		})
+}
+
+func (ba *concurrencyLimitingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	if err := ba.acquire(ctx); err != nil {
+		b.Discard()
+		return err
+	}
+	defer ba.release()
+	return ba.BlobAccess.Put(ctx, digest, b)
+}
+
+func (ba *concurrencyLimitingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	if err := ba.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer ba.release()
+	return ba.BlobAccess.FindMissing(ctx, digests)
+}
+
+// concurrencyLimitingErrorHandler releases the slot held by Get() once
+// the buffer returned by the backend has been consumed.
+type concurrencyLimitingErrorHandler struct {
+	blobAccess *concurrencyLimitingBlobAccess
+}
+
+func (eh *concurrencyLimitingErrorHandler) OnError(err error) (buffer.Buffer, error) {
+	return nil, err
+}
+
+func (eh *concurrencyLimitingErrorHandler) Done() {
+	eh.blobAccess.release()
+}
@@ -0,0 +1,136 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConcurrencyLimitingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	clock.EXPECT().Now().Return(time.Unix(1000, 0)).AnyTimes()
+	blobAccess := blobstore.NewConcurrencyLimitingBlobAccess(baseBlobAccess, clock, 1)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	// Let Get() obtain the only slot that is available. The slot
+	// should remain in use until the buffer is consumed.
+	baseBlobAccess.EXPECT().Get(ctx, digest).Return(
+		buffer.NewCASBufferFromReader(
+			digest,
+			ioutil.NopCloser(bytes.NewBufferString("Hello world")),
+			buffer.UserProvided))
+	b := blobAccess.Get(ctx, digest)
+
+	t.Run("Saturated", func(t *testing.T) {
+		// Operations should block until the slot is released,
+		// or until the request is canceled.
+		canceledCtx, cancel := context.WithCancel(blobstore.NewContextWithRequestPriority(ctx, 10))
+		cancel()
+
+		_, err := blobAccess.FindMissing(canceledCtx, []*util.Digest{digest})
+		require.Equal(t, status.Error(codes.Canceled, "context canceled"), err)
+	})
+
+	data, err := b.ToByteSlice(100)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello world"), data)
+
+	t.Run("Released", func(t *testing.T) {
+		// Consuming the buffer should have released the slot.
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+}
+
+func TestConcurrencyLimitingBlobAccessPriority(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	clock.EXPECT().Now().Return(time.Unix(1000, 0)).AnyTimes()
+	blobAccess := blobstore.NewConcurrencyLimitingBlobAccess(baseBlobAccess, clock, 1)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	lowDigest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		})
+	highDigest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+			SizeBytes: 7,
+		})
+
+	// Let Get() obtain the only slot that is available.
+	baseBlobAccess.EXPECT().Get(ctx, digest).Return(
+		buffer.NewCASBufferFromReader(
+			digest,
+			ioutil.NopCloser(bytes.NewBufferString("Hello world")),
+			buffer.UserProvided))
+	b := blobAccess.Get(ctx, digest)
+
+	// Enqueue a low priority operation, followed by a high priority
+	// operation. Once the slot is released, the high priority
+	// operation should be admitted first, even though it was
+	// enqueued last.
+	gomock.InOrder(
+		baseBlobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{highDigest}).Return(nil, nil),
+		baseBlobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{lowDigest}).Return(nil, nil))
+
+	var wg sync.WaitGroup
+	for _, operation := range []struct {
+		priority int32
+		digest   *util.Digest
+	}{
+		{-5, lowDigest},
+		{5, highDigest},
+	} {
+		waitCtx := newWaitNotifyingContext(ctx)
+		wg.Add(1)
+		go func(priority int32, digest *util.Digest) {
+			defer wg.Done()
+			_, err := blobAccess.FindMissing(blobstore.NewContextWithRequestPriority(waitCtx, priority), []*util.Digest{digest})
+			require.NoError(t, err)
+		}(operation.priority, operation.digest)
+		<-waitCtx.waiting
+	}
+
+	data, err := b.ToByteSlice(100)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello world"), data)
+	wg.Wait()
+}
@@ -5,14 +5,20 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/audit"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/chunking"
 	"github.com/buildbarn/bb-storage/pkg/blobstore/circular"
+	blobstore_filesystem "github.com/buildbarn/bb-storage/pkg/blobstore/filesystem"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/gcs"
 	"github.com/buildbarn/bb-storage/pkg/blobstore/local"
 	"github.com/buildbarn/bb-storage/pkg/blobstore/sharding"
 	"github.com/buildbarn/bb-storage/pkg/clock"
@@ -38,6 +44,7 @@ import (
 	"gocloud.dev/gcp"
 
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
@@ -46,21 +53,26 @@ import (
 
 // CreateBlobAccessObjectsFromConfig creates a pair of BlobAccess
 // objects for the Content Addressable Storage and Action cache based on
-// a configuration file.
-func CreateBlobAccessObjectsFromConfig(configuration *pb.BlobstoreConfiguration, maximumMessageSizeBytes int) (blobstore.BlobAccess, blobstore.BlobAccess, error) {
+// a configuration file. Instance names that are part of the
+// configuration are normalized using instanceNameNormalizer, so that
+// they match the instance names of digests provided by clients.
+func CreateBlobAccessObjectsFromConfig(configuration *pb.BlobstoreConfiguration, maximumMessageSizeBytes int, instanceNameNormalizer util.InstanceNameNormalizer) (blobstore.BlobAccess, blobstore.BlobAccess, error) {
 	// Create two stores based on definitions in configuration.
-	contentAddressableStorage, err := createBlobAccess(configuration.ContentAddressableStorage, blobstore.CASStorageType, "cas", maximumMessageSizeBytes)
+	contentAddressableStorage, err := createBlobAccess(configuration.ContentAddressableStorage, blobstore.CASStorageType, "cas", maximumMessageSizeBytes, instanceNameNormalizer)
 	if err != nil {
 		return nil, nil, err
 	}
-	actionCache, err := createBlobAccess(configuration.ActionCache, blobstore.ACStorageType, "ac", maximumMessageSizeBytes)
+	if configuration.InjectEmptyBlob {
+		contentAddressableStorage = blobstore.NewEmptyBlobInjectingBlobAccess(contentAddressableStorage)
+	}
+	actionCache, err := createBlobAccess(configuration.ActionCache, blobstore.ACStorageType, "ac", maximumMessageSizeBytes, instanceNameNormalizer)
 	if err != nil {
 		return nil, nil, err
 	}
 	return contentAddressableStorage, actionCache, nil
 }
 
-func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blobstore.StorageType, storageTypeName string, maximumMessageSizeBytes int) (blobstore.BlobAccess, error) {
+func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blobstore.StorageType, storageTypeName string, maximumMessageSizeBytes int, instanceNameNormalizer util.InstanceNameNormalizer) (blobstore.BlobAccess, error) {
 	var implementation blobstore.BlobAccess
 	var backendType string
 	if configuration == nil {
@@ -84,7 +96,7 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 			if err != nil {
 				return nil, err
 			}
-			implementation = blobstore.NewCloudBlobAccess(bucket, backend.Cloud.KeyPrefix, storageType)
+			implementation = blobstore.NewCloudBlobAccess(bucket, backend.Cloud.KeyPrefix, storageType, backend.Cloud.PartitionByDigestFunction, 0)
 		case *pb.CloudBlobAccessConfiguration_Azure:
 			backendType = "azure"
 			credential, err := azureblob.NewCredential(azureblob.AccountName(backendConfig.Azure.AccountName), azureblob.AccountKey(backendConfig.Azure.AccountKey))
@@ -97,7 +109,7 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 			if err != nil {
 				return nil, err
 			}
-			implementation = blobstore.NewCloudBlobAccess(bucket, backend.Cloud.KeyPrefix, storageType)
+			implementation = blobstore.NewCloudBlobAccess(bucket, backend.Cloud.KeyPrefix, storageType, backend.Cloud.PartitionByDigestFunction, 0)
 		case *pb.CloudBlobAccessConfiguration_Gcs:
 			backendType = "gcs"
 			var creds *google.Credentials
@@ -115,11 +127,22 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 			if err != nil {
 				return nil, err
 			}
-			bucket, err := gcsblob.OpenBucket(ctx, client, backendConfig.Gcs.Bucket, nil)
-			if err != nil {
-				return nil, err
+			if backendConfig.Gcs.NativeClient {
+				if backend.Cloud.PartitionByDigestFunction {
+					return nil, status.Error(codes.InvalidArgument, "Partitioning by digest function is not supported by the native GCS client")
+				}
+				storageClient, err := storage.NewClient(ctx, option.WithHTTPClient(&client.Client))
+				if err != nil {
+					return nil, err
+				}
+				implementation = gcs.NewGCSBlobAccess(storageClient.Bucket(backendConfig.Gcs.Bucket), backend.Cloud.KeyPrefix, storageType)
+			} else {
+				bucket, err := gcsblob.OpenBucket(ctx, client, backendConfig.Gcs.Bucket, nil)
+				if err != nil {
+					return nil, err
+				}
+				implementation = blobstore.NewCloudBlobAccess(bucket, backend.Cloud.KeyPrefix, storageType, backend.Cloud.PartitionByDigestFunction, 0)
 			}
-			implementation = blobstore.NewCloudBlobAccess(bucket, backend.Cloud.KeyPrefix, storageType)
 		case *pb.CloudBlobAccessConfiguration_S3:
 			backendType = "s3"
 			cfg := aws.Config{
@@ -133,16 +156,34 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 			if backendConfig.S3.AccessKeyId != "" {
 				cfg.Credentials = credentials.NewStaticCredentials(backendConfig.S3.AccessKeyId, backendConfig.S3.SecretAccessKey, "")
 			}
+			partSizeBytes := int64(s3manager.DefaultUploadPartSize)
+			if backendConfig.S3.MultipartUploadPartSizeBytes != 0 {
+				partSizeBytes = backendConfig.S3.MultipartUploadPartSizeBytes
+				if partSizeBytes < s3manager.MinUploadPartSize {
+					return nil, status.Errorf(codes.InvalidArgument, "Multipart upload part size must be at least %d bytes", s3manager.MinUploadPartSize)
+				}
+			}
 			session := session.New(&cfg)
 			ctx := context.Background()
 			bucket, err := s3blob.OpenBucket(ctx, session, backendConfig.S3.Bucket, nil)
 			if err != nil {
 				return nil, err
 			}
-			implementation = blobstore.NewCloudBlobAccess(bucket, backend.Cloud.KeyPrefix, storageType)
+			implementation = blobstore.NewCloudBlobAccess(bucket, backend.Cloud.KeyPrefix, storageType, backend.Cloud.PartitionByDigestFunction, int(partSizeBytes))
+			if backendConfig.S3.MaximumConcurrentMultipartUploads > 0 || backendConfig.S3.MaximumConcurrentMultipartUploadParts > 0 {
+				implementation = blobstore.NewMultipartUploadLimitingBlobAccess(
+					implementation,
+					partSizeBytes,
+					s3manager.DefaultUploadConcurrency,
+					backendConfig.S3.MaximumConcurrentMultipartUploads,
+					backendConfig.S3.MaximumConcurrentMultipartUploadParts)
+			}
 		default:
 			return nil, errors.New("Cloud configuration did not contain a backend")
 		}
+	case *pb.BlobAccessConfiguration_BlackHole:
+		backendType = "black_hole"
+		implementation = blobstore.NewBlackHoleBlobAccess()
 	case *pb.BlobAccessConfiguration_Error:
 		backendType = "failing"
 		implementation = blobstore.NewErrorBlobAccess(status.ErrorProto(backend.Error))
@@ -157,14 +198,16 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 			implementation = blobstore.NewActionCacheBlobAccess(client, maximumMessageSizeBytes)
 		case blobstore.CASStorageType:
 			implementation = blobstore.NewContentAddressableStorageBlobAccess(client, uuid.NewRandom, 65536)
+		default:
+			return nil, status.Error(codes.InvalidArgument, "gRPC backend does not support this storage type")
 		}
 	case *pb.BlobAccessConfiguration_ReadCaching:
 		backendType = "read_caching"
-		slow, err := createBlobAccess(backend.ReadCaching.Slow, storageType, storageTypeName, maximumMessageSizeBytes)
+		slow, err := createBlobAccess(backend.ReadCaching.Slow, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
 		if err != nil {
 			return nil, err
 		}
-		fast, err := createBlobAccess(backend.ReadCaching.Fast, storageType, storageTypeName, maximumMessageSizeBytes)
+		fast, err := createBlobAccess(backend.ReadCaching.Fast, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
 		if err != nil {
 			return nil, err
 		}
@@ -184,6 +227,10 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 				return nil, err
 			}
 		}
+		ttlPolicy, err := createTTLPolicy(backend.Redis.KeyTtlRules, keyTTL, storageType, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
 
 		var replicationTimeout time.Duration
 		if backend.Redis.ReplicationTimeout != nil {
@@ -193,6 +240,15 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 			}
 		}
 
+		// Redis can only store values up to 512 MiB in size.
+		maximumValueSizeBytes := 512 * 1024 * 1024
+		if backend.Redis.MaximumValueSizeBytes != 0 {
+			if backend.Redis.MaximumValueSizeBytes > int64(maximumValueSizeBytes) {
+				return nil, status.Errorf(codes.InvalidArgument, "Maximum value size cannot exceed %d bytes", maximumValueSizeBytes)
+			}
+			maximumValueSizeBytes = int(backend.Redis.MaximumValueSizeBytes)
+		}
+
 		switch mode := backend.Redis.Mode.(type) {
 		case *pb.RedisBlobAccessConfiguration_Clustered:
 			// Gather retry configuration (min/max delay and overall retry attempts)
@@ -231,9 +287,10 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 						WriteTimeout:    100 * time.Second,
 					}),
 				storageType,
-				keyTTL,
+				ttlPolicy,
 				backend.Redis.ReplicationCount,
-				replicationTimeout)
+				replicationTimeout,
+				maximumValueSizeBytes)
 		case *pb.RedisBlobAccessConfiguration_Single:
 			implementation = blobstore.NewRedisBlobAccess(
 				redis.NewClient(
@@ -243,15 +300,111 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 						TLSConfig: tlsConfig,
 					}),
 				storageType,
-				keyTTL,
+				ttlPolicy,
 				backend.Redis.ReplicationCount,
-				replicationTimeout)
+				replicationTimeout,
+				maximumValueSizeBytes)
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, "Redis configuration must either be clustered or single server")
 		}
 	case *pb.BlobAccessConfiguration_Remote:
 		backendType = "remote"
-		implementation = blobstore.NewRemoteBlobAccess(backend.Remote.Address, storageTypeName, storageType)
+		var getTimeout time.Duration
+		if backend.Remote.GetTimeout != nil {
+			var err error
+			getTimeout, err = ptypes.Duration(backend.Remote.GetTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var putTimeout time.Duration
+		if backend.Remote.PutTimeout != nil {
+			var err error
+			putTimeout, err = ptypes.Duration(backend.Remote.PutTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var findMissingTimeout time.Duration
+		if backend.Remote.FindMissingTimeout != nil {
+			var err error
+			findMissingTimeout, err = ptypes.Duration(backend.Remote.FindMissingTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var maximumRetryDelay time.Duration
+		if backend.Remote.MaximumRetryDelay != nil {
+			var err error
+			maximumRetryDelay, err = ptypes.Duration(backend.Remote.MaximumRetryDelay)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		findMissingConcurrency := 10
+		if backend.Remote.FindMissingConcurrency > 0 {
+			findMissingConcurrency = int(backend.Remote.FindMissingConcurrency)
+		}
+
+		roundTripper, err := util.NewHTTPTransportFromTLSClientConfiguration(backend.Remote.Tls)
+		if err != nil {
+			return nil, err
+		}
+		if backend.Remote.BearerTokenFile != "" {
+			roundTripper = blobstore.NewBearerTokenRoundTripper(
+				roundTripper,
+				blobstore.NewBearerTokenSourceFromFile(backend.Remote.BearerTokenFile))
+		}
+		httpClient := &http.Client{Transport: roundTripper}
+
+		var contentEncoding blobstore.ContentEncoding
+		switch backend.Remote.ContentEncoding {
+		case pb.RemoteBlobAccessConfiguration_IDENTITY:
+			contentEncoding = blobstore.ContentEncodingIdentity
+		case pb.RemoteBlobAccessConfiguration_GZIP:
+			contentEncoding = blobstore.ContentEncodingGzip
+		case pb.RemoteBlobAccessConfiguration_ZSTD:
+			contentEncoding = blobstore.ContentEncodingZstd
+		default:
+			return nil, status.Error(codes.InvalidArgument, "Unknown content encoding")
+		}
+
+		var skipExistingMode blobstore.SkipExistingMode
+		switch backend.Remote.SkipExisting {
+		case pb.RemoteBlobAccessConfiguration_DISABLED:
+			skipExistingMode = blobstore.SkipExistingDisabled
+		case pb.RemoteBlobAccessConfiguration_IF_NONE_MATCH:
+			skipExistingMode = blobstore.SkipExistingIfNoneMatch
+		case pb.RemoteBlobAccessConfiguration_HEAD:
+			skipExistingMode = blobstore.SkipExistingHead
+		default:
+			return nil, status.Error(codes.InvalidArgument, "Unknown skip existing mode")
+		}
+		if skipExistingMode != blobstore.SkipExistingDisabled && storageType != blobstore.CASStorageType {
+			return nil, status.Error(codes.InvalidArgument, "Skipping existing objects is only supported for the Content Addressable Storage")
+		}
+
+		implementation = blobstore.NewRemoteBlobAccess(
+			httpClient,
+			backend.Remote.Address,
+			storageTypeName,
+			storageType,
+			clock.SystemClock,
+			blobstore.RemoteBlobAccessOptions{
+				GetTimeout:             getTimeout,
+				PutTimeout:             putTimeout,
+				FindMissingTimeout:     findMissingTimeout,
+				MaximumRetryDelay:      maximumRetryDelay,
+				FindMissingConcurrency: findMissingConcurrency,
+				ContentEncoding:        contentEncoding,
+				IncludeInstanceName:    backend.Remote.IncludeInstanceName,
+				GetProbeFallback:       backend.Remote.HeadFallbackToGet,
+				SkipExistingMode:       skipExistingMode,
+			})
 	case *pb.BlobAccessConfiguration_Sharding:
 		backendType = "sharding"
 		backends := make([]blobstore.BlobAccess, 0, len(backend.Sharding.Shards))
@@ -263,7 +416,7 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 				backends = append(backends, nil)
 			} else {
 				// Undrained backend.
-				backend, err := createBlobAccess(shard.Backend, storageType, storageTypeName, maximumMessageSizeBytes)
+				backend, err := createBlobAccess(shard.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
 				if err != nil {
 					return nil, err
 				}
@@ -279,45 +432,467 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 		if !hasUndrainedBackend {
 			return nil, status.Errorf(codes.InvalidArgument, "Cannot create sharding blob access without any undrained backends")
 		}
+		var shardPermuter sharding.ShardPermuter
+		switch backend.Sharding.Algorithm {
+		case pb.ShardingBlobAccessConfiguration_WEIGHTED:
+			shardPermuter = sharding.NewWeightedShardPermuter(weights)
+		case pb.ShardingBlobAccessConfiguration_RENDEZVOUS:
+			keys := make([]string, 0, len(backend.Sharding.Shards))
+			seenKeys := map[string]struct{}{}
+			for _, shard := range backend.Sharding.Shards {
+				if shard.Key == "" {
+					return nil, status.Errorf(codes.InvalidArgument, "Shards must have keys when using rendezvous hashing")
+				}
+				if _, ok := seenKeys[shard.Key]; ok {
+					return nil, status.Errorf(codes.InvalidArgument, "Multiple shards have key %#v", shard.Key)
+				}
+				seenKeys[shard.Key] = struct{}{}
+				keys = append(keys, shard.Key)
+			}
+			shardPermuter = sharding.NewRendezvousShardPermuter(keys, weights)
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown sharding algorithm")
+		}
 		implementation = sharding.NewShardingBlobAccess(
 			backends,
-			sharding.NewWeightedShardPermuter(weights),
+			shardPermuter,
 			storageType,
 			backend.Sharding.HashInitialization)
 	case *pb.BlobAccessConfiguration_SizeDistinguishing:
 		backendType = "size_distinguishing"
-		small, err := createBlobAccess(backend.SizeDistinguishing.Small, storageType, storageTypeName, maximumMessageSizeBytes)
+		small, err := createBlobAccess(backend.SizeDistinguishing.Small, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
 		if err != nil {
 			return nil, err
 		}
-		large, err := createBlobAccess(backend.SizeDistinguishing.Large, storageType, storageTypeName, maximumMessageSizeBytes)
+		large, err := createBlobAccess(backend.SizeDistinguishing.Large, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
 		if err != nil {
 			return nil, err
 		}
 		implementation = blobstore.NewSizeDistinguishingBlobAccess(small, large, backend.SizeDistinguishing.CutoffSizeBytes)
 	case *pb.BlobAccessConfiguration_Mirrored:
 		backendType = "mirrored"
-		backendA, err := createBlobAccess(backend.Mirrored.BackendA, storageType, storageTypeName, maximumMessageSizeBytes)
+		backendA, err := createBlobAccess(backend.Mirrored.BackendA, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
 		if err != nil {
 			return nil, err
 		}
-		backendB, err := createBlobAccess(backend.Mirrored.BackendB, storageType, storageTypeName, maximumMessageSizeBytes)
+		backendB, err := createBlobAccess(backend.Mirrored.BackendB, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
 		if err != nil {
 			return nil, err
 		}
-		implementation = blobstore.NewMirroredBlobAccess(backendA, backendB)
+		asynchronousReadRepairTimeout := time.Minute
+		if backend.Mirrored.AsynchronousReadRepairTimeout != nil {
+			asynchronousReadRepairTimeout, err = ptypes.Duration(backend.Mirrored.AsynchronousReadRepairTimeout)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Failed to parse asynchronous read repair timeout")
+			}
+		}
+		implementation = blobstore.NewMirroredBlobAccess(
+			backendA,
+			backendB,
+			backend.Mirrored.BackendAReadWeight,
+			backend.Mirrored.BackendBReadWeight,
+			maximumMessageSizeBytes,
+			backend.Mirrored.AsynchronousReadRepair,
+			asynchronousReadRepairTimeout)
+	case *pb.BlobAccessConfiguration_Chunking:
+		backendType = "chunking"
+		if storageType != blobstore.CASStorageType {
+			return nil, status.Error(codes.InvalidArgument, "Chunking can only be used for the Content Addressable Storage")
+		}
+		config := backend.Chunking
+		if config.MinimumChunkSizeBytes <= 0 || config.AverageChunkSizeBytes < config.MinimumChunkSizeBytes || config.MaximumChunkSizeBytes < config.AverageChunkSizeBytes {
+			return nil, status.Error(codes.InvalidArgument, "Chunk sizes must be positive and satisfy minimum <= average <= maximum")
+		}
+		chunks, err := createBlobAccess(config.Chunks, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		manifests, err := createBlobAccess(config.Manifests, blobstore.NewChunkManifestStorageType(maximumMessageSizeBytes), storageTypeName+"_manifests", maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = chunking.NewChunkingBlobAccess(
+			chunks,
+			manifests,
+			int(config.MinimumChunkSizeBytes),
+			int(config.AverageChunkSizeBytes),
+			int(config.MaximumChunkSizeBytes),
+			maximumMessageSizeBytes)
+	case *pb.BlobAccessConfiguration_HotBlobCaching:
+		backendType = "hot_blob_caching"
+		if backend.HotBlobCaching.MaximumSizeBytes <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Maximum size must be positive")
+		}
+		if backend.HotBlobCaching.MaximumEntrySizeBytes < 0 || backend.HotBlobCaching.MaximumEntrySizeBytes > backend.HotBlobCaching.MaximumSizeBytes {
+			return nil, status.Error(codes.InvalidArgument, "Maximum entry size must be non-negative and may not exceed the maximum size")
+		}
+		base, err := createBlobAccess(backend.HotBlobCaching.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewHotBlobCachingBlobAccess(
+			base,
+			storageType,
+			backend.HotBlobCaching.MaximumSizeBytes,
+			backend.HotBlobCaching.MaximumEntrySizeBytes)
+	case *pb.BlobAccessConfiguration_WriteBehind:
+		backendType = "write_behind"
+		config := backend.WriteBehind
+		if config.Concurrency <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Write-behind concurrency must be positive")
+		}
+		if config.MaximumBlobSizeBytes <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Write-behind maximum blob size must be positive")
+		}
+		if config.FlushSizeBytes <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Write-behind flush size must be positive")
+		}
+		if config.MaximumPendingSizeBytes <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Write-behind maximum pending size must be positive")
+		}
+		flushDelay, err := ptypes.Duration(config.FlushDelay)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse flush delay")
+		}
+		base, err := createBlobAccess(config.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewWriteBehindBlobAccess(
+			base,
+			storageType,
+			clock.SystemClock,
+			config.MaximumBlobSizeBytes,
+			config.FlushSizeBytes,
+			config.MaximumPendingSizeBytes,
+			flushDelay,
+			int(config.Concurrency),
+			config.Durable)
+	case *pb.BlobAccessConfiguration_AuditLogging:
+		backendType = "audit_logging"
+		base, err := createBlobAccess(backend.AuditLogging.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		sink, err := audit.NewFileSink(backend.AuditLogging.Path)
+		if err != nil {
+			return nil, err
+		}
+		implementation = audit.NewAuditLoggingBlobAccess(base, sink, clock.SystemClock, backend.AuditLogging.Strict)
+	case *pb.BlobAccessConfiguration_SizeStaging:
+		backendType = "size_staging"
+		base, err := createBlobAccess(backend.SizeStaging.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		stagingArea, err := createStagingArea(backend.SizeStaging)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewSizeStagingBlobAccess(base, storageType, stagingArea, backend.SizeStaging.MaximumStagingSizeBytes)
+	case *pb.BlobAccessConfiguration_WarmStandby:
+		backendType = "warm_standby"
+		config := backend.WarmStandby
+		if config.Concurrency <= 0 || config.MaximumAttempts <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Warm standby concurrency and maximum attempts must be positive")
+		}
+		retryDelay, err := ptypes.Duration(config.RetryDelay)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse retry delay")
+		}
+		primary, err := createBlobAccess(config.Primary, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		standby, err := createBlobAccess(config.Standby, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewWarmStandbyBlobAccess(
+			primary,
+			standby,
+			clock.SystemClock,
+			int(config.QueueLength),
+			int(config.Concurrency),
+			int(config.MaximumAttempts),
+			retryDelay,
+			config.BlockOnOverflow,
+			config.Name)
+	case *pb.BlobAccessConfiguration_ConcurrencyLimiting:
+		backendType = "concurrency_limiting"
+		if backend.ConcurrencyLimiting.MaximumConcurrency <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Maximum concurrency must be positive")
+		}
+		base, err := createBlobAccess(backend.ConcurrencyLimiting.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewConcurrencyLimitingBlobAccess(base, clock.SystemClock, int(backend.ConcurrencyLimiting.MaximumConcurrency))
+	case *pb.BlobAccessConfiguration_HitRatio:
+		backendType = "hit_ratio"
+		base, err := createBlobAccess(backend.HitRatio.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewHitRatioBlobAccess(base, storageTypeName, int(backend.HitRatio.MaximumInstanceNames))
+	case *pb.BlobAccessConfiguration_ShadowRead:
+		backendType = "shadow_read"
+		if storageType != blobstore.CASStorageType {
+			return nil, status.Error(codes.InvalidArgument, "Shadow reads are only supported for the Content Addressable Storage")
+		}
+		if backend.ShadowRead.MaximumConcurrentComparisons == 0 {
+			return nil, status.Error(codes.InvalidArgument, "Maximum number of concurrent comparisons must be positive")
+		}
+		if samplingRate := backend.ShadowRead.SamplingRate; samplingRate < 0 || samplingRate > 1 {
+			return nil, status.Errorf(codes.InvalidArgument, "Sampling rate must be between 0.0 and 1.0, while %f was provided", samplingRate)
+		}
+		primary, err := createBlobAccess(backend.ShadowRead.Primary, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		candidate, err := createBlobAccess(backend.ShadowRead.Candidate, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewShadowReadBlobAccess(primary, candidate, backend.ShadowRead.SamplingRate, backend.ShadowRead.CompareContents, maximumMessageSizeBytes, int(backend.ShadowRead.MaximumConcurrentComparisons))
+	case *pb.BlobAccessConfiguration_ContentTypePolicy:
+		backendType = "content_type_policy"
+		base, err := createBlobAccess(backend.ContentTypePolicy.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		policies := map[string]blobstore.ContentTypePolicy{}
+		for instance, policyConfiguration := range backend.ContentTypePolicy.Policies {
+			policy := blobstore.ContentTypePolicy{
+				Allowed: map[string]bool{},
+				Denied:  map[string]bool{},
+			}
+			for _, contentType := range policyConfiguration.Allowed {
+				policy.Allowed[contentType] = true
+			}
+			for _, contentType := range policyConfiguration.Denied {
+				policy.Denied[contentType] = true
+			}
+			policies[instanceNameNormalizer(instance)] = policy
+		}
+		implementation = blobstore.NewContentTypePolicyBlobAccess(base, storageType, policies)
+	case *pb.BlobAccessConfiguration_Retrying:
+		backendType = "retrying"
+		if backend.Retrying.MaximumAttempts <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Maximum number of attempts must be positive")
+		}
+		initialDelay, err := ptypes.Duration(backend.Retrying.InitialDelay)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse initial delay")
+		}
+		maximumDelay, err := ptypes.Duration(backend.Retrying.MaximumDelay)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse maximum delay")
+		}
+		base, err := createBlobAccess(backend.Retrying.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewRetryingBlobAccess(
+			base,
+			clock.SystemClock,
+			int(backend.Retrying.MaximumAttempts),
+			blobstore.NewExponentialBackoff(initialDelay, maximumDelay, backend.Retrying.Multiplier),
+			maximumMessageSizeBytes)
+	case *pb.BlobAccessConfiguration_ExistenceCaching:
+		backendType = "existence_caching"
+		if backend.ExistenceCaching.CacheSize <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Existence cache size must be positive")
+		}
+		ttl, err := ptypes.Duration(backend.ExistenceCaching.Ttl)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse TTL")
+		}
+		if ttl <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Existence cache TTL must be positive")
+		}
+		base, err := createBlobAccess(backend.ExistenceCaching.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewExistenceCachingBlobAccess(
+			base,
+			storageType,
+			clock.SystemClock,
+			int(backend.ExistenceCaching.CacheSize),
+			ttl)
+	case *pb.BlobAccessConfiguration_Demultiplexing:
+		backendType = "demultiplexing"
+		backends := map[string]blobstore.BlobAccess{}
+		for instance, instanceConfiguration := range backend.Demultiplexing.Instances {
+			base, err := createBlobAccess(instanceConfiguration, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+			if err != nil {
+				return nil, util.StatusWrapf(err, "Instance %#v", instance)
+			}
+			backends[instanceNameNormalizer(instance)] = base
+		}
+		implementation = blobstore.NewDemultiplexingBlobAccess(func(instanceName string) (blobstore.BlobAccess, error) {
+			if base, ok := backends[instanceName]; ok {
+				return base, nil
+			}
+			return nil, status.Error(codes.InvalidArgument, "Unknown instance name")
+		})
+	case *pb.BlobAccessConfiguration_ActionResultExpiring:
+		backendType = "action_result_expiring"
+		if storageType != blobstore.ACStorageType {
+			return nil, status.Error(codes.InvalidArgument, "Action result expiring backend only supports the Action Cache")
+		}
+		maximumAge, err := ptypes.Duration(backend.ActionResultExpiring.MaximumAge)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse maximum age")
+		}
+		base, err := createBlobAccess(backend.ActionResultExpiring.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewActionResultExpiringBlobAccess(
+			base,
+			clock.SystemClock,
+			maximumAge,
+			maximumMessageSizeBytes)
+	case *pb.BlobAccessConfiguration_PutValidating:
+		backendType = "put_validating"
+		if storageType != blobstore.CASStorageType {
+			return nil, status.Error(codes.InvalidArgument, "Put validating backend only supports the Content Addressable Storage")
+		}
+		base, err := createBlobAccess(backend.PutValidating.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewPutValidatingBlobAccess(base)
+	case *pb.BlobAccessConfiguration_CircuitBreaking:
+		backendType = "circuit_breaking"
+		if backend.CircuitBreaking.FailureThreshold <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Failure threshold must be positive")
+		}
+		resetTimeout, err := ptypes.Duration(backend.CircuitBreaking.ResetTimeout)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse reset timeout")
+		}
+		base, err := createBlobAccess(backend.CircuitBreaking.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewCircuitBreakingBlobAccess(
+			base,
+			clock.SystemClock,
+			int(backend.CircuitBreaking.FailureThreshold),
+			resetTimeout,
+			backend.CircuitBreaking.Name)
+	case *pb.BlobAccessConfiguration_FaultInjecting:
+		backendType = "fault_injecting"
+		config := backend.FaultInjecting
+		if config.ErrorProbability < 0 || config.ErrorProbability > 1 {
+			return nil, status.Error(codes.InvalidArgument, "Error probability must be in range [0, 1]")
+		}
+		var injectedErr error
+		if config.ErrorProbability > 0 {
+			injectedErr = status.ErrorProto(config.Error)
+			if injectedErr == nil {
+				return nil, status.Error(codes.InvalidArgument, "An error with a non-zero code must be provided if the error probability is non-zero")
+			}
+		}
+		var minimumLatency, maximumLatency time.Duration
+		if config.MinimumLatency != nil {
+			var err error
+			minimumLatency, err = ptypes.Duration(config.MinimumLatency)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Failed to parse minimum latency")
+			}
+		}
+		if config.MaximumLatency != nil {
+			var err error
+			maximumLatency, err = ptypes.Duration(config.MaximumLatency)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Failed to parse maximum latency")
+			}
+		}
+		if maximumLatency < minimumLatency {
+			return nil, status.Error(codes.InvalidArgument, "Maximum latency must be at least the minimum latency")
+		}
+		seed := config.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		base, err := createBlobAccess(config.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewFaultInjectingBlobAccess(
+			base,
+			clock.SystemClock,
+			blobstore.FaultInjectionConfiguration{
+				AffectGet:         config.AffectGet,
+				AffectPut:         config.AffectPut,
+				AffectFindMissing: config.AffectFindMissing,
+				ErrorProbability:  config.ErrorProbability,
+				Error:             injectedErr,
+				MinimumLatency:    minimumLatency,
+				MaximumLatency:    maximumLatency,
+				Seed:              seed,
+			})
+	case *pb.BlobAccessConfiguration_Filesystem:
+		backendType = "filesystem"
+		if storageType != blobstore.CASStorageType {
+			return nil, status.Error(codes.InvalidArgument, "Filesystem backend only supports the Content Addressable Storage")
+		}
+		shardingDepth := int(backend.Filesystem.ShardingDepth)
+		if shardingDepth == 0 {
+			shardingDepth = 1
+		}
+		shardingWidth := int(backend.Filesystem.ShardingWidth)
+		if shardingWidth == 0 {
+			shardingWidth = 2
+		}
+		if shardingDepth*shardingWidth >= 32 {
+			return nil, status.Error(codes.InvalidArgument, "Filesystem sharding depth multiplied by sharding width must be smaller than 32")
+		}
+		directory, err := filesystem.NewLocalDirectory(backend.Filesystem.Path)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to open directory %#v", backend.Filesystem.Path)
+		}
+		implementation = blobstore_filesystem.NewFilesystemBlobAccess(directory, shardingDepth, shardingWidth)
+	case *pb.BlobAccessConfiguration_Tee:
+		backendType = "tee"
+		primary, err := createBlobAccess(backend.Tee.Primary, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		secondary, err := createBlobAccess(backend.Tee.Secondary, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewTeeBlobAccess(primary, secondary)
+	case *pb.BlobAccessConfiguration_PutCoalescing:
+		backendType = "put_coalescing"
+		if storageType != blobstore.CASStorageType {
+			return nil, status.Error(codes.InvalidArgument, "Put coalescing is only supported for the Content Addressable Storage")
+		}
+		base, err := createBlobAccess(backend.PutCoalescing.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewPutCoalescingBlobAccess(base, storageType)
+	case *pb.BlobAccessConfiguration_SizeLimiting:
+		backendType = "size_limiting"
+		if backend.SizeLimiting.MaximumSizeBytes <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Maximum size must be positive")
+		}
+		base, err := createBlobAccess(backend.SizeLimiting.Backend, storageType, storageTypeName, maximumMessageSizeBytes, instanceNameNormalizer)
+		if err != nil {
+			return nil, err
+		}
+		implementation = blobstore.NewSizeLimitingBlobAccess(base, backend.SizeLimiting.MaximumSizeBytes)
 	case *pb.BlobAccessConfiguration_Local:
 		backendType = "local"
 
 		var digestLocationMap local.DigestLocationMap
 		switch storageType {
-		case blobstore.CASStorageType:
-			// Let the CAS use a single store for all
-			// objects, regardless of the instance name that
-			// was used to store them. There is no need to
-			// distinguish, due to objects being content
-			// addressed.
-			digestLocationMap = createDigestLocationMap(backend.Local)
 		case blobstore.ACStorageType:
 			// Let the AC use a single store per instance name.
 			maps := map[string]local.DigestLocationMap{}
@@ -325,6 +900,13 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 				maps[instance] = createDigestLocationMap(backend.Local)
 			}
 			digestLocationMap = local.NewPerInstanceDigestLocationMap(maps)
+		default:
+			// Let the CAS and chunk manifests use a single
+			// store for all objects, regardless of the
+			// instance name that was used to store them.
+			// There is no need to distinguish, due to
+			// objects being content addressed.
+			digestLocationMap = createDigestLocationMap(backend.Local)
 		}
 
 		implementation = local.NewLocalBlobAccess(
@@ -339,7 +921,14 @@ func createBlobAccess(configuration *pb.BlobAccessConfiguration, storageType blo
 	default:
 		return nil, errors.New("Configuration did not contain a backend")
 	}
-	return blobstore.NewMetricsBlobAccess(implementation, clock.SystemClock, fmt.Sprintf("%s_%s", storageTypeName, backendType)), nil
+	name := fmt.Sprintf("%s_%s", storageTypeName, backendType)
+	if storageStats, ok := implementation.(blobstore.StorageStats); ok {
+		blobstore.RegisterStorageStats(name, storageStats)
+	}
+	if readinessChecker, ok := implementation.(blobstore.ReadinessChecker); ok {
+		blobstore.RegisterReadinessChecker(name, readinessChecker)
+	}
+	return blobstore.NewMetricsBlobAccess(implementation, clock.SystemClock, name), nil
 }
 
 func createDigestLocationMap(config *pb.LocalBlobAccessConfiguration) local.DigestLocationMap {
@@ -351,17 +940,90 @@ func createDigestLocationMap(config *pb.LocalBlobAccessConfiguration) local.Dige
 		int(config.DigestLocationMapMaximumPutAttempts))
 }
 
+func createTTLPolicy(configuration []*pb.SizeBasedTTLRule, defaultTTL time.Duration, storageType blobstore.StorageType, instanceNameNormalizer util.InstanceNameNormalizer) (blobstore.TTLPolicy, error) {
+	if len(configuration) == 0 {
+		return blobstore.NewFixedTTLPolicy(defaultTTL), nil
+	}
+	rules := make([]blobstore.SizeBasedTTLRule, 0, len(configuration))
+	for i, ruleConfiguration := range configuration {
+		// For the Action Cache, the size stored in the digest is
+		// that of the Action, as opposed to the ActionResult.
+		if ruleConfiguration.MaximumSizeBytes != 0 && storageType != blobstore.CASStorageType {
+			return nil, status.Errorf(codes.InvalidArgument, "Rule %d: Size-bounded rules are only supported for the Content Addressable Storage", i)
+		}
+		var ttl time.Duration
+		if ruleConfiguration.Ttl != nil {
+			var err error
+			ttl, err = ptypes.Duration(ruleConfiguration.Ttl)
+			if err != nil {
+				return nil, util.StatusWrapf(err, "Invalid TTL for rule %d", i)
+			}
+		}
+		instanceNames := map[string]struct{}{}
+		for _, instanceName := range ruleConfiguration.InstanceNames {
+			instanceNames[instanceNameNormalizer(instanceName)] = struct{}{}
+		}
+		rules = append(rules, blobstore.SizeBasedTTLRule{
+			MaximumSizeBytes: ruleConfiguration.MaximumSizeBytes,
+			InstanceNames:    instanceNames,
+			TTL:              ttl,
+		})
+	}
+	return blobstore.NewSizeBasedTTLPolicy(rules, defaultTTL), nil
+}
+
+func createStagingArea(config *pb.SizeStagingBlobAccessConfiguration) (blobstore.StagingArea, error) {
+	switch stagingArea := config.StagingArea.GetBackend().(type) {
+	case nil:
+		return blobstore.NewInMemoryStagingArea(config.MaximumStagingSizeBytes), nil
+	case *pb.StagingAreaConfiguration_InMemoryMaximumSizeBytes:
+		return blobstore.NewInMemoryStagingArea(stagingArea.InMemoryMaximumSizeBytes), nil
+	case *pb.StagingAreaConfiguration_DirectoryPath:
+		maximumAge, err := ptypes.Duration(config.StagingArea.DirectoryMaximumAge)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse directory maximum age")
+		}
+		if maximumAge <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "Directory maximum age must be positive")
+		}
+		directory, err := filesystem.NewLocalDirectory(stagingArea.DirectoryPath)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to open staging directory %#v", stagingArea.DirectoryPath)
+		}
+		return blobstore.NewDirectoryStagingArea(directory, clock.SystemClock, maximumAge)
+	case *pb.StagingAreaConfiguration_Bucket:
+		bucket, err := blob.OpenBucket(context.Background(), stagingArea.Bucket.Url)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to open staging bucket %#v", stagingArea.Bucket.Url)
+		}
+		return blobstore.NewBucketStagingArea(bucket, stagingArea.Bucket.KeyPrefix), nil
+	default:
+		return nil, status.Error(codes.InvalidArgument, "Unknown staging area type")
+	}
+}
+
 func createCircularBlobAccess(config *pb.CircularBlobAccessConfiguration, storageType blobstore.StorageType, storageTypeName string) (blobstore.BlobAccess, error) {
+	if config.MaximumPinnedSizeBytes < 0 || uint64(config.MaximumPinnedSizeBytes) > config.DataFileSizeBytes/4 {
+		return nil, status.Errorf(codes.InvalidArgument, "Maximum pinned size must be between 0 and a quarter of the data file size")
+	}
+	if (config.CompressData || config.MaximumPutAttempts > 1) && config.MaximumInMemoryBlobSizeBytes <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Compressing data and retrying writes require a positive maximum in-memory blob size")
+	}
+	if config.DataFileSegments > 1 {
+		if config.DataFileMmap {
+			return nil, status.Error(codes.InvalidArgument, "Memory mapping the data file cannot be combined with multiple data file segments")
+		}
+		if config.DataFileSizeBytes%uint64(config.DataFileSegments) != 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Data file size must be a multiple of the number of data file segments")
+		}
+	}
+
 	// Open input files.
 	circularDirectory, err := filesystem.NewLocalDirectory(config.Directory)
 	if err != nil {
 		return nil, err
 	}
 	defer circularDirectory.Close()
-	dataFile, err := circularDirectory.OpenReadWrite("data", filesystem.CreateReuse(0644))
-	if err != nil {
-		return nil, err
-	}
 	stateFile, err := circularDirectory.OpenReadWrite("state", filesystem.CreateReuse(0644))
 	if err != nil {
 		return nil, err
@@ -369,16 +1031,6 @@ func createCircularBlobAccess(config *pb.CircularBlobAccessConfiguration, storag
 
 	var offsetStore circular.OffsetStore
 	switch storageType {
-	case blobstore.CASStorageType:
-		// Open a single offset file for all entries. This is
-		// sufficient for the Content Addressable Storage.
-		offsetFile, err := circularDirectory.OpenReadWrite("offset", filesystem.CreateReuse(0644))
-		if err != nil {
-			return nil, err
-		}
-		offsetStore = circular.NewCachingOffsetStore(
-			circular.NewFileOffsetStore(offsetFile, config.OffsetFileSizeBytes),
-			uint(config.OffsetCacheSize))
 	case blobstore.ACStorageType:
 		// Open an offset file for every instance. This is
 		// required for the Action Cache.
@@ -399,18 +1051,137 @@ func createCircularBlobAccess(config *pb.CircularBlobAccessConfiguration, storag
 			}
 			return offsetStore, nil
 		})
+	default:
+		// Open a single offset file for all entries. This is
+		// sufficient for the Content Addressable Storage and
+		// chunk manifests.
+		offsetFile, err := circularDirectory.OpenReadWrite("offset", filesystem.CreateReuse(0644))
+		if err != nil {
+			return nil, err
+		}
+		offsetStore = circular.NewCachingOffsetStore(
+			circular.NewFileOffsetStore(offsetFile, config.OffsetFileSizeBytes),
+			uint(config.OffsetCacheSize))
 	}
 	stateStore, err := circular.NewFileStateStore(stateFile, config.DataFileSizeBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	return circular.NewCircularBlobAccess(
+	var dataStore circular.DataStore
+	if config.DataFileSegments > 1 {
+		segmentSizeBytes := config.DataFileSizeBytes / uint64(config.DataFileSegments)
+		segments := make([]circular.ReadWriterAt, 0, config.DataFileSegments)
+		for i := uint32(0); i < config.DataFileSegments; i++ {
+			segment, err := circularDirectory.OpenReadWrite(fmt.Sprintf("data.%d", i), filesystem.CreateReuse(0644))
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment)
+		}
+		dataStore = circular.NewFileDataStore(
+			circular.NewSegmentedReadWriterAt(segments, int64(segmentSizeBytes)),
+			config.DataFileSizeBytes)
+	} else {
+		dataFile, err := circularDirectory.OpenReadWrite("data", filesystem.CreateReuse(0644))
+		if err != nil {
+			return nil, err
+		}
+		if config.DataFileMmap {
+			file, ok := dataFile.(interface{ Fd() uintptr })
+			if !ok {
+				return nil, errors.New("Data file does not support memory mapping")
+			}
+			var syncInterval time.Duration
+			if config.DataFileMmapSyncInterval != nil {
+				syncInterval, err = ptypes.Duration(config.DataFileMmapSyncInterval)
+				if err != nil {
+					return nil, util.StatusWrap(err, "Failed to parse data file memory map synchronization interval")
+				}
+				if syncInterval <= 0 {
+					return nil, status.Error(codes.InvalidArgument, "Data file memory map synchronization interval must be positive")
+				}
+			}
+			mmapDataStore, err := circular.NewMmapDataStore(int(file.Fd()), config.DataFileSizeBytes, syncInterval == 0)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Failed to memory map data file")
+			}
+			if syncInterval > 0 {
+				go circular.RunMmapDataStoreSyncPeriodically(context.Background(), mmapDataStore, clock.SystemClock, syncInterval)
+			}
+			dataStore = mmapDataStore
+		} else {
+			dataStore = circular.NewFileDataStore(dataFile, config.DataFileSizeBytes)
+		}
+	}
+
+	blobAccess := circular.NewCircularBlobAccess(
 		offsetStore,
-		circular.NewFileDataStore(dataFile, config.DataFileSizeBytes),
+		dataStore,
 		circular.NewPositiveSizedBlobStateStore(
 			circular.NewBulkAllocatingStateStore(
-				stateStore,
+				circular.NewMetricsStateStore(stateStore, storageTypeName, config.Directory),
 				config.DataAllocationChunkSizeBytes)),
-		storageType), nil
+		storageType,
+		config.DataFileSizeBytes,
+		config.MaximumPinnedSizeBytes,
+		config.MaximumInMemoryBlobSizeBytes,
+		config.CompressData,
+		int(config.MaximumPutAttempts))
+
+	if len(config.PinnedBlobs) > 0 {
+		if storageType != blobstore.CASStorageType {
+			return nil, status.Error(codes.InvalidArgument, "Pinning blobs is only supported for the Content Addressable Storage")
+		}
+		for _, pinnedBlob := range config.PinnedBlobs {
+			digest, err := util.NewDigest("", pinnedBlob)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Invalid pinned blob digest")
+			}
+			if err := blobAccess.Pin(digest); err != nil {
+				return nil, util.StatusWrapf(err, "Failed to pin blob %s", digest)
+			}
+		}
+	}
+
+	// Permit verifying and repairing the contents of the Content
+	// Addressable Storage on demand.
+	if storageType == blobstore.CASStorageType {
+		circular.RegisterFsck(config.Directory, blobAccess)
+	}
+
+	if fsckConfig := config.Fsck; fsckConfig != nil {
+		if storageType != blobstore.CASStorageType {
+			return nil, status.Error(codes.InvalidArgument, "Fsck is only supported for the Content Addressable Storage")
+		}
+		if fsckConfig.Repair {
+			// Repairing periodically causes data to be
+			// removed without any human intervention.
+			// Until it has seen more use through runs
+			// triggered on demand, only permit periodic
+			// verification.
+			return nil, status.Error(codes.Unimplemented, "Periodic fsck runs do not support repairing inconsistencies. Use the CircularAdmin gRPC service instead")
+		}
+		interval, err := ptypes.Duration(fsckConfig.Interval)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse fsck interval")
+		}
+		fsckFile, err := circularDirectory.OpenReadWrite("fsck", filesystem.CreateReuse(0644))
+		if err != nil {
+			return nil, err
+		}
+		go circular.RunFsckPeriodically(
+			context.Background(),
+			blobAccess,
+			clock.SystemClock,
+			interval,
+			fsckConfig.MaximumBytesPerSecond,
+			false,
+			circular.NewReportingFsckProgressStore(
+				circular.NewMetricsFsckProgressStore(
+					circular.NewFileFsckProgressStore(fsckFile),
+					storageTypeName),
+				config.Directory))
+	}
+	return blobAccess, nil
 }
@@ -13,12 +13,14 @@ import (
 	"google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 )
 
 type contentAddressableStorageBlobAccess struct {
 	byteStreamClient                bytestream.ByteStreamClient
 	contentAddressableStorageClient remoteexecution.ContentAddressableStorageClient
+	healthClient                    grpc_health_v1.HealthClient
 	uuidGenerator                   util.UUIDGenerator
 	readChunkSize                   int
 }
@@ -32,6 +34,7 @@ func NewContentAddressableStorageBlobAccess(client *grpc.ClientConn, uuidGenerat
 	return &contentAddressableStorageBlobAccess{
 		byteStreamClient:                bytestream.NewByteStreamClient(client),
 		contentAddressableStorageClient: remoteexecution.NewContentAddressableStorageClient(client),
+		healthClient:                    grpc_health_v1.NewHealthClient(client),
 		uuidGenerator:                   uuidGenerator,
 		readChunkSize:                   readChunkSize,
 	}
@@ -150,3 +153,7 @@ func (ba *contentAddressableStorageBlobAccess) FindMissing(ctx context.Context,
 	}
 	return outDigests, nil
 }
+
+func (ba *contentAddressableStorageBlobAccess) CheckReadiness(ctx context.Context) error {
+	return checkGRPCReadiness(ctx, ba.healthClient)
+}
@@ -0,0 +1,118 @@
+package blobstore
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/klauspost/compress/zstd"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ContentEncoding is a compression algorithm that may be applied to
+// blob contents when transferring them over HTTP. Digests are always
+// computed over the uncompressed contents.
+type ContentEncoding int
+
+const (
+	// ContentEncodingIdentity transfers data without compression.
+	ContentEncodingIdentity ContentEncoding = iota
+	// ContentEncodingGzip compresses data using gzip.
+	ContentEncodingGzip
+	// ContentEncodingZstd compresses data using Zstandard.
+	ContentEncodingZstd
+)
+
+// headerValue returns the value of the Content-Encoding header that
+// corresponds to the content encoding.
+func (ce ContentEncoding) headerValue() string {
+	switch ce {
+	case ContentEncodingGzip:
+		return "gzip"
+	case ContentEncodingZstd:
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// compress returns a reader that yields a compressed copy of the data
+// read from r. Compression is performed in a separate goroutine. The
+// original reader is closed when the returned reader is closed.
+func (ce ContentEncoding) compress(r io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.WriteCloser
+		switch ce {
+		case ContentEncodingGzip:
+			w = gzip.NewWriter(pw)
+		case ContentEncodingZstd:
+			// Each request already runs in its own
+			// goroutine. Don't let the encoder spawn
+			// additional ones.
+			encoder, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				r.Close()
+				pw.CloseWithError(err)
+				return
+			}
+			w = encoder
+		default:
+			panic("Attempted to compress data using the identity content encoding")
+		}
+		_, err := io.Copy(w, r)
+		r.Close()
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// newDecompressingReader wraps the body of an HTTP response, so that
+// its contents are decompressed according to the value of its
+// Content-Encoding header.
+func newDecompressingReader(body io.ReadCloser, headerValue string) (io.ReadCloser, error) {
+	switch headerValue {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		decoder, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, util.StatusWrapWithCode(err, codes.DataLoss, "Failed to decompress gzip response")
+		}
+		return &decompressingReader{
+			Reader:  decoder,
+			decoder: decoder,
+			body:    body,
+		}, nil
+	case "zstd":
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, util.StatusWrapWithCode(err, codes.DataLoss, "Failed to decompress zstd response")
+		}
+		return &decompressingReader{
+			Reader:  decoder,
+			decoder: decoder.IOReadCloser(),
+			body:    body,
+		}, nil
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "Remote cache returned a response with unsupported content encoding %#v", headerValue)
+	}
+}
+
+// decompressingReader is a reader of decompressed data that releases
+// both the decoder and the underlying HTTP response body upon closure.
+type decompressingReader struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+func (r *decompressingReader) Close() error {
+	r.decoder.Close()
+	return r.body.Close()
+}
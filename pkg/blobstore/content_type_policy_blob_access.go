@@ -0,0 +1,140 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ContentTypeUnknown is the content type assigned to blobs whose
+// leading bytes don't match any of the known magic numbers.
+const ContentTypeUnknown = "Unknown"
+
+// contentTypeMagic is a magic number that identifies a content type.
+type contentTypeMagic struct {
+	contentType string
+	prefix      []byte
+}
+
+// contentTypeMagics is the list of magic numbers that are recognized
+// by ContentTypePolicyBlobAccess.
+var contentTypeMagics = []contentTypeMagic{
+	{"ELF", []byte("\x7fELF")},
+	{"MachO", []byte{0xfe, 0xed, 0xfa, 0xce}},
+	{"MachO", []byte{0xfe, 0xed, 0xfa, 0xcf}},
+	{"MachO", []byte{0xce, 0xfa, 0xed, 0xfe}},
+	{"MachO", []byte{0xcf, 0xfa, 0xed, 0xfe}},
+	{"PE", []byte("MZ")},
+	{"Script", []byte("#!")},
+	{"Zip", []byte("PK\x03\x04")},
+	{"Gzip", []byte{0x1f, 0x8b}},
+}
+
+// contentTypeSniffLength is the number of leading bytes of a blob that
+// need to be read to determine its content type.
+const contentTypeSniffLength = 4
+
+func detectContentType(prefix []byte) string {
+	for _, magic := range contentTypeMagics {
+		if bytes.HasPrefix(prefix, magic.prefix) {
+			return magic.contentType
+		}
+	}
+	return ContentTypeUnknown
+}
+
+// ContentTypePolicy determines which content types may be stored for
+// an instance name.
+type ContentTypePolicy struct {
+	// Content types that may be stored. When empty, all content
+	// types that are not denied may be stored.
+	Allowed map[string]bool
+	// Content types that may not be stored.
+	Denied map[string]bool
+}
+
+func (p *ContentTypePolicy) permits(contentType string) bool {
+	if p.Denied[contentType] {
+		return false
+	}
+	return len(p.Allowed) == 0 || p.Allowed[contentType]
+}
+
+type contentTypePolicyBlobAccess struct {
+	BlobAccess
+	storageType StorageType
+	policies    map[string]ContentTypePolicy
+}
+
+// NewContentTypePolicyBlobAccess creates a decorator for BlobAccess
+// that inspects the leading bytes of blobs written through Put(),
+// rejecting blobs whose content type is not permitted by the policy of
+// the instance name with PERMISSION_DENIED. Content types are
+// determined by matching magic numbers (e.g., "ELF", "MachO", "PE",
+// "Script", "Zip", "Gzip"). Blobs that don't match any of these are of
+// type ContentTypeUnknown. Instance names without a policy are not
+// restricted.
+//
+// Only the first few bytes of a blob are buffered, after which the
+// remainder is streamed to the backend. Still, sniffing prevents
+// backends from receiving buffers of byte slices directly, meaning
+// that data may need to be copied and checksum validation of CAS
+// objects is performed once more. It should therefore only be enabled
+// for instance names that require it.
+func NewContentTypePolicyBlobAccess(blobAccess BlobAccess, storageType StorageType, policies map[string]ContentTypePolicy) BlobAccess {
+	return &contentTypePolicyBlobAccess{
+		BlobAccess:  blobAccess,
+		storageType: storageType,
+		policies:    policies,
+	}
+}
+
+func (ba *contentTypePolicyBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	policy, ok := ba.policies[digest.GetInstance()]
+	if !ok {
+		return ba.BlobAccess.Put(ctx, digest, b)
+	}
+
+	// Read the leading bytes of the blob to determine its content
+	// type, before anything is written to the backend.
+	r := b.ToReader()
+	prefix := make([]byte, contentTypeSniffLength)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.Close()
+		return err
+	}
+	prefix = prefix[:n]
+	if contentType := detectContentType(prefix); !policy.permits(contentType) {
+		r.Close()
+		return status.Errorf(codes.PermissionDenied, "Blobs of content type %#v may not be stored for this instance name", contentType)
+	}
+
+	return ba.BlobAccess.Put(
+		ctx,
+		digest,
+		ba.storageType.NewBufferFromReader(
+			digest,
+			&prefixedReadCloser{
+				Reader: io.MultiReader(bytes.NewReader(prefix), r),
+				closer: r,
+			},
+			buffer.UserProvided))
+}
+
+// prefixedReadCloser is a ReadCloser that returns data that was read
+// ahead, followed by the remainder of the original stream.
+type prefixedReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *prefixedReadCloser) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,100 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContentTypePolicyBlobAccessPut(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewContentTypePolicyBlobAccess(
+		baseBlobAccess,
+		blobstore.CASStorageType,
+		map[string]blobstore.ContentTypePolicy{
+			"data": {
+				Denied: map[string]bool{
+					"ELF":    true,
+					"Script": true,
+				},
+			},
+			"archives": {
+				Allowed: map[string]bool{
+					"Zip": true,
+				},
+			},
+		})
+	helloWorld := []byte("Hello world")
+	newDigest := func(instance string) *util.Digest {
+		return util.MustNewDigest(
+			instance,
+			&remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			})
+	}
+	script := []byte("#!/bin/sh\n")
+	scriptDigest := util.MustNewDigest(
+		"data",
+		&remoteexecution.Digest{
+			Hash:      "3e2b31c72181b87149ff995e7202c0e3",
+			SizeBytes: 10,
+		})
+
+	t.Run("NoPolicy", func(t *testing.T) {
+		// Instance names without a policy should not be
+		// restricted.
+		digest := newDigest("default")
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, helloWorld, data)
+				return nil
+			})
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice(helloWorld)))
+	})
+
+	t.Run("Permitted", func(t *testing.T) {
+		// The sniffed prefix should be forwarded to the backend,
+		// followed by the remainder of the blob.
+		digest := newDigest("data")
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, helloWorld, data)
+				return nil
+			})
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice(helloWorld)))
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Blobs of content type \"Script\" may not be stored for this instance name"),
+			blobAccess.Put(ctx, scriptDigest, buffer.NewValidatedBufferFromByteSlice(script)))
+	})
+
+	t.Run("NotAllowed", func(t *testing.T) {
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Blobs of content type \"Unknown\" may not be stored for this instance name"),
+			blobAccess.Put(ctx, newDigest("archives"), buffer.NewValidatedBufferFromByteSlice(helloWorld)))
+	})
+}
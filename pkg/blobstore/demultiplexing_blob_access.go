@@ -0,0 +1,89 @@
+package blobstore
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+// BlobAccessGetter is the callback invoked by the demultiplexing
+// BlobAccess to obtain a backend that matches the instance name that
+// is provided. It should return INVALID_ARGUMENT for instance names
+// for which no backend exists.
+type BlobAccessGetter func(instanceName string) (BlobAccess, error)
+
+type demultiplexingBlobAccess struct {
+	blobAccessGetter BlobAccessGetter
+}
+
+// NewDemultiplexingBlobAccess creates a BlobAccess that forwards
+// requests to different backends, based on the instance name stored in
+// the provided digests. This may be used to give every tenant of a
+// shared storage infrastructure its own backend.
+func NewDemultiplexingBlobAccess(blobAccessGetter BlobAccessGetter) BlobAccess {
+	return &demultiplexingBlobAccess{
+		blobAccessGetter: blobAccessGetter,
+	}
+}
+
+func (ba *demultiplexingBlobAccess) getBackend(instance string) (BlobAccess, error) {
+	backend, err := ba.blobAccessGetter(instance)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to obtain backend for instance %#v", instance)
+	}
+	return backend, nil
+}
+
+func (ba *demultiplexingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	backend, err := ba.getBackend(digest.GetInstance())
+	if err != nil {
+		return buffer.NewBufferFromError(err)
+	}
+	return backend.Get(ctx, digest)
+}
+
+func (ba *demultiplexingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	backend, err := ba.getBackend(digest.GetInstance())
+	if err != nil {
+		b.Discard()
+		return err
+	}
+	return backend.Put(ctx, digest, b)
+}
+
+func (ba *demultiplexingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	// Group digests by instance name, as digests provided to a
+	// single call may belong to different backends.
+	var instances []string
+	digestsPerInstance := map[string][]*util.Digest{}
+	for _, digest := range digests {
+		instance := digest.GetInstance()
+		if _, ok := digestsPerInstance[instance]; !ok {
+			instances = append(instances, instance)
+		}
+		digestsPerInstance[instance] = append(digestsPerInstance[instance], digest)
+	}
+
+	var missingDigests []*util.Digest
+	for _, instance := range instances {
+		backend, err := ba.getBackend(instance)
+		if err != nil {
+			return nil, err
+		}
+		missing, err := backend.FindMissing(ctx, digestsPerInstance[instance])
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Instance %#v", instance)
+		}
+		missingDigests = append(missingDigests, missing...)
+	}
+	return missingDigests, nil
+}
+
+func (ba *demultiplexingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	backend, err := ba.getBackend(digest.GetInstance())
+	if err != nil {
+		return err
+	}
+	return Delete(ctx, backend, digest)
+}
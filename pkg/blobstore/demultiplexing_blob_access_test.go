@@ -0,0 +1,72 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDemultiplexingBlobAccessUnknownInstance(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccessGetter := mock.NewMockBlobAccessGetter(ctrl)
+	blobAccess := blobstore.NewDemultiplexingBlobAccess(blobAccessGetter.Call)
+	digest := util.MustNewDigest("unknown", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	blobAccessGetter.EXPECT().Call("unknown").Return(nil, status.Error(codes.InvalidArgument, "Unknown instance name")).Times(3)
+
+	_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+	require.Equal(t, status.Error(codes.InvalidArgument, "Failed to obtain backend for instance \"unknown\": Unknown instance name"), err)
+
+	err = blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello")))
+	require.Equal(t, status.Error(codes.InvalidArgument, "Failed to obtain backend for instance \"unknown\": Unknown instance name"), err)
+
+	_, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.Equal(t, status.Error(codes.InvalidArgument, "Failed to obtain backend for instance \"unknown\": Unknown instance name"), err)
+}
+
+func TestDemultiplexingBlobAccessFindMissing(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccessGetter := mock.NewMockBlobAccessGetter(ctrl)
+	blobAccess := blobstore.NewDemultiplexingBlobAccess(blobAccessGetter.Call)
+	digestA1 := util.MustNewDigest("a", &remoteexecution.Digest{
+		Hash:      "00000000000000000000000000000001",
+		SizeBytes: 1,
+	})
+	digestA2 := util.MustNewDigest("a", &remoteexecution.Digest{
+		Hash:      "00000000000000000000000000000002",
+		SizeBytes: 1,
+	})
+	digestB := util.MustNewDigest("b", &remoteexecution.Digest{
+		Hash:      "00000000000000000000000000000003",
+		SizeBytes: 1,
+	})
+
+	// Digests should be grouped by instance name, so that every
+	// backend is only called once.
+	backendA := mock.NewMockBlobAccess(ctrl)
+	blobAccessGetter.EXPECT().Call("a").Return(backendA, nil)
+	backendA.EXPECT().FindMissing(ctx, []*util.Digest{digestA1, digestA2}).Return([]*util.Digest{digestA2}, nil)
+	backendB := mock.NewMockBlobAccess(ctrl)
+	blobAccessGetter.EXPECT().Call("b").Return(backendB, nil)
+	backendB.EXPECT().FindMissing(ctx, []*util.Digest{digestB}).Return([]*util.Digest{digestB}, nil)
+
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestA1, digestB, digestA2})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{digestA2, digestB}, missing)
+}
@@ -0,0 +1,146 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/filesystem"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type directoryStagingArea struct {
+	directory  filesystem.Directory
+	clock      clock.Clock
+	maximumAge time.Duration
+	usageBytes prometheus.Gauge
+
+	lock    sync.Mutex
+	entries map[*directoryStagedData]struct{}
+}
+
+// NewDirectoryStagingArea creates a StagingArea that holds data in
+// files stored in a local directory. This permits staging data that
+// is too large to be held in memory.
+//
+// The directory is emptied upon creation, so that data left behind by
+// previous runs (e.g., due to crashes) is removed. The directory should
+// therefore not be used for any other purpose.
+//
+// Data that has been staged for longer than maximumAge is removed,
+// even if it has not been released. This prevents the directory from
+// filling up in case staged data is leaked. Expired data is removed
+// whenever new data is staged.
+func NewDirectoryStagingArea(directory filesystem.Directory, clock clock.Clock, maximumAge time.Duration) (StagingArea, error) {
+	registerStagingAreaMetrics()
+
+	if err := directory.RemoveAllChildren(); err != nil {
+		return nil, util.StatusWrap(err, "Failed to remove data left behind by previous runs")
+	}
+	return &directoryStagingArea{
+		directory:  directory,
+		clock:      clock,
+		maximumAge: maximumAge,
+		usageBytes: stagingAreaUsageBytes.WithLabelValues("Directory"),
+		entries:    map[*directoryStagedData]struct{}{},
+	}, nil
+}
+
+// removeExpired removes all staged data that has been staged for
+// longer than the maximum age.
+func (sa *directoryStagingArea) removeExpired(now time.Time) {
+	sa.lock.Lock()
+	var expired []*directoryStagedData
+	for sd := range sa.entries {
+		if !now.Before(sd.stagedAt.Add(sa.maximumAge)) {
+			expired = append(expired, sd)
+			delete(sa.entries, sd)
+		}
+	}
+	sa.lock.Unlock()
+
+	for _, sd := range expired {
+		log.Printf("Removing staging file %#v, as it has not been released within %s", sd.name, sa.maximumAge)
+		sd.remove()
+	}
+}
+
+func (sa *directoryStagingArea) Stage(ctx context.Context, r io.Reader, maximumSizeBytes int64) (StagedData, error) {
+	now := sa.clock.Now()
+	sa.removeExpired(now)
+
+	name := uuid.New().String()
+	w, err := sa.directory.OpenAppend(name, filesystem.CreateExcl(0600))
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to create staging file %#v", name)
+	}
+	sizeBytes, err := copyToStagingArea(w, r, maximumSizeBytes)
+	if closeErr := w.Close(); err == nil && closeErr != nil {
+		err = util.StatusWrapf(closeErr, "Failed to close staging file %#v", name)
+	}
+	if err != nil {
+		if removeErr := sa.directory.Remove(name); removeErr != nil {
+			log.Printf("Failed to remove staging file %#v: %s", name, removeErr)
+		}
+		return nil, err
+	}
+
+	sa.usageBytes.Add(float64(sizeBytes))
+	sd := &directoryStagedData{
+		stagingArea: sa,
+		name:        name,
+		sizeBytes:   sizeBytes,
+		stagedAt:    now,
+	}
+	sa.lock.Lock()
+	sa.entries[sd] = struct{}{}
+	sa.lock.Unlock()
+	return sd, nil
+}
+
+type directoryStagedData struct {
+	stagingArea *directoryStagingArea
+	name        string
+	sizeBytes   int64
+	stagedAt    time.Time
+}
+
+func (sd *directoryStagedData) GetSizeBytes() int64 {
+	return sd.sizeBytes
+}
+
+func (sd *directoryStagedData) Open(ctx context.Context) (io.ReadCloser, error) {
+	f, err := sd.stagingArea.directory.OpenRead(sd.name)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to open staging file %#v", sd.name)
+	}
+	return &stagedDataReader{
+		Reader:     io.NewSectionReader(f, 0, sd.sizeBytes),
+		closer:     f,
+		stagedData: sd,
+	}, nil
+}
+
+func (sd *directoryStagedData) Release() {
+	// Only remove the data if it has not expired already.
+	sa := sd.stagingArea
+	sa.lock.Lock()
+	_, ok := sa.entries[sd]
+	delete(sa.entries, sd)
+	sa.lock.Unlock()
+	if ok {
+		sd.remove()
+	}
+}
+
+func (sd *directoryStagedData) remove() {
+	if err := sd.stagingArea.directory.Remove(sd.name); err != nil {
+		log.Printf("Failed to remove staging file %#v: %s", sd.name, err)
+	}
+	sd.stagingArea.usageBytes.Sub(float64(sd.sizeBytes))
+}
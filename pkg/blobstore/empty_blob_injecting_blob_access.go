@@ -0,0 +1,57 @@
+package blobstore
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+type emptyBlobInjectingBlobAccess struct {
+	BlobAccess
+}
+
+// NewEmptyBlobInjectingBlobAccess is a decorator for the Content
+// Addressable Storage that treats the empty blob as always being
+// present. Clients may assume the empty blob exists without uploading
+// it, as its contents are trivially known. Requests for the empty blob
+// are therefore never forwarded to the backend.
+//
+// The empty blob is recognized for every supported digest function,
+// as each function has its own hash for the empty blob.
+func NewEmptyBlobInjectingBlobAccess(base BlobAccess) BlobAccess {
+	return &emptyBlobInjectingBlobAccess{
+		BlobAccess: base,
+	}
+}
+
+func (ba *emptyBlobInjectingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	if digest.IsEmptyBlob() {
+		return buffer.NewValidatedBufferFromByteSlice(nil)
+	}
+	return ba.BlobAccess.Get(ctx, digest)
+}
+
+func (ba *emptyBlobInjectingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	if digest.IsEmptyBlob() {
+		// There is no need to store the empty blob. Still
+		// validate the data, so that clients uploading
+		// corrupted data get notified.
+		_, err := b.ToByteSlice(0)
+		return err
+	}
+	return ba.BlobAccess.Put(ctx, digest, b)
+}
+
+func (ba *emptyBlobInjectingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	nonEmptyDigests := make([]*util.Digest, 0, len(digests))
+	for _, digest := range digests {
+		if !digest.IsEmptyBlob() {
+			nonEmptyDigests = append(nonEmptyDigests, digest)
+		}
+	}
+	if len(nonEmptyDigests) == 0 {
+		return nil, nil
+	}
+	return ba.BlobAccess.FindMissing(ctx, nonEmptyDigests)
+}
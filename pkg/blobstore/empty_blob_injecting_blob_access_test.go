@@ -0,0 +1,149 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var emptyBlobDigests = []*util.Digest{
+	util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "d41d8cd98f00b204e9800998ecf8427e",
+		SizeBytes: 0,
+	}),
+	util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+		SizeBytes: 0,
+	}),
+	util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		SizeBytes: 0,
+	}),
+	util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e",
+		SizeBytes: 0,
+	}),
+}
+
+func TestEmptyBlobInjectingBlobAccessGet(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewEmptyBlobInjectingBlobAccess(baseBlobAccess)
+
+	t.Run("Empty", func(t *testing.T) {
+		// The empty blob should be returned for every digest
+		// function, without contacting the backend.
+		for _, digest := range emptyBlobDigests {
+			data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+			require.NoError(t, err)
+			require.Empty(t, data)
+		}
+	})
+
+	t.Run("EmptyWrongHash", func(t *testing.T) {
+		// A zero-sized blob whose hash does not correspond to
+		// the empty blob should be forwarded to the backend.
+		digest := util.MustNewDigest("default", &remoteexecution.Digest{
+			Hash:      "f7ff9e8b7bb2e09b70935a5d785e0cc5d9d0abf0",
+			SizeBytes: 0,
+		})
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice(nil))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Empty(t, data)
+	})
+
+	t.Run("NonEmpty", func(t *testing.T) {
+		digest := util.MustNewDigest("default", &remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+}
+
+func TestEmptyBlobInjectingBlobAccessPut(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewEmptyBlobInjectingBlobAccess(baseBlobAccess)
+
+	t.Run("Empty", func(t *testing.T) {
+		// Writes of the empty blob should not be forwarded to
+		// the backend.
+		for _, digest := range emptyBlobDigests {
+			require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewCASBufferFromByteSlice(digest, nil, buffer.UserProvided)))
+		}
+	})
+
+	t.Run("EmptyCorrupted", func(t *testing.T) {
+		// The data should still be validated, so that clients
+		// are informed about uploading corrupted data.
+		digest := emptyBlobDigests[0]
+		err := blobAccess.Put(ctx, digest, buffer.NewCASBufferFromByteSlice(digest, []byte("Hello"), buffer.UserProvided))
+		require.Equal(t, status.Error(codes.InvalidArgument, "Buffer is 5 bytes in size, while 0 bytes were expected"), err)
+	})
+
+	t.Run("NonEmpty", func(t *testing.T) {
+		digest := util.MustNewDigest("default", &remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello world"), data)
+				return nil
+			})
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+}
+
+func TestEmptyBlobInjectingBlobAccessFindMissing(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewEmptyBlobInjectingBlobAccess(baseBlobAccess)
+
+	t.Run("OnlyEmpty", func(t *testing.T) {
+		// The empty blob should never be reported as missing,
+		// regardless of the digest function.
+		missing, err := blobAccess.FindMissing(ctx, emptyBlobDigests)
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("Mixed", func(t *testing.T) {
+		// Only non-empty blobs should be forwarded.
+		digest := util.MustNewDigest("default", &remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return([]*util.Digest{digest}, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, append([]*util.Digest{digest}, emptyBlobDigests...))
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest}, missing)
+	})
+}
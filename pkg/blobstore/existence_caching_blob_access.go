@@ -0,0 +1,222 @@
+package blobstore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	existenceCachingBlobAccessPrometheusMetrics sync.Once
+
+	existenceCachingBlobAccessFindMissingDigests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "existence_caching_blob_access_find_missing_digests_total",
+			Help:      "Number of digests passed to FindMissing() that were answered by the existence cache.",
+		},
+		[]string{"result"})
+	existenceCachingBlobAccessFindMissingDigestsHit  = existenceCachingBlobAccessFindMissingDigests.WithLabelValues("Hit")
+	existenceCachingBlobAccessFindMissingDigestsMiss = existenceCachingBlobAccessFindMissingDigests.WithLabelValues("Miss")
+)
+
+type existenceCachingBlobAccess struct {
+	BlobAccess
+	storageType StorageType
+	clock       clock.Clock
+	cacheSize   int
+	ttl         time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lruList list.List
+}
+
+type existenceCacheEntry struct {
+	key        string
+	expiration time.Time
+}
+
+// NewExistenceCachingBlobAccess creates a decorator for BlobAccess that
+// remembers which blobs have recently been observed to be present.
+// FindMissing() does not forward these blobs to the backend, which
+// reduces load caused by clients that repeatedly check the existence
+// of the same blobs.
+//
+// Only the presence of blobs is cached, as missing blobs may be
+// uploaded at any time. Entries expire after ttl, so that blobs that
+// have been evicted from the backend are eventually reported as
+// missing. At most cacheSize entries are retained, evicting the least
+// recently used ones first.
+//
+// Cached results are not forwarded to the backend, meaning that they
+// do not cause backends such as LocalBlobAccess to refresh the blobs.
+// The ttl must therefore be well below the amount of time for which
+// the backend retains blobs that are not accessed. Otherwise, clients
+// may be told that blobs are present, while they have already been
+// evicted.
+//
+// The cache is skipped for requests whose context has a cache bypass
+// mode set through NewContextWithCacheBypassMode().
+func NewExistenceCachingBlobAccess(blobAccess BlobAccess, storageType StorageType, clock clock.Clock, cacheSize int, ttl time.Duration) BlobAccess {
+	existenceCachingBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(existenceCachingBlobAccessFindMissingDigests)
+	})
+
+	return &existenceCachingBlobAccess{
+		BlobAccess:  blobAccess,
+		storageType: storageType,
+		clock:       clock,
+		cacheSize:   cacheSize,
+		ttl:         ttl,
+		entries:     map[string]*list.Element{},
+	}
+}
+
+func (ba *existenceCachingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	// Blobs that turn out to be absent should no longer be
+	// reported as being present.
+	key := ba.storageType.GetDigestKey(digest)
+	return buffer.WithErrorHandler(
+		ba.BlobAccess.Get(ctx, digest),
+		&existenceCachingErrorHandler{
+			blobAccess: ba,
+			key:        key,
+		})
+}
+
+func (ba *existenceCachingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	if err := ba.BlobAccess.Put(ctx, digest, b); err != nil {
+		return err
+	}
+	ba.lock.Lock()
+	ba.insert(ba.storageType.GetDigestKey(digest), ba.clock.Now())
+	ba.lock.Unlock()
+	return nil
+}
+
+func (ba *existenceCachingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	mode := GetCacheBypassModeFromContext(ctx)
+	if mode == CacheBypassRead {
+		return ba.BlobAccess.FindMissing(ctx, digests)
+	}
+
+	// Only forward digests to the backend that are not known to
+	// be present, unless the cache needs to be repopulated.
+	now := ba.clock.Now()
+	var uncachedDigests []*util.Digest
+	ba.lock.Lock()
+	for _, digest := range digests {
+		if mode == CacheBypassReadAndRepopulate {
+			uncachedDigests = append(uncachedDigests, digest)
+			continue
+		}
+		key := ba.storageType.GetDigestKey(digest)
+		if element, ok := ba.entries[key]; ok {
+			if entry := element.Value.(*existenceCacheEntry); now.Before(entry.expiration) {
+				ba.lruList.MoveToBack(element)
+				continue
+			}
+			ba.removeElement(element)
+		}
+		uncachedDigests = append(uncachedDigests, digest)
+	}
+	ba.lock.Unlock()
+	existenceCachingBlobAccessFindMissingDigestsHit.Add(float64(len(digests) - len(uncachedDigests)))
+	existenceCachingBlobAccessFindMissingDigestsMiss.Add(float64(len(uncachedDigests)))
+	if len(uncachedDigests) == 0 {
+		return nil, nil
+	}
+
+	missing, err := ba.BlobAccess.FindMissing(ctx, uncachedDigests)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache the digests that the backend reported as being present.
+	// When repopulating, entries of digests that are missing may
+	// still be present. Remove these.
+	missingKeys := make(map[string]struct{}, len(missing))
+	for _, digest := range missing {
+		missingKeys[ba.storageType.GetDigestKey(digest)] = struct{}{}
+	}
+	ba.lock.Lock()
+	for _, digest := range uncachedDigests {
+		key := ba.storageType.GetDigestKey(digest)
+		if _, ok := missingKeys[key]; !ok {
+			ba.insert(key, now)
+		} else if element, ok := ba.entries[key]; ok {
+			ba.removeElement(element)
+		}
+	}
+	ba.lock.Unlock()
+	return missing, nil
+}
+
+// insert marks a blob as being present. It must be called while
+// holding the lock.
+func (ba *existenceCachingBlobAccess) insert(key string, now time.Time) {
+	expiration := now.Add(ba.ttl)
+	if element, ok := ba.entries[key]; ok {
+		element.Value.(*existenceCacheEntry).expiration = expiration
+		ba.lruList.MoveToBack(element)
+		return
+	}
+	ba.entries[key] = ba.lruList.PushBack(&existenceCacheEntry{
+		key:        key,
+		expiration: expiration,
+	})
+
+	// Evict the least recently used entries until we're within
+	// the size limit again.
+	for len(ba.entries) > ba.cacheSize {
+		ba.removeElement(ba.lruList.Front())
+	}
+}
+
+func (ba *existenceCachingBlobAccess) removeElement(element *list.Element) {
+	entry := ba.lruList.Remove(element).(*existenceCacheEntry)
+	delete(ba.entries, entry.key)
+}
+
+type existenceCachingErrorHandler struct {
+	blobAccess *existenceCachingBlobAccess
+	key        string
+}
+
+func (eh *existenceCachingErrorHandler) OnError(err error) (buffer.Buffer, error) {
+	if status.Code(err) == codes.NotFound {
+		ba := eh.blobAccess
+		ba.lock.Lock()
+		if element, ok := ba.entries[eh.key]; ok {
+			ba.removeElement(element)
+		}
+		ba.lock.Unlock()
+	}
+	return nil, err
+}
+
+func (eh *existenceCachingErrorHandler) Done() {}
+
+func (ba *existenceCachingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	err := Delete(ctx, ba.BlobAccess, digest)
+
+	// Even if deleting failed, the blob may have been removed
+	// partially. Stop reporting it as being present.
+	ba.lock.Lock()
+	if element, ok := ba.entries[ba.storageType.GetDigestKey(digest)]; ok {
+		ba.removeElement(element)
+	}
+	ba.lock.Unlock()
+	return err
+}
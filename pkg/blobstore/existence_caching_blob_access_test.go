@@ -0,0 +1,176 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestExistenceCachingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	blobAccess := blobstore.NewExistenceCachingBlobAccess(baseBlobAccess, blobstore.CASStorageType, clock, 2, time.Minute)
+	digestHello := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	digestGoodbye := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "35f7fc6f4fc7b7ecc13b5ad1e0d2b0e3",
+			SizeBytes: 13,
+		})
+	digestLarge := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "0f5ab4b0c3ba10b34e8f2ae3fd4b8a5d",
+			SizeBytes: 16,
+		})
+
+	t.Run("MissingNotCached", func(t *testing.T) {
+		// Only the presence of blobs may be cached, as missing
+		// blobs may be uploaded at any time.
+		clock.EXPECT().Now().Return(time.Unix(1000, 0))
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestHello, digestGoodbye}).
+			Return([]*util.Digest{digestGoodbye}, nil)
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestHello, digestGoodbye})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestGoodbye}, missing)
+
+		clock.EXPECT().Now().Return(time.Unix(1010, 0))
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestGoodbye}).
+			Return([]*util.Digest{digestGoodbye}, nil)
+		missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digestHello, digestGoodbye})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestGoodbye}, missing)
+	})
+
+	t.Run("PutPopulates", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Put(ctx, digestGoodbye, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+		clock.EXPECT().Now().Return(time.Unix(1020, 0))
+		require.NoError(t, blobAccess.Put(ctx, digestGoodbye, buffer.NewValidatedBufferFromByteSlice([]byte("Goodbye world"))))
+
+		clock.EXPECT().Now().Return(time.Unix(1030, 0))
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestHello, digestGoodbye})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		// The entry for digestHello was created at t=1000 and
+		// should have expired by now. The entry for
+		// digestGoodbye is still valid.
+		clock.EXPECT().Now().Return(time.Unix(1060, 0))
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestHello}).Return(nil, nil)
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestHello, digestGoodbye})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		// The cache can hold two entries. Adding a third one
+		// should evict the least recently used one, being
+		// digestGoodbye.
+		clock.EXPECT().Now().Return(time.Unix(1070, 0))
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestLarge}).Return(nil, nil)
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestLarge})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+
+		clock.EXPECT().Now().Return(time.Unix(1080, 0))
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestGoodbye}).Return(nil, nil)
+		missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digestHello, digestGoodbye, digestLarge})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("GetNotFoundInvalidates", func(t *testing.T) {
+		// Blobs that turn out to be absent when read should no
+		// longer be reported as being present.
+		baseBlobAccess.EXPECT().Get(ctx, digestLarge).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+		_, err := blobAccess.Get(ctx, digestLarge).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+
+		clock.EXPECT().Now().Return(time.Unix(1090, 0))
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestLarge}).Return([]*util.Digest{digestLarge}, nil)
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestGoodbye, digestLarge})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestLarge}, missing)
+	})
+
+	t.Run("CacheBypass", func(t *testing.T) {
+		// When reading is bypassed, the backend should be
+		// consulted without modifying the cache.
+		bypassCtx := blobstore.NewContextWithCacheBypassMode(ctx, blobstore.CacheBypassRead)
+		baseBlobAccess.EXPECT().FindMissing(bypassCtx, []*util.Digest{digestGoodbye}).Return([]*util.Digest{digestGoodbye}, nil)
+		missing, err := blobAccess.FindMissing(bypassCtx, []*util.Digest{digestGoodbye})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestGoodbye}, missing)
+
+		clock.EXPECT().Now().Return(time.Unix(1091, 0))
+		missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digestGoodbye})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+
+		// When repopulating, results from the backend should
+		// replace the contents of the cache.
+		repopulateCtx := blobstore.NewContextWithCacheBypassMode(ctx, blobstore.CacheBypassReadAndRepopulate)
+		clock.EXPECT().Now().Return(time.Unix(1092, 0))
+		baseBlobAccess.EXPECT().FindMissing(repopulateCtx, []*util.Digest{digestGoodbye}).Return([]*util.Digest{digestGoodbye}, nil)
+		missing, err = blobAccess.FindMissing(repopulateCtx, []*util.Digest{digestGoodbye})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestGoodbye}, missing)
+
+		clock.EXPECT().Now().Return(time.Unix(1093, 0))
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestGoodbye}).Return(nil, nil)
+		missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digestGoodbye})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("DeleteInvalidates", func(t *testing.T) {
+		// Deleting a blob should cause it to no longer be
+		// reported as being present, even if the backend was
+		// only able to remove it partially.
+		blobDeleter := &blobAccessDeleter{
+			MockBlobAccess:  baseBlobAccess,
+			MockBlobDeleter: mock.NewMockBlobDeleter(ctrl),
+		}
+		blobAccess := blobstore.NewExistenceCachingBlobAccess(blobDeleter, blobstore.CASStorageType, clock, 2, time.Minute)
+
+		clock.EXPECT().Now().Return(time.Unix(1100, 0))
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestHello}).Return(nil, nil)
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestHello})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+
+		blobDeleter.MockBlobDeleter.EXPECT().Delete(ctx, digestHello).Return(status.Error(codes.Internal, "Disk on fire"))
+		require.Equal(t, status.Error(codes.Internal, "Disk on fire"), blobstore.Delete(ctx, blobAccess, digestHello))
+
+		clock.EXPECT().Now().Return(time.Unix(1110, 0))
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digestHello}).Return([]*util.Digest{digestHello}, nil)
+		missing, err = blobAccess.FindMissing(ctx, []*util.Digest{digestHello})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestHello}, missing)
+	})
+}
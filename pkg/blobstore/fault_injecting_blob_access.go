@@ -0,0 +1,143 @@
+package blobstore
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	faultInjectingBlobAccessPrometheusMetrics sync.Once
+
+	faultInjectingBlobAccessInjectedErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "fault_injecting_blob_access_injected_errors_total",
+			Help:      "Number of operations that failed due to an injected error.",
+		},
+		[]string{"operation"})
+	faultInjectingBlobAccessInjectedErrorsGet         = faultInjectingBlobAccessInjectedErrors.WithLabelValues("Get")
+	faultInjectingBlobAccessInjectedErrorsPut         = faultInjectingBlobAccessInjectedErrors.WithLabelValues("Put")
+	faultInjectingBlobAccessInjectedErrorsFindMissing = faultInjectingBlobAccessInjectedErrors.WithLabelValues("FindMissing")
+)
+
+// FaultInjectionConfiguration describes the faults that
+// FaultInjectingBlobAccess injects into operations.
+type FaultInjectionConfiguration struct {
+	// Operations into which faults are injected.
+	AffectGet         bool
+	AffectPut         bool
+	AffectFindMissing bool
+
+	// Probability in range [0, 1] at which an operation fails with
+	// Error, instead of being forwarded to the backend.
+	ErrorProbability float64
+	Error            error
+
+	// Latency that is added to operations. The latency is chosen
+	// uniformly at random in range [MinimumLatency, MaximumLatency].
+	// Setting both to the same value causes a fixed latency to be
+	// added.
+	MinimumLatency time.Duration
+	MaximumLatency time.Duration
+
+	// Seed of the random number generator that is used to decide
+	// which faults are injected.
+	Seed int64
+}
+
+type faultInjectingBlobAccess struct {
+	BlobAccess
+	clock         clock.Clock
+	configuration FaultInjectionConfiguration
+
+	lock      sync.Mutex
+	generator *rand.Rand
+}
+
+// NewFaultInjectingBlobAccess creates a decorator for BlobAccess that
+// adds latency to operations and lets them fail randomly. It can be
+// used to validate the behavior of decorators such as
+// RetryingBlobAccess and CircuitBreakingBlobAccess against unreliable
+// backends.
+//
+// Faults are decided using a random number generator that is seeded
+// with a fixed value, meaning that a sequence of operations that is
+// performed sequentially is always subject to the same faults.
+func NewFaultInjectingBlobAccess(blobAccess BlobAccess, clock clock.Clock, configuration FaultInjectionConfiguration) BlobAccess {
+	faultInjectingBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(faultInjectingBlobAccessInjectedErrors)
+	})
+
+	return &faultInjectingBlobAccess{
+		BlobAccess:    blobAccess,
+		clock:         clock,
+		configuration: configuration,
+		generator:     rand.New(rand.NewSource(configuration.Seed)),
+	}
+}
+
+// injectFault applies the faults chosen for a single operation. It
+// blocks for the amount of latency chosen, returning an error if the
+// operation should fail.
+func (ba *faultInjectingBlobAccess) injectFault(ctx context.Context, injectedErrors prometheus.Counter) error {
+	// Make all random decisions up front, so that the sequence of
+	// values drawn from the generator does not depend on timing.
+	ba.lock.Lock()
+	latency := ba.configuration.MinimumLatency
+	if spread := ba.configuration.MaximumLatency - ba.configuration.MinimumLatency; spread > 0 {
+		latency += time.Duration(ba.generator.Int63n(int64(spread) + 1))
+	}
+	fail := ba.generator.Float64() < ba.configuration.ErrorProbability
+	ba.lock.Unlock()
+
+	if latency > 0 {
+		timer, t := ba.clock.NewTimer(latency)
+		select {
+		case <-t:
+		case <-ctx.Done():
+			timer.Stop()
+			return util.StatusFromContext(ctx)
+		}
+	}
+	if fail {
+		injectedErrors.Inc()
+		return ba.configuration.Error
+	}
+	return nil
+}
+
+func (ba *faultInjectingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	if ba.configuration.AffectGet {
+		if err := ba.injectFault(ctx, faultInjectingBlobAccessInjectedErrorsGet); err != nil {
+			return buffer.NewBufferFromError(err)
+		}
+	}
+	return ba.BlobAccess.Get(ctx, digest)
+}
+
+func (ba *faultInjectingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	if ba.configuration.AffectPut {
+		if err := ba.injectFault(ctx, faultInjectingBlobAccessInjectedErrorsPut); err != nil {
+			b.Discard()
+			return err
+		}
+	}
+	return ba.BlobAccess.Put(ctx, digest, b)
+}
+
+func (ba *faultInjectingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	if ba.configuration.AffectFindMissing {
+		if err := ba.injectFault(ctx, faultInjectingBlobAccessInjectedErrorsFindMissing); err != nil {
+			return nil, err
+		}
+	}
+	return ba.BlobAccess.FindMissing(ctx, digests)
+}
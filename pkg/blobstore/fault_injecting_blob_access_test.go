@@ -0,0 +1,165 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFaultInjectingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	expectTimer := func(d time.Duration) {
+		timer := mock.NewMockTimer(ctrl)
+		ch := make(chan time.Time, 1)
+		ch <- time.Unix(1000, 0)
+		clock.EXPECT().NewTimer(d).Return(timer, ch)
+	}
+
+	t.Run("UnaffectedOperation", func(t *testing.T) {
+		// Operations that are not selected should be forwarded
+		// to the backend as is.
+		blobAccess := blobstore.NewFaultInjectingBlobAccess(baseBlobAccess, clock, blobstore.FaultInjectionConfiguration{
+			AffectPut:        true,
+			ErrorProbability: 1,
+			Error:            status.Error(codes.Unavailable, "Injected fault"),
+			MinimumLatency:   time.Second,
+			MaximumLatency:   time.Second,
+		})
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("AlwaysFail", func(t *testing.T) {
+		blobAccess := blobstore.NewFaultInjectingBlobAccess(baseBlobAccess, clock, blobstore.FaultInjectionConfiguration{
+			AffectGet:         true,
+			AffectPut:         true,
+			AffectFindMissing: true,
+			ErrorProbability:  1,
+			Error:             status.Error(codes.Unavailable, "Injected fault"),
+		})
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Unavailable, "Injected fault"), err)
+
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Injected fault"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		_, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.Equal(t, status.Error(codes.Unavailable, "Injected fault"), err)
+	})
+
+	t.Run("FixedLatency", func(t *testing.T) {
+		blobAccess := blobstore.NewFaultInjectingBlobAccess(baseBlobAccess, clock, blobstore.FaultInjectionConfiguration{
+			AffectFindMissing: true,
+			MinimumLatency:    5 * time.Second,
+			MaximumLatency:    5 * time.Second,
+		})
+		expectTimer(5 * time.Second)
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("ContextCanceled", func(t *testing.T) {
+		// Cancelation of the context should interrupt the
+		// latency that is added.
+		blobAccess := blobstore.NewFaultInjectingBlobAccess(baseBlobAccess, clock, blobstore.FaultInjectionConfiguration{
+			AffectFindMissing: true,
+			MinimumLatency:    5 * time.Second,
+			MaximumLatency:    5 * time.Second,
+		})
+		timer := mock.NewMockTimer(ctrl)
+		clock.EXPECT().NewTimer(5*time.Second).Return(timer, make(chan time.Time))
+		timer.EXPECT().Stop().Return(true)
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := blobAccess.FindMissing(canceledCtx, []*util.Digest{digest})
+		require.Equal(t, status.Error(codes.Canceled, "context canceled"), err)
+	})
+}
+
+func TestFaultInjectingBlobAccessDeterministic(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	configuration := blobstore.FaultInjectionConfiguration{
+		AffectFindMissing: true,
+		ErrorProbability:  0.5,
+		Error:             status.Error(codes.Unavailable, "Injected fault"),
+		MinimumLatency:    time.Second,
+		MaximumLatency:    2 * time.Second,
+		Seed:              42,
+	}
+
+	// Instances that use the same seed should inject the same
+	// faults when subject to the same sequence of operations.
+	runOperations := func() ([]time.Duration, []bool) {
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		baseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil).AnyTimes()
+		mockClock := mock.NewMockClock(ctrl)
+		var latencies []time.Duration
+		mockClock.EXPECT().NewTimer(gomock.Any()).DoAndReturn(func(d time.Duration) (clock.Timer, <-chan time.Time) {
+			latencies = append(latencies, d)
+			ch := make(chan time.Time, 1)
+			ch <- time.Unix(1000, 0)
+			return mock.NewMockTimer(ctrl), ch
+		}).Times(100)
+
+		blobAccess := blobstore.NewFaultInjectingBlobAccess(baseBlobAccess, mockClock, configuration)
+		var failures []bool
+		for i := 0; i < 100; i++ {
+			_, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+			failures = append(failures, err != nil)
+		}
+		return latencies, failures
+	}
+
+	latencies1, failures1 := runOperations()
+	latencies2, failures2 := runOperations()
+	require.Equal(t, latencies1, latencies2)
+	require.Equal(t, failures1, failures2)
+
+	// Latencies should lie within the configured range, and both
+	// outcomes should have occurred.
+	for _, latency := range latencies1 {
+		require.True(t, latency >= time.Second && latency <= 2*time.Second)
+	}
+	require.Contains(t, failures1, true)
+	require.Contains(t, failures1, false)
+}
@@ -0,0 +1,220 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/filesystem"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/google/uuid"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type filesystemBlobAccess struct {
+	directory     filesystem.Directory
+	shardingDepth int
+	shardingWidth int
+}
+
+// NewFilesystemBlobAccess creates a BlobAccess that stores every blob
+// as a separate file in a directory on disk. This may be used in
+// single node setups where the amount of data is too large to be held
+// by the circular storage backend, or where data should be inspectable
+// using regular tools.
+//
+// To prevent directories from becoming excessively large, blobs are
+// sharded across shardingDepth levels of subdirectories, each named
+// after the next shardingWidth characters of their hash. The file
+// itself is named after the remainder of the hash. Both values must be
+// positive. As they determine where blobs are stored, changing them
+// requires the existing contents of the directory to be discarded or
+// moved into place.
+//
+// Blobs are first written to a temporary file, which is hard linked
+// to its final location once complete. This ensures that partially
+// written blobs are never observed. As blobs are identified by their
+// hash, this backend can only be used for the Content Addressable
+// Storage.
+func NewFilesystemBlobAccess(directory filesystem.Directory, shardingDepth int, shardingWidth int) blobstore.BlobAccess {
+	return &filesystemBlobAccess{
+		directory:     directory,
+		shardingDepth: shardingDepth,
+		shardingWidth: shardingWidth,
+	}
+}
+
+// getPath splits the hash of a digest into the path of the
+// subdirectory and the name of the file in which the blob is stored.
+func (ba *filesystemBlobAccess) getPath(digest *util.Digest) ([]string, string) {
+	hash := digest.GetHashString()
+	subdirectoryNames := make([]string, 0, ba.shardingDepth)
+	for i := 0; i < ba.shardingDepth; i++ {
+		subdirectoryNames = append(subdirectoryNames, hash[:ba.shardingWidth])
+		hash = hash[ba.shardingWidth:]
+	}
+	return subdirectoryNames, hash
+}
+
+// enterSubdirectory opens the subdirectory in which a blob is stored.
+// If create is set, subdirectories that don't exist are created.
+func (ba *filesystemBlobAccess) enterSubdirectory(subdirectoryNames []string, create bool) (filesystem.Directory, error) {
+	var subdirectory filesystem.Directory
+	for _, name := range subdirectoryNames {
+		parent := ba.directory
+		if subdirectory != nil {
+			parent = subdirectory
+		}
+		if create {
+			if err := parent.Mkdir(name, 0777); err != nil && !os.IsExist(err) {
+				if subdirectory != nil {
+					subdirectory.Close()
+				}
+				return nil, err
+			}
+		}
+		child, err := parent.Enter(name)
+		if subdirectory != nil {
+			subdirectory.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		subdirectory = child
+	}
+	return subdirectory, nil
+}
+
+func (ba *filesystemBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	subdirectoryNames, fileName := ba.getPath(digest)
+	subdirectory, err := ba.enterSubdirectory(subdirectoryNames, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found"))
+		}
+		return buffer.NewBufferFromError(util.StatusWrapf(err, "Failed to open directory %#v", strings.Join(subdirectoryNames, "/")))
+	}
+	defer subdirectory.Close()
+
+	f, err := subdirectory.OpenRead(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found"))
+		}
+		return buffer.NewBufferFromError(util.StatusWrapf(err, "Failed to open file %#v", fileName))
+	}
+	return buffer.NewCASBufferFromReader(
+		digest,
+		&fileReader{
+			Reader: io.NewSectionReader(f, 0, digest.GetSizeBytes()),
+			closer: f,
+		},
+		buffer.Reparable(digest, func() error {
+			// Remove corrupted blobs, so that they are
+			// reported as missing and uploaded once more.
+			subdirectory, err := ba.enterSubdirectory(subdirectoryNames, false)
+			if err != nil {
+				return err
+			}
+			defer subdirectory.Close()
+			return subdirectory.Remove(fileName)
+		}))
+}
+
+func (ba *filesystemBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	subdirectoryNames, fileName := ba.getPath(digest)
+	subdirectory, err := ba.enterSubdirectory(subdirectoryNames, true)
+	if err != nil {
+		b.Discard()
+		return util.StatusWrapf(err, "Failed to create directory %#v", strings.Join(subdirectoryNames, "/"))
+	}
+	defer subdirectory.Close()
+
+	// Write the blob to a temporary file. Hashes only consist of
+	// hexadecimal characters, meaning the name of the temporary
+	// file cannot collide with that of any blob.
+	temporaryName := "tmp." + uuid.New().String()
+	w, err := subdirectory.OpenAppend(temporaryName, filesystem.CreateExcl(0444))
+	if err != nil {
+		b.Discard()
+		return util.StatusWrapf(err, "Failed to create temporary file %#v", temporaryName)
+	}
+	err = b.IntoWriter(w)
+	if closeErr := w.Close(); err == nil && closeErr != nil {
+		err = util.StatusWrapf(closeErr, "Failed to close temporary file %#v", temporaryName)
+	}
+	defer func() {
+		if err := subdirectory.Remove(temporaryName); err != nil {
+			log.Printf("Failed to remove temporary file %#v: %s", temporaryName, err)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	// Move the blob into place. If the blob already exists, it
+	// was written concurrently. Its contents must be identical.
+	if err := subdirectory.Link(temporaryName, subdirectory, fileName); err != nil && !os.IsExist(err) {
+		return util.StatusWrapf(err, "Failed to link temporary file %#v to %#v", temporaryName, fileName)
+	}
+	return nil
+}
+
+func (ba *filesystemBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	var missing []*util.Digest
+	for _, digest := range digests {
+		subdirectoryNames, fileName := ba.getPath(digest)
+		subdirectory, err := ba.enterSubdirectory(subdirectoryNames, false)
+		if err != nil {
+			if os.IsNotExist(err) {
+				missing = append(missing, digest)
+				continue
+			}
+			return nil, util.StatusWrapf(err, "Failed to open directory %#v", strings.Join(subdirectoryNames, "/"))
+		}
+		_, err = subdirectory.Lstat(fileName)
+		subdirectory.Close()
+		if err != nil {
+			if os.IsNotExist(err) {
+				missing = append(missing, digest)
+				continue
+			}
+			return nil, util.StatusWrapf(err, "Failed to obtain attributes of file %#v", fileName)
+		}
+	}
+	return missing, nil
+}
+
+func (ba *filesystemBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	subdirectoryNames, fileName := ba.getPath(digest)
+	subdirectory, err := ba.enterSubdirectory(subdirectoryNames, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return util.StatusWrapf(err, "Failed to open directory %#v", strings.Join(subdirectoryNames, "/"))
+	}
+	defer subdirectory.Close()
+
+	if err := subdirectory.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return util.StatusWrapf(err, "Failed to remove file %#v", fileName)
+	}
+	return nil
+}
+
+// fileReader turns a file opened through filesystem.Directory into an
+// io.ReadCloser, so that it may be used to construct a buffer.
+type fileReader struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *fileReader) Close() error {
+	return r.closer.Close()
+}
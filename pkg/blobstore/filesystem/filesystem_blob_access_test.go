@@ -0,0 +1,152 @@
+package filesystem_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	blobstore_filesystem "github.com/buildbarn/bb-storage/pkg/blobstore/filesystem"
+	"github.com/buildbarn/bb-storage/pkg/filesystem"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFilesystemBlobAccess(t *testing.T) {
+	ctx := context.Background()
+
+	p := filepath.Join(os.Getenv("TEST_TMPDIR"), t.Name())
+	require.NoError(t, os.Mkdir(p, 0777))
+	directory, err := filesystem.NewLocalDirectory(p)
+	require.NoError(t, err)
+	defer directory.Close()
+	blobAccess := blobstore_filesystem.NewFilesystemBlobAccess(directory, 1, 2)
+
+	helloDigest := util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		_, err := blobAccess.Get(ctx, helloDigest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{helloDigest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{helloDigest}, missing)
+	})
+
+	t.Run("Present", func(t *testing.T) {
+		require.NoError(t, blobAccess.Put(ctx, helloDigest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+
+		// Blobs should be stored in a subdirectory named
+		// after the first two characters of the hash. No
+		// temporary files should be left behind.
+		entries, err := ioutil.ReadDir(filepath.Join(p, "8b"))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "1a9953c4611296a827abf8c47804d7", entries[0].Name())
+
+		data, err := blobAccess.Get(ctx, helloDigest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{helloDigest})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+
+		// Writing the same blob once more should be permitted.
+		require.NoError(t, blobAccess.Put(ctx, helloDigest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		require.NoError(t, blobstore.Delete(ctx, blobAccess, helloDigest))
+
+		_, err := blobAccess.Get(ctx, helloDigest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{helloDigest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{helloDigest}, missing)
+
+		// Deleting blobs that are absent should not be an error.
+		require.NoError(t, blobstore.Delete(ctx, blobAccess, helloDigest))
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		// Blobs whose contents don't match the digest should
+		// be removed upon access.
+		corruptedDigest := util.MustNewDigest("default", &remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+		require.NoError(t, os.Mkdir(filepath.Join(p, "3e"), 0777))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(p, "3e", "25960a79dbc69b674cd4ec67a72c62"), []byte("Hello xorld"), 0444))
+
+		_, err := blobAccess.Get(ctx, corruptedDigest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Internal, "Buffer has checksum 5e479f49e3204db0d34ab93a37747d9a, while 3e25960a79dbc69b674cd4ec67a72c62 was expected"), err)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{corruptedDigest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{corruptedDigest}, missing)
+	})
+}
+
+func TestFilesystemBlobAccessShardingDepth(t *testing.T) {
+	ctx := context.Background()
+
+	p := filepath.Join(os.Getenv("TEST_TMPDIR"), t.Name())
+	require.NoError(t, os.Mkdir(p, 0777))
+	directory, err := filesystem.NewLocalDirectory(p)
+	require.NoError(t, err)
+	defer directory.Close()
+	blobAccess := blobstore_filesystem.NewFilesystemBlobAccess(directory, 3, 1)
+
+	helloDigest := util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("Placement", func(t *testing.T) {
+		// Blobs should be stored in three levels of
+		// subdirectories, each named after a single character
+		// of the hash.
+		require.NoError(t, blobAccess.Put(ctx, helloDigest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+
+		entries, err := ioutil.ReadDir(filepath.Join(p, "8", "b", "1"))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "a9953c4611296a827abf8c47804d7", entries[0].Name())
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		data, err := blobAccess.Get(ctx, helloDigest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{helloDigest})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+
+		// Blobs placed at a different depth should not be
+		// found, as changing the sharding depth requires the
+		// directory to be rebuilt.
+		otherDigest := util.MustNewDigest("default", &remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+		require.NoError(t, os.Mkdir(filepath.Join(p, "3e"), 0777))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(p, "3e", "25960a79dbc69b674cd4ec67a72c62"), []byte("Hello world"), 0444))
+
+		missing, err = blobAccess.FindMissing(ctx, []*util.Digest{otherDigest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{otherDigest}, missing)
+	})
+}
@@ -0,0 +1,112 @@
+package gcs
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// googleDefaultChunkSizeBytes is the chunk size that is used by the
+// Google Cloud Storage client library by default.
+const googleDefaultChunkSizeBytes = 16 * 1024 * 1024
+
+type gcsBlobAccess struct {
+	bucket      *storage.BucketHandle
+	keyPrefix   string
+	storageType blobstore.StorageType
+}
+
+// NewGCSBlobAccess creates a BlobAccess that stores blobs as objects
+// in a Google Cloud Storage bucket. Unlike NewCloudBlobAccess(), it
+// uses the Google Cloud Storage client library directly. This permits
+// passing the size of objects to the client library, so that uploads
+// of small objects don't require a full chunk of memory to be
+// allocated.
+func NewGCSBlobAccess(bucket *storage.BucketHandle, keyPrefix string, storageType blobstore.StorageType) blobstore.BlobAccess {
+	return &gcsBlobAccess{
+		bucket:      bucket,
+		keyPrefix:   keyPrefix,
+		storageType: storageType,
+	}
+}
+
+// convertError converts errors returned by the Google Cloud Storage
+// client library to gRPC status errors. Objects that don't exist are
+// reported as NOT_FOUND, so that they are treated as cache misses.
+func convertError(err error) error {
+	if err == storage.ErrObjectNotExist {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return err
+}
+
+func (ba *gcsBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	object := ba.getObject(digest)
+	r, err := object.NewReader(ctx)
+	if err != nil {
+		return buffer.NewBufferFromError(convertError(err))
+	}
+	return ba.storageType.NewBufferFromReader(
+		digest,
+		r,
+		buffer.Reparable(digest, func() error {
+			return convertError(object.Delete(ctx))
+		}))
+}
+
+func (ba *gcsBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	sizeBytes, err := b.GetSizeBytes()
+	if err != nil {
+		b.Discard()
+		return err
+	}
+	r := b.ToReader()
+	defer r.Close()
+
+	// Canceling the context before closing the writer causes the
+	// upload to be aborted.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := ba.getObject(digest).NewWriter(ctx)
+	if sizeBytes < int64(googleDefaultChunkSizeBytes) {
+		// Objects smaller than a single chunk are uploaded in a
+		// single request. Only allocate as much memory as the
+		// object needs.
+		w.ChunkSize = int(sizeBytes)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (ba *gcsBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	var missing []*util.Digest
+	for _, digest := range digests {
+		if _, err := ba.getObject(digest).Attrs(ctx); err == storage.ErrObjectNotExist {
+			missing = append(missing, digest)
+		} else if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to obtain attributes of object for blob %s", digest)
+		}
+	}
+	return missing, nil
+}
+
+func (ba *gcsBlobAccess) GetStats(ctx context.Context) (int64, int64, int64, error) {
+	// Cloud-based object stores are effectively unbounded. Their
+	// usage cannot be determined without listing all objects.
+	return blobstore.UnknownStorageSize, blobstore.UnknownStorageSize, blobstore.UnknownStorageSize, nil
+}
+
+func (ba *gcsBlobAccess) getObject(digest *util.Digest) *storage.ObjectHandle {
+	return ba.bucket.Object(ba.keyPrefix + ba.storageType.GetDigestKey(digest))
+}
@@ -0,0 +1,239 @@
+package gcs_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/gcs"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeGCSServer is a minimal implementation of the Google Cloud
+// Storage APIs used by the client library. It supports downloading
+// objects, obtaining object attributes, deleting objects and
+// performing single request (multipart) uploads against a single
+// bucket.
+type fakeGCSServer struct {
+	bucket string
+
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeGCSServer) writeObjectMetadata(w http.ResponseWriter, name string, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"bucket": s.bucket,
+		"name":   name,
+		"size":   strconv.Itoa(len(data)),
+	})
+}
+
+func (s *fakeGCSServer) writeNotFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	io.WriteString(w, `{"error":{"code":404,"message":"Not Found"}}`)
+}
+
+func (s *fakeGCSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	jsonPrefix := "/storage/v1/b/" + s.bucket + "/o/"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/"+s.bucket+"/o":
+		// Single request upload, consisting of a part with
+		// metadata, followed by a part with the object.
+		if r.URL.Query().Get("uploadType") != "multipart" {
+			http.Error(w, "Only multipart uploads are supported", http.StatusNotImplemented)
+			return
+		}
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parts := multipart.NewReader(r.Body, params["boundary"])
+		metadataPart, err := parts.NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var metadata struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(metadataPart).Decode(&metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dataPart, err := parts.NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(dataPart)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[metadata.Name] = data
+		s.writeObjectMetadata(w, metadata.Name, data)
+	case strings.HasPrefix(r.URL.Path, jsonPrefix):
+		name := strings.TrimPrefix(r.URL.Path, jsonPrefix)
+		data, ok := s.objects[name]
+		if !ok {
+			s.writeNotFound(w)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.writeObjectMetadata(w, name, data)
+		case http.MethodDelete:
+			delete(s.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/"+s.bucket+"/"):
+		// Object downloads.
+		data, ok := s.objects[strings.TrimPrefix(r.URL.Path, "/"+s.bucket+"/")]
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("X-Goog-Generation", "1")
+		w.Write(data)
+	default:
+		http.Error(w, "Unsupported request", http.StatusNotImplemented)
+	}
+}
+
+// redirectingRoundTripper sends all requests to the fake server,
+// regardless of the host name used by the client library.
+type redirectingRoundTripper struct {
+	target *url.URL
+}
+
+func (rt redirectingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	redirected := *r
+	u := *r.URL
+	u.Scheme = rt.target.Scheme
+	u.Host = rt.target.Host
+	redirected.URL = &u
+	redirected.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(&redirected)
+}
+
+func TestGCSBlobAccess(t *testing.T) {
+	ctx := context.Background()
+
+	fakeServer := &fakeGCSServer{
+		bucket:  "my-bucket",
+		objects: map[string][]byte{},
+	}
+	httpServer := httptest.NewServer(fakeServer)
+	defer httpServer.Close()
+	target, err := url.Parse(httpServer.URL)
+	require.NoError(t, err)
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{
+		Transport: redirectingRoundTripper{target: target},
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	blobAccess := gcs.NewGCSBlobAccess(client.Bucket("my-bucket"), "cas/", blobstore.CASStorageType)
+	digestHello := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	digestGoodbye := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "35f7fc6f4fc7b7ecc13b5ad1e0d2b0e3",
+			SizeBytes: 13,
+		})
+
+	t.Run("GetNotFound", func(t *testing.T) {
+		_, err := blobAccess.Get(ctx, digestHello).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, storage.ErrObjectNotExist.Error()), err)
+	})
+
+	t.Run("FindMissingAllMissing", func(t *testing.T) {
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestHello, digestGoodbye})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestHello, digestGoodbye}, missing)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		// Objects should be stored under the key prefix.
+		require.NoError(t, blobAccess.Put(ctx, digestHello, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		fakeServer.lock.Lock()
+		require.Equal(t, map[string][]byte{
+			"cas/3e25960a79dbc69b674cd4ec67a72c62-11": []byte("Hello world"),
+		}, fakeServer.objects)
+		fakeServer.lock.Unlock()
+	})
+
+	t.Run("PutBufferError", func(t *testing.T) {
+		// Errors obtaining the size of the buffer should be
+		// propagated without uploading anything.
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Disk on fire"),
+			blobAccess.Put(ctx, digestGoodbye, buffer.NewBufferFromError(status.Error(codes.Internal, "Disk on fire"))))
+	})
+
+	t.Run("FindMissingSomePresent", func(t *testing.T) {
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestHello, digestGoodbye})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestGoodbye}, missing)
+	})
+
+	t.Run("GetSuccess", func(t *testing.T) {
+		data, err := blobAccess.Get(ctx, digestHello).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("GetCorrupted", func(t *testing.T) {
+		// Objects whose contents don't match their digest
+		// should be deleted, so that they can be uploaded once
+		// again.
+		fakeServer.lock.Lock()
+		fakeServer.objects["cas/35f7fc6f4fc7b7ecc13b5ad1e0d2b0e3-13"] = []byte("Goodbye WORLD")
+		fakeServer.lock.Unlock()
+
+		_, err := blobAccess.Get(ctx, digestGoodbye).ToByteSlice(100)
+		require.Equal(t, codes.Internal, status.Code(err))
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digestHello, digestGoodbye})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digestGoodbye}, missing)
+	})
+}
@@ -0,0 +1,104 @@
+package blobstore
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+// GetTransform is a streaming transformation that may be applied to the
+// contents of blobs when they are served to clients that expect a
+// different framing (e.g., gzip or base64 encoded data).
+type GetTransform interface {
+	Transform(r io.ReadCloser) io.ReadCloser
+}
+
+// GetTransformingBlobAccess is a BlobAccess that is capable of serving
+// the contents of blobs with a transformation applied.
+type GetTransformingBlobAccess interface {
+	BlobAccess
+
+	// GetTransformed returns the contents of a blob with the
+	// transformation applied. The digest refers to the
+	// untransformed contents of the blob, which are validated
+	// before being transformed.
+	GetTransformed(ctx context.Context, digest *util.Digest) io.ReadCloser
+}
+
+type getTransformingBlobAccess struct {
+	BlobAccess
+	transform GetTransform
+}
+
+// NewGetTransformingBlobAccess creates a decorator for BlobAccess that
+// provides a GetTransformed() function, returning blobs with a
+// transformation applied. As the transformation is only applied when
+// serving data, the data stored in the backend and returned by Get()
+// remains unaltered.
+func NewGetTransformingBlobAccess(base BlobAccess, transform GetTransform) GetTransformingBlobAccess {
+	return &getTransformingBlobAccess{
+		BlobAccess: base,
+		transform:  transform,
+	}
+}
+
+func (ba *getTransformingBlobAccess) GetTransformed(ctx context.Context, digest *util.Digest) io.ReadCloser {
+	return ba.transform.Transform(ba.BlobAccess.Get(ctx, digest).ToReader())
+}
+
+type writerGetTransform struct {
+	newWriter func(w io.Writer) io.WriteCloser
+}
+
+// transformingReader is the reader returned by writerGetTransform. The
+// original reader is owned by the goroutine that applies the
+// transformation. Closing the transformed reader terminates this
+// goroutine and waits for it to finish, so that the original reader
+// is closed by the time Close() returns.
+type transformingReader struct {
+	*io.PipeReader
+	done <-chan struct{}
+}
+
+func (r transformingReader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
+}
+
+func (t writerGetTransform) Transform(r io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := t.newWriter(pw)
+		_, err := io.Copy(w, r)
+		r.Close()
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return transformingReader{
+		PipeReader: pr,
+		done:       done,
+	}
+}
+
+// GzipGetTransform compresses the contents of blobs using gzip.
+var GzipGetTransform GetTransform = writerGetTransform{
+	newWriter: func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	},
+}
+
+// Base64GetTransform encodes the contents of blobs using standard
+// base64 encoding.
+var Base64GetTransform GetTransform = writerGetTransform{
+	newWriter: func(w io.Writer) io.WriteCloser {
+		return base64.NewEncoder(base64.StdEncoding, w)
+	},
+}
@@ -0,0 +1,110 @@
+package blobstore_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetTransformingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("Base64", func(t *testing.T) {
+		blobAccess := blobstore.NewGetTransformingBlobAccess(baseBlobAccess, blobstore.Base64GetTransform)
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewCASBufferFromByteSlice(digest, []byte("Hello world"), buffer.UserProvided))
+
+		r := blobAccess.GetTransformed(ctx, digest)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("SGVsbG8gd29ybGQ="), data)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("Gzip", func(t *testing.T) {
+		blobAccess := blobstore.NewGetTransformingBlobAccess(baseBlobAccess, blobstore.GzipGetTransform)
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewCASBufferFromByteSlice(digest, []byte("Hello world"), buffer.UserProvided))
+
+		r := blobAccess.GetTransformed(ctx, digest)
+		gr, err := gzip.NewReader(r)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(gr)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		// Errors returned by the backend should be propagated.
+		blobAccess := blobstore.NewGetTransformingBlobAccess(baseBlobAccess, blobstore.Base64GetTransform)
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+
+		r := blobAccess.GetTransformed(ctx, digest)
+		_, err := ioutil.ReadAll(r)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+		r.Close()
+	})
+
+	t.Run("CloseEarly", func(t *testing.T) {
+		// Closing the transformed reader before all data has
+		// been consumed should cause the original reader to be
+		// closed before Close() returns.
+		blobAccess := blobstore.NewGetTransformingBlobAccess(baseBlobAccess, blobstore.Base64GetTransform)
+		largeDigest := util.MustNewDigest(
+			"default",
+			&remoteexecution.Digest{
+				Hash:      "09f34d28e9c8bb445ec996388968a9e8",
+				SizeBytes: 1 << 30,
+			})
+		reader := mock.NewMockReadCloser(ctrl)
+		reader.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+			return len(p), nil
+		}).AnyTimes()
+		closed := false
+		reader.EXPECT().Close().DoAndReturn(func() error {
+			closed = true
+			return nil
+		})
+		baseBlobAccess.EXPECT().Get(ctx, largeDigest).Return(buffer.NewCASBufferFromReader(largeDigest, reader, buffer.UserProvided))
+
+		r := blobAccess.GetTransformed(ctx, largeDigest)
+		var data [4]byte
+		_, err := io.ReadFull(r, data[:])
+		require.NoError(t, err)
+		require.Equal(t, []byte("AAAA"), data[:])
+		require.NoError(t, r.Close())
+		require.True(t, closed)
+	})
+
+	t.Run("Untransformed", func(t *testing.T) {
+		// Regular calls to Get() should return the original
+		// data.
+		blobAccess := blobstore.NewGetTransformingBlobAccess(baseBlobAccess, blobstore.Base64GetTransform)
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+}
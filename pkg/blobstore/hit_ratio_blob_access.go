@@ -0,0 +1,112 @@
+package blobstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	hitRatioBlobAccessPrometheusMetrics sync.Once
+
+	hitRatioBlobAccessGetResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "hit_ratio_blob_access_get_results_total",
+			Help:      "Number of Get() operations, per instance name and outcome.",
+		},
+		[]string{"storage_type", "instance_name", "result"})
+)
+
+// HitRatioOtherInstanceName is the value of the "instance_name" label
+// used by HitRatioBlobAccess for instance names that exceed the
+// configured limit.
+const HitRatioOtherInstanceName = "__other__"
+
+type hitRatioBlobAccess struct {
+	BlobAccess
+	storageTypeName      string
+	maximumInstanceNames int
+
+	lock          sync.Mutex
+	instanceNames map[string]struct{}
+}
+
+// NewHitRatioBlobAccess creates a decorator for BlobAccess that counts
+// the outcomes of Get() operations, labeled by instance name. Outcomes
+// are categorized as "Hit", "Miss" (NOT_FOUND) and "Error" (any other
+// error), so that operators can compute per-tenant hit ratios to
+// determine cache sizing.
+//
+// To bound the cardinality of the resulting metrics, only the first
+// maximumInstanceNames instance names observed are tracked
+// individually. Any further instance names are aggregated under
+// HitRatioOtherInstanceName.
+func NewHitRatioBlobAccess(blobAccess BlobAccess, storageTypeName string, maximumInstanceNames int) BlobAccess {
+	hitRatioBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(hitRatioBlobAccessGetResults)
+	})
+
+	return &hitRatioBlobAccess{
+		BlobAccess:           blobAccess,
+		storageTypeName:      storageTypeName,
+		maximumInstanceNames: maximumInstanceNames,
+		instanceNames:        map[string]struct{}{},
+	}
+}
+
+// getInstanceNameLabel returns the value of the "instance_name" label
+// to use for a given instance name.
+func (ba *hitRatioBlobAccess) getInstanceNameLabel(instanceName string) string {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if _, ok := ba.instanceNames[instanceName]; ok {
+		return instanceName
+	}
+	if len(ba.instanceNames) < ba.maximumInstanceNames {
+		ba.instanceNames[instanceName] = struct{}{}
+		return instanceName
+	}
+	return HitRatioOtherInstanceName
+}
+
+func (ba *hitRatioBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	return buffer.WithErrorHandler(
+		ba.BlobAccess.Get(ctx, digest),
+		&hitRatioErrorHandler{
+			blobAccess:   ba,
+			instanceName: digest.GetInstance(),
+			result:       "Hit",
+		})
+}
+
+type hitRatioErrorHandler struct {
+	blobAccess   *hitRatioBlobAccess
+	instanceName string
+	result       string
+}
+
+func (eh *hitRatioErrorHandler) OnError(err error) (buffer.Buffer, error) {
+	if status.Code(err) == codes.NotFound {
+		eh.result = "Miss"
+	} else {
+		eh.result = "Error"
+	}
+	return nil, err
+}
+
+func (eh *hitRatioErrorHandler) Done() {
+	ba := eh.blobAccess
+	hitRatioBlobAccessGetResults.WithLabelValues(
+		ba.storageTypeName,
+		ba.getInstanceNameLabel(eh.instanceName),
+		eh.result).Inc()
+}
@@ -0,0 +1,95 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHitRatioBlobAccessGet(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewHitRatioBlobAccess(baseBlobAccess, "hit_ratio_test", 1)
+	newDigest := func(instance string) *util.Digest {
+		return util.MustNewDigest(
+			instance,
+			&remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			})
+	}
+	getCount := func(instanceName string, result string) float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "buildbarn_blobstore_hit_ratio_blob_access_get_results_total" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				if labels["storage_type"] == "hit_ratio_test" && labels["instance_name"] == instanceName && labels["result"] == result {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+		return 0
+	}
+
+	t.Run("Hit", func(t *testing.T) {
+		digest := newDigest("default")
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		require.Equal(t, 1.0, getCount("default", "Hit"))
+	})
+
+	t.Run("Miss", func(t *testing.T) {
+		// NOT_FOUND errors should not be reported as errors.
+		digest := newDigest("default")
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+		require.Equal(t, 1.0, getCount("default", "Miss"))
+		require.Equal(t, 0.0, getCount("default", "Error"))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		digest := newDigest("default")
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.Internal, "Server on fire")))
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Internal, "Server on fire"), err)
+		require.Equal(t, 1.0, getCount("default", "Error"))
+	})
+
+	t.Run("CardinalityLimit", func(t *testing.T) {
+		// Only a single instance name may be tracked. Any other
+		// instance names should be aggregated.
+		digest := newDigest("other")
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, 0.0, getCount("other", "Hit"))
+		require.Equal(t, 1.0, getCount(blobstore.HitRatioOtherInstanceName, "Hit"))
+	})
+}
@@ -0,0 +1,185 @@
+package blobstore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	hotBlobCachingBlobAccessPrometheusMetrics sync.Once
+
+	hotBlobCachingBlobAccessGetOperations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "hot_blob_caching_blob_access_get_operations_total",
+			Help:      "Number of Get() operations performed against the in-memory hot blob cache.",
+		},
+		[]string{"result"})
+	hotBlobCachingBlobAccessGetOperationsHit  = hotBlobCachingBlobAccessGetOperations.WithLabelValues("Hit")
+	hotBlobCachingBlobAccessGetOperationsMiss = hotBlobCachingBlobAccessGetOperations.WithLabelValues("Miss")
+)
+
+type hotBlobCachingBlobAccess struct {
+	BlobAccess
+	storageType           StorageType
+	maximumSizeBytes      int64
+	maximumEntrySizeBytes int64
+
+	lock           sync.Mutex
+	entries        map[string]*list.Element
+	lruList        list.List
+	totalSizeBytes int64
+
+	// Incremented every time entries are removed. This prevents
+	// Get() calls that were in flight while an entry was
+	// overwritten from inserting stale data into the cache.
+	generation uint64
+}
+
+type hotBlobCacheEntry struct {
+	key  string
+	data []byte
+}
+
+// NewHotBlobCachingBlobAccess creates a decorator for BlobAccess that
+// keeps copies of small blobs in memory, so that repeated Get() calls
+// for frequently requested blobs (e.g., Action and Command messages) do
+// not need to access the backend. Blobs are evicted from memory
+// according to a Least Recently Used (LRU) policy, once the total size
+// of all cached blobs exceeds maximumSizeBytes. Blobs larger than
+// maximumEntrySizeBytes are never cached.
+//
+// Cached blobs are removed in case a consumer detects that they are
+// corrupted.
+func NewHotBlobCachingBlobAccess(blobAccess BlobAccess, storageType StorageType, maximumSizeBytes int64, maximumEntrySizeBytes int64) BlobAccess {
+	hotBlobCachingBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(hotBlobCachingBlobAccessGetOperations)
+	})
+
+	return &hotBlobCachingBlobAccess{
+		BlobAccess:            blobAccess,
+		storageType:           storageType,
+		maximumSizeBytes:      maximumSizeBytes,
+		maximumEntrySizeBytes: maximumEntrySizeBytes,
+		entries:               map[string]*list.Element{},
+	}
+}
+
+func (ba *hotBlobCachingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	// Only for the Content Addressable Storage does the size
+	// stored in the digest correspond to the size of the blob. For
+	// other storage types the size is only known after loading it.
+	if ba.storageType == CASStorageType && digest.GetSizeBytes() > ba.maximumEntrySizeBytes {
+		return ba.BlobAccess.Get(ctx, digest)
+	}
+
+	key := ba.storageType.GetDigestKey(digest)
+	switch GetCacheBypassModeFromContext(ctx) {
+	case CacheBypassRead:
+		return ba.BlobAccess.Get(ctx, digest)
+	case CacheBypassReadAndRepopulate:
+		ba.remove(key)
+		return ba.getAndInsert(ctx, digest, key)
+	}
+
+	ba.lock.Lock()
+	var data []byte
+	element, ok := ba.entries[key]
+	if ok {
+		ba.lruList.MoveToBack(element)
+		data = element.Value.(*hotBlobCacheEntry).data
+	}
+	ba.lock.Unlock()
+	if ok {
+		hotBlobCachingBlobAccessGetOperationsHit.Inc()
+		return ba.storageType.NewBufferFromByteSlice(
+			digest,
+			data,
+			buffer.Reparable(digest, func() error {
+				ba.remove(key)
+				return nil
+			}))
+	}
+
+	hotBlobCachingBlobAccessGetOperationsMiss.Inc()
+	return ba.getAndInsert(ctx, digest, key)
+}
+
+// getAndInsert loads a blob from the backend and inserts it into the
+// cache. Converting it to a byte slice causes it to be validated,
+// meaning that only valid blobs end up being cached. Blobs that turn
+// out to be too large to be cached are returned as is.
+func (ba *hotBlobCachingBlobAccess) getAndInsert(ctx context.Context, digest *util.Digest, key string) buffer.Buffer {
+	ba.lock.Lock()
+	generation := ba.generation
+	ba.lock.Unlock()
+
+	b := ba.BlobAccess.Get(ctx, digest)
+	if sizeBytes, err := b.GetSizeBytes(); err != nil || sizeBytes > ba.maximumEntrySizeBytes {
+		return b
+	}
+	data, err := b.ToByteSlice(int(ba.maximumEntrySizeBytes))
+	if err != nil {
+		return buffer.NewBufferFromError(err)
+	}
+	ba.insert(key, data, generation)
+	return buffer.NewValidatedBufferFromByteSlice(data)
+}
+
+func (ba *hotBlobCachingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	// Entries in the Action Cache may be overwritten. Remove any
+	// cached copy after the write completes to prevent returning
+	// stale data. Removing it up front would permit concurrent
+	// Get() calls to insert the old version once again.
+	err := ba.BlobAccess.Put(ctx, digest, b)
+	ba.remove(ba.storageType.GetDigestKey(digest))
+	return err
+}
+
+func (ba *hotBlobCachingBlobAccess) insert(key string, data []byte, generation uint64) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if _, ok := ba.entries[key]; ok || ba.generation != generation {
+		return
+	}
+	ba.entries[key] = ba.lruList.PushBack(&hotBlobCacheEntry{
+		key:  key,
+		data: data,
+	})
+	ba.totalSizeBytes += int64(len(data))
+
+	// Evict the least recently used blobs until we're within the
+	// size limit again.
+	for ba.totalSizeBytes > ba.maximumSizeBytes {
+		ba.removeElement(ba.lruList.Front())
+	}
+}
+
+func (ba *hotBlobCachingBlobAccess) remove(key string) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	ba.generation++
+	if element, ok := ba.entries[key]; ok {
+		ba.removeElement(element)
+	}
+}
+
+func (ba *hotBlobCachingBlobAccess) removeElement(element *list.Element) {
+	entry := ba.lruList.Remove(element).(*hotBlobCacheEntry)
+	ba.totalSizeBytes -= int64(len(entry.data))
+	delete(ba.entries, entry.key)
+}
+
+func (ba *hotBlobCachingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	err := Delete(ctx, ba.BlobAccess, digest)
+	ba.remove(ba.storageType.GetDigestKey(digest))
+	return err
+}
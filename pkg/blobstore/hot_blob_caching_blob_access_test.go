@@ -0,0 +1,167 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHotBlobCachingBlobAccessGet(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewHotBlobCachingBlobAccess(baseBlobAccess, blobstore.CASStorageType, 20, 15)
+	digestHello := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	digestGoodbye := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "35f7fc6f4fc7b7ecc13b5ad1e0d2b0e3",
+			SizeBytes: 13,
+		})
+	digestLarge := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "0f5ab4b0c3ba10b34e8f2ae3fd4b8a5d",
+			SizeBytes: 16,
+		})
+
+	t.Run("BackendFailure", func(t *testing.T) {
+		// Errors should be propagated and not cause anything
+		// to be cached.
+		baseBlobAccess.EXPECT().Get(ctx, digestHello).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+
+		_, err := blobAccess.Get(ctx, digestHello).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+
+	t.Run("Miss", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Get(ctx, digestHello).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := blobAccess.Get(ctx, digestHello).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("Hit", func(t *testing.T) {
+		// The blob should now be served from memory.
+		data, err := blobAccess.Get(ctx, digestHello).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// Blobs exceeding the maximum entry size should never
+		// be cached.
+		for i := 0; i < 2; i++ {
+			baseBlobAccess.EXPECT().Get(ctx, digestLarge).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world!!!!!")))
+
+			data, err := blobAccess.Get(ctx, digestLarge).ToByteSlice(100)
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hello world!!!!!"), data)
+		}
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		// Caching another blob should cause the total size to
+		// exceed the limit, meaning the first blob is evicted.
+		baseBlobAccess.EXPECT().Get(ctx, digestGoodbye).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Goodbye world")))
+
+		data, err := blobAccess.Get(ctx, digestGoodbye).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Goodbye world"), data)
+
+		baseBlobAccess.EXPECT().Get(ctx, digestHello).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err = blobAccess.Get(ctx, digestHello).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("PutInvalidates", func(t *testing.T) {
+		// Writing a blob should remove any cached copy.
+		baseBlobAccess.EXPECT().Put(ctx, digestHello, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+		require.NoError(t, blobAccess.Put(ctx, digestHello, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		baseBlobAccess.EXPECT().Get(ctx, digestHello).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := blobAccess.Get(ctx, digestHello).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("PutDuringGet", func(t *testing.T) {
+		// Data returned by Get() calls that were in flight
+		// while a blob was written should not be cached, as it
+		// may be stale.
+		baseBlobAccess.EXPECT().Put(ctx, digestGoodbye, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+		baseBlobAccess.EXPECT().Get(ctx, digestGoodbye).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest) buffer.Buffer {
+				require.NoError(t, blobAccess.Put(ctx, digestGoodbye, buffer.NewValidatedBufferFromByteSlice([]byte("Goodbye world"))))
+				return buffer.NewValidatedBufferFromByteSlice([]byte("Goodbye world"))
+			})
+		data, err := blobAccess.Get(ctx, digestGoodbye).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Goodbye world"), data)
+
+		baseBlobAccess.EXPECT().Get(ctx, digestGoodbye).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Goodbye world")))
+		data, err = blobAccess.Get(ctx, digestGoodbye).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Goodbye world"), data)
+	})
+}
+
+func TestHotBlobCachingBlobAccessGetActionCache(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewHotBlobCachingBlobAccess(baseBlobAccess, blobstore.ACStorageType, 20, 15)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 1,
+		})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// For the Action Cache, the size in the digest
+		// corresponds to the size of the Action, not to the
+		// size of the ActionResult. Large ActionResults should
+		// be returned without being cached.
+		actionResult := &remoteexecution.ActionResult{
+			StdoutRaw: []byte("This is a lot of output"),
+		}
+		for i := 0; i < 2; i++ {
+			baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewACBufferFromActionResult(actionResult, buffer.Irreparable))
+
+			got, err := blobAccess.Get(ctx, digest).ToActionResult(100)
+			require.NoError(t, err)
+			require.True(t, proto.Equal(actionResult, got))
+		}
+	})
+}
@@ -0,0 +1,328 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	inMemoryBlobAccessPrometheusMetrics sync.Once
+
+	inMemoryBlobAccessSnapshotEntriesSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "in_memory_blob_access_snapshot_entries_skipped_total",
+			Help:      "Number of entries in snapshots that were skipped while loading, due to them being corrupted.",
+		},
+		[]string{"reason"})
+	inMemoryBlobAccessSnapshotEntriesSkippedMalformedDigest = inMemoryBlobAccessSnapshotEntriesSkipped.WithLabelValues("MalformedDigest")
+	inMemoryBlobAccessSnapshotEntriesSkippedInvalidData     = inMemoryBlobAccessSnapshotEntriesSkipped.WithLabelValues("InvalidData")
+	inMemoryBlobAccessSnapshotEntriesSkippedTruncated       = inMemoryBlobAccessSnapshotEntriesSkipped.WithLabelValues("Truncated")
+)
+
+// SnapshottingBlobAccess is a BlobAccess whose contents can be written
+// to a stream and restored at a later point in time, thereby allowing
+// the contents of volatile storage to be persisted across restarts.
+type SnapshottingBlobAccess interface {
+	blobstore.BlobAccess
+
+	// WriteSnapshot writes all blobs stored to a stream.
+	WriteSnapshot(w io.Writer) error
+
+	// LoadSnapshot inserts all blobs contained in a stream
+	// previously created by WriteSnapshot(). Corrupted entries are
+	// skipped.
+	LoadSnapshot(r io.Reader) error
+}
+
+type inMemoryBlobEntry struct {
+	key    string
+	digest *util.Digest
+	data   []byte
+}
+
+type inMemoryBlobAccess struct {
+	storageType      blobstore.StorageType
+	maximumSizeBytes int64
+
+	lock           sync.Mutex
+	entries        map[string]*list.Element
+	lru            *list.List
+	totalSizeBytes int64
+}
+
+// NewInMemoryBlobAccess creates a storage backend that stores blobs in
+// a simple map in memory. Blob contents are never modified after
+// insertion, meaning that they may be shared with callers without
+// copying.
+//
+// The total size of all blobs stored is bounded by maximumSizeBytes.
+// When exceeded, blobs are evicted in least recently used order. Both
+// Get() and Put() cause blobs to become most recently used. This
+// makes this backend suitable as a lightweight fixture in tests and
+// for small deployments.
+func NewInMemoryBlobAccess(storageType blobstore.StorageType, maximumSizeBytes int64) SnapshottingBlobAccess {
+	inMemoryBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(inMemoryBlobAccessSnapshotEntriesSkipped)
+	})
+
+	return &inMemoryBlobAccess{
+		storageType:      storageType,
+		maximumSizeBytes: maximumSizeBytes,
+		entries:          map[string]*list.Element{},
+		lru:              list.New(),
+	}
+}
+
+func (ba *inMemoryBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	key := ba.storageType.GetDigestKey(digest)
+	ba.lock.Lock()
+	element, ok := ba.entries[key]
+	if !ok {
+		ba.lock.Unlock()
+		return buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found"))
+	}
+	ba.lru.MoveToFront(element)
+	entry := element.Value.(*inMemoryBlobEntry)
+	ba.lock.Unlock()
+
+	return ba.storageType.NewBufferFromByteSlice(
+		digest,
+		entry.data,
+		buffer.Reparable(digest, func() error {
+			ba.lock.Lock()
+			// Only remove the entry if it hasn't been
+			// replaced in the meantime.
+			if ba.entries[key] == element {
+				ba.remove(element)
+			}
+			ba.lock.Unlock()
+			return nil
+		}))
+}
+
+func (ba *inMemoryBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	sizeBytes, err := b.GetSizeBytes()
+	if err != nil {
+		b.Discard()
+		return err
+	}
+	if sizeBytes > ba.maximumSizeBytes {
+		b.Discard()
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while this backend is only capable of storing %d bytes", sizeBytes, ba.maximumSizeBytes)
+	}
+	data, err := b.ToByteSlice(int(sizeBytes))
+	if err != nil {
+		return err
+	}
+	ba.insert(digest, data)
+	return nil
+}
+
+func (ba *inMemoryBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	var missing []*util.Digest
+	for _, digest := range digests {
+		if _, ok := ba.entries[ba.storageType.GetDigestKey(digest)]; !ok {
+			missing = append(missing, digest)
+		}
+	}
+	return missing, nil
+}
+
+func (ba *inMemoryBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if element, ok := ba.entries[ba.storageType.GetDigestKey(digest)]; ok {
+		ba.remove(element)
+	}
+	return nil
+}
+
+// insert a blob, evicting the least recently used blobs as needed to
+// stay within the size limit. Blobs that exceed the size limit by
+// themselves are ignored.
+func (ba *inMemoryBlobAccess) insert(digest *util.Digest, data []byte) {
+	sizeBytes := int64(len(data))
+	if sizeBytes > ba.maximumSizeBytes {
+		return
+	}
+	key := ba.storageType.GetDigestKey(digest)
+
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+
+	if element, ok := ba.entries[key]; ok {
+		ba.remove(element)
+	}
+	for ba.totalSizeBytes+sizeBytes > ba.maximumSizeBytes {
+		ba.remove(ba.lru.Back())
+	}
+	ba.entries[key] = ba.lru.PushFront(&inMemoryBlobEntry{
+		key:    key,
+		digest: digest,
+		data:   data,
+	})
+	ba.totalSizeBytes += sizeBytes
+}
+
+// remove an entry from the map and the LRU list.
+func (ba *inMemoryBlobAccess) remove(element *list.Element) {
+	entry := ba.lru.Remove(element).(*inMemoryBlobEntry)
+	delete(ba.entries, entry.key)
+	ba.totalSizeBytes -= int64(len(entry.data))
+}
+
+// Snapshots consist of a sequence of entries, each having the following
+// layout:
+//
+// - Instance name: uvarint length, followed by the name.
+// - Hash: uvarint length, followed by the hexadecimal hash.
+// - Digest size: uvarint.
+// - Data length: uvarint, followed by the blob's contents.
+//
+// The digest size and the data length are stored separately, as they
+// differ for storage types that don't address objects by their
+// contents (e.g., the Action Cache).
+
+func writeSnapshotString(w *bufio.Writer, s string) error {
+	var length [binary.MaxVarintLen64]byte
+	if _, err := w.Write(length[:binary.PutUvarint(length[:], uint64(len(s)))]); err != nil {
+		return err
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+func (ba *inMemoryBlobAccess) WriteSnapshot(w io.Writer) error {
+	// Obtain the list of keys up front. Entries are looked up
+	// individually afterwards, so that the lock is not held while
+	// writing data. Entries removed in the meantime are skipped.
+	ba.lock.Lock()
+	keys := make([]string, 0, len(ba.entries))
+	for key := range ba.entries {
+		keys = append(keys, key)
+	}
+	ba.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, key := range keys {
+		ba.lock.Lock()
+		element, ok := ba.entries[key]
+		ba.lock.Unlock()
+		if !ok {
+			continue
+		}
+		entry := element.Value.(*inMemoryBlobEntry)
+
+		if err := writeSnapshotString(bw, entry.digest.GetInstance()); err != nil {
+			return util.StatusWrapWithCode(err, codes.Internal, "Failed to write snapshot entry")
+		}
+		if err := writeSnapshotString(bw, entry.digest.GetHashString()); err != nil {
+			return util.StatusWrapWithCode(err, codes.Internal, "Failed to write snapshot entry")
+		}
+		var length [binary.MaxVarintLen64]byte
+		if _, err := bw.Write(length[:binary.PutUvarint(length[:], uint64(entry.digest.GetSizeBytes()))]); err != nil {
+			return util.StatusWrapWithCode(err, codes.Internal, "Failed to write snapshot entry")
+		}
+		if _, err := bw.Write(length[:binary.PutUvarint(length[:], uint64(len(entry.data)))]); err != nil {
+			return util.StatusWrapWithCode(err, codes.Internal, "Failed to write snapshot entry")
+		}
+		if _, err := bw.Write(entry.data); err != nil {
+			return util.StatusWrapWithCode(err, codes.Internal, "Failed to write snapshot entry")
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to write snapshot")
+	}
+	return nil
+}
+
+// readSnapshotString reads a length-prefixed string from a snapshot.
+// Lengths are bounded to prevent corrupted snapshots from causing
+// excessive memory allocation.
+func readSnapshotString(r *bufio.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if length > 1024 {
+		return "", status.Errorf(codes.InvalidArgument, "String of %d bytes is too long", length)
+	}
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func (ba *inMemoryBlobAccess) LoadSnapshot(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		// Parse the header of the next entry.
+		instance, err := readSnapshotString(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			inMemoryBlobAccessSnapshotEntriesSkippedTruncated.Inc()
+			return nil
+		}
+		hash, err := readSnapshotString(br)
+		if err != nil {
+			inMemoryBlobAccessSnapshotEntriesSkippedTruncated.Inc()
+			return nil
+		}
+		sizeBytes, err := binary.ReadUvarint(br)
+		if err != nil || sizeBytes > 1<<62 {
+			inMemoryBlobAccessSnapshotEntriesSkippedTruncated.Inc()
+			return nil
+		}
+		dataLength, err := binary.ReadUvarint(br)
+		if err != nil || dataLength > 1<<62 {
+			inMemoryBlobAccessSnapshotEntriesSkippedTruncated.Inc()
+			return nil
+		}
+
+		// Read the contents of the blob. Use a bytes.Buffer, so
+		// that memory is allocated as data is read. A corrupted
+		// size field should not cause excessive allocations.
+		var data bytes.Buffer
+		if _, err := io.CopyN(&data, br, int64(dataLength)); err != nil {
+			inMemoryBlobAccessSnapshotEntriesSkippedTruncated.Inc()
+			return nil
+		}
+
+		digest, err := util.NewDigest(instance, &remoteexecution.Digest{
+			Hash:      hash,
+			SizeBytes: int64(sizeBytes),
+		})
+		if err != nil {
+			inMemoryBlobAccessSnapshotEntriesSkippedMalformedDigest.Inc()
+			continue
+		}
+		validatedData, err := ba.storageType.NewBufferFromByteSlice(digest, data.Bytes(), buffer.Irreparable).ToByteSlice(int(dataLength))
+		if err != nil {
+			inMemoryBlobAccessSnapshotEntriesSkippedInvalidData.Inc()
+			continue
+		}
+		ba.insert(digest, validatedData)
+	}
+}
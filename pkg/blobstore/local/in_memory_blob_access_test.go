@@ -0,0 +1,211 @@
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/local"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInMemoryBlobAccess(t *testing.T) {
+	ctx := context.Background()
+
+	blobAccess := local.NewInMemoryBlobAccess(blobstore.CASStorageType, 1024*1024)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest}, missing)
+	})
+
+	t.Run("Found", func(t *testing.T) {
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		require.NoError(t, blobstore.Delete(ctx, blobAccess, digest))
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest}, missing)
+
+		// Deleting blobs that are absent should not be an error.
+		require.NoError(t, blobstore.Delete(ctx, blobAccess, digest))
+	})
+}
+
+func TestInMemoryBlobAccessSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	digest1 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	digest2 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		})
+
+	blobAccess1 := local.NewInMemoryBlobAccess(blobstore.CASStorageType, 1024*1024)
+	require.NoError(t, blobAccess1.Put(ctx, digest1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	require.NoError(t, blobAccess1.Put(ctx, digest2, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+
+	var snapshot bytes.Buffer
+	require.NoError(t, blobAccess1.WriteSnapshot(&snapshot))
+
+	t.Run("Complete", func(t *testing.T) {
+		blobAccess2 := local.NewInMemoryBlobAccess(blobstore.CASStorageType, 1024*1024)
+		require.NoError(t, blobAccess2.LoadSnapshot(bytes.NewReader(snapshot.Bytes())))
+
+		data, err := blobAccess2.Get(ctx, digest1).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+
+		data, err = blobAccess2.Get(ctx, digest2).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		// Entries that are incomplete should be skipped. Loading
+		// should still succeed, as the snapshot may have been
+		// written partially.
+		blobAccess2 := local.NewInMemoryBlobAccess(blobstore.CASStorageType, 1024*1024)
+		require.NoError(t, blobAccess2.LoadSnapshot(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-1])))
+
+		missing, err := blobAccess2.FindMissing(ctx, []*util.Digest{digest1, digest2})
+		require.NoError(t, err)
+		require.Len(t, missing, 1)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		// Entries whose contents don't match the digest should
+		// be skipped.
+		corrupted := append([]byte(nil), snapshot.Bytes()...)
+		corrupted[len(corrupted)-1] ^= 0xff
+		blobAccess2 := local.NewInMemoryBlobAccess(blobstore.CASStorageType, 1024*1024)
+		require.NoError(t, blobAccess2.LoadSnapshot(bytes.NewReader(corrupted)))
+
+		missing, err := blobAccess2.FindMissing(ctx, []*util.Digest{digest1, digest2})
+		require.NoError(t, err)
+		require.Len(t, missing, 1)
+	})
+}
+
+func TestInMemoryBlobAccessSnapshotActionCache(t *testing.T) {
+	ctx := context.Background()
+
+	// The size stored in the digest of an Action Cache entry
+	// corresponds to the size of the Action, not the size of the
+	// ActionResult. Both should be preserved by snapshots, so that
+	// entries are restored under the original key.
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 1234,
+		})
+	actionResult := &remoteexecution.ActionResult{
+		ExitCode: 1,
+	}
+
+	blobAccess1 := local.NewInMemoryBlobAccess(blobstore.ACStorageType, 1024*1024)
+	require.NoError(t, blobAccess1.Put(ctx, digest, buffer.NewACBufferFromActionResult(actionResult, buffer.UserProvided)))
+
+	var snapshot bytes.Buffer
+	require.NoError(t, blobAccess1.WriteSnapshot(&snapshot))
+
+	blobAccess2 := local.NewInMemoryBlobAccess(blobstore.ACStorageType, 1024*1024)
+	require.NoError(t, blobAccess2.LoadSnapshot(bytes.NewReader(snapshot.Bytes())))
+
+	restoredActionResult, err := blobAccess2.Get(ctx, digest).ToActionResult(100)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(actionResult, restoredActionResult))
+}
+
+func TestInMemoryBlobAccessEviction(t *testing.T) {
+	ctx := context.Background()
+
+	// Provide enough space to store two of the blobs below.
+	blobAccess := local.NewInMemoryBlobAccess(blobstore.CASStorageType, 25)
+	digest1 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	digest2 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "f0ef7081e1539ac00ef5b761b4fb01b3",
+			SizeBytes: 12,
+		})
+	digest3 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "6f5902ac237024bdd0c176cb93063dc4",
+			SizeBytes: 12,
+		})
+
+	require.NoError(t, blobAccess.Put(ctx, digest1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	require.NoError(t, blobAccess.Put(ctx, digest2, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world\n"))))
+
+	// Reading the first blob should make it the most recently
+	// used one. Inserting the third blob should thus cause the
+	// second blob to be evicted.
+	data, err := blobAccess.Get(ctx, digest1).ToByteSlice(100)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello world"), data)
+
+	require.NoError(t, blobAccess.Put(ctx, digest3, buffer.NewValidatedBufferFromByteSlice([]byte("hello world\n"))))
+
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest1, digest2, digest3})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{digest2}, missing)
+
+	// Blobs that exceed the size limit by themselves can't be stored.
+	digest4 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "c3fcd3d76192e4007dfb496cca67e13b",
+			SizeBytes: 26,
+		})
+	require.Equal(
+		t,
+		status.Error(codes.InvalidArgument, "Blob is 26 bytes in size, while this backend is only capable of storing 25 bytes"),
+		blobAccess.Put(ctx, digest4, buffer.NewValidatedBufferFromByteSlice([]byte("abcdefghijklmnopqrstuvwxyz"))))
+}
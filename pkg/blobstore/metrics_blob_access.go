@@ -44,6 +44,14 @@ var (
 			Buckets:   util.DecimalExponentialBuckets(-3, 6, 2),
 		},
 		[]string{"name", "operation", "grpc_code"})
+	blobAccessOperationsTransferredBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "blob_access_operations_transferred_bytes_total",
+			Help:      "Total size of blobs successfully inserted/retrieved, in bytes.",
+		},
+		[]string{"name", "operation"})
 )
 
 type metricsBlobAccess struct {
@@ -52,19 +60,24 @@ type metricsBlobAccess struct {
 
 	getBlobSizeBytes           prometheus.Observer
 	getDurationSeconds         prometheus.ObserverVec
+	getTransferredBytes        prometheus.Counter
 	putBlobSizeBytes           prometheus.Observer
 	putDurationSeconds         prometheus.ObserverVec
+	putTransferredBytes        prometheus.Counter
 	findMissingBatchSize       prometheus.Observer
 	findMissingDurationSeconds prometheus.ObserverVec
 }
 
 // NewMetricsBlobAccess creates an adapter for BlobAccess that adds
-// basic instrumentation in the form of Prometheus metrics.
+// basic instrumentation in the form of Prometheus metrics. Metrics are
+// labeled with the name provided, so that the individual layers of a
+// composed storage stack can be distinguished.
 func NewMetricsBlobAccess(blobAccess BlobAccess, clock clock.Clock, name string) BlobAccess {
 	blobAccessOperationsPrometheusMetrics.Do(func() {
 		prometheus.MustRegister(blobAccessOperationsBlobSizeBytes)
 		prometheus.MustRegister(blobAccessOperationsFindMissingBatchSize)
 		prometheus.MustRegister(blobAccessOperationsDurationSeconds)
+		prometheus.MustRegister(blobAccessOperationsTransferredBytes)
 	})
 
 	return &metricsBlobAccess{
@@ -73,8 +86,10 @@ func NewMetricsBlobAccess(blobAccess BlobAccess, clock clock.Clock, name string)
 
 		getBlobSizeBytes:           blobAccessOperationsBlobSizeBytes.WithLabelValues(name, "Get"),
 		getDurationSeconds:         blobAccessOperationsDurationSeconds.MustCurryWith(map[string]string{"name": name, "operation": "Get"}),
+		getTransferredBytes:        blobAccessOperationsTransferredBytes.WithLabelValues(name, "Get"),
 		putBlobSizeBytes:           blobAccessOperationsBlobSizeBytes.WithLabelValues(name, "Put"),
 		putDurationSeconds:         blobAccessOperationsDurationSeconds.MustCurryWith(map[string]string{"name": name, "operation": "Put"}),
+		putTransferredBytes:        blobAccessOperationsTransferredBytes.WithLabelValues(name, "Put"),
 		findMissingBatchSize:       blobAccessOperationsFindMissingBatchSize.WithLabelValues(name),
 		findMissingDurationSeconds: blobAccessOperationsDurationSeconds.MustCurryWith(map[string]string{"name": name, "operation": "FindMissing"}),
 	}
@@ -86,20 +101,30 @@ func (ba *metricsBlobAccess) updateDurationSeconds(vec prometheus.ObserverVec, c
 
 func (ba *metricsBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
 	ba.getBlobSizeBytes.Observe(float64(digest.GetSizeBytes()))
+	timeStart := ba.clock.Now()
+	b := ba.blobAccess.Get(ctx, digest)
+	// Buffers returned by backends that fail immediately report
+	// their error through OnError() as well.
+	sizeBytes, _ := b.GetSizeBytes()
 	return buffer.WithErrorHandler(
-		ba.blobAccess.Get(ctx, digest),
+		b,
 		&metricsErrorHandler{
 			blobAccess: ba,
-			timeStart:  ba.clock.Now(),
+			timeStart:  timeStart,
+			sizeBytes:  sizeBytes,
 			errorCode:  codes.OK,
 		})
 }
 
 func (ba *metricsBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
 	ba.putBlobSizeBytes.Observe(float64(digest.GetSizeBytes()))
+	sizeBytes, sizeErr := b.GetSizeBytes()
 	timeStart := ba.clock.Now()
 	err := ba.blobAccess.Put(ctx, digest, b)
 	ba.updateDurationSeconds(ba.putDurationSeconds, status.Code(err), timeStart)
+	if err == nil && sizeErr == nil {
+		ba.putTransferredBytes.Add(float64(sizeBytes))
+	}
 	return err
 }
 
@@ -118,9 +143,17 @@ func (ba *metricsBlobAccess) FindMissing(ctx context.Context, digests []*util.Di
 	return digests, err
 }
 
+// Delete forwards calls to the backend, so that the metrics decorator
+// that wraps every backend created from configuration does not hide
+// the backend's ability to delete objects.
+func (ba *metricsBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	return Delete(ctx, ba.blobAccess, digest)
+}
+
 type metricsErrorHandler struct {
 	blobAccess *metricsBlobAccess
 	timeStart  time.Time
+	sizeBytes  int64
 	errorCode  codes.Code
 }
 
@@ -131,4 +164,7 @@ func (eh *metricsErrorHandler) OnError(err error) (buffer.Buffer, error) {
 
 func (eh *metricsErrorHandler) Done() {
 	eh.blobAccess.updateDurationSeconds(eh.blobAccess.getDurationSeconds, eh.errorCode, eh.timeStart)
+	if eh.errorCode == codes.OK {
+		eh.blobAccess.getTransferredBytes.Add(float64(eh.sizeBytes))
+	}
 }
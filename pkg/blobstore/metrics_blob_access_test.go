@@ -0,0 +1,129 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"gocloud.dev/blob/memblob"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsBlobAccessTransferredBytes(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	clock.EXPECT().Now().Return(time.Unix(1000, 0)).AnyTimes()
+	blobAccess := blobstore.NewMetricsBlobAccess(baseBlobAccess, clock, "metrics_test")
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	getTransferredBytes := func(operation string) float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "buildbarn_blobstore_blob_access_operations_transferred_bytes_total" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				if labels["name"] == "metrics_test" && labels["operation"] == operation {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+		return 0
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		require.Equal(t, 11.0, getTransferredBytes("Get"))
+
+		// Failed reads should not be accounted for.
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+		_, err = blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+		require.Equal(t, 11.0, getTransferredBytes("Get"))
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		require.Equal(t, 11.0, getTransferredBytes("Put"))
+
+		// Failed writes should not be accounted for.
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return status.Error(codes.Internal, "Disk on fire")
+			})
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Disk on fire"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		require.Equal(t, 11.0, getTransferredBytes("Put"))
+	})
+}
+
+func TestMetricsBlobAccessDelete(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("Supported", func(t *testing.T) {
+		// Calls to Delete() should be forwarded to backends
+		// that support deleting objects.
+		bucket := memblob.OpenBucket(nil)
+		defer bucket.Close()
+		baseBlobAccess := blobstore.NewCloudBlobAccess(bucket, "cas/", blobstore.CASStorageType, false, 0)
+		blobAccess := blobstore.NewMetricsBlobAccess(baseBlobAccess, mock.NewMockClock(ctrl), "metrics_test")
+
+		require.NoError(t, baseBlobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		require.NoError(t, blobstore.Delete(ctx, blobAccess, digest))
+
+		missing, err := baseBlobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest}, missing)
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		blobAccess := blobstore.NewMetricsBlobAccess(mock.NewMockBlobAccess(ctrl), mock.NewMockClock(ctrl), "metrics_test")
+
+		require.Equal(
+			t,
+			status.Error(codes.Unimplemented, "Backend does not support deleting objects"),
+			blobstore.Delete(ctx, blobAccess, digest))
+	})
+}
@@ -2,8 +2,10 @@ package blobstore
 
 import (
 	"context"
+	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
 	"github.com/buildbarn/bb-storage/pkg/util"
@@ -27,12 +29,47 @@ var (
 		[]string{"direction"})
 	mirroredBlobAccessFindMissingSynchronizationsFromAToB = mirroredBlobAccessFindMissingSynchronizations.WithLabelValues("FromAToB")
 	mirroredBlobAccessFindMissingSynchronizationsFromBToA = mirroredBlobAccessFindMissingSynchronizations.WithLabelValues("FromBToA")
+
+	mirroredBlobAccessGetOperations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "mirrored_blob_access_get_operations_total",
+			Help:      "Number of Get() operations that were initially sent to a backend",
+		},
+		[]string{"backend"})
+	mirroredBlobAccessGetOperationsBackendA = mirroredBlobAccessGetOperations.WithLabelValues("A")
+	mirroredBlobAccessGetOperationsBackendB = mirroredBlobAccessGetOperations.WithLabelValues("B")
+
+	mirroredBlobAccessGetRepairs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "mirrored_blob_access_get_repairs_total",
+			Help:      "Number of blobs synchronized in Get()",
+		},
+		[]string{"direction"})
+	mirroredBlobAccessGetRepairsFromAToB = mirroredBlobAccessGetRepairs.WithLabelValues("FromAToB")
+	mirroredBlobAccessGetRepairsFromBToA = mirroredBlobAccessGetRepairs.WithLabelValues("FromBToA")
+
+	mirroredBlobAccessGetRepairsSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "mirrored_blob_access_get_repairs_skipped_total",
+			Help:      "Number of blobs not synchronized in Get(), due to them being too large to be repaired asynchronously",
+		})
 )
 
 type mirroredBlobAccess struct {
-	backendA BlobAccess
-	backendB BlobAccess
-	round    uint32
+	backendA                      BlobAccess
+	backendB                      BlobAccess
+	readWeightA                   uint32
+	readWeightSum                 uint32
+	maximumMessageSizeBytes       int
+	asynchronousReadRepair        bool
+	asynchronousReadRepairTimeout time.Duration
+	round                         uint32
 }
 
 // NewMirroredBlobAccess creates a BlobAccess that applies operations to
@@ -40,27 +77,58 @@ type mirroredBlobAccess struct {
 // inconsistencies between the two storage backends are detected (i.e.,
 // a blob is only present in one of the backends), the blob is
 // replicated.
-func NewMirroredBlobAccess(backendA BlobAccess, backendB BlobAccess) BlobAccess {
+//
+// Reads are distributed across the backends according to the weights
+// provided, falling back to the other backend in case a blob cannot be
+// obtained. A weight of zero causes a backend to only be used as a
+// fallback. If both weights are zero, reads are distributed equally.
+//
+// Blobs obtained from the fallback backend are written back into the
+// backend that did not contain them. By default, Get() only completes
+// once this write has finished, and fails if the write fails. If
+// asynchronousReadRepair is set, the write is performed in the
+// background and failures are only logged. The blob is copied into
+// memory, so that a slow write does not slow down the caller. Blobs
+// larger than maximumMessageSizeBytes are therefore not repaired. The
+// write is canceled after asynchronousReadRepairTimeout.
+func NewMirroredBlobAccess(backendA BlobAccess, backendB BlobAccess, readWeightA uint32, readWeightB uint32, maximumMessageSizeBytes int, asynchronousReadRepair bool, asynchronousReadRepairTimeout time.Duration) BlobAccess {
 	mirroredBlobAccessPrometheusMetrics.Do(func() {
 		prometheus.MustRegister(mirroredBlobAccessFindMissingSynchronizations)
+		prometheus.MustRegister(mirroredBlobAccessGetOperations)
+		prometheus.MustRegister(mirroredBlobAccessGetRepairs)
+		prometheus.MustRegister(mirroredBlobAccessGetRepairsSkipped)
 	})
 
+	if readWeightA == 0 && readWeightB == 0 {
+		readWeightA, readWeightB = 1, 1
+	}
 	return &mirroredBlobAccess{
-		backendA: backendA,
-		backendB: backendB,
+		backendA:                      backendA,
+		backendB:                      backendB,
+		readWeightA:                   readWeightA,
+		readWeightSum:                 readWeightA + readWeightB,
+		maximumMessageSizeBytes:       maximumMessageSizeBytes,
+		asynchronousReadRepair:        asynchronousReadRepair,
+		asynchronousReadRepairTimeout: asynchronousReadRepairTimeout,
 	}
 }
 
 func (ba *mirroredBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
-	// Alternate requests between storage backends.
+	// Distribute requests between storage backends in proportion
+	// to their weights.
 	var firstBackend, secondBackend BlobAccess
 	var firstBackendName, secondBackendName string
-	if atomic.AddUint32(&ba.round, 1)%2 == 1 {
+	var repairs prometheus.Counter
+	if (atomic.AddUint32(&ba.round, 1)-1)%ba.readWeightSum < ba.readWeightA {
 		firstBackend, secondBackend = ba.backendA, ba.backendB
 		firstBackendName, secondBackendName = "Backend A", "Backend B"
+		repairs = mirroredBlobAccessGetRepairsFromBToA
+		mirroredBlobAccessGetOperationsBackendA.Inc()
 	} else {
 		firstBackend, secondBackend = ba.backendB, ba.backendA
 		firstBackendName, secondBackendName = "Backend B", "Backend A"
+		repairs = mirroredBlobAccessGetRepairsFromAToB
+		mirroredBlobAccessGetOperationsBackendB.Inc()
 	}
 
 	return buffer.WithErrorHandler(
@@ -70,6 +138,8 @@ func (ba *mirroredBlobAccess) Get(ctx context.Context, digest *util.Digest) buff
 			firstBackendName:  firstBackendName,
 			secondBackend:     secondBackend,
 			secondBackendName: secondBackendName,
+			repairs:           repairs,
+			blobAccess:        ba,
 			context:           ctx,
 			digest:            digest,
 		})
@@ -146,6 +216,8 @@ type mirroredErrorHandler struct {
 	firstBackendName  string
 	secondBackend     BlobAccess
 	secondBackendName string
+	repairs           prometheus.Counter
+	blobAccess        *mirroredBlobAccess
 	context           context.Context
 	digest            *util.Digest
 }
@@ -173,12 +245,40 @@ func (eh *mirroredErrorHandler) OnError(err error) (buffer.Buffer, error) {
 	// Consult the other storage backend. It may still have a copy
 	// of the object. Attempt to sync it back to repair this
 	// inconsistency.
-	b1, b2 := eh.secondBackend.Get(eh.context, eh.digest).CloneStream()
+	b := eh.secondBackend.Get(eh.context, eh.digest)
 	eh.secondBackend = nil
+	if ba := eh.blobAccess; ba.asynchronousReadRepair {
+		// Don't let the caller wait for the repair to complete.
+		// The blob is copied into memory, so that the caller
+		// isn't slowed down by the repair. Don't repair blobs
+		// that are too large to be copied.
+		if eh.digest.GetSizeBytes() > int64(ba.maximumMessageSizeBytes) {
+			mirroredBlobAccessGetRepairsSkipped.Inc()
+			return b, nil
+		}
+		b1, b2 := b.CloneCopy(ba.maximumMessageSizeBytes)
+
+		// As the repair may outlive the caller's request, it
+		// cannot use the caller's context.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), ba.asynchronousReadRepairTimeout)
+			defer cancel()
+			if err := eh.firstBackend.Put(ctx, eh.digest, b2); err == nil {
+				eh.repairs.Inc()
+			} else if status.Code(err) != codes.NotFound {
+				log.Printf("Failed to repair blob %s: %s", eh.digest, util.StatusWrap(err, eh.firstBackendName))
+			}
+		}()
+		return b1, nil
+	}
+
+	b1, b2 := b.CloneStream()
 	b1, t := buffer.WithBackgroundTask(b1)
 	go func() {
 		err := eh.firstBackend.Put(eh.context, eh.digest, b2)
-		if err != nil {
+		if err == nil {
+			eh.repairs.Inc()
+		} else {
 			err = util.StatusWrap(err, eh.firstBackendName)
 		}
 		t.Finish(err)
@@ -187,3 +287,19 @@ func (eh *mirroredErrorHandler) OnError(err error) (buffer.Buffer, error) {
 }
 
 func (eh *mirroredErrorHandler) Done() {}
+
+func (ba *mirroredBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	// Remove object from both storage backends.
+	errAChan := make(chan error, 1)
+	go func() {
+		errAChan <- Delete(ctx, ba.backendA, digest)
+	}()
+	errB := Delete(ctx, ba.backendB, digest)
+	if errA := <-errAChan; errA != nil {
+		return util.StatusWrap(errA, "Backend A")
+	}
+	if errB != nil {
+		return util.StatusWrap(errB, "Backend B")
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package blobstore_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/buildbarn/bb-storage/internal/mock"
@@ -38,7 +39,7 @@ func TestMirroredBlobAccessGet(t *testing.T) {
 			backendA.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))),
 		)
 
-		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB)
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, false, time.Minute)
 		for i := 0; i < 3; i++ {
 			data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
 			require.NoError(t, err)
@@ -46,6 +47,37 @@ func TestMirroredBlobAccessGet(t *testing.T) {
 		}
 	})
 
+	t.Run("Weighted", func(t *testing.T) {
+		// Requests should be spread out in proportion to the
+		// weights of the backends.
+		gomock.InOrder(
+			backendA.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))),
+			backendA.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))),
+			backendB.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))),
+			backendA.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))),
+		)
+
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 2, 1, 100, false, time.Minute)
+		for i := 0; i < 4; i++ {
+			data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hello world"), data)
+		}
+	})
+
+	t.Run("FallbackOnly", func(t *testing.T) {
+		// Backends with a weight of zero should only be used
+		// in case the blob cannot be obtained from the other.
+		backendB.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))).Times(2)
+
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 0, 1, 100, false, time.Minute)
+		for i := 0; i < 2; i++ {
+			data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hello world"), data)
+		}
+	})
+
 	t.Run("NotFoundBoth", func(t *testing.T) {
 		// Simulate the case where a blob is not present in both
 		// backends. It will try to synchronize the blob from
@@ -59,7 +91,7 @@ func TestMirroredBlobAccessGet(t *testing.T) {
 				return err
 			})
 
-		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB)
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, false, time.Minute)
 		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
 		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
 	})
@@ -77,7 +109,7 @@ func TestMirroredBlobAccessGet(t *testing.T) {
 				return nil
 			})
 
-		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB)
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, false, time.Minute)
 		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
 		require.NoError(t, err)
 		require.Equal(t, []byte("Hello world"), data)
@@ -94,7 +126,7 @@ func TestMirroredBlobAccessGet(t *testing.T) {
 				return status.Error(codes.Internal, "Server on fire")
 			})
 
-		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB)
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, false, time.Minute)
 		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
 		require.Equal(t, status.Error(codes.Internal, "Backend A: Server on fire"), err)
 	})
@@ -104,7 +136,7 @@ func TestMirroredBlobAccessGet(t *testing.T) {
 
 		// In case of fatal errors, the name of the backend
 		// should be prepended.
-		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB)
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, false, time.Minute)
 		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
 		require.Equal(t, status.Error(codes.Internal, "Backend A: Server on fire"), err)
 	})
@@ -119,10 +151,112 @@ func TestMirroredBlobAccessGet(t *testing.T) {
 				return err
 			})
 
-		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB)
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, false, time.Minute)
 		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
 		require.Equal(t, status.Error(codes.Internal, "Backend B: Server on fire"), err)
 	})
+
+	t.Run("AsynchronousRepairSuccess", func(t *testing.T) {
+		// The blob is only present in the second backend. It
+		// will get synchronized into the first in the
+		// background.
+		backendA.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+		backendB.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		repaired := make(chan struct{})
+		backendA.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello world"), data)
+				close(repaired)
+				return nil
+			})
+
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, true, time.Minute)
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		<-repaired
+	})
+
+	t.Run("AsynchronousRepairError", func(t *testing.T) {
+		// Failures to synchronize the blob into the first
+		// backend should not cause the read to fail.
+		backendA.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+		backendB.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		repaired := make(chan struct{})
+		backendA.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				close(repaired)
+				return status.Error(codes.Internal, "Server on fire")
+			})
+
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, true, time.Minute)
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		<-repaired
+	})
+
+	t.Run("AsynchronousRepairBlocked", func(t *testing.T) {
+		// A repair that blocks should not prevent the caller
+		// from reading the blob. The repair should be subject to
+		// a timeout, as it cannot use the caller's context.
+		backendA.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+		backendB.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		unblock := make(chan struct{})
+		repaired := make(chan struct{})
+		backendA.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				_, ok := ctx.Deadline()
+				require.True(t, ok)
+				<-unblock
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello world"), data)
+				close(repaired)
+				return nil
+			})
+
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, true, time.Minute)
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		close(unblock)
+		<-repaired
+	})
+
+	t.Run("AsynchronousRepairTooLarge", func(t *testing.T) {
+		// Blobs that are too large to be copied into memory
+		// should be returned without being repaired.
+		backendA.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+		backendB.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 10, true, time.Minute)
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("AsynchronousNotFoundBoth", func(t *testing.T) {
+		// If the blob is not present in both backends, the
+		// caller should still observe the error.
+		backendA.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+		backendB.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+		repaired := make(chan struct{})
+		backendA.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				_, err := b.ToByteSlice(100)
+				close(repaired)
+				return err
+			})
+
+		blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, true, time.Minute)
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+		<-repaired
+	})
 }
 
 func TestMirroredBlobAccessPut(t *testing.T) {
@@ -137,7 +271,7 @@ func TestMirroredBlobAccessPut(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		})
-	blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB)
+	blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, false, time.Minute)
 
 	t.Run("Success", func(t *testing.T) {
 		backendA.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(
@@ -226,7 +360,7 @@ func TestMirroredBlobAccessFindMissing(t *testing.T) {
 			SizeBytes: 5,
 		})
 	allDigests := []*util.Digest{digestNone, digestA, digestB, digestBoth}
-	blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB)
+	blobAccess := blobstore.NewMirroredBlobAccess(backendA, backendB, 1, 1, 100, false, time.Minute)
 
 	t.Run("Success", func(t *testing.T) {
 		// Listings of both backends should be requested.
@@ -0,0 +1,101 @@
+package blobstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"golang.org/x/sync/semaphore"
+)
+
+var (
+	multipartUploadLimitingBlobAccessPrometheusMetrics sync.Once
+
+	multipartUploadLimitingBlobAccessUploadsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "multipart_upload_limiting_blob_access_uploads_in_flight",
+			Help:      "Number of multipart uploads that are currently being performed.",
+		})
+)
+
+type multipartUploadLimitingBlobAccess struct {
+	BlobAccess
+	partSizeBytes         int64
+	maximumPartsPerUpload int64
+	uploads               *semaphore.Weighted
+	parts                 *semaphore.Weighted
+}
+
+// NewMultipartUploadLimitingBlobAccess creates a decorator for
+// BlobAccess that limits the number of multipart uploads that may be
+// performed concurrently. Object stores such as S3 split large objects
+// up into parts, of which multiple are buffered in memory while
+// uploading. An unbounded number of concurrent uploads of large objects
+// may thus cause the process to run out of memory.
+//
+// Blobs that fit in a single part are uploaded in a single request and
+// are not subject to these limits. Larger blobs block until both an
+// upload slot is available and a sufficient number of parts may be
+// buffered. The number of parts buffered by a single upload is bounded
+// by maximumPartsPerUpload. A limit of zero disables the respective
+// check.
+func NewMultipartUploadLimitingBlobAccess(blobAccess BlobAccess, partSizeBytes int64, maximumPartsPerUpload int64, maximumConcurrentUploads int64, maximumConcurrentParts int64) BlobAccess {
+	multipartUploadLimitingBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(multipartUploadLimitingBlobAccessUploadsInFlight)
+	})
+
+	ba := &multipartUploadLimitingBlobAccess{
+		BlobAccess:            blobAccess,
+		partSizeBytes:         partSizeBytes,
+		maximumPartsPerUpload: maximumPartsPerUpload,
+	}
+	if maximumConcurrentUploads > 0 {
+		ba.uploads = semaphore.NewWeighted(maximumConcurrentUploads)
+	}
+	if maximumConcurrentParts > 0 {
+		if maximumPartsPerUpload > maximumConcurrentParts {
+			// Prevent uploads from blocking indefinitely.
+			ba.maximumPartsPerUpload = maximumConcurrentParts
+		}
+		ba.parts = semaphore.NewWeighted(maximumConcurrentParts)
+	}
+	return ba
+}
+
+func (ba *multipartUploadLimitingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	sizeBytes := digest.GetSizeBytes()
+	if sizeBytes <= ba.partSizeBytes {
+		return ba.BlobAccess.Put(ctx, digest, b)
+	}
+
+	if ba.uploads != nil {
+		if err := ba.uploads.Acquire(ctx, 1); err != nil {
+			b.Discard()
+			return util.StatusFromContext(ctx)
+		}
+		defer ba.uploads.Release(1)
+	}
+
+	if ba.parts != nil {
+		// The number of parts buffered is bounded by both the
+		// size of the object and the per-upload concurrency.
+		parts := (sizeBytes + ba.partSizeBytes - 1) / ba.partSizeBytes
+		if ba.maximumPartsPerUpload > 0 && parts > ba.maximumPartsPerUpload {
+			parts = ba.maximumPartsPerUpload
+		}
+		if err := ba.parts.Acquire(ctx, parts); err != nil {
+			b.Discard()
+			return util.StatusFromContext(ctx)
+		}
+		defer ba.parts.Release(parts)
+	}
+
+	multipartUploadLimitingBlobAccessUploadsInFlight.Inc()
+	defer multipartUploadLimitingBlobAccessUploadsInFlight.Dec()
+	return ba.BlobAccess.Put(ctx, digest, b)
+}
@@ -0,0 +1,97 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMultipartUploadLimitingBlobAccessPut(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewMultipartUploadLimitingBlobAccess(baseBlobAccess, 10, 5, 1, 0)
+	digestSmall := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 10,
+		})
+	digestLarge1 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "35f7fc6f4fc7b7ecc13b5ad1e0d2b0e3",
+			SizeBytes: 25,
+		})
+	digestLarge2 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "0f5ab4b0c3ba10b34e8f2ae3fd4b8a5d",
+			SizeBytes: 30,
+		})
+
+	// Let a multipart upload hang, so that it holds on to the only
+	// upload slot that is available.
+	uploadStarted := make(chan struct{})
+	uploadUnblocked := make(chan struct{})
+	baseBlobAccess.EXPECT().Put(ctx, digestLarge1, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+			close(uploadStarted)
+			<-uploadUnblocked
+			b.Discard()
+			return nil
+		})
+	uploadDone := make(chan error)
+	go func() {
+		uploadDone <- blobAccess.Put(ctx, digestLarge1, buffer.NewValidatedBufferFromByteSlice(make([]byte, 25)))
+	}()
+	<-uploadStarted
+
+	t.Run("SmallBlob", func(t *testing.T) {
+		// Small blobs are uploaded using a single request.
+		// These should not be blocked.
+		baseBlobAccess.EXPECT().Put(ctx, digestSmall, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+
+		require.NoError(t, blobAccess.Put(ctx, digestSmall, buffer.NewValidatedBufferFromByteSlice(make([]byte, 10))))
+	})
+
+	t.Run("LargeBlobCanceled", func(t *testing.T) {
+		// Large blobs should block until an upload slot becomes
+		// available, or until the request is canceled.
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "context canceled"),
+			blobAccess.Put(canceledCtx, digestLarge2, buffer.NewValidatedBufferFromByteSlice(make([]byte, 30))))
+	})
+
+	close(uploadUnblocked)
+	require.NoError(t, <-uploadDone)
+
+	t.Run("LargeBlobAfterRelease", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Put(ctx, digestLarge2, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+
+		require.NoError(t, blobAccess.Put(ctx, digestLarge2, buffer.NewValidatedBufferFromByteSlice(make([]byte, 30))))
+	})
+}
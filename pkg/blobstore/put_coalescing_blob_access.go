@@ -0,0 +1,144 @@
+package blobstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	putCoalescingBlobAccessPrometheusMetrics sync.Once
+
+	putCoalescingBlobAccessPuts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "put_coalescing_blob_access_puts_total",
+			Help:      "Number of Put() calls, distinguishing calls that were forwarded to the backend from ones that were coalesced with a concurrent call.",
+		},
+		[]string{"result"})
+	putCoalescingBlobAccessPutsForwarded = putCoalescingBlobAccessPuts.WithLabelValues("Forwarded")
+	putCoalescingBlobAccessPutsCoalesced = putCoalescingBlobAccessPuts.WithLabelValues("Coalesced")
+)
+
+type putCoalescingBlobAccess struct {
+	BlobAccess
+	storageType StorageType
+
+	lock        sync.Mutex
+	inFlightPut map[string]*inFlightPut
+}
+
+// inFlightPut keeps track of a Put() call that is being forwarded to
+// the backend. Once completed, done is closed and err contains the
+// result of the call.
+type inFlightPut struct {
+	done chan struct{}
+	err  error
+}
+
+// NewPutCoalescingBlobAccess creates a decorator for BlobAccess that
+// coalesces concurrent Put() calls for the same object. Only the first
+// call is forwarded to the backend. Other calls wait for it to
+// complete, so that identical outputs produced by many clients at the
+// same time are only transferred once.
+//
+// Callers that wait cannot supply their data to the backend at a later
+// point in time, as the data may only be consumed once. They therefore
+// hold on to their buffer until the forwarded call completes. If it
+// succeeds, the buffer is discarded. If it fails, one of the waiting
+// callers retries the upload using its own buffer. This prevents
+// failures specific to a single caller (e.g., cancelation) from
+// affecting others.
+//
+// FindMissing() waits for uploads of the objects that are queried that
+// are in flight. Objects for which the upload succeeded are reported
+// as being present without consulting the backend.
+//
+// This decorator may only be used for the Content Addressable Storage.
+// For other storage types, concurrent writes of the same key may
+// contain different data, meaning that they cannot be coalesced.
+func NewPutCoalescingBlobAccess(blobAccess BlobAccess, storageType StorageType) BlobAccess {
+	putCoalescingBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(putCoalescingBlobAccessPuts)
+	})
+
+	return &putCoalescingBlobAccess{
+		BlobAccess:  blobAccess,
+		storageType: storageType,
+		inFlightPut: map[string]*inFlightPut{},
+	}
+}
+
+func (ba *putCoalescingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	key := ba.storageType.GetDigestKey(digest)
+	for {
+		ba.lock.Lock()
+		p, ok := ba.inFlightPut[key]
+		if !ok {
+			// No upload of this object is in flight. Forward
+			// the call to the backend.
+			p = &inFlightPut{done: make(chan struct{})}
+			ba.inFlightPut[key] = p
+			ba.lock.Unlock()
+			putCoalescingBlobAccessPutsForwarded.Inc()
+
+			p.err = ba.BlobAccess.Put(ctx, digest, b)
+			ba.lock.Lock()
+			delete(ba.inFlightPut, key)
+			ba.lock.Unlock()
+			close(p.done)
+			return p.err
+		}
+		ba.lock.Unlock()
+
+		// Wait for the upload that is in flight to complete.
+		select {
+		case <-p.done:
+			if p.err == nil {
+				putCoalescingBlobAccessPutsCoalesced.Inc()
+				b.Discard()
+				return nil
+			}
+		case <-ctx.Done():
+			b.Discard()
+			return util.StatusFromContext(ctx)
+		}
+	}
+}
+
+func (ba *putCoalescingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	// Look up uploads of the objects that are in flight.
+	var waitDigests []*util.Digest
+	var waitPuts []*inFlightPut
+	remainingDigests := make([]*util.Digest, 0, len(digests))
+	ba.lock.Lock()
+	for _, digest := range digests {
+		if p, ok := ba.inFlightPut[ba.storageType.GetDigestKey(digest)]; ok {
+			waitDigests = append(waitDigests, digest)
+			waitPuts = append(waitPuts, p)
+		} else {
+			remainingDigests = append(remainingDigests, digest)
+		}
+	}
+	ba.lock.Unlock()
+
+	// Objects whose upload succeeded don't need to be checked.
+	for i, p := range waitPuts {
+		select {
+		case <-p.done:
+			if p.err != nil {
+				remainingDigests = append(remainingDigests, waitDigests[i])
+			}
+		case <-ctx.Done():
+			return nil, util.StatusFromContext(ctx)
+		}
+	}
+	if len(remainingDigests) == 0 {
+		return nil, nil
+	}
+	return ba.BlobAccess.FindMissing(ctx, remainingDigests)
+}
@@ -0,0 +1,252 @@
+package blobstore_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// waitNotifyingContext is a context that signals when Done() is
+// called. This allows tests to determine that PutCoalescingBlobAccess
+// is blocked waiting for an upload that is in flight.
+type waitNotifyingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan struct{}
+}
+
+func newWaitNotifyingContext(ctx context.Context) *waitNotifyingContext {
+	return &waitNotifyingContext{
+		Context: ctx,
+		waiting: make(chan struct{}),
+	}
+}
+
+func (ctx *waitNotifyingContext) Done() <-chan struct{} {
+	ctx.once.Do(func() { close(ctx.waiting) })
+	return ctx.Context.Done()
+}
+
+func TestPutCoalescingBlobAccessPut(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewPutCoalescingBlobAccess(baseBlobAccess, blobstore.CASStorageType)
+	digest := util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("WaitCanceled", func(t *testing.T) {
+		// Let the first call block, so that other calls are
+		// forced to wait for it.
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				close(started)
+				<-unblock
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello"), data)
+				return nil
+			})
+
+		leaderErr := make(chan error, 1)
+		go func() {
+			leaderErr <- blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello")))
+		}()
+		<-started
+
+		// Calls that wait for the upload in flight should not
+		// contact the backend. They should still respect
+		// cancelation.
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "context canceled"),
+			blobAccess.Put(canceledCtx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+		_, err := blobAccess.FindMissing(canceledCtx, []*util.Digest{digest})
+		require.Equal(t, status.Error(codes.Canceled, "context canceled"), err)
+
+		close(unblock)
+		require.NoError(t, <-leaderErr)
+	})
+
+	t.Run("LeaderFailure", func(t *testing.T) {
+		// When the call that is forwarded to the backend fails,
+		// a waiting call should retry using its own buffer.
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		gomock.InOrder(
+			baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+				func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+					close(started)
+					<-unblock
+					b.Discard()
+					return status.Error(codes.Unavailable, "Server not reachable")
+				}),
+			baseBlobAccess.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(
+				func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+					data, err := b.ToByteSlice(100)
+					require.NoError(t, err)
+					require.Equal(t, []byte("Hello"), data)
+					return nil
+				}))
+
+		leaderErr := make(chan error, 1)
+		go func() {
+			leaderErr <- blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello")))
+		}()
+		<-started
+
+		// Only let the leader fail after the waiter has started
+		// waiting for it.
+		waiterCtx := newWaitNotifyingContext(ctx)
+		waiterErr := make(chan error, 1)
+		go func() {
+			waiterErr <- blobAccess.Put(waiterCtx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello")))
+		}()
+		<-waiterCtx.waiting
+		close(unblock)
+		require.Equal(t, status.Error(codes.Unavailable, "Server not reachable"), <-leaderErr)
+		require.NoError(t, <-waiterErr)
+	})
+
+	t.Run("WaiterCoalesced", func(t *testing.T) {
+		// When the call that is forwarded to the backend
+		// succeeds, waiting calls should complete without
+		// contacting the backend.
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				close(started)
+				<-unblock
+				b.Discard()
+				return nil
+			})
+
+		leaderErr := make(chan error, 1)
+		go func() {
+			leaderErr <- blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello")))
+		}()
+		<-started
+
+		waiterCtx := newWaitNotifyingContext(ctx)
+		waiterErr := make(chan error, 1)
+		go func() {
+			waiterErr <- blobAccess.Put(waiterCtx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello")))
+		}()
+		<-waiterCtx.waiting
+		close(unblock)
+		require.NoError(t, <-leaderErr)
+		require.NoError(t, <-waiterErr)
+	})
+}
+
+func TestPutCoalescingBlobAccessFindMissing(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewPutCoalescingBlobAccess(baseBlobAccess, blobstore.CASStorageType)
+	digest1 := util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	digest2 := util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+		SizeBytes: 11,
+	})
+
+	t.Run("UploadSucceeded", func(t *testing.T) {
+		// Objects whose upload is in flight and succeeds should
+		// be reported as present without consulting the backend.
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		baseBlobAccess.EXPECT().Put(ctx, digest1, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				close(started)
+				<-unblock
+				b.Discard()
+				return nil
+			})
+
+		putErr := make(chan error, 1)
+		go func() {
+			putErr <- blobAccess.Put(ctx, digest1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello")))
+		}()
+		<-started
+
+		findMissingCtx := newWaitNotifyingContext(ctx)
+		type findMissingResult struct {
+			missing []*util.Digest
+			err     error
+		}
+		findMissingResults := make(chan findMissingResult, 1)
+		go func() {
+			missing, err := blobAccess.FindMissing(findMissingCtx, []*util.Digest{digest1})
+			findMissingResults <- findMissingResult{missing: missing, err: err}
+		}()
+		<-findMissingCtx.waiting
+		close(unblock)
+		require.NoError(t, <-putErr)
+		result := <-findMissingResults
+		require.NoError(t, result.err)
+		require.Empty(t, result.missing)
+	})
+
+	t.Run("UploadFailed", func(t *testing.T) {
+		// Objects whose upload failed should be checked against
+		// the backend, together with objects that were not
+		// being uploaded.
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		baseBlobAccess.EXPECT().Put(ctx, digest1, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				close(started)
+				<-unblock
+				b.Discard()
+				return status.Error(codes.Unavailable, "Server not reachable")
+			})
+		baseBlobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{digest2, digest1}).
+			Return([]*util.Digest{digest1}, nil)
+
+		putErr := make(chan error, 1)
+		go func() {
+			putErr <- blobAccess.Put(ctx, digest1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello")))
+		}()
+		<-started
+
+		findMissingCtx := newWaitNotifyingContext(ctx)
+		type findMissingResult struct {
+			missing []*util.Digest
+			err     error
+		}
+		findMissingResults := make(chan findMissingResult, 1)
+		go func() {
+			missing, err := blobAccess.FindMissing(findMissingCtx, []*util.Digest{digest1, digest2})
+			findMissingResults <- findMissingResult{missing: missing, err: err}
+		}()
+		<-findMissingCtx.waiting
+		close(unblock)
+		require.Equal(t, status.Error(codes.Unavailable, "Server not reachable"), <-putErr)
+		result := <-findMissingResults
+		require.NoError(t, result.err)
+		require.Equal(t, []*util.Digest{digest1}, result.missing)
+	})
+}
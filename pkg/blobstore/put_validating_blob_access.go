@@ -0,0 +1,34 @@
+package blobstore
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+type putValidatingBlobAccess struct {
+	BlobAccess
+}
+
+// NewPutValidatingBlobAccess creates a decorator for BlobAccess that
+// validates the contents of objects written into the Content
+// Addressable Storage against their digest, regardless of how the
+// buffer was constructed.
+//
+// Buffers created through NewValidatedBufferFromByteSlice() are
+// normally trusted, as their contents are assumed to have been checked
+// by the caller. This decorator may be used as a hardening measure,
+// ensuring that bugs that cause objects to be written with an
+// incorrect digest are caught before they end up in storage. Writes
+// of objects whose contents don't match the digest fail with
+// INVALID_ARGUMENT.
+func NewPutValidatingBlobAccess(blobAccess BlobAccess) BlobAccess {
+	return &putValidatingBlobAccess{
+		BlobAccess: blobAccess,
+	}
+}
+
+func (ba *putValidatingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	return ba.BlobAccess.Put(ctx, digest, buffer.NewCASBufferFromReader(digest, b.ToReader(), buffer.UserProvided))
+}
@@ -2,6 +2,7 @@ package blobstore
 
 import (
 	"context"
+	"log"
 
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
 	"github.com/buildbarn/bb-storage/pkg/util"
@@ -19,7 +20,8 @@ type readCachingBlobAccess struct {
 // for a slow data store. All writes are performed against the slow data
 // store directly. The slow data store is only accessed for reading in
 // case the fast data store does not contain the blob. The blob is then
-// streamed into the fast data store.
+// streamed into the fast data store. Failures to write into the fast
+// data store are logged, but do not cause reads to fail.
 func NewReadCachingBlobAccess(slow BlobAccess, fast BlobAccess) BlobAccess {
 	return &readCachingBlobAccess{
 		slow: slow,
@@ -28,6 +30,12 @@ func NewReadCachingBlobAccess(slow BlobAccess, fast BlobAccess) BlobAccess {
 }
 
 func (ba *readCachingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	switch GetCacheBypassModeFromContext(ctx) {
+	case CacheBypassRead:
+		return ba.slow.Get(ctx, digest)
+	case CacheBypassReadAndRepopulate:
+		return ba.getFromSlowAndRepopulate(ctx, digest)
+	}
 	return buffer.WithErrorHandler(
 		ba.fast.Get(ctx, digest),
 		&readCachingErrorHandler{
@@ -37,6 +45,24 @@ func (ba *readCachingBlobAccess) Get(ctx context.Context, digest *util.Digest) b
 		})
 }
 
+// getFromSlowAndRepopulate reads a blob from the slow backend, while
+// storing it in the fast backend.
+func (ba *readCachingBlobAccess) getFromSlowAndRepopulate(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	b1, b2 := ba.slow.Get(ctx, digest).CloneStream()
+	b1, t := buffer.WithBackgroundTask(b1)
+	go func() {
+		// The slow backend remains the source of truth. Don't
+		// let the inability to populate the cache fail reads.
+		// NotFound errors originate from the slow backend, and
+		// are already returned to the caller.
+		if err := ba.fast.Put(ctx, digest, b2); err != nil && status.Code(err) != codes.NotFound {
+			log.Printf("Failed to populate fast backend with blob %s: %s", digest, err)
+		}
+		t.Finish(nil)
+	}()
+	return b1
+}
+
 func (ba *readCachingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
 	return ba.slow.Put(ctx, digest, b)
 }
@@ -57,10 +83,19 @@ func (eh *readCachingErrorHandler) OnError(observedErr error) (buffer.Buffer, er
 	}
 	ba := eh.blobAccess
 	eh.blobAccess = nil
-	b1, b2 := ba.slow.Get(eh.context, eh.digest).CloneStream()
-	b1, t := buffer.WithBackgroundTask(b1)
-	go func() { t.Finish(ba.fast.Put(eh.context, eh.digest, b2)) }()
-	return b1, nil
+	return ba.getFromSlowAndRepopulate(eh.context, eh.digest), nil
 }
 
 func (eh *readCachingErrorHandler) Done() {}
+
+func (ba *readCachingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	// Remove the object from the slow backend first. Otherwise,
+	// concurrent reads could repopulate the fast backend.
+	if err := Delete(ctx, ba.slow, digest); err != nil {
+		return util.StatusWrap(err, "Slow backend")
+	}
+	if err := Delete(ctx, ba.fast, digest); err != nil {
+		return util.StatusWrap(err, "Fast backend")
+	}
+	return nil
+}
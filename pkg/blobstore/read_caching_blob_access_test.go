@@ -84,7 +84,9 @@ func TestReadCachingBlobAccessGet(t *testing.T) {
 	})
 
 	t.Run("FastPutError", func(t *testing.T) {
-		// Write errors on the fast backend should propagate.
+		// Write errors on the fast backend should not cause
+		// the read to fail, as the blob can still be obtained
+		// from the slow backend.
 		fastBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
 		slowBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
 		fastBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
@@ -93,8 +95,39 @@ func TestReadCachingBlobAccessGet(t *testing.T) {
 				return status.Error(codes.Internal, "Disk on fire")
 			})
 
-		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
-		require.Equal(t, status.Error(codes.Internal, "Disk on fire"), err)
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("BypassRead", func(t *testing.T) {
+		// When requested, the fast backend should not be
+		// accessed at all.
+		bypassCtx := blobstore.NewContextWithCacheBypassMode(ctx, blobstore.CacheBypassRead)
+		slowBlobAccess.EXPECT().Get(bypassCtx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := blobAccess.Get(bypassCtx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("BypassReadAndRepopulate", func(t *testing.T) {
+		// The blob should be read from the slow backend, even
+		// though the fast backend may contain it. The fresh
+		// copy should be written into the fast backend.
+		bypassCtx := blobstore.NewContextWithCacheBypassMode(ctx, blobstore.CacheBypassReadAndRepopulate)
+		slowBlobAccess.EXPECT().Get(bypassCtx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		fastBlobAccess.EXPECT().Put(bypassCtx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello world"), data)
+				return nil
+			})
+
+		data, err := blobAccess.Get(bypassCtx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
 	})
 }
 
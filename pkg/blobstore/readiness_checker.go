@@ -0,0 +1,100 @@
+package blobstore
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// ReadinessChecker is implemented by storage backends that are capable
+// of reporting whether they are able to serve requests. This interface
+// is optional, as many backends (e.g., ones backed by local memory)
+// are always ready.
+type ReadinessChecker interface {
+	// CheckReadiness returns an error if the backend is currently
+	// unable to serve requests (e.g., because a remote service is
+	// unreachable).
+	CheckReadiness(ctx context.Context) error
+}
+
+var (
+	readinessCheckersLock sync.Mutex
+	readinessCheckers     = map[string][]ReadinessChecker{}
+)
+
+// RegisterReadinessChecker registers a ReadinessChecker, so that it is
+// taken into account by CheckReadiness(). Multiple backends may be
+// registered under the same name (e.g., when multiple shards use the
+// same type of backend), in which case all of them are checked.
+func RegisterReadinessChecker(name string, readinessChecker ReadinessChecker) {
+	readinessCheckersLock.Lock()
+	defer readinessCheckersLock.Unlock()
+	readinessCheckers[name] = append(readinessCheckers[name], readinessChecker)
+}
+
+// CheckReadiness calls into all registered ReadinessCheckers, returning
+// the first error that is encountered.
+func CheckReadiness(ctx context.Context) error {
+	type namedReadinessChecker struct {
+		name    string
+		checker ReadinessChecker
+	}
+
+	readinessCheckersLock.Lock()
+	names := make([]string, 0, len(readinessCheckers))
+	for name := range readinessCheckers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var checkers []namedReadinessChecker
+	for _, name := range names {
+		for _, checker := range readinessCheckers[name] {
+			checkers = append(checkers, namedReadinessChecker{
+				name:    name,
+				checker: checker,
+			})
+		}
+	}
+	readinessCheckersLock.Unlock()
+
+	for _, checker := range checkers {
+		if err := checker.checker.CheckReadiness(ctx); err != nil {
+			return util.StatusWrapf(err, "Backend %#v", checker.name)
+		}
+	}
+	return nil
+}
+
+// ServeReadiness is an HTTP handler that returns the results of
+// CheckReadiness(). It may be used as a readiness probe for load
+// balancers.
+func ServeReadiness(w http.ResponseWriter, r *http.Request) {
+	if err := CheckReadiness(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// checkGRPCReadiness checks whether a remote gRPC server is able to
+// serve requests, using the gRPC health checking protocol. Servers
+// that don't implement this protocol are considered to be ready, as
+// the fact that they responded implies they are reachable.
+func checkGRPCReadiness(ctx context.Context, healthClient grpc_health_v1.HealthClient) error {
+	response, err := healthClient.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return nil
+		}
+		return err
+	}
+	if response.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return status.Errorf(codes.Unavailable, "Server reported status %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package blobstore_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestCheckReadiness(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Register multiple backends under the same name. All of them
+	// should be checked, as opposed to only the first one.
+	checker1 := mock.NewMockReadinessChecker(ctrl)
+	checker2 := mock.NewMockReadinessChecker(ctrl)
+	checker3 := mock.NewMockReadinessChecker(ctrl)
+	blobstore.RegisterReadinessChecker("grpc", checker1)
+	blobstore.RegisterReadinessChecker("grpc", checker2)
+	blobstore.RegisterReadinessChecker("redis", checker3)
+
+	t.Run("Ready", func(t *testing.T) {
+		checker1.EXPECT().CheckReadiness(ctx)
+		checker2.EXPECT().CheckReadiness(ctx)
+		checker3.EXPECT().CheckReadiness(ctx)
+
+		require.NoError(t, blobstore.CheckReadiness(ctx))
+	})
+
+	t.Run("NotReady", func(t *testing.T) {
+		checker1.EXPECT().CheckReadiness(ctx)
+		checker2.EXPECT().CheckReadiness(ctx).Return(status.Error(codes.Unavailable, "Server offline"))
+
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Backend \"grpc\": Server offline"),
+			blobstore.CheckReadiness(ctx))
+	})
+}
+
+func TestGRPCReadiness(t *testing.T) {
+	ctx := context.Background()
+
+	newBlobAccess := func(t *testing.T, healthServer grpc_health_v1.HealthServer) (blobstore.ReadinessChecker, func()) {
+		l := bufconn.Listen(1 << 20)
+		server := grpc.NewServer()
+		if healthServer != nil {
+			grpc_health_v1.RegisterHealthServer(server, healthServer)
+		}
+		go server.Serve(l)
+		conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return l.Dial()
+		}), grpc.WithInsecure())
+		require.NoError(t, err)
+		blobAccess := blobstore.NewContentAddressableStorageBlobAccess(conn, nil, 1<<20)
+		return blobAccess.(blobstore.ReadinessChecker), func() {
+			conn.Close()
+			server.Stop()
+		}
+	}
+
+	t.Run("Unimplemented", func(t *testing.T) {
+		// Servers that don't implement the health checking
+		// protocol should be considered to be ready.
+		blobAccess, cleanup := newBlobAccess(t, nil)
+		defer cleanup()
+
+		require.NoError(t, blobAccess.CheckReadiness(ctx))
+	})
+
+	t.Run("Serving", func(t *testing.T) {
+		healthServer := health.NewServer()
+		healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+		blobAccess, cleanup := newBlobAccess(t, healthServer)
+		defer cleanup()
+
+		require.NoError(t, blobAccess.CheckReadiness(ctx))
+	})
+
+	t.Run("NotServing", func(t *testing.T) {
+		healthServer := health.NewServer()
+		healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+		blobAccess, cleanup := newBlobAccess(t, healthServer)
+		defer cleanup()
+
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Server reported status NOT_SERVING"),
+			blobAccess.CheckReadiness(ctx))
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/go-redis/redis"
 
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // RedisClient is an interface that contains the set of functions of the
@@ -23,24 +24,33 @@ type RedisClient interface {
 type redisBlobAccess struct {
 	redisClient        RedisClient
 	storageType        StorageType
-	keyTTL             time.Duration
+	ttlPolicy          TTLPolicy
 	replicationCount   int64
 	replicationTimeout int
+	maximumSizeBytes   int
 }
 
 // NewRedisBlobAccess creates a BlobAccess that uses Redis as its
-// backing store.
+// backing store. The TTL of keys is computed by a TTLPolicy, permitting
+// blobs to be retained for different amounts of time depending on
+// their size.
+//
+// As all values are held in memory by Redis, this backend is best
+// suited for small objects. Attempts to store blobs larger than
+// maximumSizeBytes are rejected.
 func NewRedisBlobAccess(redisClient RedisClient,
 	storageType StorageType,
-	keyTTL time.Duration,
+	ttlPolicy TTLPolicy,
 	replicationCount int64,
-	replicationTimeout time.Duration) BlobAccess {
+	replicationTimeout time.Duration,
+	maximumSizeBytes int) BlobAccess {
 	return &redisBlobAccess{
 		redisClient:        redisClient,
 		storageType:        storageType,
-		keyTTL:             keyTTL,
+		ttlPolicy:          ttlPolicy,
 		replicationCount:   int64(replicationCount),
 		replicationTimeout: int(replicationTimeout.Milliseconds()),
+		maximumSizeBytes:   maximumSizeBytes,
 	}
 }
 
@@ -68,17 +78,35 @@ func (ba *redisBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffe
 		b.Discard()
 		return err
 	}
-	// Redis can only store values up to 512 MiB in size.
-	value, err := b.ToByteSlice(512 * 1024 * 1024)
+	sizeBytes, err := b.GetSizeBytes()
+	if err != nil {
+		b.Discard()
+		return util.StatusWrap(err, "Failed to put blob")
+	}
+	if sizeBytes > int64(ba.maximumSizeBytes) {
+		b.Discard()
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while this backend is only permitted to store blobs of up to %d bytes in size", sizeBytes, ba.maximumSizeBytes)
+	}
+	value, err := b.ToByteSlice(ba.maximumSizeBytes)
 	if err != nil {
 		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to put blob")
 	}
-	if err := ba.redisClient.Set(ba.storageType.GetDigestKey(digest), value, ba.keyTTL).Err(); err != nil {
+	if err := ba.redisClient.Set(ba.storageType.GetDigestKey(digest), value, ba.ttlPolicy(digest)).Err(); err != nil {
 		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to put blob")
 	}
 	return ba.waitIfReplicationEnabled()
 }
 
+func (ba *redisBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	if err := util.StatusFromContext(ctx); err != nil {
+		return err
+	}
+	if err := ba.redisClient.Del(ba.storageType.GetDigestKey(digest)).Err(); err != nil {
+		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to delete blob")
+	}
+	return ba.waitIfReplicationEnabled()
+}
+
 func (ba *redisBlobAccess) waitIfReplicationEnabled() error {
 	if ba.replicationCount == 0 {
 		return nil
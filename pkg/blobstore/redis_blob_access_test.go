@@ -2,6 +2,7 @@ package blobstore_test
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
@@ -9,6 +10,7 @@ import (
 	"github.com/buildbarn/bb-storage/pkg/blobstore"
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
 	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/go-redis/redis"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
 
@@ -21,7 +23,7 @@ func TestRedisBlobAccessContextCanceled(t *testing.T) {
 	defer ctrl.Finish()
 
 	redisClient := mock.NewMockRedisClient(ctrl)
-	blobAccess := blobstore.NewRedisBlobAccess(redisClient, blobstore.CASStorageType, 0, 0, 0)
+	blobAccess := blobstore.NewRedisBlobAccess(redisClient, blobstore.CASStorageType, blobstore.NewFixedTTLPolicy(0), 0, 0, 1024)
 
 	canceledCtx, cancel := context.WithCancel(ctx)
 	cancel()
@@ -49,3 +51,76 @@ func TestRedisBlobAccessContextCanceled(t *testing.T) {
 	_, err = blobAccess.FindMissing(canceledCtx, []*util.Digest{digest})
 	require.Equal(t, err, status.Error(codes.Canceled, "context canceled"))
 }
+
+func TestRedisBlobAccessPutTooLarge(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	redisClient := mock.NewMockRedisClient(ctrl)
+	blobAccess := blobstore.NewRedisBlobAccess(redisClient, blobstore.CASStorageType, blobstore.NewFixedTTLPolicy(0), 0, 0, 10)
+
+	// Blobs exceeding the maximum size should be rejected without
+	// calling into Redis.
+	err := blobAccess.Put(
+		ctx,
+		util.MustNewDigest(
+			"example",
+			&remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			}),
+		buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+	require.Equal(t, status.Error(codes.InvalidArgument, "Blob is 11 bytes in size, while this backend is only permitted to store blobs of up to 10 bytes in size"), err)
+}
+
+func TestRedisBlobAccessPutSizeFailure(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	redisClient := mock.NewMockRedisClient(ctrl)
+	blobAccess := blobstore.NewRedisBlobAccess(redisClient, blobstore.CASStorageType, blobstore.NewFixedTTLPolicy(0), 0, 0, 10)
+
+	// Errors obtaining the size of the buffer should be propagated
+	// with their original code.
+	err := blobAccess.Put(
+		ctx,
+		util.MustNewDigest(
+			"example",
+			&remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			}),
+		buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+	require.Equal(t, status.Error(codes.NotFound, "Failed to put blob: Blob not found"), err)
+}
+
+func TestRedisBlobAccessDelete(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	redisClient := mock.NewMockRedisClient(ctrl)
+	blobAccess := blobstore.NewRedisBlobAccess(redisClient, blobstore.CASStorageType, blobstore.NewFixedTTLPolicy(0), 0, 0, 1024)
+	digest := util.MustNewDigest(
+		"example",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("Success", func(t *testing.T) {
+		redisClient.EXPECT().Del("3e25960a79dbc69b674cd4ec67a72c62-11").Return(redis.NewIntResult(1, nil))
+		require.NoError(t, blobstore.Delete(ctx, blobAccess, digest))
+
+		redisClient.EXPECT().Get("3e25960a79dbc69b674cd4ec67a72c62-11").Return(redis.NewStringResult("", redis.Nil))
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		redisClient.EXPECT().Del("3e25960a79dbc69b674cd4ec67a72c62-11").Return(redis.NewIntResult(0, errors.New("Connection refused")))
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Failed to delete blob: Connection refused"),
+			blobstore.Delete(ctx, blobAccess, digest))
+	})
+}
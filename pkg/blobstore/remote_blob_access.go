@@ -2,94 +2,534 @@ package blobstore
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
 	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/ptypes"
 
 	"golang.org/x/net/context/ctxhttp"
+	"golang.org/x/sync/errgroup"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// SkipExistingMode controls whether and how RemoteBlobAccess prevents
+// uploading blobs that are already present in the remote cache.
+type SkipExistingMode int
+
+const (
+	// SkipExistingDisabled uploads blobs unconditionally.
+	SkipExistingDisabled SkipExistingMode = iota
+	// SkipExistingIfNoneMatch uploads blobs with an
+	// "If-None-Match: *" header. The remote cache responds with 412
+	// (Precondition Failed) if the blob is already present.
+	SkipExistingIfNoneMatch
+	// SkipExistingHead issues a HEAD request prior to uploading,
+	// skipping the upload if the blob is already present.
+	SkipExistingHead
+)
+
 type remoteBlobAccess struct {
-	address     string
-	prefix      string
-	storageType StorageType
+	httpClient         *http.Client
+	address            string
+	prefix             string
+	storageType        StorageType
+	clock              clock.Clock
+	getTimeout         time.Duration
+	putTimeout         time.Duration
+	findMissingTimeout time.Duration
+	maximumRetryDelay  time.Duration
+
+	findMissingConcurrency int
+	contentEncoding        ContentEncoding
+	includeInstanceName    bool
+	getProbeFallback       bool
+	skipExistingMode       SkipExistingMode
+
+	// Set to a non-zero value once the remote cache has rejected a
+	// HEAD request with 405 (Method Not Allowed), causing all
+	// subsequent existence checks to use GET requests.
+	useGetProbes uint32
 }
 
-func convertHTTPUnexpectedStatus(resp *http.Response) error {
-	return status.Errorf(codes.Unknown, "Unexpected status code from remote cache: %d - %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+// RemoteBlobAccessOptions contains the optional settings of
+// RemoteBlobAccess. The zero value corresponds to a remote cache that
+// is accessed without timeouts or compression.
+type RemoteBlobAccessOptions struct {
+	// Timeouts for each type of operation. These are applied on
+	// top of the deadline of the incoming request, preventing a
+	// slow cache from consuming the full time budget of the
+	// request. A timeout of zero disables this.
+	GetTimeout         time.Duration
+	PutTimeout         time.Duration
+	FindMissingTimeout time.Duration
+
+	// Upper bound on the delay that is requested through the
+	// Retry-After header. Zero means no upper bound is applied.
+	MaximumRetryDelay time.Duration
+
+	// The maximum number of HEAD requests that FindMissing() issues
+	// concurrently. Values below one are treated as one.
+	FindMissingConcurrency int
+
+	// Blob contents may be compressed during transfer by providing
+	// a content encoding other than ContentEncodingIdentity. Put()
+	// compresses the request body, while Get() requests compressed
+	// responses and decompresses them based on their
+	// Content-Encoding header.
+	ContentEncoding ContentEncoding
+
+	// When set, the instance name of the digest is prepended to the
+	// prefix (i.e., address/instance/prefix/hash), so that instances
+	// sharing a single remote cache use distinct keyspaces. Digests
+	// with an empty instance name continue to use the original URL
+	// scheme.
+	IncludeInstanceName bool
+
+	// Some remote caches only support GET and PUT requests,
+	// responding to HEAD requests with 405 (Method Not Allowed).
+	// When set, the first such response causes FindMissing() to
+	// switch to checking the existence of blobs by issuing GET
+	// requests for the first byte of each blob.
+	GetProbeFallback bool
+
+	// Blobs in the Content Addressable Storage are immutable,
+	// meaning that uploading a blob that is already present is
+	// wasteful. This option controls whether Put() attempts to
+	// prevent this. It should not be enabled for the Action Cache,
+	// as its entries may be overwritten.
+	SkipExistingMode SkipExistingMode
 }
 
 // NewRemoteBlobAccess for use of HTTP/1.1 cache backend.
 //
 // See: https://docs.bazel.build/versions/master/remote-caching.html#http-caching-protocol
-func NewRemoteBlobAccess(address string, prefix string, storageType StorageType) BlobAccess {
+//
+// Objects are stored at URLs of the form address/prefix/hash.
+// Requests are issued through the provided HTTP client. Credentials can
+// be attached to requests by using a client whose transport is wrapped
+// (e.g., using NewBearerTokenRoundTripper()).
+//
+// Responses with status 429 (Too Many Requests) and 5xx are converted
+// to RESOURCE_EXHAUSTED and UNAVAILABLE errors, respectively. If the
+// remote cache provides a Retry-After header, the delay is attached to
+// the error in the form of a RetryInfo message.
+func NewRemoteBlobAccess(httpClient *http.Client, address string, prefix string, storageType StorageType, clock clock.Clock, options RemoteBlobAccessOptions) BlobAccess {
+	findMissingConcurrency := options.FindMissingConcurrency
+	if findMissingConcurrency < 1 {
+		findMissingConcurrency = 1
+	}
 	return &remoteBlobAccess{
-		address:     address,
-		prefix:      prefix,
-		storageType: storageType,
+		httpClient:         httpClient,
+		address:            address,
+		prefix:             prefix,
+		storageType:        storageType,
+		clock:              clock,
+		getTimeout:         options.GetTimeout,
+		putTimeout:         options.PutTimeout,
+		findMissingTimeout: options.FindMissingTimeout,
+		maximumRetryDelay:  options.MaximumRetryDelay,
+
+		findMissingConcurrency: findMissingConcurrency,
+		contentEncoding:        options.ContentEncoding,
+		includeInstanceName:    options.IncludeInstanceName,
+		getProbeFallback:       options.GetProbeFallback,
+		skipExistingMode:       options.SkipExistingMode,
+	}
+}
+
+// getURL returns the URL at which the object corresponding to a
+// digest is stored in the remote cache.
+func (ba *remoteBlobAccess) getURL(digest *util.Digest) string {
+	if instance := digest.GetInstance(); ba.includeInstanceName && instance != "" {
+		return fmt.Sprintf("%s/%s/%s/%s", ba.address, instance, ba.prefix, digest.GetHashString())
+	}
+	return fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
+}
+
+func (ba *remoteBlobAccess) convertHTTPUnexpectedStatus(resp *http.Response) error {
+	var code codes.Code
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case resp.StatusCode >= 500 && resp.StatusCode < 600:
+		// Server errors are assumed to be transient, so that
+		// RetryingBlobAccess may retry them.
+		code = codes.Unavailable
+	default:
+		return status.Errorf(codes.Unknown, "Unexpected status code from remote cache: %d - %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	retryDelay, ok := ba.parseRetryAfter(resp.Header.Get("Retry-After"))
+	if !ok {
+		return status.Errorf(code, "Remote cache returned status code %d - %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	s := status.Newf(code, "Remote cache returned status code %d - %s, requesting a retry after %s", resp.StatusCode, http.StatusText(resp.StatusCode), retryDelay)
+	if sWithDetails, err := s.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: ptypes.DurationProto(retryDelay),
+	}); err == nil {
+		s = sWithDetails
+	}
+	return s.Err()
+}
+
+// convertHTTPError converts errors returned by the HTTP client to
+// gRPC errors. Failures to validate the certificate of the remote
+// cache (e.g., because it has expired or is signed by an untrusted
+// certificate authority) are reported explicitly, as these are likely
+// caused by misconfiguration.
+func convertHTTPError(err error) error {
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var certificateInvalidError x509.CertificateInvalidError
+	var hostnameError x509.HostnameError
+	switch {
+	case errors.As(err, &unknownAuthorityError):
+		return status.Errorf(codes.Unavailable, "Certificate of remote cache is signed by an untrusted authority: %s", unknownAuthorityError)
+	case errors.As(err, &certificateInvalidError):
+		return status.Errorf(codes.Unavailable, "Certificate of remote cache is invalid: %s", certificateInvalidError)
+	case errors.As(err, &hostnameError):
+		return status.Errorf(codes.Unavailable, "Certificate of remote cache does not match its hostname: %s", hostnameError)
+	default:
+		return err
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which may
+// either be a number of seconds or an HTTP-date.
+func (ba *remoteBlobAccess) parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var retryDelay time.Duration
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		retryDelay = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		retryDelay = t.Sub(ba.clock.Now())
+		if retryDelay < 0 {
+			retryDelay = 0
+		}
+	} else {
+		return 0, false
 	}
+	if ba.maximumRetryDelay > 0 && retryDelay > ba.maximumRetryDelay {
+		retryDelay = ba.maximumRetryDelay
+	}
+	return retryDelay, true
+}
+
+// withTimeout derives a context that has a deadline applied, if a
+// timeout is configured.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 func (ba *remoteBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
-	url := fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
-	resp, err := ctxhttp.Get(ctx, http.DefaultClient, url)
+	ctx, cancel := withTimeout(ctx, ba.getTimeout)
+	url := ba.getURL(digest)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
+		cancel()
 		return buffer.NewBufferFromError(err)
 	}
+	if contentEncoding := ba.contentEncoding.headerValue(); contentEncoding != "" {
+		// Explicitly setting Accept-Encoding disables the
+		// transparent decompression performed by http.Transport.
+		req.Header.Set("Accept-Encoding", contentEncoding)
+	}
+	resp, err := ctxhttp.Do(ctx, ba.httpClient, req)
+	if err != nil {
+		cancel()
+		return buffer.NewBufferFromError(convertHTTPError(err))
+	}
 
 	switch resp.StatusCode {
 	case http.StatusNotFound:
 		resp.Body.Close()
+		cancel()
 		return buffer.NewBufferFromError(status.Error(codes.NotFound, url))
 	case http.StatusOK:
-		return ba.storageType.NewBufferFromReader(digest, resp.Body, buffer.Irreparable)
+		contentEncoding := resp.Header.Get("Content-Encoding")
+		body, err := newDecompressingReader(resp.Body, contentEncoding)
+		if err != nil {
+			resp.Body.Close()
+			cancel()
+			return buffer.NewBufferFromError(err)
+		}
+		if ba.storageType != CASStorageType {
+			// The size of a digest in the Action Cache is
+			// that of the Action, not that of the
+			// ActionResult. The size of the response can
+			// thus not be validated.
+			return ba.storageType.NewBufferFromReader(
+				digest,
+				&cancelingReadCloser{
+					ReadCloser: body,
+					cancel:     cancel,
+				},
+				buffer.Irreparable)
+		}
+
+		// Misconfigured caches may return responses that are
+		// truncated or belong to other objects. Detect this
+		// cheaply by validating the size of the response. The
+		// Content-Length header cannot be validated for
+		// compressed responses.
+		if contentEncoding == "" && resp.ContentLength >= 0 && resp.ContentLength != digest.GetSizeBytes() {
+			body.Close()
+			cancel()
+			return buffer.NewBufferFromError(status.Errorf(codes.DataLoss, "Remote cache returned %d bytes, while %d bytes were expected", resp.ContentLength, digest.GetSizeBytes()))
+		}
+		return ba.storageType.NewBufferFromReader(
+			digest,
+			&sizeVerifyingReader{
+				r:                 body,
+				cancel:            cancel,
+				bytesRemaining:    digest.GetSizeBytes(),
+				expectedSizeBytes: digest.GetSizeBytes(),
+			},
+			buffer.Irreparable)
 	default:
 		resp.Body.Close()
-		return buffer.NewBufferFromError(convertHTTPUnexpectedStatus(resp))
+		cancel()
+		return buffer.NewBufferFromError(ba.convertHTTPUnexpectedStatus(resp))
 	}
 }
 
+// cancelingReadCloser is a wrapper around the body of an HTTP response
+// that releases the context of the request upon closure.
+type cancelingReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
+
+// sizeVerifyingReader is a wrapper around the body of an HTTP response
+// that causes reads to fail with DATA_LOSS in case the number of bytes
+// returned does not match the size of the blob.
+type sizeVerifyingReader struct {
+	r                 io.ReadCloser
+	cancel            context.CancelFunc
+	bytesRemaining    int64
+	expectedSizeBytes int64
+}
+
+func (r *sizeVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.bytesRemaining -= int64(n)
+	if r.bytesRemaining < 0 {
+		return 0, status.Errorf(codes.DataLoss, "Remote cache returned more than %d bytes", r.expectedSizeBytes)
+	}
+	if err == io.EOF && r.bytesRemaining > 0 {
+		return n, status.Errorf(codes.DataLoss, "Remote cache returned %d bytes, while %d bytes were expected", r.expectedSizeBytes-r.bytesRemaining, r.expectedSizeBytes)
+	}
+	return n, err
+}
+
+func (r *sizeVerifyingReader) Close() error {
+	err := r.r.Close()
+	r.cancel()
+	return err
+}
+
 func (ba *remoteBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
 	sizeBytes, err := b.GetSizeBytes()
 	if err != nil {
 		b.Discard()
 		return err
 	}
-	url := fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
+	ctx, cancel := withTimeout(ctx, ba.putTimeout)
+	defer cancel()
+	if ba.skipExistingMode == SkipExistingHead {
+		// Failures to check for existence are not fatal, as the
+		// upload below will report any persistent problems.
+		if missing, err := ba.isMissing(ctx, digest); err == nil && !missing {
+			b.Discard()
+			return nil
+		}
+	}
+	url := ba.getURL(digest)
 	r := b.ToReader()
+	contentEncoding := ba.contentEncoding.headerValue()
+	if contentEncoding != "" {
+		r = ba.contentEncoding.compress(r)
+	}
 	req, err := http.NewRequest(http.MethodPut, url, r)
 	if err != nil {
 		r.Close()
 		return err
 	}
-	req.ContentLength = sizeBytes
-	_, err = ctxhttp.Do(ctx, http.DefaultClient, req)
-	return err
+	if contentEncoding == "" {
+		req.ContentLength = sizeBytes
+	} else {
+		// The size of the compressed body is not known in
+		// advance, causing chunked transfer encoding to be used.
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if ba.skipExistingMode == SkipExistingIfNoneMatch {
+		// Let the remote cache reject the request before the
+		// body is transmitted if the blob is already present.
+		req.Header.Set("If-None-Match", "*")
+		req.Header.Set("Expect", "100-continue")
+	}
+	resp, err := ctxhttp.Do(ctx, ba.httpClient, req)
+	if err != nil {
+		return convertHTTPError(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusPreconditionFailed:
+		if ba.skipExistingMode == SkipExistingIfNoneMatch {
+			// Blob is already present.
+			return nil
+		}
+		return ba.convertHTTPUnexpectedStatus(resp)
+	default:
+		return ba.convertHTTPUnexpectedStatus(resp)
+	}
 }
 
 func (ba *remoteBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
-	var missing []*util.Digest
-	for _, digest := range digests {
-		url := fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
-		resp, err := ctxhttp.Head(ctx, http.DefaultClient, url)
-		if err != nil {
-			return nil, err
+	ctx, cancel := withTimeout(ctx, ba.findMissingTimeout)
+	defer cancel()
+
+	// Issue HEAD requests concurrently, using a bounded number of
+	// workers. The first failure cancels all other requests.
+	group, groupCtx := errgroup.WithContext(ctx)
+	isMissing := make([]bool, len(digests))
+	indices := make(chan int)
+	group.Go(func() error {
+		defer close(indices)
+		for i := range digests {
+			select {
+			case indices <- i:
+			case <-groupCtx.Done():
+				return util.StatusFromContext(groupCtx)
+			}
 		}
+		return nil
+	})
+	for worker := 0; worker < ba.findMissingConcurrency && worker < len(digests); worker++ {
+		group.Go(func() error {
+			for i := range indices {
+				missing, err := ba.isMissing(groupCtx, digests[i])
+				if err != nil {
+					return err
+				}
+				isMissing[i] = missing
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
 
-		switch resp.StatusCode {
-		case http.StatusNotFound:
+	var missing []*util.Digest
+	for i, digest := range digests {
+		if isMissing[i] {
 			missing = append(missing, digest)
-		case http.StatusOK:
-			continue
-		default:
-			return nil, convertHTTPUnexpectedStatus(resp)
 		}
 	}
-
 	return missing, nil
 }
+
+// isMissing checks whether a single blob is absent in the remote cache.
+func (ba *remoteBlobAccess) isMissing(ctx context.Context, digest *util.Digest) (bool, error) {
+	url := ba.getURL(digest)
+	if atomic.LoadUint32(&ba.useGetProbes) != 0 {
+		return ba.isMissingGet(ctx, url)
+	}
+	resp, err := ctxhttp.Head(ctx, ba.httpClient, url)
+	if err != nil {
+		return false, convertHTTPError(err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return true, nil
+	case http.StatusOK:
+		return false, nil
+	case http.StatusMethodNotAllowed:
+		if ba.getProbeFallback {
+			atomic.StoreUint32(&ba.useGetProbes, 1)
+			return ba.isMissingGet(ctx, url)
+		}
+		return false, ba.convertHTTPUnexpectedStatus(resp)
+	default:
+		return false, ba.convertHTTPUnexpectedStatus(resp)
+	}
+}
+
+// isMissingGet checks whether a single blob is absent in the remote
+// cache by requesting its first byte. This is used for remote caches
+// that don't support HEAD requests.
+func (ba *remoteBlobAccess) isMissingGet(ctx context.Context, url string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := ctxhttp.Do(ctx, ba.httpClient, req)
+	if err != nil {
+		return false, convertHTTPError(err)
+	}
+	// Remote caches that ignore the Range header return the full
+	// object. Close the body without reading it.
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return true, nil
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// Requesting the first byte of an empty object yields
+		// 416 (Requested Range Not Satisfiable).
+		return false, nil
+	default:
+		return false, ba.convertHTTPUnexpectedStatus(resp)
+	}
+}
+
+// CheckReadiness issues a HEAD request against a path that does not
+// correspond to any object, thereby checking whether the remote cache
+// is reachable. Responses other than 429 and 5xx are considered to be
+// an indication of the remote cache being healthy.
+func (ba *remoteBlobAccess) CheckReadiness(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, ba.findMissingTimeout)
+	defer cancel()
+
+	resp, err := ctxhttp.Head(ctx, ba.httpClient, fmt.Sprintf("%s/%s/readiness-probe", ba.address, ba.prefix))
+	if err != nil {
+		return convertHTTPError(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return ba.convertHTTPUnexpectedStatus(resp)
+	}
+	return nil
+}
@@ -0,0 +1,669 @@
+package blobstore_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRemoteBlobAccessGet(t *testing.T) {
+	ctx := context.Background()
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("Success", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/cas/3e25960a79dbc69b674cd4ec67a72c62", r.URL.Path)
+			w.Write([]byte("Hello world"))
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("TruncatedWithContentLength", func(t *testing.T) {
+		// The response is shorter than the size of the blob.
+		// This should be detected based on the Content-Length
+		// header.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello"))
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.DataLoss, "Remote cache returned 5 bytes, while 11 bytes were expected"), err)
+	})
+
+	t.Run("TruncatedChunked", func(t *testing.T) {
+		// The response uses chunked transfer encoding, meaning
+		// no Content-Length header is provided. Truncation
+		// should be detected while reading.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hel"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("lo"))
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.DataLoss, "Remote cache returned 5 bytes, while 11 bytes were expected"), err)
+	})
+
+	t.Run("ActionCache", func(t *testing.T) {
+		// The size of an Action Cache digest is that of the
+		// Action, not that of the ActionResult. The size of
+		// the response should thus not be validated.
+		actionResult := &remoteexecution.ActionResult{
+			ExitCode:  1,
+			StdoutRaw: []byte("A message that is longer than the size of the digest"),
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/ac/3e25960a79dbc69b674cd4ec67a72c62", r.URL.Path)
+			data, err := proto.Marshal(actionResult)
+			require.NoError(t, err)
+			w.Write(data)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "ac", blobstore.ACStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		observedActionResult, err := blobAccess.Get(ctx, digest).ToActionResult(1000)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(actionResult, observedActionResult))
+	})
+}
+
+func TestRemoteBlobAccessPut(t *testing.T) {
+	ctx := context.Background()
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	for _, statusCode := range []int{http.StatusOK, http.StatusCreated, http.StatusNoContent} {
+		t.Run(http.StatusText(statusCode), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, http.MethodPut, r.Method)
+				require.Equal(t, "/cas/3e25960a79dbc69b674cd4ec67a72c62", r.URL.Path)
+				body, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello world"), body)
+				w.WriteHeader(statusCode)
+			}))
+			defer server.Close()
+
+			blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+			require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		})
+	}
+
+	t.Run("Forbidden", func(t *testing.T) {
+		// Errors returned by the remote cache should not be
+		// ignored, as that would cause blobs to be dropped.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		require.Equal(
+			t,
+			status.Error(codes.Unknown, "Unexpected status code from remote cache: 403 - Forbidden"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+}
+
+func TestRemoteBlobAccessSkipExisting(t *testing.T) {
+	ctx := context.Background()
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("IfNoneMatchPresent", func(t *testing.T) {
+		// 412 responses indicate that the blob is already
+		// present, meaning the upload was not needed.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodPut, r.Method)
+			require.Equal(t, "*", r.Header.Get("If-None-Match"))
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10, SkipExistingMode: blobstore.SkipExistingIfNoneMatch})
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("IfNoneMatchAbsent", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodPut, r.Method)
+			require.Equal(t, "*", r.Header.Get("If-None-Match"))
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hello world"), body)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10, SkipExistingMode: blobstore.SkipExistingIfNoneMatch})
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("PreconditionFailedWithoutIfNoneMatch", func(t *testing.T) {
+		// When not requested, 412 responses should be treated
+		// as errors.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Empty(t, r.Header.Get("If-None-Match"))
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		require.Equal(
+			t,
+			status.Error(codes.Unknown, "Unexpected status code from remote cache: 412 - Precondition Failed"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("HeadPresent", func(t *testing.T) {
+		// The upload should be skipped entirely.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodHead, r.Method)
+			require.Equal(t, "/cas/3e25960a79dbc69b674cd4ec67a72c62", r.URL.Path)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10, SkipExistingMode: blobstore.SkipExistingHead})
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("HeadAbsent", func(t *testing.T) {
+		var methods []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			methods = append(methods, r.Method)
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hello world"), body)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10, SkipExistingMode: blobstore.SkipExistingHead})
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		require.Equal(t, []string{http.MethodHead, http.MethodPut}, methods)
+	})
+}
+
+func TestRemoteBlobAccessFindMissing(t *testing.T) {
+	ctx := context.Background()
+
+	var digests []*util.Digest
+	for _, hash := range []string{
+		"00000000000000000000000000000001",
+		"00000000000000000000000000000002",
+		"00000000000000000000000000000003",
+		"00000000000000000000000000000004",
+		"00000000000000000000000000000005",
+	} {
+		digests = append(digests, util.MustNewDigest(
+			"default",
+			&remoteexecution.Digest{
+				Hash:      hash,
+				SizeBytes: 1,
+			}))
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		// Results should be returned in the original order,
+		// regardless of the order in which requests complete.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodHead, r.Method)
+			switch r.URL.Path {
+			case "/cas/00000000000000000000000000000002", "/cas/00000000000000000000000000000005":
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 2})
+		missing, err := blobAccess.FindMissing(ctx, digests)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digests[1], digests[4]}, missing)
+	})
+
+	t.Run("ZeroConcurrency", func(t *testing.T) {
+		// A concurrency of zero should not cause FindMissing()
+		// to block indefinitely. Requests should be issued
+		// sequentially instead.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/cas/00000000000000000000000000000003" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{})
+		missing, err := blobAccess.FindMissing(ctx, digests)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digests[2]}, missing)
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/cas/00000000000000000000000000000003" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 2})
+		_, err := blobAccess.FindMissing(ctx, digests)
+		require.Equal(t, status.Error(codes.Unknown, "Unexpected status code from remote cache: 403 - Forbidden"), err)
+	})
+
+	t.Run("HeadNotAllowed", func(t *testing.T) {
+		// Without the fallback enabled, 405 responses should
+		// be propagated.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 2})
+		_, err := blobAccess.FindMissing(ctx, digests)
+		require.Equal(t, status.Error(codes.Unknown, "Unexpected status code from remote cache: 405 - Method Not Allowed"), err)
+	})
+
+	t.Run("GetProbeFallback", func(t *testing.T) {
+		// Only the first HEAD request should be issued. After
+		// it fails with 405, all blobs should be probed using
+		// ranged GET requests.
+		headRequests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodHead:
+				headRequests++
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			case http.MethodGet:
+				require.Equal(t, "bytes=0-0", r.Header.Get("Range"))
+				switch r.URL.Path {
+				case "/cas/00000000000000000000000000000002", "/cas/00000000000000000000000000000005":
+					w.WriteHeader(http.StatusNotFound)
+				case "/cas/00000000000000000000000000000003":
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				default:
+					w.Header().Set("Content-Range", "bytes 0-0/1")
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write([]byte("x"))
+				}
+			default:
+				t.Errorf("Unexpected method %s", r.Method)
+			}
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 1, GetProbeFallback: true})
+		missing, err := blobAccess.FindMissing(ctx, digests)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digests[1], digests[4]}, missing)
+
+		missing, err = blobAccess.FindMissing(ctx, digests)
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digests[1], digests[4]}, missing)
+		require.Equal(t, 1, headRequests)
+	})
+}
+
+func TestRemoteBlobAccessBearerToken(t *testing.T) {
+	ctx := context.Background()
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	// The token source should be called for every request, so
+	// that rotated tokens are picked up.
+	tokens := []string{"token1", "token2", "token3"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer "+tokens[0], r.Header.Get("Authorization"))
+		tokens = tokens[1:]
+		if r.Method == http.MethodGet {
+			w.Write([]byte("Hello world"))
+		}
+	}))
+	defer server.Close()
+
+	tokenSource := func(ctx context.Context) (string, error) {
+		return tokens[0], nil
+	}
+	httpClient := &http.Client{
+		Transport: blobstore.NewBearerTokenRoundTripper(http.DefaultTransport, tokenSource),
+	}
+	blobAccess := blobstore.NewRemoteBlobAccess(httpClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+
+	data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello world"), data)
+
+	require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Empty(t, tokens)
+}
+
+func TestRemoteBlobAccessRetryAfter(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	newServer := func(statusCode int, retryAfter string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statusCode)
+		}))
+	}
+	getRetryDelay := func(err error) time.Duration {
+		details := status.Convert(err).Details()
+		require.Len(t, details, 1)
+		retryInfo, ok := details[0].(*errdetails.RetryInfo)
+		require.True(t, ok)
+		retryDelay, err := ptypes.Duration(retryInfo.RetryDelay)
+		require.NoError(t, err)
+		return retryDelay
+	}
+
+	t.Run("Seconds", func(t *testing.T) {
+		server := newServer(http.StatusTooManyRequests, "120")
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		require.Equal(t, "Remote cache returned status code 429 - Too Many Requests, requesting a retry after 2m0s", status.Convert(err).Message())
+		require.Equal(t, 2*time.Minute, getRetryDelay(err))
+	})
+
+	t.Run("HTTPDate", func(t *testing.T) {
+		server := newServer(http.StatusServiceUnavailable, "Wed, 21 Oct 2015 07:28:00 GMT")
+		defer server.Close()
+
+		clock := mock.NewMockClock(ctrl)
+		clock.EXPECT().Now().Return(time.Date(2015, 10, 21, 7, 27, 30, 0, time.UTC))
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		_, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.Equal(t, "Remote cache returned status code 503 - Service Unavailable, requesting a retry after 30s", status.Convert(err).Message())
+		require.Equal(t, 30*time.Second, getRetryDelay(err))
+	})
+
+	t.Run("Capped", func(t *testing.T) {
+		server := newServer(http.StatusTooManyRequests, "3600")
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{MaximumRetryDelay: time.Minute, FindMissingConcurrency: 10})
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		require.Equal(t, time.Minute, getRetryDelay(err))
+	})
+
+	t.Run("MissingHeader", func(t *testing.T) {
+		// Without a Retry-After header, the error should still
+		// use the right code, but not carry any details.
+		server := newServer(http.StatusServiceUnavailable, "")
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Unavailable, "Remote cache returned status code 503 - Service Unavailable"), err)
+	})
+}
+
+func TestRemoteBlobAccessContentEncoding(t *testing.T) {
+	ctx := context.Background()
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("GetGzip", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+			w.Header().Set("Content-Encoding", "gzip")
+			gzipWriter := gzip.NewWriter(w)
+			gzipWriter.Write([]byte("Hello world"))
+			gzipWriter.Close()
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10, ContentEncoding: blobstore.ContentEncodingGzip})
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("GetUncompressed", func(t *testing.T) {
+		// Remote caches may ignore Accept-Encoding, returning
+		// data without compression.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello world"))
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10, ContentEncoding: blobstore.ContentEncodingGzip})
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("GetUnsupported", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte("Hello world"))
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10, ContentEncoding: blobstore.ContentEncodingGzip})
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Unimplemented, "Remote cache returned a response with unsupported content encoding \"br\""), err)
+	})
+
+	t.Run("PutGzip", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+			gzipReader, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(gzipReader)
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hello world"), body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10, ContentEncoding: blobstore.ContentEncodingGzip})
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+}
+
+func TestRemoteBlobAccessIncludeInstanceName(t *testing.T) {
+	ctx := context.Background()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cas/3e25960a79dbc69b674cd4ec67a72c62", "/some/instance/cas/3e25960a79dbc69b674cd4ec67a72c62":
+			w.Write([]byte("Hello world"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10, IncludeInstanceName: true})
+
+	t.Run("EmptyInstance", func(t *testing.T) {
+		// Objects without an instance name should be stored at
+		// the same location as before, so that existing
+		// deployments don't need to be rekeyed.
+		data, err := blobAccess.Get(ctx, util.MustNewDigest(
+			"",
+			&remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			})).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("NonEmptyInstance", func(t *testing.T) {
+		data, err := blobAccess.Get(ctx, util.MustNewDigest(
+			"some/instance",
+			&remoteexecution.Digest{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: 11,
+			})).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("OtherInstance", func(t *testing.T) {
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{
+			util.MustNewDigest(
+				"other",
+				&remoteexecution.Digest{
+					Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+					SizeBytes: 11,
+				}),
+		})
+		require.NoError(t, err)
+		require.Len(t, missing, 1)
+	})
+}
+
+func TestRemoteBlobAccessCheckReadiness(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Ready", func(t *testing.T) {
+		// A 404 response indicates that the remote cache is
+		// reachable.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodHead, r.Method)
+			require.Equal(t, "/cas/readiness-probe", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		require.NoError(t, blobAccess.(blobstore.ReadinessChecker).CheckReadiness(ctx))
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Remote cache returned status code 503 - Service Unavailable"),
+			blobAccess.(blobstore.ReadinessChecker).CheckReadiness(ctx))
+	})
+}
+
+func TestRemoteBlobAccessTLS(t *testing.T) {
+	ctx := context.Background()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello world"))
+	}))
+	defer server.Close()
+
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("Trusted", func(t *testing.T) {
+		blobAccess := blobstore.NewRemoteBlobAccess(server.Client(), server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		// The certificate of the test server is not signed by
+		// any of the system certificate authorities. This
+		// should be reported explicitly.
+		blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", blobstore.CASStorageType, clock.SystemClock, blobstore.RemoteBlobAccessOptions{FindMissingConcurrency: 10})
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.Contains(t, status.Convert(err).Message(), "Certificate of remote cache is signed by an untrusted authority: ")
+
+		_, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.Contains(t, status.Convert(err).Message(), "Certificate of remote cache is signed by an untrusted authority: ")
+	})
+}
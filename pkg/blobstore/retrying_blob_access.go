@@ -0,0 +1,230 @@
+package blobstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	retryingBlobAccessPrometheusMetrics sync.Once
+
+	retryingBlobAccessRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "retrying_blob_access_retries_total",
+			Help:      "Number of times operations were retried.",
+		},
+		[]string{"operation"})
+	retryingBlobAccessRetriesGet         = retryingBlobAccessRetries.WithLabelValues("Get")
+	retryingBlobAccessRetriesPut         = retryingBlobAccessRetries.WithLabelValues("Put")
+	retryingBlobAccessRetriesFindMissing = retryingBlobAccessRetries.WithLabelValues("FindMissing")
+
+	retryingBlobAccessPutsNotRetryable = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "retrying_blob_access_puts_not_retryable_total",
+			Help:      "Number of Put() calls that were forwarded without retrying, due to the buffer being too large or having an unknown size.",
+		})
+)
+
+// Backoff computes the amount of time to wait before retrying an
+// operation.
+type Backoff interface {
+	// GetDelay returns the delay before the next attempt, given the
+	// number of attempts that have been made so far.
+	GetDelay(attempts int) time.Duration
+}
+
+type exponentialBackoff struct {
+	initialDelay time.Duration
+	maximumDelay time.Duration
+	multiplier   float64
+}
+
+// NewExponentialBackoff creates a Backoff that starts with an initial
+// delay, multiplying it for every subsequent attempt, up to a maximum.
+func NewExponentialBackoff(initialDelay time.Duration, maximumDelay time.Duration, multiplier float64) Backoff {
+	return &exponentialBackoff{
+		initialDelay: initialDelay,
+		maximumDelay: maximumDelay,
+		multiplier:   multiplier,
+	}
+}
+
+func (b *exponentialBackoff) GetDelay(attempts int) time.Duration {
+	delay := float64(b.initialDelay)
+	for i := 1; i < attempts && delay < float64(b.maximumDelay); i++ {
+		delay *= b.multiplier
+	}
+	if delay > float64(b.maximumDelay) {
+		return b.maximumDelay
+	}
+	return time.Duration(delay)
+}
+
+type retryingBlobAccess struct {
+	BlobAccess
+	clock                        clock.Clock
+	maximumAttempts              int
+	backoff                      Backoff
+	maximumPutRetryableSizeBytes int
+}
+
+// NewRetryingBlobAccess creates a decorator for BlobAccess that
+// retries operations that fail with transient errors, namely
+// UNAVAILABLE and DEADLINE_EXCEEDED. Backends that convert HTTP 5xx
+// responses to UNAVAILABLE (e.g., RemoteBlobAccess) are thus also
+// covered. RESOURCE_EXHAUSTED errors are only retried if the backend
+// provided a RetryInfo message, in which case the requested delay is
+// honored.
+//
+// Operations are attempted at most maximumAttempts times, waiting
+// between attempts as computed by the Backoff. Retrying stops as soon
+// as the next attempt would exceed the deadline of the context.
+//
+// Put() can only be retried if the buffer can be read repeatedly. To
+// achieve this, buffers are loaded into memory. Buffers larger than
+// maximumPutRetryableSizeBytes and buffers of unknown size are
+// forwarded to the backend without retrying. Such calls are counted
+// separately, so that the limit can be adjusted if needed.
+func NewRetryingBlobAccess(blobAccess BlobAccess, clock clock.Clock, maximumAttempts int, backoff Backoff, maximumPutRetryableSizeBytes int) BlobAccess {
+	retryingBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(retryingBlobAccessRetries)
+		prometheus.MustRegister(retryingBlobAccessPutsNotRetryable)
+	})
+
+	return &retryingBlobAccess{
+		BlobAccess:                   blobAccess,
+		clock:                        clock,
+		maximumAttempts:              maximumAttempts,
+		backoff:                      backoff,
+		maximumPutRetryableSizeBytes: maximumPutRetryableSizeBytes,
+	}
+}
+
+// getRetryDelay returns whether an error is transient. If so, it
+// returns the minimum amount of time to wait requested by the backend.
+func getRetryDelay(err error) (time.Duration, bool) {
+	s := status.Convert(err)
+	var retryDelay time.Duration
+	hasRetryInfo := false
+	for _, detail := range s.Details() {
+		if retryInfo, ok := detail.(*errdetails.RetryInfo); ok {
+			if d, err := ptypes.Duration(retryInfo.RetryDelay); err == nil {
+				retryDelay = d
+				hasRetryInfo = true
+			}
+		}
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return retryDelay, true
+	case codes.ResourceExhausted:
+		return retryDelay, hasRetryInfo
+	default:
+		return 0, false
+	}
+}
+
+// waitBeforeRetry blocks until the next attempt of an operation may be
+// made. It returns false if the operation should not be retried.
+func (ba *retryingBlobAccess) waitBeforeRetry(ctx context.Context, attempts int, err error) bool {
+	if attempts >= ba.maximumAttempts || ctx.Err() != nil {
+		return false
+	}
+	retryDelay, ok := getRetryDelay(err)
+	if !ok {
+		return false
+	}
+	if delay := ba.backoff.GetDelay(attempts); delay > retryDelay {
+		retryDelay = delay
+	}
+	if deadline, ok := ctx.Deadline(); ok && ba.clock.Now().Add(retryDelay).After(deadline) {
+		return false
+	}
+
+	timer, t := ba.clock.NewTimer(retryDelay)
+	select {
+	case <-t:
+		return true
+	case <-ctx.Done():
+		timer.Stop()
+		return false
+	}
+}
+
+func (ba *retryingBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	return buffer.WithErrorHandler(
+		ba.BlobAccess.Get(ctx, digest),
+		&retryingErrorHandler{
+			blobAccess: ba,
+			context:    ctx,
+			digest:     digest,
+			attempts:   1,
+		})
+}
+
+func (ba *retryingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	if sizeBytes, err := b.GetSizeBytes(); err != nil || sizeBytes > int64(ba.maximumPutRetryableSizeBytes) {
+		retryingBlobAccessPutsNotRetryable.Inc()
+		return ba.BlobAccess.Put(ctx, digest, b)
+	}
+
+	for attempts := 1; ; attempts++ {
+		if attempts >= ba.maximumAttempts {
+			return ba.BlobAccess.Put(ctx, digest, b)
+		}
+		bAttempt, bRemaining := b.CloneCopy(ba.maximumPutRetryableSizeBytes)
+		err := ba.BlobAccess.Put(ctx, digest, bAttempt)
+		if err == nil || !ba.waitBeforeRetry(ctx, attempts, err) {
+			bRemaining.Discard()
+			return err
+		}
+		retryingBlobAccessRetriesPut.Inc()
+		b = bRemaining
+	}
+}
+
+func (ba *retryingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	for attempts := 1; ; attempts++ {
+		missing, err := ba.BlobAccess.FindMissing(ctx, digests)
+		if err == nil || !ba.waitBeforeRetry(ctx, attempts, err) {
+			return missing, err
+		}
+		retryingBlobAccessRetriesFindMissing.Inc()
+	}
+}
+
+// retryingErrorHandler is used by Get() to substitute buffers that
+// fail with transient errors by new buffers obtained from the backend.
+type retryingErrorHandler struct {
+	blobAccess *retryingBlobAccess
+	context    context.Context
+	digest     *util.Digest
+	attempts   int
+}
+
+func (eh *retryingErrorHandler) OnError(err error) (buffer.Buffer, error) {
+	ba := eh.blobAccess
+	if !ba.waitBeforeRetry(eh.context, eh.attempts, err) {
+		return nil, err
+	}
+	retryingBlobAccessRetriesGet.Inc()
+	eh.attempts++
+	return ba.BlobAccess.Get(eh.context, eh.digest), nil
+}
+
+func (eh *retryingErrorHandler) Done() {}
@@ -0,0 +1,131 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := blobstore.NewExponentialBackoff(time.Second, 10*time.Second, 2.0)
+	require.Equal(t, time.Second, backoff.GetDelay(1))
+	require.Equal(t, 2*time.Second, backoff.GetDelay(2))
+	require.Equal(t, 8*time.Second, backoff.GetDelay(4))
+	require.Equal(t, 10*time.Second, backoff.GetDelay(5))
+	require.Equal(t, 10*time.Second, backoff.GetDelay(100))
+}
+
+func TestRetryingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	blobAccess := blobstore.NewRetryingBlobAccess(
+		baseBlobAccess,
+		clock,
+		3,
+		blobstore.NewExponentialBackoff(time.Second, 10*time.Second, 2.0),
+		100)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	expectTimer := func(d time.Duration) {
+		timer := mock.NewMockTimer(ctrl)
+		ch := make(chan time.Time, 1)
+		ch <- time.Unix(1000, 0)
+		clock.EXPECT().NewTimer(d).Return(timer, ch)
+	}
+
+	t.Run("GetSuccessAfterRetry", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.Unavailable, "Server offline")))
+		expectTimer(time.Second)
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("GetTooManyAttempts", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.Unavailable, "Server offline"))).Times(3)
+		expectTimer(time.Second)
+		expectTimer(2 * time.Second)
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	})
+
+	t.Run("GetNotRetryable", func(t *testing.T) {
+		baseBlobAccess.EXPECT().Get(ctx, digest).Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+
+		_, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+
+	t.Run("PutSuccessAfterRetry", func(t *testing.T) {
+		// The buffer should be provided to the backend again
+		// after the first attempt fails.
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return status.Error(codes.Unavailable, "Server offline")
+			})
+		expectTimer(time.Second)
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello world"), data)
+				return nil
+			})
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("PutTooLarge", func(t *testing.T) {
+		// Buffers exceeding the maximum size cannot be retained
+		// in memory. They should be forwarded without retrying.
+		largeDigest := util.MustNewDigest(
+			"default",
+			&remoteexecution.Digest{
+				Hash:      "6a0e4bf6a5b2da4f9fb4d4af0d1a3da4",
+				SizeBytes: 101,
+			})
+		baseBlobAccess.EXPECT().Put(ctx, largeDigest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return status.Error(codes.Unavailable, "Server offline")
+			})
+
+		err := blobAccess.Put(ctx, largeDigest, buffer.NewValidatedBufferFromByteSlice(make([]byte, 101)))
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	})
+
+	t.Run("FindMissingDeadlineExceeded", func(t *testing.T) {
+		// Retrying should stop if the next attempt would take
+		// place after the deadline of the context.
+		deadline := time.Now().Add(time.Hour)
+		ctxWithDeadline, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+		baseBlobAccess.EXPECT().FindMissing(ctxWithDeadline, []*util.Digest{digest}).Return(nil, status.Error(codes.Unavailable, "Server offline"))
+		clock.EXPECT().Now().Return(deadline.Add(-500 * time.Millisecond))
+
+		_, err := blobAccess.FindMissing(ctxWithDeadline, []*util.Digest{digest})
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	})
+}
@@ -0,0 +1,155 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	shadowReadBlobAccessPrometheusMetrics sync.Once
+
+	shadowReadBlobAccessComparisons = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "shadow_read_blob_access_comparisons_total",
+			Help:      "Number of reads that were compared against the candidate backend, and their outcome.",
+		},
+		[]string{"result"})
+	shadowReadBlobAccessComparisonsMatch            = shadowReadBlobAccessComparisons.WithLabelValues("Match")
+	shadowReadBlobAccessComparisonsMismatch         = shadowReadBlobAccessComparisons.WithLabelValues("Mismatch")
+	shadowReadBlobAccessComparisonsCandidateMissing = shadowReadBlobAccessComparisons.WithLabelValues("CandidateMissing")
+	shadowReadBlobAccessComparisonsCandidateError   = shadowReadBlobAccessComparisons.WithLabelValues("CandidateError")
+	shadowReadBlobAccessComparisonsPrimaryError     = shadowReadBlobAccessComparisons.WithLabelValues("PrimaryError")
+	shadowReadBlobAccessComparisonsDropped          = shadowReadBlobAccessComparisons.WithLabelValues("Dropped")
+)
+
+type shadowReadBlobAccess struct {
+	BlobAccess
+	candidate        BlobAccess
+	samplingRate     float64
+	compareContents  bool
+	maximumSizeBytes int
+	comparisons      *semaphore.Weighted
+
+	round uint64
+}
+
+// NewShadowReadBlobAccess creates a decorator for BlobAccess that
+// serves all requests from a primary backend, while comparing a
+// fraction of reads against a candidate backend. This can be used to
+// validate that a new storage backend serves identical content under
+// real traffic, before switching over to it.
+//
+// Comparisons are performed asynchronously and never affect the
+// response returned to the client. When compareContents is false, the
+// candidate backend is only checked for the existence of blobs.
+// Otherwise, the contents of the blobs returned by both backends are
+// compared, which requires the blob returned by the primary backend to
+// be held in memory. For blobs larger than maximumSizeBytes, only
+// existence is checked.
+//
+// At most maximumConcurrentComparisons comparisons are performed at
+// the same time. Sampled reads are not compared if this limit is
+// reached, so that a slow candidate backend cannot cause unbounded
+// memory usage.
+//
+// As objects in the Action Cache may legitimately differ between
+// backends, this decorator should only be used for the Content
+// Addressable Storage.
+func NewShadowReadBlobAccess(primary BlobAccess, candidate BlobAccess, samplingRate float64, compareContents bool, maximumSizeBytes int, maximumConcurrentComparisons int) BlobAccess {
+	shadowReadBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(shadowReadBlobAccessComparisons)
+	})
+
+	return &shadowReadBlobAccess{
+		BlobAccess:       primary,
+		candidate:        candidate,
+		samplingRate:     samplingRate,
+		compareContents:  compareContents,
+		maximumSizeBytes: maximumSizeBytes,
+		comparisons:      semaphore.NewWeighted(int64(maximumConcurrentComparisons)),
+	}
+}
+
+// shouldSample returns whether the current read should be compared
+// against the candidate backend. Reads are sampled deterministically,
+// so that exactly the configured fraction of reads gets compared.
+func (ba *shadowReadBlobAccess) shouldSample() bool {
+	round := atomic.AddUint64(&ba.round, 1)
+	return uint64(float64(round)*ba.samplingRate) != uint64(float64(round-1)*ba.samplingRate)
+}
+
+func (ba *shadowReadBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	b := ba.BlobAccess.Get(ctx, digest)
+	if !ba.shouldSample() {
+		return b
+	}
+	if !ba.comparisons.TryAcquire(1) {
+		shadowReadBlobAccessComparisonsDropped.Inc()
+		return b
+	}
+
+	// Comparisons are performed in the background, so that they
+	// don't add latency to the client's request. As they may
+	// outlive the client's request, they can't use its context.
+	if !ba.compareContents || digest.GetSizeBytes() > int64(ba.maximumSizeBytes) {
+		go ba.compareExistence(context.Background(), digest)
+		return b
+	}
+	b1, b2 := b.CloneCopy(ba.maximumSizeBytes)
+	go ba.compareBuffers(context.Background(), digest, b2)
+	return b1
+}
+
+func (ba *shadowReadBlobAccess) compareExistence(ctx context.Context, digest *util.Digest) {
+	defer ba.comparisons.Release(1)
+
+	missing, err := ba.candidate.FindMissing(ctx, []*util.Digest{digest})
+	if err != nil {
+		shadowReadBlobAccessComparisonsCandidateError.Inc()
+		log.Printf("Failed to check existence of blob %s in candidate backend: %s", digest, err)
+	} else if len(missing) > 0 {
+		shadowReadBlobAccessComparisonsCandidateMissing.Inc()
+		log.Printf("Blob %s is absent in candidate backend", digest)
+	} else {
+		shadowReadBlobAccessComparisonsMatch.Inc()
+	}
+}
+
+func (ba *shadowReadBlobAccess) compareBuffers(ctx context.Context, digest *util.Digest, primaryBuffer buffer.Buffer) {
+	defer ba.comparisons.Release(1)
+
+	primaryData, err := primaryBuffer.ToByteSlice(ba.maximumSizeBytes)
+	if err != nil {
+		// There is nothing to compare against. Errors are
+		// already reported to the client.
+		shadowReadBlobAccessComparisonsPrimaryError.Inc()
+		return
+	}
+
+	candidateData, err := ba.candidate.Get(ctx, digest).ToByteSlice(ba.maximumSizeBytes)
+	if status.Code(err) == codes.NotFound {
+		shadowReadBlobAccessComparisonsCandidateMissing.Inc()
+		log.Printf("Blob %s is absent in candidate backend", digest)
+	} else if err != nil {
+		shadowReadBlobAccessComparisonsCandidateError.Inc()
+		log.Printf("Failed to read blob %s from candidate backend: %s", digest, err)
+	} else if !bytes.Equal(primaryData, candidateData) {
+		shadowReadBlobAccessComparisonsMismatch.Inc()
+		log.Printf("Blob %s has different contents in candidate backend: %d bytes in primary backend, %d bytes in candidate backend", digest, len(primaryData), len(candidateData))
+	} else {
+		shadowReadBlobAccessComparisonsMatch.Inc()
+	}
+}
@@ -0,0 +1,119 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShadowReadBlobAccessGet(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	primary := mock.NewMockBlobAccess(ctrl)
+	candidate := mock.NewMockBlobAccess(ctrl)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		})
+
+	t.Run("NotSampled", func(t *testing.T) {
+		// With a sampling rate of zero, the candidate backend
+		// should never be contacted.
+		blobAccess := blobstore.NewShadowReadBlobAccess(primary, candidate, 0.0, true, 100, 1)
+		primary.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("CompareExistence", func(t *testing.T) {
+		// When contents aren't compared, the candidate backend
+		// should only be checked for the existence of the blob.
+		blobAccess := blobstore.NewShadowReadBlobAccess(primary, candidate, 1.0, false, 100, 1)
+		primary.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		done := make(chan struct{})
+		candidate.EXPECT().FindMissing(gomock.Any(), []*util.Digest{digest}).DoAndReturn(
+			func(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+				close(done)
+				return nil, nil
+			})
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		<-done
+	})
+
+	t.Run("CompareContents", func(t *testing.T) {
+		// When contents are compared, the blob should be read
+		// from the candidate backend. The client should still
+		// receive the data from the primary backend.
+		blobAccess := blobstore.NewShadowReadBlobAccess(primary, candidate, 1.0, true, 100, 1)
+		primary.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		done := make(chan struct{})
+		candidate.EXPECT().Get(gomock.Any(), digest).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest) buffer.Buffer {
+				close(done)
+				return buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))
+			})
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		<-done
+	})
+
+	t.Run("CompareContentsTooLarge", func(t *testing.T) {
+		// Blobs that are too large to be held in memory should
+		// only be checked for existence.
+		blobAccess := blobstore.NewShadowReadBlobAccess(primary, candidate, 1.0, true, 10, 1)
+		primary.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		done := make(chan struct{})
+		candidate.EXPECT().FindMissing(gomock.Any(), []*util.Digest{digest}).DoAndReturn(
+			func(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+				close(done)
+				return nil, nil
+			})
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		<-done
+	})
+
+	t.Run("ConcurrencyLimitReached", func(t *testing.T) {
+		// While the maximum number of comparisons is being
+		// performed, sampled reads should not be compared.
+		blobAccess := blobstore.NewShadowReadBlobAccess(primary, candidate, 1.0, false, 100, 1)
+		primary.EXPECT().Get(ctx, digest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))).Times(2)
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		candidate.EXPECT().FindMissing(gomock.Any(), []*util.Digest{digest}).DoAndReturn(
+			func(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+				close(started)
+				<-unblock
+				return nil, nil
+			})
+
+		data, err := blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		<-started
+
+		data, err = blobAccess.Get(ctx, digest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		close(unblock)
+	})
+}
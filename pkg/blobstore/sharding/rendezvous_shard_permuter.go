@@ -0,0 +1,80 @@
+package sharding
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+type rendezvousShardPermuter struct {
+	keyHashes []uint64
+	weights   []float64
+}
+
+// NewRendezvousShardPermuter is a shard selection algorithm that uses
+// weighted rendezvous hashing (also known as highest random weight
+// hashing). For every hash, a score is computed for each backend. The
+// backends are returned in order of decreasing score.
+//
+// Unlike the algorithm provided by NewWeightedShardPermuter(), the
+// score of a backend only depends on the hash, the key of the backend
+// and its weight. Keys are stable identifiers of backends (e.g., their
+// address) that must be unique. Adding or removing a backend thus only
+// causes keys owned by that backend to be remapped, regardless of the
+// position at which it is placed. The downside of this approach is
+// that computing the permutation takes time proportional to the number
+// of backends.
+func NewRendezvousShardPermuter(keys []string, weights []uint32) ShardPermuter {
+	keyHashes := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		keyHashes = append(keyHashes, h.Sum64())
+	}
+	floatWeights := make([]float64, 0, len(weights))
+	for _, weight := range weights {
+		floatWeights = append(floatWeights, float64(weight))
+	}
+	return &rendezvousShardPermuter{
+		keyHashes: keyHashes,
+		weights:   floatWeights,
+	}
+}
+
+// mixRendezvousHash combines a hash with the hash of the key of a
+// backend, yielding a uniformly distributed 64-bit value. It uses the
+// finalizer of the SplitMix64 pseudo-random number generator.
+func mixRendezvousHash(hash uint64, keyHash uint64) uint64 {
+	h := hash ^ keyHash
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
+
+func (s *rendezvousShardPermuter) GetShard(hash uint64, selector ShardSelector) {
+	// Compute scores for every backend. By dividing the weight by
+	// the negated logarithm of a uniformly distributed value in
+	// (0, 1), the probability of a backend having the highest score
+	// is proportional to its weight.
+	indices := make([]int, 0, len(s.weights))
+	scores := make([]float64, 0, len(s.weights))
+	for index, weight := range s.weights {
+		u := (float64(mixRendezvousHash(hash, s.keyHashes[index])>>11) + 0.5) / (1 << 53)
+		indices = append(indices, index)
+		scores = append(scores, weight/-math.Log(u))
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return scores[indices[i]] > scores[indices[j]]
+	})
+
+	// Backends are only permitted to be returned repeatedly if the
+	// selector keeps on rejecting them. Cycle through the
+	// permutation to satisfy that requirement.
+	for {
+		for _, index := range indices {
+			if !selector(index) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package sharding_test
+
+import (
+	"testing"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/sharding"
+	"github.com/stretchr/testify/require"
+)
+
+func getFirstShard(s sharding.ShardPermuter, hash uint64) int {
+	var shard int
+	s.GetShard(hash, func(i int) bool {
+		shard = i
+		return false
+	})
+	return shard
+}
+
+func TestRendezvousShardPermuterDistribution(t *testing.T) {
+	// Distribution across five backends with a total weight of 15.
+	weights := []uint32{1, 4, 2, 5, 3}
+	s := sharding.NewRendezvousShardPermuter([]string{"a", "b", "c", "d", "e"}, weights)
+
+	occurrences := map[int]uint32{}
+	for hash := uint64(0); hash < 1000000; hash++ {
+		occurrences[getFirstShard(s, hash*0x9e3779b97f4a7c15)]++
+	}
+
+	// Keys should be fanned out with a small error margin.
+	for shard, weight := range weights {
+		require.InEpsilon(t, weight*1000000/15, occurrences[shard], 0.01)
+	}
+}
+
+func TestRendezvousShardPermuterPermutation(t *testing.T) {
+	// Every backend should be returned before any backend is
+	// returned a second time.
+	s := sharding.NewRendezvousShardPermuter([]string{"a", "b", "c", "d", "e"}, []uint32{1, 4, 2, 5, 3})
+	seen := map[int]bool{}
+	s.GetShard(12345, func(i int) bool {
+		require.False(t, seen[i])
+		seen[i] = true
+		return len(seen) < 5
+	})
+	require.Len(t, seen, 5)
+}
+
+func TestRendezvousShardPermuterAddShard(t *testing.T) {
+	// Adding a sixth backend should only cause keys to move to the
+	// newly added backend. The fraction of keys remapped should be
+	// proportional to its weight.
+	s1 := sharding.NewRendezvousShardPermuter(
+		[]string{"a", "b", "c", "d", "e"},
+		[]uint32{1, 1, 1, 1, 1})
+	s2 := sharding.NewRendezvousShardPermuter(
+		[]string{"a", "b", "c", "d", "e", "f"},
+		[]uint32{1, 1, 1, 1, 1, 1})
+
+	remapped := 0
+	for hash := uint64(0); hash < 1000000; hash++ {
+		h := hash * 0x9e3779b97f4a7c15
+		if shard1, shard2 := getFirstShard(s1, h), getFirstShard(s2, h); shard1 != shard2 {
+			require.Equal(t, 5, shard2)
+			remapped++
+		}
+	}
+	require.InEpsilon(t, 1000000/6, remapped, 0.01)
+}
+
+func TestRendezvousShardPermuterRemoveShard(t *testing.T) {
+	// Removing a backend from the middle of the list should only
+	// cause keys owned by that backend to be remapped, even though
+	// the indices of the backends after it change.
+	s1 := sharding.NewRendezvousShardPermuter(
+		[]string{"a", "b", "c", "d", "e"},
+		[]uint32{1, 1, 1, 1, 1})
+	s2 := sharding.NewRendezvousShardPermuter(
+		[]string{"a", "b", "d", "e"},
+		[]uint32{1, 1, 1, 1})
+	oldToNew := map[int]int{0: 0, 1: 1, 3: 2, 4: 3}
+
+	remapped := 0
+	for hash := uint64(0); hash < 1000000; hash++ {
+		h := hash * 0x9e3779b97f4a7c15
+		shard1, shard2 := getFirstShard(s1, h), getFirstShard(s2, h)
+		if shard1 == 2 {
+			remapped++
+		} else {
+			require.Equal(t, oldToNew[shard1], shard2)
+		}
+	}
+	require.InEpsilon(t, 1000000/5, remapped, 0.01)
+}
@@ -91,3 +91,7 @@ func (ba *shardingBlobAccess) FindMissing(ctx context.Context, digests []*util.D
 	}
 	return missingDigests, err
 }
+
+func (ba *shardingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	return blobstore.Delete(ctx, ba.getBackend(digest), digest)
+}
@@ -64,7 +64,14 @@ func (ba *sizeDistinguishingBlobAccess) FindMissing(ctx context.Context, digests
 		}
 	}
 
-	// Forward FindMissing() to both implementations.
+	// Forward FindMissing() to both implementations. Don't call
+	// into backends for which there are no digests to check.
+	if len(smallDigests) == 0 {
+		return ba.largeBlobAccess.FindMissing(ctx, largeDigests)
+	}
+	if len(largeDigests) == 0 {
+		return ba.smallBlobAccess.FindMissing(ctx, smallDigests)
+	}
 	smallResultsChan := make(chan findMissingResults, 1)
 	go func() {
 		smallResultsChan <- callFindMissing(ctx, ba.smallBlobAccess, smallDigests)
@@ -81,3 +88,10 @@ func (ba *sizeDistinguishingBlobAccess) FindMissing(ctx context.Context, digests
 	}
 	return append(smallResults.missing, largeResults.missing...), nil
 }
+
+func (ba *sizeDistinguishingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	if digest.GetSizeBytes() <= ba.cutoffSizeBytes {
+		return Delete(ctx, ba.smallBlobAccess, digest)
+	}
+	return Delete(ctx, ba.largeBlobAccess, digest)
+}
@@ -0,0 +1,101 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSizeDistinguishingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	smallBlobAccess := mock.NewMockBlobAccess(ctrl)
+	largeBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewSizeDistinguishingBlobAccess(smallBlobAccess, largeBlobAccess, 11)
+
+	smallDigest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	largeDigest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "f0ef7081e1539ac00ef5b761b4fb01b3",
+			SizeBytes: 12,
+		})
+
+	t.Run("Get", func(t *testing.T) {
+		// Blobs up to the cutoff size should be read from the
+		// small backend.
+		smallBlobAccess.EXPECT().Get(ctx, smallDigest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		data, err := blobAccess.Get(ctx, smallDigest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+
+		largeBlobAccess.EXPECT().Get(ctx, largeDigest).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world\n")))
+		data, err = blobAccess.Get(ctx, largeDigest).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world\n"), data)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		smallBlobAccess.EXPECT().Put(ctx, smallDigest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+		require.NoError(t, blobAccess.Put(ctx, smallDigest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		largeBlobAccess.EXPECT().Put(ctx, largeDigest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return status.Error(codes.Internal, "Disk on fire")
+			})
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Disk on fire"),
+			blobAccess.Put(ctx, largeDigest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world\n"))))
+	})
+
+	t.Run("FindMissingBoth", func(t *testing.T) {
+		// Digests should be split up by size, and results
+		// should be merged.
+		smallBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{smallDigest}).Return([]*util.Digest{smallDigest}, nil)
+		largeBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{largeDigest}).Return([]*util.Digest{largeDigest}, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{smallDigest, largeDigest})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []*util.Digest{smallDigest, largeDigest}, missing)
+	})
+
+	t.Run("FindMissingSmallOnly", func(t *testing.T) {
+		// The large backend should not be contacted if there
+		// are no large digests.
+		smallBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{smallDigest}).Return(nil, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{smallDigest})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+
+	t.Run("FindMissingError", func(t *testing.T) {
+		smallBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{smallDigest}).Return(nil, nil)
+		largeBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{largeDigest}).Return(nil, status.Error(codes.Internal, "Disk on fire"))
+
+		_, err := blobAccess.FindMissing(ctx, []*util.Digest{smallDigest, largeDigest})
+		require.Equal(t, status.Error(codes.Internal, "Disk on fire"), err)
+	})
+}
@@ -0,0 +1,41 @@
+package blobstore
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type sizeLimitingBlobAccess struct {
+	BlobAccess
+	maximumSizeBytes int64
+}
+
+// NewSizeLimitingBlobAccess is a decorator for BlobAccess that rejects
+// writes of objects that exceed a maximum size. This protects storage
+// backends against accidental uploads of excessively large objects
+// (e.g., core files produced by misbehaving build actions). Reads and
+// existence checks are forwarded unmodified.
+func NewSizeLimitingBlobAccess(blobAccess BlobAccess, maximumSizeBytes int64) BlobAccess {
+	return &sizeLimitingBlobAccess{
+		BlobAccess:       blobAccess,
+		maximumSizeBytes: maximumSizeBytes,
+	}
+}
+
+func (ba *sizeLimitingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	sizeBytes, err := b.GetSizeBytes()
+	if err != nil {
+		b.Discard()
+		return err
+	}
+	if sizeBytes > ba.maximumSizeBytes {
+		b.Discard()
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while this backend is limited to %d bytes", sizeBytes, ba.maximumSizeBytes)
+	}
+	return ba.BlobAccess.Put(ctx, digest, b)
+}
@@ -0,0 +1,53 @@
+package blobstore
+
+import (
+	"context"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+type sizeStagingBlobAccess struct {
+	BlobAccess
+	storageType             StorageType
+	stagingArea             StagingArea
+	maximumStagingSizeBytes int64
+}
+
+// NewSizeStagingBlobAccess creates a decorator for BlobAccess that
+// stages the contents of buffers of unknown size in a StagingArea
+// prior to writing them. Backends such as CircularBlobAccess and
+// RemoteBlobAccess need to know the size of an object before they can
+// store it, causing them to reject such buffers otherwise.
+//
+// Buffers of unknown size that exceed maximumStagingSizeBytes are
+// rejected. Buffers of known size are forwarded without staging.
+// Staged data is removed from the StagingArea once the backend has
+// consumed it, or when the write is aborted.
+func NewSizeStagingBlobAccess(blobAccess BlobAccess, storageType StorageType, stagingArea StagingArea, maximumStagingSizeBytes int64) BlobAccess {
+	return &sizeStagingBlobAccess{
+		BlobAccess:              blobAccess,
+		storageType:             storageType,
+		stagingArea:             stagingArea,
+		maximumStagingSizeBytes: maximumStagingSizeBytes,
+	}
+}
+
+func (ba *sizeStagingBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	if _, err := b.GetSizeBytes(); err != buffer.ErrSizeUnknown {
+		return ba.BlobAccess.Put(ctx, digest, b)
+	}
+
+	r := b.ToReader()
+	stagedData, err := ba.stagingArea.Stage(ctx, r, ba.maximumStagingSizeBytes)
+	r.Close()
+	if err != nil {
+		return util.StatusWrap(err, "Failed to stage buffer of unknown size")
+	}
+	stagedReader, err := stagedData.Open(ctx)
+	if err != nil {
+		stagedData.Release()
+		return util.StatusWrap(err, "Failed to open staged buffer")
+	}
+	return ba.BlobAccess.Put(ctx, digest, ba.storageType.NewBufferFromReader(digest, stagedReader, buffer.UserProvided))
+}
@@ -0,0 +1,115 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSizeStagingBlobAccessPut(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewSizeStagingBlobAccess(baseBlobAccess, blobstore.CASStorageType, blobstore.NewInMemoryStagingArea(100), 15)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("KnownSize", func(t *testing.T) {
+		// Buffers of known size should be forwarded as is.
+		b := buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))
+		baseBlobAccess.EXPECT().Put(ctx, digest, b).Return(nil)
+
+		require.NoError(t, blobAccess.Put(ctx, digest, b))
+	})
+
+	t.Run("UnknownSize", func(t *testing.T) {
+		// Buffers of unknown size should be staged, so that
+		// the backend can obtain the size.
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				sizeBytes, err := b.GetSizeBytes()
+				require.NoError(t, err)
+				require.Equal(t, int64(11), sizeBytes)
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello world"), data)
+				return nil
+			})
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewUnsizedBufferFromReader(
+			ioutil.NopCloser(bytes.NewBufferString("Hello world")))))
+	})
+
+	t.Run("UnknownSizeTooBig", func(t *testing.T) {
+		// Buffers exceeding the staging limit should be
+		// rejected without contacting the backend.
+		require.Equal(
+			t,
+			status.Error(codes.InvalidArgument, "Failed to stage buffer of unknown size: Buffer is at least 16 bytes in size, while a maximum of 15 bytes is permitted"),
+			blobAccess.Put(ctx, digest, buffer.NewUnsizedBufferFromReader(
+				ioutil.NopCloser(bytes.NewBufferString("Hello world, this is a long message")))))
+	})
+
+	t.Run("StagingAreaFull", func(t *testing.T) {
+		// The in-memory staging area only permits holding a
+		// bounded amount of data. Data should be released once
+		// consumed, making room for subsequent writes.
+		blobAccess := blobstore.NewSizeStagingBlobAccess(baseBlobAccess, blobstore.CASStorageType, blobstore.NewInMemoryStagingArea(11), 15)
+		var stagedBuffer buffer.Buffer
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				stagedBuffer = b
+				return nil
+			})
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewUnsizedBufferFromReader(
+			ioutil.NopCloser(bytes.NewBufferString("Hello world")))))
+
+		require.Equal(
+			t,
+			status.Error(codes.ResourceExhausted, "Failed to stage buffer of unknown size: Staging 11 bytes would cause the total size of staged data to exceed 11 bytes"),
+			blobAccess.Put(ctx, digest, buffer.NewUnsizedBufferFromReader(
+				ioutil.NopCloser(bytes.NewBufferString("Hello world")))))
+
+		stagedBuffer.Discard()
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewUnsizedBufferFromReader(
+			ioutil.NopCloser(bytes.NewBufferString("Hello world")))))
+	})
+
+	t.Run("UnknownSizeCorrupted", func(t *testing.T) {
+		// Staged data should still be validated against the
+		// digest.
+		baseBlobAccess.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				_, err := b.ToByteSlice(100)
+				return err
+			})
+
+		require.Equal(
+			t,
+			status.Error(codes.InvalidArgument, "Buffer is at least 13 bytes in size, while 11 bytes were expected"),
+			blobAccess.Put(ctx, digest, buffer.NewUnsizedBufferFromReader(
+				ioutil.NopCloser(bytes.NewBufferString("Goodbye world")))))
+	})
+}
@@ -0,0 +1,153 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	stagingAreaPrometheusMetrics sync.Once
+
+	stagingAreaUsageBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "staging_area_usage_bytes",
+			Help:      "Total size of data held in staging areas, in bytes.",
+		},
+		[]string{"type"})
+)
+
+func registerStagingAreaMetrics() {
+	stagingAreaPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(stagingAreaUsageBytes)
+	})
+}
+
+// StagingArea is a location where data can be held temporarily, until
+// it is ready to be written to storage. It is used to hold data whose
+// size is not known in advance.
+type StagingArea interface {
+	// Stage copies data from a reader into the staging area. Data
+	// exceeding maximumSizeBytes is rejected.
+	Stage(ctx context.Context, r io.Reader, maximumSizeBytes int64) (StagedData, error)
+}
+
+// StagedData is a handle to data that is held in a StagingArea. Every
+// handle needs to be released exactly once, either by closing the
+// reader returned by Open(), or by calling Release().
+type StagedData interface {
+	// GetSizeBytes returns the size of the staged data.
+	GetSizeBytes() int64
+	// Open the staged data for reading. The staged data is
+	// removed from the staging area when the reader is closed.
+	Open(ctx context.Context) (io.ReadCloser, error)
+	// Release removes the staged data from the staging area
+	// without reading it.
+	Release()
+}
+
+// copyToStagingArea copies data from a reader to a writer, failing in
+// case the data exceeds a maximum size.
+func copyToStagingArea(w io.Writer, r io.Reader, maximumSizeBytes int64) (int64, error) {
+	// Attempt to copy one byte more than permitted, so that
+	// oversized data can be detected.
+	n, err := io.Copy(w, io.LimitReader(r, maximumSizeBytes+1))
+	if err != nil {
+		return 0, err
+	}
+	if n > maximumSizeBytes {
+		return 0, status.Errorf(codes.InvalidArgument, "Buffer is at least %d bytes in size, while a maximum of %d bytes is permitted", n, maximumSizeBytes)
+	}
+	return n, nil
+}
+
+type inMemoryStagingArea struct {
+	maximumSizeBytes int64
+	usageBytes       prometheus.Gauge
+
+	lock           sync.Mutex
+	totalSizeBytes int64
+}
+
+// NewInMemoryStagingArea creates a StagingArea that holds data in
+// memory. The total size of all data held at the same time is bounded
+// by maximumSizeBytes. Attempts to stage more data fail with
+// RESOURCE_EXHAUSTED.
+func NewInMemoryStagingArea(maximumSizeBytes int64) StagingArea {
+	registerStagingAreaMetrics()
+
+	return &inMemoryStagingArea{
+		maximumSizeBytes: maximumSizeBytes,
+		usageBytes:       stagingAreaUsageBytes.WithLabelValues("InMemory"),
+	}
+}
+
+func (sa *inMemoryStagingArea) Stage(ctx context.Context, r io.Reader, maximumSizeBytes int64) (StagedData, error) {
+	var data bytes.Buffer
+	if _, err := copyToStagingArea(&data, r, maximumSizeBytes); err != nil {
+		return nil, err
+	}
+
+	sizeBytes := int64(data.Len())
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	if sa.totalSizeBytes+sizeBytes > sa.maximumSizeBytes {
+		return nil, status.Errorf(codes.ResourceExhausted, "Staging %d bytes would cause the total size of staged data to exceed %d bytes", sizeBytes, sa.maximumSizeBytes)
+	}
+	sa.totalSizeBytes += sizeBytes
+	sa.usageBytes.Add(float64(sizeBytes))
+	return &inMemoryStagedData{
+		stagingArea: sa,
+		data:        data.Bytes(),
+	}, nil
+}
+
+type inMemoryStagedData struct {
+	stagingArea *inMemoryStagingArea
+	data        []byte
+}
+
+func (sd *inMemoryStagedData) GetSizeBytes() int64 {
+	return int64(len(sd.data))
+}
+
+func (sd *inMemoryStagedData) Open(ctx context.Context) (io.ReadCloser, error) {
+	return &stagedDataReader{
+		Reader:     bytes.NewReader(sd.data),
+		stagedData: sd,
+	}, nil
+}
+
+func (sd *inMemoryStagedData) Release() {
+	sa := sd.stagingArea
+	sizeBytes := int64(len(sd.data))
+	sa.lock.Lock()
+	sa.totalSizeBytes -= sizeBytes
+	sa.lock.Unlock()
+	sa.usageBytes.Sub(float64(sizeBytes))
+}
+
+// stagedDataReader is a reader for staged data that releases the
+// staged data upon closure.
+type stagedDataReader struct {
+	io.Reader
+	closer     io.Closer
+	stagedData StagedData
+}
+
+func (r *stagedDataReader) Close() error {
+	var err error
+	if r.closer != nil {
+		err = r.closer.Close()
+	}
+	r.stagedData.Release()
+	return err
+}
@@ -0,0 +1,138 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/filesystem"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func readStagedData(ctx context.Context, t *testing.T, sd blobstore.StagedData) []byte {
+	r, err := sd.Open(ctx)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	return data
+}
+
+func TestInMemoryStagingArea(t *testing.T) {
+	ctx := context.Background()
+
+	stagingArea := blobstore.NewInMemoryStagingArea(20)
+
+	t.Run("TooLarge", func(t *testing.T) {
+		_, err := stagingArea.Stage(ctx, bytes.NewBufferString("Hello world"), 10)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Buffer is at least 11 bytes in size, while a maximum of 10 bytes is permitted"), err)
+	})
+
+	t.Run("TotalSizeExceeded", func(t *testing.T) {
+		// Staged data should count against the limit until it is
+		// released, either explicitly or by reading it.
+		sd1, err := stagingArea.Stage(ctx, bytes.NewBufferString("Hello world"), 100)
+		require.NoError(t, err)
+		require.Equal(t, int64(11), sd1.GetSizeBytes())
+
+		_, err = stagingArea.Stage(ctx, bytes.NewBufferString("Goodbye world"), 100)
+		require.Equal(t, status.Error(codes.ResourceExhausted, "Staging 13 bytes would cause the total size of staged data to exceed 20 bytes"), err)
+
+		require.Equal(t, []byte("Hello world"), readStagedData(ctx, t, sd1))
+
+		sd2, err := stagingArea.Stage(ctx, bytes.NewBufferString("Goodbye world"), 100)
+		require.NoError(t, err)
+		sd2.Release()
+
+		sd3, err := stagingArea.Stage(ctx, bytes.NewBufferString("Goodbye world"), 100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Goodbye world"), readStagedData(ctx, t, sd3))
+	})
+}
+
+func TestDirectoryStagingArea(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	path, err := ioutil.TempDir("", "staging_area")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+
+	// Files left behind by previous runs should be removed upon
+	// creation.
+	require.NoError(t, ioutil.WriteFile(path+"/stale", []byte("Stale"), 0600))
+	directory, err := filesystem.NewLocalDirectory(path)
+	require.NoError(t, err)
+	defer directory.Close()
+	clock := mock.NewMockClock(ctrl)
+	stagingArea, err := blobstore.NewDirectoryStagingArea(directory, clock, time.Minute)
+	require.NoError(t, err)
+
+	getFileCount := func() int {
+		entries, err := directory.ReadDir()
+		require.NoError(t, err)
+		return len(entries)
+	}
+	require.Equal(t, 0, getFileCount())
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// Files of data that is rejected should be removed.
+		clock.EXPECT().Now().Return(time.Unix(1000, 0))
+		_, err := stagingArea.Stage(ctx, bytes.NewBufferString("Hello world"), 10)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Buffer is at least 11 bytes in size, while a maximum of 10 bytes is permitted"), err)
+		require.Equal(t, 0, getFileCount())
+	})
+
+	t.Run("ReadAndRelease", func(t *testing.T) {
+		clock.EXPECT().Now().Return(time.Unix(1000, 0))
+		sd1, err := stagingArea.Stage(ctx, bytes.NewBufferString("Hello world"), 100)
+		require.NoError(t, err)
+		require.Equal(t, int64(11), sd1.GetSizeBytes())
+
+		clock.EXPECT().Now().Return(time.Unix(1001, 0))
+		sd2, err := stagingArea.Stage(ctx, bytes.NewBufferString("Goodbye world"), 100)
+		require.NoError(t, err)
+		require.Equal(t, 2, getFileCount())
+
+		require.Equal(t, []byte("Hello world"), readStagedData(ctx, t, sd1))
+		require.Equal(t, 1, getFileCount())
+		sd2.Release()
+		require.Equal(t, 0, getFileCount())
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		clock.EXPECT().Now().Return(time.Unix(1000, 0))
+		sd1, err := stagingArea.Stage(ctx, bytes.NewBufferString("Hello world"), 100)
+		require.NoError(t, err)
+
+		clock.EXPECT().Now().Return(time.Unix(1030, 0))
+		sd2, err := stagingArea.Stage(ctx, bytes.NewBufferString("Goodbye world"), 100)
+		require.NoError(t, err)
+		require.Equal(t, 2, getFileCount())
+
+		// Staging data after the first file has expired should
+		// cause it to be removed. The second file should be
+		// left alone.
+		clock.EXPECT().Now().Return(time.Unix(1060, 0))
+		sd3, err := stagingArea.Stage(ctx, bytes.NewBufferString("Hello"), 100)
+		require.NoError(t, err)
+		require.Equal(t, 2, getFileCount())
+
+		// Releasing expired data should be a no-op.
+		sd1.Release()
+		require.Equal(t, 2, getFileCount())
+
+		require.Equal(t, []byte("Goodbye world"), readStagedData(ctx, t, sd2))
+		require.Equal(t, []byte("Hello"), readStagedData(ctx, t, sd3))
+		require.Equal(t, 0, getFileCount())
+	})
+}
@@ -0,0 +1,172 @@
+package blobstore
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UnknownStorageSize is returned by StorageStats.GetStats() for values
+// that cannot be determined. This is the case for backends whose
+// capacity is unbounded (e.g., cloud-based object stores), as
+// reporting zero would be misleading.
+const UnknownStorageSize int64 = -1
+
+// StorageStats is implemented by storage backends that are capable of
+// reporting how much space they have available.
+type StorageStats interface {
+	// GetStats returns the total capacity of the storage backend,
+	// the amount of space used and the amount of space free, all in
+	// bytes. Values that cannot be determined are set to
+	// UnknownStorageSize.
+	GetStats(ctx context.Context) (capacity int64, used int64, free int64, err error)
+}
+
+var (
+	storageStatsPrometheusMetrics sync.Once
+
+	storageStatsLock     sync.Mutex
+	storageStatsBackends = map[string][]StorageStats{}
+
+	storageStatsCapacityBytesDesc = prometheus.NewDesc(
+		"buildbarn_blobstore_storage_stats_capacity_bytes",
+		"Total capacity of the storage backend, in bytes.",
+		[]string{"name"},
+		nil)
+	storageStatsUsedBytesDesc = prometheus.NewDesc(
+		"buildbarn_blobstore_storage_stats_used_bytes",
+		"Amount of space used by the storage backend, in bytes.",
+		[]string{"name"},
+		nil)
+	storageStatsFreeBytesDesc = prometheus.NewDesc(
+		"buildbarn_blobstore_storage_stats_free_bytes",
+		"Amount of space available in the storage backend, in bytes.",
+		[]string{"name"},
+		nil)
+)
+
+// RegisterStorageStats registers a StorageStats, so that the values
+// returned by GetStats() are exposed as Prometheus gauges. Statistics
+// are obtained every time metrics are scraped. Multiple backends may
+// be registered under the same name (e.g., when multiple shards use
+// the same type of backend), in which case their statistics are
+// summed. Values that are unknown for any of the backends are omitted.
+func RegisterStorageStats(name string, storageStats StorageStats) {
+	storageStatsPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(storageStatsCollector{})
+	})
+
+	storageStatsLock.Lock()
+	defer storageStatsLock.Unlock()
+	storageStatsBackends[name] = append(storageStatsBackends[name], storageStats)
+}
+
+// storageStatsCollector is a Prometheus collector that exposes the
+// statistics of all backends registered through RegisterStorageStats().
+type storageStatsCollector struct{}
+
+func (c storageStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storageStatsCapacityBytesDesc
+	ch <- storageStatsUsedBytesDesc
+	ch <- storageStatsFreeBytesDesc
+}
+
+func (c storageStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, entry := range getStorageStats(context.Background()) {
+		if entry.Error != "" {
+			// Don't report partial statistics, as they
+			// would be misleading.
+			log.Printf("Failed to obtain storage statistics for backend %#v: %s", entry.Name, entry.Error)
+			continue
+		}
+		for _, metric := range []struct {
+			desc  *prometheus.Desc
+			value *int64
+		}{
+			{storageStatsCapacityBytesDesc, entry.CapacityBytes},
+			{storageStatsUsedBytesDesc, entry.UsedBytes},
+			{storageStatsFreeBytesDesc, entry.FreeBytes},
+		} {
+			if metric.value != nil {
+				ch <- prometheus.MustNewConstMetric(metric.desc, prometheus.GaugeValue, float64(*metric.value), entry.Name)
+			}
+		}
+	}
+}
+
+// storageStatsEntry contains the statistics of all backends registered
+// under a single name, summed. Values that are unknown for any of the
+// backends are left unset.
+type storageStatsEntry struct {
+	Name          string `json:"name"`
+	CapacityBytes *int64 `json:"capacity_bytes,omitempty"`
+	UsedBytes     *int64 `json:"used_bytes,omitempty"`
+	FreeBytes     *int64 `json:"free_bytes,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// getStorageStats obtains the statistics of all backends registered
+// through RegisterStorageStats(), sorted by name.
+func getStorageStats(ctx context.Context) []storageStatsEntry {
+	storageStatsLock.Lock()
+	names := make([]string, 0, len(storageStatsBackends))
+	for name := range storageStatsBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	backends := make([][]StorageStats, 0, len(names))
+	for _, name := range names {
+		backends = append(backends, append([]StorageStats(nil), storageStatsBackends[name]...))
+	}
+	storageStatsLock.Unlock()
+
+	entries := make([]storageStatsEntry, 0, len(names))
+	for i, name := range names {
+		totals := [3]int64{}
+		known := [3]bool{true, true, true}
+		var statsErr error
+		for _, storageStats := range backends[i] {
+			capacity, used, free, err := storageStats.GetStats(ctx)
+			if err != nil {
+				statsErr = err
+				break
+			}
+			for j, value := range [3]int64{capacity, used, free} {
+				if value == UnknownStorageSize {
+					known[j] = false
+				} else {
+					totals[j] += value
+				}
+			}
+		}
+
+		entry := storageStatsEntry{Name: name}
+		if statsErr != nil {
+			entry.Error = statsErr.Error()
+		} else {
+			for j, value := range []**int64{&entry.CapacityBytes, &entry.UsedBytes, &entry.FreeBytes} {
+				if known[j] {
+					total := totals[j]
+					*value = &total
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// ServeStorageStats is an HTTP handler that returns the capacity, used
+// space and free space of all backends registered through
+// RegisterStorageStats() in JSON form. Values that cannot be determined
+// are omitted. Backends for which statistics could not be obtained
+// have their error message reported instead.
+func ServeStorageStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getStorageStats(r.Context()))
+}
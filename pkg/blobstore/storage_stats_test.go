@@ -0,0 +1,131 @@
+package blobstore_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStorageStats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	getStats := func() map[string]map[string]float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		require.NoError(t, err)
+		stats := map[string]map[string]float64{}
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "name" && (label.GetValue() == "storage_stats_test_a" || label.GetValue() == "storage_stats_test_b") {
+						if stats[label.GetValue()] == nil {
+							stats[label.GetValue()] = map[string]float64{}
+						}
+						stats[label.GetValue()][family.GetName()] = metric.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+		return stats
+	}
+
+	// Register two backends under the same name, and one backend
+	// under another name. Registering multiple backends should not
+	// cause registration of the Prometheus collector to fail.
+	storageStatsA1 := mock.NewMockStorageStats(ctrl)
+	storageStatsA2 := mock.NewMockStorageStats(ctrl)
+	storageStatsB := mock.NewMockStorageStats(ctrl)
+	blobstore.RegisterStorageStats("storage_stats_test_a", storageStatsA1)
+	blobstore.RegisterStorageStats("storage_stats_test_a", storageStatsA2)
+	blobstore.RegisterStorageStats("storage_stats_test_b", storageStatsB)
+
+	t.Run("Summed", func(t *testing.T) {
+		// Statistics of backends registered under the same
+		// name should be summed. Unknown values should be
+		// omitted.
+		storageStatsA1.EXPECT().GetStats(gomock.Any()).Return(int64(1000), int64(300), int64(700), nil)
+		storageStatsA2.EXPECT().GetStats(gomock.Any()).Return(int64(2000), int64(500), int64(1500), nil)
+		storageStatsB.EXPECT().GetStats(gomock.Any()).Return(blobstore.UnknownStorageSize, int64(42), blobstore.UnknownStorageSize, nil)
+
+		require.Equal(t, map[string]map[string]float64{
+			"storage_stats_test_a": {
+				"buildbarn_blobstore_storage_stats_capacity_bytes": 3000,
+				"buildbarn_blobstore_storage_stats_used_bytes":     800,
+				"buildbarn_blobstore_storage_stats_free_bytes":     2200,
+			},
+			"storage_stats_test_b": {
+				"buildbarn_blobstore_storage_stats_used_bytes": 42,
+			},
+		}, getStats())
+	})
+
+	t.Run("PartiallyUnknown", func(t *testing.T) {
+		// If a value is unknown for one of the backends, the
+		// sum cannot be computed.
+		storageStatsA1.EXPECT().GetStats(gomock.Any()).Return(int64(1000), int64(300), int64(700), nil)
+		storageStatsA2.EXPECT().GetStats(gomock.Any()).Return(blobstore.UnknownStorageSize, int64(500), blobstore.UnknownStorageSize, nil)
+		storageStatsB.EXPECT().GetStats(gomock.Any()).Return(blobstore.UnknownStorageSize, int64(42), blobstore.UnknownStorageSize, nil)
+
+		require.Equal(t, map[string]map[string]float64{
+			"storage_stats_test_a": {
+				"buildbarn_blobstore_storage_stats_used_bytes": 800,
+			},
+			"storage_stats_test_b": {
+				"buildbarn_blobstore_storage_stats_used_bytes": 42,
+			},
+		}, getStats())
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		// Failures should only cause statistics of the affected
+		// backends to be omitted. They should not cause
+		// gathering of all metrics to fail.
+		storageStatsA1.EXPECT().GetStats(gomock.Any()).Return(int64(0), int64(0), int64(0), status.Error(codes.Internal, "Disk on fire"))
+		storageStatsB.EXPECT().GetStats(gomock.Any()).Return(blobstore.UnknownStorageSize, int64(42), blobstore.UnknownStorageSize, nil)
+
+		require.Equal(t, map[string]map[string]float64{
+			"storage_stats_test_b": {
+				"buildbarn_blobstore_storage_stats_used_bytes": 42,
+			},
+		}, getStats())
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		// The same statistics should be exposed through an
+		// HTTP handler. Failures should be reported as well.
+		storageStatsA1.EXPECT().GetStats(gomock.Any()).Return(int64(0), int64(0), int64(0), status.Error(codes.Internal, "Disk on fire"))
+		storageStatsB.EXPECT().GetStats(gomock.Any()).Return(blobstore.UnknownStorageSize, int64(42), blobstore.UnknownStorageSize, nil)
+
+		w := httptest.NewRecorder()
+		blobstore.ServeStorageStats(w, httptest.NewRequest(http.MethodGet, "/-/storage_stats", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var entries []map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		stats := map[string]map[string]interface{}{}
+		for _, entry := range entries {
+			if name := entry["name"]; name == "storage_stats_test_a" || name == "storage_stats_test_b" {
+				stats[name.(string)] = entry
+			}
+		}
+		require.Equal(t, map[string]map[string]interface{}{
+			"storage_stats_test_a": {
+				"name":  "storage_stats_test_a",
+				"error": "rpc error: code = Internal desc = Disk on fire",
+			},
+			"storage_stats_test_b": {
+				"name":       "storage_stats_test_b",
+				"used_bytes": float64(42),
+			},
+		}, stats)
+	})
+}
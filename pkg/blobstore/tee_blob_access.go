@@ -0,0 +1,67 @@
+package blobstore
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	teeBlobAccessPrometheusMetrics sync.Once
+
+	teeBlobAccessSecondaryPuts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "tee_blob_access_secondary_puts_total",
+			Help:      "Number of blobs for which a write to the secondary backend was attempted.",
+		},
+		[]string{"result"})
+	teeBlobAccessSecondaryPutsSuccess = teeBlobAccessSecondaryPuts.WithLabelValues("Success")
+	teeBlobAccessSecondaryPutsFailure = teeBlobAccessSecondaryPuts.WithLabelValues("Failure")
+)
+
+type teeBlobAccess struct {
+	BlobAccess
+	secondary BlobAccess
+}
+
+// NewTeeBlobAccess creates a decorator for BlobAccess that writes
+// blobs to a secondary backend in addition to the primary backend.
+// Get() and FindMissing() are only forwarded to the primary backend.
+// This may be used to populate a new backend during a migration.
+//
+// Unlike MirroredBlobAccess, failures to write to the secondary
+// backend are only logged. They do not cause Put() to fail. Data is
+// streamed to both backends simultaneously, meaning that a slow
+// secondary backend does slow down writes.
+func NewTeeBlobAccess(primary BlobAccess, secondary BlobAccess) BlobAccess {
+	teeBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(teeBlobAccessSecondaryPuts)
+	})
+
+	return &teeBlobAccess{
+		BlobAccess: primary,
+		secondary:  secondary,
+	}
+}
+
+func (ba *teeBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	bPrimary, bSecondary := b.CloneStream()
+	errSecondaryChan := make(chan error, 1)
+	go func() {
+		errSecondaryChan <- ba.secondary.Put(ctx, digest, bSecondary)
+	}()
+	errPrimary := ba.BlobAccess.Put(ctx, digest, bPrimary)
+	if errSecondary := <-errSecondaryChan; errSecondary == nil {
+		teeBlobAccessSecondaryPutsSuccess.Inc()
+	} else {
+		teeBlobAccessSecondaryPutsFailure.Inc()
+		log.Printf("Failed to write blob %s to secondary backend: %s", digest, errSecondary)
+	}
+	return errPrimary
+}
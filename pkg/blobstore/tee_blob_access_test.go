@@ -0,0 +1,71 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTeeBlobAccessPut(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	primary := mock.NewMockBlobAccess(ctrl)
+	secondary := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewTeeBlobAccess(primary, secondary)
+	digest := util.MustNewDigest("default", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	putSuccess := func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+		data, err := b.ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+		return nil
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		// Both backends should receive the full contents.
+		primary.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(putSuccess)
+		secondary.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(putSuccess)
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+	})
+
+	t.Run("PrimaryFailure", func(t *testing.T) {
+		primary.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return status.Error(codes.Internal, "I/O error")
+			})
+		secondary.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(putSuccess)
+
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "I/O error"),
+			blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+	})
+
+	t.Run("SecondaryFailure", func(t *testing.T) {
+		// Failures of the secondary backend should not cause
+		// the write to fail.
+		primary.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(putSuccess)
+		secondary.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return status.Error(codes.Unavailable, "Server not reachable")
+			})
+
+		require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+	})
+}
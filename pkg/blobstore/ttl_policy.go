@@ -0,0 +1,70 @@
+package blobstore
+
+import (
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+)
+
+// TTLPolicy computes how long a blob should be retained by storage
+// backends that support expiration of individual objects, such as
+// Redis. A duration of zero indicates that the blob should not expire.
+//
+// Backends that evict data in FIFO order (e.g., the circular and local
+// storage backends) have no notion of per-object lifetimes. For these
+// backends, TTL policies have no effect.
+type TTLPolicy func(digest *util.Digest) time.Duration
+
+// NewFixedTTLPolicy creates a TTLPolicy that assigns the same TTL to
+// all blobs.
+func NewFixedTTLPolicy(ttl time.Duration) TTLPolicy {
+	return func(digest *util.Digest) time.Duration {
+		return ttl
+	}
+}
+
+// SizeBasedTTLRule is a rule that is evaluated by a TTLPolicy created
+// through NewSizeBasedTTLPolicy().
+type SizeBasedTTLRule struct {
+	// Upper bound on the size of blobs matched by this rule. Zero
+	// indicates that there is no upper bound. As the size is
+	// obtained from the digest, this should only be set for the
+	// Content Addressable Storage.
+	MaximumSizeBytes int64
+	// Instance names of blobs matched by this rule. When empty,
+	// blobs stored under any instance name are matched.
+	InstanceNames map[string]struct{}
+	// The TTL to assign to matching blobs.
+	TTL time.Duration
+}
+
+func (r *SizeBasedTTLRule) matches(digest *util.Digest) bool {
+	if r.MaximumSizeBytes > 0 && digest.GetSizeBytes() > r.MaximumSizeBytes {
+		return false
+	}
+	if len(r.InstanceNames) > 0 {
+		if _, ok := r.InstanceNames[digest.GetInstance()]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// NewSizeBasedTTLPolicy creates a TTLPolicy that computes the TTL of a
+// blob based on its size and instance name. Rules are evaluated in
+// order, where the first matching rule determines the TTL. If no rules
+// match, defaultTTL is used.
+//
+// This permits retaining small blobs (e.g., Action and Directory
+// messages) for a long time, while letting large intermediate build
+// artifacts expire quickly to reclaim space.
+func NewSizeBasedTTLPolicy(rules []SizeBasedTTLRule, defaultTTL time.Duration) TTLPolicy {
+	return func(digest *util.Digest) time.Duration {
+		for i := range rules {
+			if rules[i].matches(digest) {
+				return rules[i].TTL
+			}
+		}
+		return defaultTTL
+	}
+}
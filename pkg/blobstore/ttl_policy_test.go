@@ -0,0 +1,53 @@
+package blobstore_test
+
+import (
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeBasedTTLPolicy(t *testing.T) {
+	ttlPolicy := blobstore.NewSizeBasedTTLPolicy(
+		[]blobstore.SizeBasedTTLRule{
+			{
+				MaximumSizeBytes: 1000,
+				InstanceNames:    map[string]struct{}{"ci": {}},
+				TTL:              time.Hour,
+			},
+			{
+				MaximumSizeBytes: 1000,
+				TTL:              24 * time.Hour,
+			},
+			{
+				InstanceNames: map[string]struct{}{"release": {}},
+				TTL:           0,
+			},
+		},
+		10*time.Minute)
+	newDigest := func(instance string, sizeBytes int64) *util.Digest {
+		return util.MustNewDigest(
+			instance,
+			&remoteexecution.Digest{
+				Hash:      "8b1a9953c4611296a827abf8c47804d7",
+				SizeBytes: sizeBytes,
+			})
+	}
+
+	t.Run("FirstMatchingRule", func(t *testing.T) {
+		require.Equal(t, time.Hour, ttlPolicy(newDigest("ci", 1000)))
+		require.Equal(t, 24*time.Hour, ttlPolicy(newDigest("default", 1000)))
+	})
+
+	t.Run("NoExpiration", func(t *testing.T) {
+		require.Equal(t, time.Duration(0), ttlPolicy(newDigest("release", 1001)))
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		require.Equal(t, 10*time.Minute, ttlPolicy(newDigest("ci", 1001)))
+		require.Equal(t, 10*time.Minute, ttlPolicy(newDigest("default", 1001)))
+	})
+}
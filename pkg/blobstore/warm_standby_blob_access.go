@@ -0,0 +1,169 @@
+package blobstore
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	warmStandbyBlobAccessPrometheusMetrics sync.Once
+
+	warmStandbyBlobAccessQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "warm_standby_blob_access_queue_depth",
+			Help:      "Number of blobs that have been written to the primary, but not yet to the standby.",
+		},
+		[]string{"name"})
+	warmStandbyBlobAccessReplicationLagSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "warm_standby_blob_access_replication_lag_seconds",
+			Help:      "Amount of time between a blob being written to the primary and it being written to the standby, in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2.0, 18),
+		},
+		[]string{"name"})
+	warmStandbyBlobAccessReplications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "warm_standby_blob_access_replications_total",
+			Help:      "Number of blobs for which replication to the standby was attempted.",
+		},
+		[]string{"name", "result"})
+)
+
+type warmStandbyEntry struct {
+	digest     *util.Digest
+	enqueuedAt time.Time
+}
+
+type warmStandbyBlobAccess struct {
+	BlobAccess
+	standby         BlobAccess
+	clock           clock.Clock
+	queue           chan warmStandbyEntry
+	maximumAttempts int
+	retryDelay      time.Duration
+	blockOnOverflow bool
+
+	queueDepth          prometheus.Gauge
+	replicationLag      prometheus.Observer
+	replicationsSuccess prometheus.Counter
+	replicationsFailure prometheus.Counter
+	replicationsDropped prometheus.Counter
+}
+
+// NewWarmStandbyBlobAccess creates a decorator for BlobAccess that
+// replicates all blobs written through Put() to a standby backend
+// asynchronously. Put() returns as soon as the blob has been written
+// to the primary backend. Get() and FindMissing() are only forwarded
+// to the primary backend. This allows the standby backend to remain
+// nearly up to date, so that it may take over in case the primary
+// backend fails, without adding latency to writes.
+//
+// Blobs are replicated by reading them back from the primary backend,
+// meaning that no copies of blobs are held in memory while queued.
+// Replication is attempted up to maximumAttempts times, waiting
+// retryDelay between attempts.
+//
+// When the queue of blobs pending replication is full, Put() either
+// blocks until space becomes available (blockOnOverflow) or drops the
+// blob from replication. Dropped blobs are counted, so that operators
+// can determine whether the standby is complete. Metrics are labeled
+// with the provided name, so that multiple instances can be told
+// apart.
+func NewWarmStandbyBlobAccess(primary BlobAccess, standby BlobAccess, clock clock.Clock, queueLength int, concurrency int, maximumAttempts int, retryDelay time.Duration, blockOnOverflow bool, name string) BlobAccess {
+	warmStandbyBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(warmStandbyBlobAccessQueueDepth)
+		prometheus.MustRegister(warmStandbyBlobAccessReplicationLagSeconds)
+		prometheus.MustRegister(warmStandbyBlobAccessReplications)
+	})
+
+	ba := &warmStandbyBlobAccess{
+		BlobAccess:      primary,
+		standby:         standby,
+		clock:           clock,
+		queue:           make(chan warmStandbyEntry, queueLength),
+		maximumAttempts: maximumAttempts,
+		retryDelay:      retryDelay,
+		blockOnOverflow: blockOnOverflow,
+
+		queueDepth:          warmStandbyBlobAccessQueueDepth.WithLabelValues(name),
+		replicationLag:      warmStandbyBlobAccessReplicationLagSeconds.WithLabelValues(name),
+		replicationsSuccess: warmStandbyBlobAccessReplications.WithLabelValues(name, "Success"),
+		replicationsFailure: warmStandbyBlobAccessReplications.WithLabelValues(name, "Failure"),
+		replicationsDropped: warmStandbyBlobAccessReplications.WithLabelValues(name, "Dropped"),
+	}
+	for i := 0; i < concurrency; i++ {
+		go ba.replicate()
+	}
+	return ba
+}
+
+func (ba *warmStandbyBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	if err := ba.BlobAccess.Put(ctx, digest, b); err != nil {
+		return err
+	}
+
+	entry := warmStandbyEntry{
+		digest:     digest,
+		enqueuedAt: ba.clock.Now(),
+	}
+	ba.queueDepth.Inc()
+	if ba.blockOnOverflow {
+		select {
+		case ba.queue <- entry:
+		case <-ctx.Done():
+			// The blob has been written to the primary, but
+			// can't be replicated to the standby. Report
+			// the write as failed, so that the client
+			// retries it.
+			ba.queueDepth.Dec()
+			ba.replicationsDropped.Inc()
+			return util.StatusFromContext(ctx)
+		}
+	} else {
+		select {
+		case ba.queue <- entry:
+		default:
+			ba.queueDepth.Dec()
+			ba.replicationsDropped.Inc()
+		}
+	}
+	return nil
+}
+
+// replicate copies blobs in the queue from the primary backend to the
+// standby backend.
+func (ba *warmStandbyBlobAccess) replicate() {
+	ctx := context.Background()
+	for entry := range ba.queue {
+		var err error
+		for attempt := 1; ; attempt++ {
+			if err = ba.standby.Put(ctx, entry.digest, ba.BlobAccess.Get(ctx, entry.digest)); err == nil || attempt >= ba.maximumAttempts {
+				break
+			}
+			_, t := ba.clock.NewTimer(ba.retryDelay)
+			<-t
+		}
+
+		ba.queueDepth.Dec()
+		if err == nil {
+			ba.replicationsSuccess.Inc()
+			ba.replicationLag.Observe(ba.clock.Now().Sub(entry.enqueuedAt).Seconds())
+		} else {
+			ba.replicationsFailure.Inc()
+			log.Printf("Failed to replicate blob %s to standby: %s", entry.digest, err)
+		}
+	}
+}
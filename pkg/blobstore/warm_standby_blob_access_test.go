@@ -0,0 +1,156 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func getWarmStandbyMetric(t *testing.T, metricName string, name string, result string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != metricName {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["name"] == name && labels["result"] == result {
+				if counter := metric.GetCounter(); counter != nil {
+					return counter.GetValue()
+				}
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestWarmStandbyBlobAccessReplication(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	primary := mock.NewMockBlobAccess(ctrl)
+	standby := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	blobAccess := blobstore.NewWarmStandbyBlobAccess(primary, standby, clock, 10, 1, 2, time.Second, false, "warm_standby_replication_test")
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	// Store a blob. The first attempt to replicate it fails, while
+	// the second attempt succeeds. The blob should be read back from
+	// the primary for every attempt.
+	primary.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+			b.Discard()
+			return nil
+		})
+	clock.EXPECT().Now().Return(time.Unix(1000, 0))
+	primary.EXPECT().Get(gomock.Any(), digest).
+		DoAndReturn(func(ctx context.Context, digest *util.Digest) buffer.Buffer {
+			return buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))
+		}).
+		Times(2)
+	gomock.InOrder(
+		standby.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return status.Error(codes.Unavailable, "Server offline")
+			}),
+		standby.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				data, err := b.ToByteSlice(100)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello world"), data)
+				return nil
+			}))
+	timer := make(chan time.Time, 1)
+	timer <- time.Unix(1001, 0)
+	clock.EXPECT().NewTimer(time.Second).Return(mock.NewMockTimer(ctrl), timer)
+	replicated := make(chan struct{})
+	clock.EXPECT().Now().DoAndReturn(func() time.Time {
+		close(replicated)
+		return time.Unix(1002, 0)
+	})
+
+	require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	<-replicated
+
+	// Metrics are updated after the replication lag is measured.
+	for getWarmStandbyMetric(t, "buildbarn_blobstore_warm_standby_blob_access_replications_total", "warm_standby_replication_test", "Success") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, 0.0, getWarmStandbyMetric(t, "buildbarn_blobstore_warm_standby_blob_access_queue_depth", "warm_standby_replication_test", ""))
+	require.Equal(t, 0.0, getWarmStandbyMetric(t, "buildbarn_blobstore_warm_standby_blob_access_replications_total", "warm_standby_replication_test", "Failure"))
+}
+
+func TestWarmStandbyBlobAccessOverflow(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	primary := mock.NewMockBlobAccess(ctrl)
+	standby := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	digest := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	primary.EXPECT().Put(ctx, digest, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+			b.Discard()
+			return nil
+		}).AnyTimes()
+	clock.EXPECT().Now().Return(time.Unix(1000, 0)).AnyTimes()
+
+	t.Run("Drop", func(t *testing.T) {
+		// Without any replication workers, the queue can hold
+		// a single blob. The second blob should be dropped.
+		blobAccess := blobstore.NewWarmStandbyBlobAccess(primary, standby, clock, 1, 0, 1, time.Second, false, "warm_standby_drop_test")
+		for i := 0; i < 2; i++ {
+			require.NoError(t, blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		}
+		require.Equal(t, 1.0, getWarmStandbyMetric(t, "buildbarn_blobstore_warm_standby_blob_access_queue_depth", "warm_standby_drop_test", ""))
+		require.Equal(t, 1.0, getWarmStandbyMetric(t, "buildbarn_blobstore_warm_standby_blob_access_replications_total", "warm_standby_drop_test", "Dropped"))
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		// When blocking on overflow, the write should fail if
+		// the caller's context is canceled, so that the client
+		// retries it.
+		blobAccess := blobstore.NewWarmStandbyBlobAccess(primary, standby, clock, 0, 0, 1, time.Second, true, "warm_standby_block_test")
+		ctxCanceled, cancel := context.WithCancel(ctx)
+		cancel()
+		primary.EXPECT().Put(ctxCanceled, digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				b.Discard()
+				return nil
+			})
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "context canceled"),
+			blobAccess.Put(ctxCanceled, digest, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		require.Equal(t, 0.0, getWarmStandbyMetric(t, "buildbarn_blobstore_warm_standby_blob_access_queue_depth", "warm_standby_block_test", ""))
+		require.Equal(t, 1.0, getWarmStandbyMetric(t, "buildbarn_blobstore_warm_standby_blob_access_replications_total", "warm_standby_block_test", "Dropped"))
+	})
+}
@@ -0,0 +1,344 @@
+package blobstore
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	writeBehindBlobAccessPrometheusMetrics sync.Once
+
+	writeBehindBlobAccessPendingSizeBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "write_behind_blob_access_pending_size_bytes",
+			Help:      "Total size of blobs that have been buffered, but not yet written to the backend, in bytes.",
+		})
+	writeBehindBlobAccessFlushedBatchSizeBlobs = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "write_behind_blob_access_flushed_batch_size_blobs",
+			Help:      "Number of blobs contained in batches that were written to the backend.",
+			Buckets:   prometheus.ExponentialBuckets(1.0, 2.0, 17),
+		})
+)
+
+type writeBehindEntry struct {
+	digest *util.Digest
+	data   []byte
+}
+
+// writeBehindBatch is a set of blobs that are written to the backend
+// together.
+type writeBehindBatch struct {
+	entries   map[string]writeBehindEntry
+	sizeBytes int64
+
+	// Closed after all blobs have been written to the backend. err
+	// contains the first error that occurred while doing so.
+	done chan struct{}
+	err  error
+}
+
+type writeBehindBlobAccess struct {
+	BlobAccess
+	storageType             StorageType
+	clock                   clock.Clock
+	maximumBlobSizeBytes    int64
+	flushSizeBytes          int64
+	maximumPendingSizeBytes int64
+	flushDelay              time.Duration
+	concurrency             int
+	durable                 bool
+
+	lock             sync.Mutex
+	currentBatch     *writeBehindBatch
+	pendingBatches   []*writeBehindBatch
+	pendingSizeBytes int64
+	pendingReduced   chan struct{}
+}
+
+// NewWriteBehindBlobAccess creates a decorator for BlobAccess that
+// buffers small blobs provided to Put() in memory, writing them to the
+// backend in batches. Batches are flushed once their total size
+// reaches flushSizeBytes, or when flushDelay has passed since the first
+// blob was added to it. Blobs within a batch are written concurrently.
+// This reduces the overhead of storing many tiny blobs in backends
+// with a high per-request latency, such as S3.
+//
+// The total size of blobs that are buffered is bounded by
+// maximumPendingSizeBytes. Once reached, Put() blocks until batches
+// have been written to the backend.
+//
+// If durable is set, Put() only returns after the batch has been
+// written to the backend, thereby reporting any errors to the caller.
+// Otherwise, Put() returns immediately and errors are only logged.
+//
+// Blobs that are buffered are returned by Get() and FindMissing() to
+// ensure that writes are observed by subsequent reads. Blobs larger
+// than maximumBlobSizeBytes are written to the backend directly, after
+// discarding or waiting for older buffered versions of the same blob.
+func NewWriteBehindBlobAccess(blobAccess BlobAccess, storageType StorageType, clock clock.Clock, maximumBlobSizeBytes int64, flushSizeBytes int64, maximumPendingSizeBytes int64, flushDelay time.Duration, concurrency int, durable bool) BlobAccess {
+	writeBehindBlobAccessPrometheusMetrics.Do(func() {
+		prometheus.MustRegister(writeBehindBlobAccessPendingSizeBytes)
+		prometheus.MustRegister(writeBehindBlobAccessFlushedBatchSizeBlobs)
+	})
+
+	return &writeBehindBlobAccess{
+		BlobAccess:              blobAccess,
+		storageType:             storageType,
+		clock:                   clock,
+		maximumBlobSizeBytes:    maximumBlobSizeBytes,
+		flushSizeBytes:          flushSizeBytes,
+		maximumPendingSizeBytes: maximumPendingSizeBytes,
+		flushDelay:              flushDelay,
+		concurrency:             concurrency,
+		durable:                 durable,
+		pendingReduced:          make(chan struct{}),
+	}
+}
+
+// getPending returns the contents of a blob that is buffered, but not
+// yet written to the backend. If the blob is buffered multiple times,
+// the most recently written version is returned.
+func (ba *writeBehindBlobAccess) getPending(key string) ([]byte, bool) {
+	for i := len(ba.pendingBatches) - 1; i >= 0; i-- {
+		if entry, ok := ba.pendingBatches[i].entries[key]; ok {
+			return entry.data, true
+		}
+	}
+	return nil, false
+}
+
+func (ba *writeBehindBlobAccess) Get(ctx context.Context, digest *util.Digest) buffer.Buffer {
+	ba.lock.Lock()
+	data, ok := ba.getPending(ba.storageType.GetDigestKey(digest))
+	ba.lock.Unlock()
+	if ok {
+		return buffer.NewValidatedBufferFromByteSlice(data)
+	}
+	return ba.BlobAccess.Get(ctx, digest)
+}
+
+// waitForPendingKey removes a blob from the batch that is currently
+// being filled and waits for batches that are being written to the
+// backend to complete their writes of the blob. This is called prior to
+// writing a blob to the backend directly, as older versions that are
+// buffered would otherwise overwrite it.
+func (ba *writeBehindBlobAccess) waitForPendingKey(ctx context.Context, key string) error {
+	ba.lock.Lock()
+	if batch := ba.currentBatch; batch != nil {
+		if oldEntry, ok := batch.entries[key]; ok {
+			delete(batch.entries, key)
+			batch.sizeBytes -= int64(len(oldEntry.data))
+			ba.pendingSizeBytes -= int64(len(oldEntry.data))
+			writeBehindBlobAccessPendingSizeBytes.Sub(float64(len(oldEntry.data)))
+		}
+	}
+	var predecessors []*writeBehindBatch
+	for _, pendingBatch := range ba.pendingBatches {
+		if _, ok := pendingBatch.entries[key]; ok {
+			predecessors = append(predecessors, pendingBatch)
+		}
+	}
+	ba.lock.Unlock()
+
+	for _, predecessor := range predecessors {
+		select {
+		case <-predecessor.done:
+		case <-ctx.Done():
+			return util.StatusFromContext(ctx)
+		}
+	}
+	return nil
+}
+
+func (ba *writeBehindBlobAccess) Put(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+	// Use the size of the buffer, as opposed to the size stored in
+	// the digest. For the Action Cache, the latter corresponds to
+	// the size of the Action message.
+	bufferSizeBytes, err := b.GetSizeBytes()
+	if err != nil {
+		b.Discard()
+		return err
+	}
+	if bufferSizeBytes > ba.maximumBlobSizeBytes {
+		if err := ba.waitForPendingKey(ctx, ba.storageType.GetDigestKey(digest)); err != nil {
+			b.Discard()
+			return err
+		}
+		return ba.BlobAccess.Put(ctx, digest, b)
+	}
+	data, err := b.ToByteSlice(int(ba.maximumBlobSizeBytes))
+	if err != nil {
+		return err
+	}
+	sizeBytes := int64(len(data))
+
+	// Wait for pending batches to be written to the backend if
+	// buffering the blob would exceed the memory limit.
+	ba.lock.Lock()
+	for ba.pendingSizeBytes > 0 && ba.pendingSizeBytes+sizeBytes > ba.maximumPendingSizeBytes {
+		pendingReduced := ba.pendingReduced
+		ba.lock.Unlock()
+		select {
+		case <-pendingReduced:
+		case <-ctx.Done():
+			return util.StatusFromContext(ctx)
+		}
+		ba.lock.Lock()
+	}
+
+	// Add the blob to the current batch.
+	batch := ba.currentBatch
+	if batch == nil {
+		batch = &writeBehindBatch{
+			entries: map[string]writeBehindEntry{},
+			done:    make(chan struct{}),
+		}
+		ba.currentBatch = batch
+		ba.pendingBatches = append(ba.pendingBatches, batch)
+		go ba.flushAfterDelay(batch)
+	}
+	key := ba.storageType.GetDigestKey(digest)
+	if oldEntry, ok := batch.entries[key]; ok {
+		// Overwrite the blob that was written previously.
+		// Though this has no effect for the Content Addressable
+		// Storage, it is needed to ensure that the last write
+		// to the Action Cache wins.
+		batch.sizeBytes -= int64(len(oldEntry.data))
+		ba.pendingSizeBytes -= int64(len(oldEntry.data))
+		writeBehindBlobAccessPendingSizeBytes.Sub(float64(len(oldEntry.data)))
+	}
+	batch.entries[key] = writeBehindEntry{
+		digest: digest,
+		data:   data,
+	}
+	batch.sizeBytes += sizeBytes
+	ba.pendingSizeBytes += sizeBytes
+	writeBehindBlobAccessPendingSizeBytes.Add(float64(sizeBytes))
+	if batch.sizeBytes >= ba.flushSizeBytes {
+		ba.currentBatch = nil
+		go ba.flush(batch)
+	}
+	ba.lock.Unlock()
+
+	if !ba.durable {
+		return nil
+	}
+	select {
+	case <-batch.done:
+		return batch.err
+	case <-ctx.Done():
+		return util.StatusFromContext(ctx)
+	}
+}
+
+func (ba *writeBehindBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	ba.lock.Lock()
+	var remaining []*util.Digest
+	for _, digest := range digests {
+		if _, ok := ba.getPending(ba.storageType.GetDigestKey(digest)); !ok {
+			remaining = append(remaining, digest)
+		}
+	}
+	ba.lock.Unlock()
+
+	if len(remaining) == 0 {
+		return nil, nil
+	}
+	return ba.BlobAccess.FindMissing(ctx, remaining)
+}
+
+// flushAfterDelay flushes a batch once the flush delay has passed,
+// unless it has already been flushed due to reaching its maximum size.
+func (ba *writeBehindBlobAccess) flushAfterDelay(batch *writeBehindBatch) {
+	_, t := ba.clock.NewTimer(ba.flushDelay)
+	<-t
+
+	ba.lock.Lock()
+	if ba.currentBatch != batch {
+		ba.lock.Unlock()
+		return
+	}
+	ba.currentBatch = nil
+	ba.lock.Unlock()
+	ba.flush(batch)
+}
+
+// flush writes all blobs contained in a batch to the backend.
+func (ba *writeBehindBlobAccess) flush(batch *writeBehindBatch) {
+	writeBehindBlobAccessFlushedBatchSizeBlobs.Observe(float64(len(batch.entries)))
+
+	// Batches that were created earlier may still be in the process
+	// of writing older versions of the same blobs. Writes of these
+	// blobs need to wait for those batches to complete, as they
+	// would otherwise overwrite newer versions.
+	ba.lock.Lock()
+	predecessors := map[string][]*writeBehindBatch{}
+	for _, pendingBatch := range ba.pendingBatches {
+		if pendingBatch == batch {
+			break
+		}
+		for key := range batch.entries {
+			if _, ok := pendingBatch.entries[key]; ok {
+				predecessors[key] = append(predecessors[key], pendingBatch)
+			}
+		}
+	}
+	ba.lock.Unlock()
+
+	// The batch is no longer modified at this point, meaning it
+	// can be iterated without holding the lock.
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	semaphore := make(chan struct{}, ba.concurrency)
+	for key, entry := range batch.entries {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(entry writeBehindEntry, predecessors []*writeBehindBatch) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			for _, predecessor := range predecessors {
+				<-predecessor.done
+			}
+			if err := ba.BlobAccess.Put(context.Background(), entry.digest, buffer.NewValidatedBufferFromByteSlice(entry.data)); err != nil {
+				err = util.StatusWrapf(err, "Failed to write blob %s", entry.digest)
+				if !ba.durable {
+					log.Print(err)
+				}
+				errLock.Lock()
+				if batch.err == nil {
+					batch.err = err
+				}
+				errLock.Unlock()
+			}
+		}(entry, predecessors[key])
+	}
+	wg.Wait()
+
+	ba.lock.Lock()
+	for i, pendingBatch := range ba.pendingBatches {
+		if pendingBatch == batch {
+			ba.pendingBatches = append(ba.pendingBatches[:i], ba.pendingBatches[i+1:]...)
+			break
+		}
+	}
+	ba.pendingSizeBytes -= batch.sizeBytes
+	writeBehindBlobAccessPendingSizeBytes.Sub(float64(batch.sizeBytes))
+	close(ba.pendingReduced)
+	ba.pendingReduced = make(chan struct{})
+	ba.lock.Unlock()
+	close(batch.done)
+}
@@ -0,0 +1,168 @@
+package blobstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteBehindBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest1 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	digest2 := util.MustNewDigest(
+		"default",
+		&remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 5,
+		})
+
+	// expectPut lets a backend Put() call store its data in a
+	// channel, so that tests can wait for it to be called.
+	expectPut := func(baseBlobAccess *mock.MockBlobAccess, digest *util.Digest, err error) <-chan []byte {
+		written := make(chan []byte, 1)
+		baseBlobAccess.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+				data, dataErr := b.ToByteSlice(100)
+				require.NoError(t, dataErr)
+				written <- data
+				return err
+			})
+		return written
+	}
+
+	t.Run("FlushAfterDelay", func(t *testing.T) {
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		clock := mock.NewMockClock(ctrl)
+		timer := make(chan time.Time, 1)
+		clock.EXPECT().NewTimer(time.Minute).Return(mock.NewMockTimer(ctrl), timer)
+		blobAccess := blobstore.NewWriteBehindBlobAccess(baseBlobAccess, blobstore.CASStorageType, clock, 100, 1000, 1000, time.Minute, 1, false)
+
+		require.NoError(t, blobAccess.Put(ctx, digest1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		// Buffered blobs should be visible to reads without
+		// contacting the backend.
+		data, err := blobAccess.Get(ctx, digest1).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest1})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+
+		// Once the delay has passed, the blob should be
+		// written to the backend.
+		written := expectPut(baseBlobAccess, digest1, nil)
+		timer <- time.Unix(1000, 0)
+		require.Equal(t, []byte("Hello world"), <-written)
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		// Writing the same key twice should cause the last
+		// version to be written to the backend. This is
+		// important for the Action Cache.
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		clock := mock.NewMockClock(ctrl)
+		timer := make(chan time.Time, 1)
+		clock.EXPECT().NewTimer(time.Minute).Return(mock.NewMockTimer(ctrl), timer)
+		blobAccess := blobstore.NewWriteBehindBlobAccess(baseBlobAccess, blobstore.ACStorageType, clock, 100, 1000, 1000, time.Minute, 1, false)
+
+		require.NoError(t, blobAccess.Put(ctx, digest1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+		require.NoError(t, blobAccess.Put(ctx, digest1, buffer.NewValidatedBufferFromByteSlice([]byte("World"))))
+
+		data, err := blobAccess.Get(ctx, digest1).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("World"), data)
+
+		written := expectPut(baseBlobAccess, digest1, nil)
+		timer <- time.Unix(1000, 0)
+		require.Equal(t, []byte("World"), <-written)
+	})
+
+	t.Run("BypassOverwritesPending", func(t *testing.T) {
+		// Whether blobs are buffered should be decided based on
+		// the size of the buffer. For the Action Cache, the
+		// size stored in the digest is that of the Action.
+		// Blobs that are written to the backend directly should
+		// cause older buffered versions to be discarded, as
+		// these would otherwise overwrite them.
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		clock := mock.NewMockClock(ctrl)
+		timer := make(chan time.Time, 1)
+		clock.EXPECT().NewTimer(time.Minute).Return(mock.NewMockTimer(ctrl), timer)
+		blobAccess := blobstore.NewWriteBehindBlobAccess(baseBlobAccess, blobstore.ACStorageType, clock, 8, 1000, 1000, time.Minute, 1, false)
+
+		require.NoError(t, blobAccess.Put(ctx, digest2, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+
+		written := expectPut(baseBlobAccess, digest2, nil)
+		require.NoError(t, blobAccess.Put(ctx, digest2, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+		require.Equal(t, []byte("Hello world"), <-written)
+
+		baseBlobAccess.EXPECT().Get(ctx, digest2).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		data, err := blobAccess.Get(ctx, digest2).ToByteSlice(100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+
+		// Flushing the batch should not cause the older version
+		// to be written to the backend.
+		timer <- time.Unix(1000, 0)
+	})
+
+	t.Run("DurableFlushOnSize", func(t *testing.T) {
+		// Batches should be flushed immediately when reaching
+		// the flush size. Durable writes should report errors
+		// returned by the backend.
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		clock := mock.NewMockClock(ctrl)
+		clock.EXPECT().NewTimer(time.Minute).Return(mock.NewMockTimer(ctrl), make(chan time.Time)).AnyTimes()
+		blobAccess := blobstore.NewWriteBehindBlobAccess(baseBlobAccess, blobstore.CASStorageType, clock, 100, 10, 1000, time.Minute, 1, true)
+
+		expectPut(baseBlobAccess, digest1, status.Error(codes.Internal, "Server on fire"))
+		require.Equal(
+			t,
+			status.Error(codes.Internal, "Failed to write blob 3e25960a79dbc69b674cd4ec67a72c62-11-default: Server on fire"),
+			blobAccess.Put(ctx, digest1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+	})
+
+	t.Run("MaximumPendingSize", func(t *testing.T) {
+		baseBlobAccess := mock.NewMockBlobAccess(ctrl)
+		clock := mock.NewMockClock(ctrl)
+		timer1 := make(chan time.Time, 1)
+		clock.EXPECT().NewTimer(time.Minute).Return(mock.NewMockTimer(ctrl), timer1)
+		blobAccess := blobstore.NewWriteBehindBlobAccess(baseBlobAccess, blobstore.CASStorageType, clock, 100, 1000, 11, time.Minute, 1, false)
+
+		require.NoError(t, blobAccess.Put(ctx, digest1, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world"))))
+
+		// The buffer is full, meaning that writes should block
+		// until the pending batch has been flushed.
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		require.Equal(
+			t,
+			status.Error(codes.Canceled, "context canceled"),
+			blobAccess.Put(canceledCtx, digest2, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+
+		written := expectPut(baseBlobAccess, digest1, nil)
+		clock.EXPECT().NewTimer(time.Minute).Return(mock.NewMockTimer(ctrl), make(chan time.Time)).AnyTimes()
+		timer1 <- time.Unix(1000, 0)
+		require.NoError(t, blobAccess.Put(ctx, digest2, buffer.NewValidatedBufferFromByteSlice([]byte("Hello"))))
+		require.Equal(t, []byte("Hello world"), <-written)
+	})
+}
@@ -11,15 +11,32 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// batchFramingOverheadBytes is the amount of space reserved in batch
+// requests and responses for fields other than the blobs' contents,
+// such as digests and statuses. This space is subtracted from the
+// maximum message size when announcing the maximum batch size.
+const batchFramingOverheadBytes = 1 << 16
+
 type nonExecutableBuildQueue struct {
+	maximumBatchTotalSizeBytes int
 }
 
 // NewNonExecutableBuildQueue creates a build queue that is incapable of
 // executing anything. It is merely needed to provide a functional
 // implementation of GetCapabilities() for instances that provide remote
 // caching without the execution.
-func NewNonExecutableBuildQueue() BuildQueue {
-	return &nonExecutableBuildQueue{}
+//
+// Clients are informed that batch operations against the Content
+// Addressable Storage may transfer up to maximumMessageSizeBytes, minus
+// the space needed to frame the blobs in a single message.
+func NewNonExecutableBuildQueue(maximumMessageSizeBytes int) BuildQueue {
+	maximumBatchTotalSizeBytes := maximumMessageSizeBytes - batchFramingOverheadBytes
+	if maximumBatchTotalSizeBytes < 0 {
+		maximumBatchTotalSizeBytes = 0
+	}
+	return &nonExecutableBuildQueue{
+		maximumBatchTotalSizeBytes: maximumBatchTotalSizeBytes,
+	}
 }
 
 func (bq *nonExecutableBuildQueue) GetCapabilities(ctx context.Context, in *remoteexecution.GetCapabilitiesRequest) (*remoteexecution.ServerCapabilities, error) {
@@ -30,7 +47,7 @@ func (bq *nonExecutableBuildQueue) GetCapabilities(ctx context.Context, in *remo
 				UpdateEnabled: false,
 			},
 			// CachePriorityCapabilities: Priorities not supported.
-			// MaxBatchTotalSize: Not used by Bazel yet.
+			MaxBatchTotalSizeBytes:      int64(bq.maximumBatchTotalSizeBytes),
 			SymlinkAbsolutePathStrategy: remoteexecution.SymlinkAbsolutePathStrategy_ALLOWED,
 		},
 		// TODO(edsch): DeprecatedApiVersion.
@@ -0,0 +1,35 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/bazelbuild/remote-apis/build/bazel/semver"
+	"github.com/buildbarn/bb-storage/pkg/builder"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNonExecutableBuildQueueGetCapabilities(t *testing.T) {
+	ctx := context.Background()
+
+	buildQueue := builder.NewUpdatableActionCacheBuildQueue(builder.NewNonExecutableBuildQueue(4 * 1024 * 1024))
+	capabilities, err := buildQueue.GetCapabilities(ctx, &remoteexecution.GetCapabilitiesRequest{
+		InstanceName: "default",
+	})
+	require.NoError(t, err)
+	require.True(t, proto.Equal(&remoteexecution.ServerCapabilities{
+		CacheCapabilities: &remoteexecution.CacheCapabilities{
+			DigestFunction: util.SupportedDigestFunctions,
+			ActionCacheUpdateCapabilities: &remoteexecution.ActionCacheUpdateCapabilities{
+				UpdateEnabled: true,
+			},
+			MaxBatchTotalSizeBytes:      4*1024*1024 - 64*1024,
+			SymlinkAbsolutePathStrategy: remoteexecution.SymlinkAbsolutePathStrategy_ALLOWED,
+		},
+		LowApiVersion:  &semver.SemVer{Major: 2},
+		HighApiVersion: &semver.SemVer{Major: 2},
+	}, capabilities))
+}
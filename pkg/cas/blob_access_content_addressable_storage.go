@@ -3,6 +3,7 @@ package cas
 import (
 	"context"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
 
@@ -13,6 +14,9 @@ import (
 	cas_proto "github.com/buildbarn/bb-storage/pkg/proto/cas"
 	"github.com/buildbarn/bb-storage/pkg/util"
 	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type blobAccessContentAddressableStorage struct {
@@ -98,9 +102,33 @@ func (cas *blobAccessContentAddressableStorage) GetTree(ctx context.Context, dig
 	return &tree, nil
 }
 
+func (cas *blobAccessContentAddressableStorage) Peek(ctx context.Context, digest *util.Digest, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Negative number of bytes to peek: %d", n)
+	}
+	if sizeBytes := digest.GetSizeBytes(); int64(n) > sizeBytes {
+		n = int(sizeBytes)
+	}
+
+	// Only read the leading part of the blob and close the reader
+	// afterwards. This prevents the buffer from reading the
+	// remainder of the blob to validate its checksum.
+	r := cas.blobAccess.Get(ctx, digest).ToReader()
+	defer r.Close()
+	data := make([]byte, n)
+	nRead, err := io.ReadFull(r, data)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return data[:nRead], nil
+}
+
 func (cas *blobAccessContentAddressableStorage) putBlob(ctx context.Context, data []byte, parentDigest *util.Digest) (*util.Digest, error) {
 	// Compute new digest of data.
-	digestGenerator := parentDigest.NewDigestGenerator()
+	digestGenerator, err := parentDigest.NewDigestGenerator()
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to create digest generator")
+	}
 	if _, err := digestGenerator.Write(data); err != nil {
 		return nil, err
 	}
@@ -121,13 +149,40 @@ func (cas *blobAccessContentAddressableStorage) putMessage(ctx context.Context,
 }
 
 func (cas *blobAccessContentAddressableStorage) PutFile(ctx context.Context, directory filesystem.Directory, name string, parentDigest *util.Digest) (*util.Digest, error) {
+	digestGenerator, err := parentDigest.NewDigestGenerator()
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to create digest generator")
+	}
 	file, err := directory.OpenRead(name)
 	if err != nil {
 		return nil, err
 	}
 
-	// Walk through the file to compute the digest.
-	digestGenerator := parentDigest.NewDigestGenerator()
+	// Check whether the file fits in a single message by probing
+	// for data past the maximum message size. Files that fit can be
+	// loaded into memory, so that they only need to be read once.
+	var probe [1]byte
+	if n, err := file.ReadAt(probe[:], int64(cas.maximumMessageSizeBytes)); n == 0 {
+		if err != io.EOF {
+			file.Close()
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(io.NewSectionReader(file, 0, int64(cas.maximumMessageSizeBytes)))
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		digestGenerator.Write(data)
+		digest := digestGenerator.Sum()
+		if err := cas.blobAccess.Put(ctx, digest, buffer.NewValidatedBufferFromByteSlice(data)); err != nil {
+			return nil, err
+		}
+		return digest, nil
+	}
+
+	// Walk through the file to compute the digest. BlobAccess.Put()
+	// requires the digest to be known before any data is
+	// transmitted, meaning that large files need to be read twice.
 	sizeBytes, err := io.Copy(digestGenerator, io.NewSectionReader(file, 0, math.MaxInt64))
 	if err != nil {
 		file.Close()
@@ -165,12 +220,82 @@ func newSectionReadCloser(r filesystem.FileReader, off int64, n int64) io.ReadCl
 	}
 }
 
+func (cas *blobAccessContentAddressableStorage) PutDryRun(ctx context.Context, b buffer.Buffer, parentDigest *util.Digest) (*util.Digest, bool, error) {
+	// Compute the digest of the data, discarding it afterwards.
+	digestGenerator, err := parentDigest.NewDigestGenerator()
+	if err != nil {
+		b.Discard()
+		return nil, false, util.StatusWrap(err, "Failed to create digest generator")
+	}
+	r := b.ToReader()
+	_, err = io.Copy(digestGenerator, r)
+	r.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	digest := digestGenerator.Sum()
+
+	missing, err := cas.blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	if err != nil {
+		return nil, false, err
+	}
+	return digest, len(missing) == 0, nil
+}
+
 func (cas *blobAccessContentAddressableStorage) PutLog(ctx context.Context, log []byte, parentDigest *util.Digest) (*util.Digest, error) {
 	return cas.putBlob(ctx, log, parentDigest)
 }
 
+// marshalTree writes the wire format of a Tree to a writer. Instead of
+// marshaling the Tree as a whole, it marshals one Directory at a time.
+// As the wire format of repeated fields is identical to the
+// concatenation of their individual elements, the output is identical
+// to that of proto.Marshal(), while the amount of memory used is
+// bounded by the size of the largest Directory.
+func marshalTree(w io.Writer, tree *remoteexecution.Tree) error {
+	if tree.Root != nil {
+		if err := marshalTreePart(w, &remoteexecution.Tree{Root: tree.Root}); err != nil {
+			return err
+		}
+	}
+	for _, child := range tree.Children {
+		if err := marshalTreePart(w, &remoteexecution.Tree{Children: []*remoteexecution.Directory{child}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func marshalTreePart(w io.Writer, part *remoteexecution.Tree) error {
+	data, err := proto.Marshal(part)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
 func (cas *blobAccessContentAddressableStorage) PutTree(ctx context.Context, tree *remoteexecution.Tree, parentDigest *util.Digest) (*util.Digest, error) {
-	return cas.putMessage(ctx, tree, parentDigest)
+	// Trees of large output directories may be too big to marshal
+	// in memory. Marshal the Tree twice: once to compute its
+	// digest, and once more while uploading it.
+	digestGenerator, err := parentDigest.NewDigestGenerator()
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to create digest generator")
+	}
+	if err := marshalTree(digestGenerator, tree); err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to marshal tree")
+	}
+	digest := digestGenerator.Sum()
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(marshalTree(w, tree))
+	}()
+	if err := cas.blobAccess.Put(ctx, digest, buffer.NewCASBufferFromReader(digest, r, buffer.UserProvided)); err != nil {
+		return nil, err
+	}
+	return digest, nil
 }
 
 func (cas *blobAccessContentAddressableStorage) PutUncachedActionResult(ctx context.Context, uncachedActionResult *cas_proto.UncachedActionResult, parentDigest *util.Digest) (*util.Digest, error) {
@@ -11,7 +11,10 @@ import (
 	"github.com/buildbarn/bb-storage/pkg/cas"
 	"github.com/buildbarn/bb-storage/pkg/util"
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestBlobAccessContentAddressableStoragePutFileSuccess(t *testing.T) {
@@ -23,11 +26,73 @@ func TestBlobAccessContentAddressableStoragePutFileSuccess(t *testing.T) {
 	directory.EXPECT().OpenRead("hello").Return(file, nil)
 
 	// Operations that should appear on the file that is being
-	// uploaded. A first pass is used to compute the file's digest.
-	// A second pass is used to upload the file's contents. The file
-	// may have grown in the meantime, but the second pass should
-	// not read beyond the part that was used for digest computation.
+	// uploaded. As the file is small, it should be loaded into
+	// memory, so that it only needs to be read once.
 	gomock.InOrder(
+		file.EXPECT().ReadAt(gomock.Any(), int64(1000)).DoAndReturn(
+			func(p []byte, off int64) (int, error) {
+				require.Len(t, p, 1)
+				return 0, io.EOF
+			}),
+		file.EXPECT().ReadAt(gomock.Any(), int64(0)).DoAndReturn(
+			func(p []byte, off int64) (int, error) {
+				require.Greater(t, len(p), 11)
+				copy(p, "Hello world")
+				return 11, io.EOF
+			}),
+		file.EXPECT().Close().Return(nil),
+	)
+
+	// Operations that should appear against the BlobAccess. Read
+	// all the data to ensure all file operations are triggered.
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	helloWorldDigest := util.MustNewDigest(
+		"default-scheduler",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+	blobAccess.EXPECT().Put(ctx, helloWorldDigest, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+			data, err := b.ToByteSlice(100)
+			require.NoError(t, err)
+			require.Equal(t, []byte("Hello world"), data)
+			return nil
+		})
+
+	contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(blobAccess, 1000)
+	digest, err := contentAddressableStorage.PutFile(ctx, directory, "hello", util.MustNewDigest(
+		"default-scheduler",
+		&remoteexecution.Digest{
+			Hash:      "d41d8cd98f00b204e9800998ecf8427e",
+			SizeBytes: 123,
+		}))
+	require.NoError(t, err)
+	require.Equal(t, digest, helloWorldDigest)
+}
+
+func TestBlobAccessContentAddressableStoragePutFileLarge(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	directory := mock.NewMockDirectory(ctrl)
+	file := mock.NewMockFileReader(ctrl)
+	directory.EXPECT().OpenRead("hello").Return(file, nil)
+
+	// Operations that should appear on the file that is being
+	// uploaded. The file does not fit in memory, which should be
+	// detected without loading its contents. A first pass is used
+	// to compute the file's digest. A second pass is used to upload
+	// the file's contents. The file may have grown in the meantime,
+	// but the second pass should not read beyond the part that was
+	// used for digest computation.
+	gomock.InOrder(
+		file.EXPECT().ReadAt(gomock.Any(), int64(5)).DoAndReturn(
+			func(p []byte, off int64) (int, error) {
+				require.Len(t, p, 1)
+				copy(p, " ")
+				return 1, nil
+			}),
 		file.EXPECT().ReadAt(gomock.Any(), int64(0)).DoAndReturn(
 			func(p []byte, off int64) (int, error) {
 				require.Greater(t, len(p), 11)
@@ -60,7 +125,7 @@ func TestBlobAccessContentAddressableStoragePutFileSuccess(t *testing.T) {
 			return nil
 		})
 
-	contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(blobAccess, 1000)
+	contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(blobAccess, 5)
 	digest, err := contentAddressableStorage.PutFile(ctx, directory, "hello", util.MustNewDigest(
 		"default-scheduler",
 		&remoteexecution.Digest{
@@ -70,3 +135,176 @@ func TestBlobAccessContentAddressableStoragePutFileSuccess(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, digest, helloWorldDigest)
 }
+
+func TestBlobAccessContentAddressableStoragePutTree(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(blobAccess, 1000)
+	parentDigest := util.MustNewDigest(
+		"default-scheduler",
+		&remoteexecution.Digest{
+			Hash:      "d41d8cd98f00b204e9800998ecf8427e",
+			SizeBytes: 123,
+		})
+	tree := &remoteexecution.Tree{
+		Root: &remoteexecution.Directory{
+			Directories: []*remoteexecution.DirectoryNode{
+				{
+					Name: "a",
+					Digest: &remoteexecution.Digest{
+						Hash:      "4b3b03436604cb9d831b91c71a8c1952",
+						SizeBytes: 8,
+					},
+				},
+			},
+		},
+		Children: []*remoteexecution.Directory{
+			{
+				Files: []*remoteexecution.FileNode{
+					{
+						Name: "hello.txt",
+						Digest: &remoteexecution.Digest{
+							Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+							SizeBytes: 11,
+						},
+					},
+				},
+			},
+			{},
+		},
+	}
+
+	// Even though the Tree is marshaled one Directory at a time,
+	// the resulting object should be identical to the one
+	// obtained by marshaling it as a whole.
+	expectedData, err := proto.Marshal(tree)
+	require.NoError(t, err)
+	digestGenerator, err := parentDigest.NewDigestGenerator()
+	require.NoError(t, err)
+	digestGenerator.Write(expectedData)
+	expectedDigest := digestGenerator.Sum()
+
+	blobAccess.EXPECT().Put(ctx, expectedDigest, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+			data, err := b.ToByteSlice(1000)
+			require.NoError(t, err)
+			require.Equal(t, expectedData, data)
+			return nil
+		})
+
+	digest, err := contentAddressableStorage.PutTree(ctx, tree, parentDigest)
+	require.NoError(t, err)
+	require.Equal(t, expectedDigest, digest)
+}
+
+func TestBlobAccessContentAddressableStoragePutDryRun(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(blobAccess, 1000)
+	parentDigest := util.MustNewDigest(
+		"default-scheduler",
+		&remoteexecution.Digest{
+			Hash:      "d41d8cd98f00b204e9800998ecf8427e",
+			SizeBytes: 123,
+		})
+	helloWorldDigest := util.MustNewDigest(
+		"default-scheduler",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("Present", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(ctx, []*util.Digest{helloWorldDigest}).Return(nil, nil)
+
+		digest, present, err := contentAddressableStorage.PutDryRun(ctx, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")), parentDigest)
+		require.NoError(t, err)
+		require.Equal(t, helloWorldDigest, digest)
+		require.True(t, present)
+	})
+
+	t.Run("Absent", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(ctx, []*util.Digest{helloWorldDigest}).Return([]*util.Digest{helloWorldDigest}, nil)
+
+		digest, present, err := contentAddressableStorage.PutDryRun(ctx, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")), parentDigest)
+		require.NoError(t, err)
+		require.Equal(t, helloWorldDigest, digest)
+		require.False(t, present)
+	})
+
+	t.Run("FindMissingFailure", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(ctx, []*util.Digest{helloWorldDigest}).Return(nil, status.Error(codes.Unavailable, "Server offline"))
+
+		_, _, err := contentAddressableStorage.PutDryRun(ctx, buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")), parentDigest)
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	})
+}
+
+func TestBlobAccessContentAddressableStoragePutLogInvalidParentDigest(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Digests that are not created through util.NewDigest() lack a
+	// digest function. Attempting to derive digests from them
+	// should fail cleanly, as opposed to terminating the process.
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(blobAccess, 1000)
+	_, err := contentAddressableStorage.PutLog(ctx, []byte("Hello world"), &util.Digest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestBlobAccessContentAddressableStoragePeek(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(blobAccess, 1000)
+	helloWorldDigest := util.MustNewDigest(
+		"default-scheduler",
+		&remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+
+	t.Run("Prefix", func(t *testing.T) {
+		// Only the leading part of the blob should be read. As
+		// the blob is not read entirely, corruption in the
+		// remainder of the blob goes unnoticed.
+		reader := mock.NewMockReadCloser(ctrl)
+		gomock.InOrder(
+			reader.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+				require.Len(t, p, 5)
+				return copy(p, "Hello"), nil
+			}),
+			reader.EXPECT().Close().Return(nil))
+		blobAccess.EXPECT().Get(ctx, helloWorldDigest).Return(
+			buffer.NewCASBufferFromReader(helloWorldDigest, reader, buffer.Irreparable))
+
+		data, err := contentAddressableStorage.Peek(ctx, helloWorldDigest, 5)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+	})
+
+	t.Run("BeyondEnd", func(t *testing.T) {
+		// Requesting more data than the size of the blob should
+		// simply return the entire blob.
+		blobAccess.EXPECT().Get(ctx, helloWorldDigest).Return(
+			buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		data, err := contentAddressableStorage.Peek(ctx, helloWorldDigest, 100)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		blobAccess.EXPECT().Get(ctx, helloWorldDigest).Return(
+			buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+
+		_, err := contentAddressableStorage.Peek(ctx, helloWorldDigest, 5)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+}
@@ -0,0 +1,80 @@
+package cas
+
+import (
+	"io"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/proto/blobpresence"
+	"github.com/buildbarn/bb-storage/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type blobPresenceServer struct {
+	contentAddressableStorage blobstore.BlobAccess
+	maximumDigestsPerRequest  int
+	instanceNameNormalizer    util.InstanceNameNormalizer
+}
+
+// NewBlobPresenceServer creates a gRPC service that allows clients to
+// determine which blobs are present in the Content Addressable Storage
+// in a streaming fashion. The number of digests that may be provided
+// in a single request is bounded, so that the amount of work performed
+// per request is limited. Instance names provided by clients are
+// normalized using instanceNameNormalizer.
+func NewBlobPresenceServer(contentAddressableStorage blobstore.BlobAccess, maximumDigestsPerRequest int, instanceNameNormalizer util.InstanceNameNormalizer) blobpresence.BlobPresenceServer {
+	return &blobPresenceServer{
+		contentAddressableStorage: contentAddressableStorage,
+		maximumDigestsPerRequest:  maximumDigestsPerRequest,
+		instanceNameNormalizer:    instanceNameNormalizer,
+	}
+}
+
+func (s *blobPresenceServer) FindPresentBlobs(stream blobpresence.BlobPresence_FindPresentBlobsServer) error {
+	ctx := stream.Context()
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(request.BlobDigests) > s.maximumDigestsPerRequest {
+			return status.Errorf(codes.InvalidArgument, "Request contains %d digests, while a maximum of %d is permitted", len(request.BlobDigests), s.maximumDigestsPerRequest)
+		}
+
+		digests := make([]*util.Digest, 0, len(request.BlobDigests))
+		for _, partialDigest := range request.BlobDigests {
+			digest, err := util.NewDigest(s.instanceNameNormalizer(request.InstanceName), partialDigest)
+			if err != nil {
+				return err
+			}
+			digests = append(digests, digest)
+		}
+		digests = util.RemoveDuplicateDigests(digests)
+		missing, err := s.contentAddressableStorage.FindMissing(ctx, digests)
+		if err != nil {
+			return err
+		}
+
+		// Convert the list of missing blobs to a list of
+		// present blobs, retaining the original order.
+		missingKeys := make(map[string]struct{}, len(missing))
+		for _, digest := range missing {
+			missingKeys[digest.GetKey(util.DigestKeyWithoutInstance)] = struct{}{}
+		}
+		var present []*remoteexecution.Digest
+		for _, digest := range digests {
+			if _, ok := missingKeys[digest.GetKey(util.DigestKeyWithoutInstance)]; !ok {
+				present = append(present, digest.GetPartialDigest())
+			}
+		}
+		if err := stream.Send(&blobpresence.FindPresentBlobsResponse{
+			PresentBlobDigests: present,
+		}); err != nil {
+			return err
+		}
+	}
+}
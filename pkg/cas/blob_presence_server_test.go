@@ -0,0 +1,143 @@
+package cas_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/cas"
+	"github.com/buildbarn/bb-storage/pkg/proto/blobpresence"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestBlobPresenceServer(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Create an RPC server/client pair.
+	l := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	blobpresence.RegisterBlobPresenceServer(server, cas.NewBlobPresenceServer(blobAccess, 3, util.IdentityInstanceNameNormalizer))
+	go func() {
+		require.NoError(t, server.Serve(l))
+	}()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer server.Stop()
+	defer conn.Close()
+	client := blobpresence.NewBlobPresenceClient(conn)
+
+	digestHello := &remoteexecution.Digest{
+		Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+		SizeBytes: 11,
+	}
+	digestGoodbye := &remoteexecution.Digest{
+		Hash:      "35f7fc6f4fc7b7ecc13b5ad1e0d2b0e3",
+		SizeBytes: 13,
+	}
+	digestLarge := &remoteexecution.Digest{
+		Hash:      "0f5ab4b0c3ba10b34e8f2ae3fd4b8a5d",
+		SizeBytes: 16,
+	}
+
+	t.Run("MultipleRequests", func(t *testing.T) {
+		// Every request should yield a response, listing the
+		// blobs that are present in the original order.
+		// Duplicate digests should only be reported once.
+		blobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{
+			util.MustNewDigest("default", digestHello),
+			util.MustNewDigest("default", digestGoodbye),
+			util.MustNewDigest("default", digestLarge),
+		}).Return([]*util.Digest{
+			util.MustNewDigest("default", digestGoodbye),
+		}, nil)
+		blobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{
+			util.MustNewDigest("other", digestGoodbye),
+		}).Return(nil, nil)
+
+		stream, err := client.FindPresentBlobs(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, stream.Send(&blobpresence.FindPresentBlobsRequest{
+			InstanceName: "default",
+			BlobDigests:  []*remoteexecution.Digest{digestHello, digestGoodbye, digestHello, digestLarge},
+		}))
+		response, err := stream.Recv()
+		require.NoError(t, err)
+		require.True(t, proto.Equal(&blobpresence.FindPresentBlobsResponse{
+			PresentBlobDigests: []*remoteexecution.Digest{digestHello, digestLarge},
+		}, response))
+
+		require.NoError(t, stream.Send(&blobpresence.FindPresentBlobsRequest{
+			InstanceName: "other",
+			BlobDigests:  []*remoteexecution.Digest{digestGoodbye},
+		}))
+		response, err = stream.Recv()
+		require.NoError(t, err)
+		require.True(t, proto.Equal(&blobpresence.FindPresentBlobsResponse{
+			PresentBlobDigests: []*remoteexecution.Digest{digestGoodbye},
+		}, response))
+
+		require.NoError(t, stream.CloseSend())
+		_, err = stream.Recv()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("TooManyDigests", func(t *testing.T) {
+		stream, err := client.FindPresentBlobs(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, stream.Send(&blobpresence.FindPresentBlobsRequest{
+			InstanceName: "default",
+			BlobDigests:  []*remoteexecution.Digest{digestHello, digestGoodbye, digestLarge, digestHello},
+		}))
+		_, err = stream.Recv()
+		require.Equal(t, status.Error(codes.InvalidArgument, "Request contains 4 digests, while a maximum of 3 is permitted"), err)
+	})
+
+	t.Run("InvalidDigest", func(t *testing.T) {
+		stream, err := client.FindPresentBlobs(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, stream.Send(&blobpresence.FindPresentBlobsRequest{
+			InstanceName: "default",
+			BlobDigests: []*remoteexecution.Digest{{
+				Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+				SizeBytes: -1,
+			}},
+		}))
+		_, err = stream.Recv()
+		require.Equal(t, status.Error(codes.InvalidArgument, "Invalid digest size: -1 bytes"), err)
+	})
+
+	t.Run("BackendFailure", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{
+			util.MustNewDigest("default", digestHello),
+		}).Return(nil, status.Error(codes.Unavailable, "Server offline"))
+
+		stream, err := client.FindPresentBlobs(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, stream.Send(&blobpresence.FindPresentBlobsRequest{
+			InstanceName: "default",
+			BlobDigests:  []*remoteexecution.Digest{digestHello},
+		}))
+		_, err = stream.Recv()
+		require.Equal(t, status.Error(codes.Unavailable, "Server offline"), err)
+	})
+}
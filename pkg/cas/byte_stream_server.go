@@ -3,93 +3,382 @@ package cas
 import (
 	"context"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
+	"time"
 
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/buildbarn/bb-storage/pkg/blobstore"
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/clock"
 	"github.com/buildbarn/bb-storage/pkg/util"
 
 	"google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
-// parseResourceNameWrite parses resource name strings in one of the following two forms:
+const (
+	// DeferredVerificationMetadataKey is the gRPC request metadata
+	// key that clients may set to request that the outcome of
+	// integrity verification is reported through trailer metadata
+	// when reading blobs through ByteStream.
+	DeferredVerificationMetadataKey = "bb-deferred-verification"
+	// VerificationResultTrailerKey is the gRPC trailer metadata key
+	// under which the outcome of integrity verification is
+	// reported. Its value is either "verified" or "unverified".
+	VerificationResultTrailerKey = "bb-verification-result"
+)
+
+// compressorZstd is the name of the Zstandard compressor, as used in
+// resource names of compressed blobs.
+const compressorZstd = "zstd"
+
+// parseBlobFields parses the trailing fields of a resource name that
+// refer to a blob. These fields have one of the following two forms:
 //
-// - uploads/${uuid}/blobs/${hash}/${size}
-// - ${instance}/uploads/${uuid}/blobs/${hash}/${size}
+// - blobs/${hash}/${size}
+// - compressed-blobs/${compressor}/${hash}/${size}
 //
-// In the process, the hash, size and instance are extracted.
-func parseResourceNameWrite(resourceName string) (*util.Digest, error) {
-	fields := strings.FieldsFunc(resourceName, func(r rune) bool { return r == '/' })
+// In the process, the hash, size and compressor are extracted. The
+// compressor is empty for uncompressed blobs. The fields preceding the
+// blob are returned, so that the caller may parse them.
+func parseBlobFields(fields []string) ([]string, string, int64, string, error) {
 	l := len(fields)
-	if (l != 5 && l != 6) || fields[l-5] != "uploads" || fields[l-3] != "blobs" {
-		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
+	var prefix []string
+	compressor := ""
+	if l >= 3 && fields[l-3] == "blobs" {
+		prefix = fields[:l-3]
+	} else if l >= 4 && fields[l-4] == "compressed-blobs" {
+		prefix = fields[:l-4]
+		switch fields[l-3] {
+		case "identity":
+		case compressorZstd:
+			compressor = compressorZstd
+		default:
+			return nil, "", 0, "", status.Errorf(codes.InvalidArgument, "Unsupported compressor %#v", fields[l-3])
+		}
+	} else {
+		return nil, "", 0, "", status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
 	}
 	size, err := strconv.ParseInt(fields[l-1], 10, 64)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
+		return nil, "", 0, "", status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
+	}
+	return prefix, fields[l-2], size, compressor, nil
+}
+
+// parseResourceNameRead parses resource name strings in one of the
+// following forms:
+//
+// - blobs/${hash}/${size}
+// - ${instance}/blobs/${hash}/${size}
+// - compressed-blobs/${compressor}/${hash}/${size}
+// - ${instance}/compressed-blobs/${compressor}/${hash}/${size}
+//
+// In the process, the hash, size, instance and compressor are
+// extracted. The instance name is normalized.
+func parseResourceNameRead(resourceName string, instanceNameNormalizer util.InstanceNameNormalizer) (*util.Digest, string, error) {
+	fields := strings.FieldsFunc(resourceName, func(r rune) bool { return r == '/' })
+	prefix, hash, size, compressor, err := parseBlobFields(fields)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(prefix) > 1 {
+		return nil, "", status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
+	}
+	instance := ""
+	if len(prefix) == 1 {
+		instance = prefix[0]
+	}
+	digest, err := util.NewDigest(
+		instanceNameNormalizer(instance),
+		&remoteexecution.Digest{
+			Hash:      hash,
+			SizeBytes: size,
+		})
+	return digest, compressor, err
+}
+
+// parseResourceNameWrite parses resource name strings in one of the
+// following forms:
+//
+// - uploads/${uuid}/blobs/${hash}/${size}
+// - ${instance}/uploads/${uuid}/blobs/${hash}/${size}
+// - uploads/${uuid}/compressed-blobs/${compressor}/${hash}/${size}
+// - ${instance}/uploads/${uuid}/compressed-blobs/${compressor}/${hash}/${size}
+//
+// In the process, the hash, size, instance and compressor are
+// extracted. The instance name is normalized.
+func parseResourceNameWrite(resourceName string, instanceNameNormalizer util.InstanceNameNormalizer) (*util.Digest, string, error) {
+	fields := strings.FieldsFunc(resourceName, func(r rune) bool { return r == '/' })
+	prefix, hash, size, compressor, err := parseBlobFields(fields)
+	if err != nil {
+		return nil, "", err
+	}
+	l := len(prefix)
+	if (l != 2 && l != 3) || prefix[l-2] != "uploads" {
+		return nil, "", status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
 	}
 	instance := ""
-	if l == 6 {
-		instance = fields[0]
+	if l == 3 {
+		instance = prefix[0]
 	}
-	return util.NewDigest(
-		instance,
+	digest, err := util.NewDigest(
+		instanceNameNormalizer(instance),
 		&remoteexecution.Digest{
-			Hash:      fields[l-2],
+			Hash:      hash,
 			SizeBytes: size,
 		})
+	return digest, compressor, err
 }
 
 type byteStreamServer struct {
-	blobAccess    blobstore.BlobAccess
-	readChunkSize int
+	blobAccess                     blobstore.BlobAccess
+	readChunkSize                  int
+	chunkPool                      *buffer.ChunkPool
+	clock                          clock.Clock
+	maximumReadDuration            time.Duration
+	maximumReadDurationPerInstance map[string]time.Duration
+	skipExistingWrites             bool
+	instanceNameNormalizer         util.InstanceNameNormalizer
+	readTransformsPerInstance      map[string]blobstore.GetTransformingBlobAccess
 }
 
 // NewByteStreamServer creates a GRPC service for reading blobs from and
 // writing blobs to a BlobAccess. It is used by Bazel to access the
 // Content Addressable Storage (CAS).
-func NewByteStreamServer(blobAccess blobstore.BlobAccess, readChunkSize int) bytestream.ByteStreamServer {
+//
+// Data is returned by Read() in chunks of at most readChunkSize bytes.
+// Ranges that are larger than readChunkSize are split up into chunks
+// of roughly equal size. When gRPC message compression is enabled,
+// incompressible data may cause messages to grow slightly (i.e., by
+// gzip's framing overhead of a couple of bytes per block).
+// readChunkSize should therefore be kept well below the maximum
+// message size of clients. Storage for chunks is obtained from a pool,
+// so that streaming doesn't generate garbage proportional to the size
+// of the blobs read.
+//
+// To prevent clients that read slowly from holding on to resources
+// indefinitely, Read() calls are aborted with DEADLINE_EXCEEDED once
+// they take longer than maximumReadDuration. The context used to read
+// from the backend is canceled at that point, while the stream is
+// aborted once the message that is being sent at that time has been
+// consumed. This limit may be overridden for individual instance
+// names. A duration of zero disables the limit.
+//
+// When skipExistingWrites is set, Write() first checks whether the
+// blob is already present. If so, the write completes immediately,
+// without receiving the remainder of the data or storing it once more.
+// This is permitted by the Remote Execution API and reduces load on
+// storage for workloads where the same blobs are written frequently.
+//
+// Read() calls for uncompressed blobs belonging to instance names
+// contained in readTransformsPerInstance return the contents of blobs
+// with a transformation applied (e.g., for legacy clients that expect
+// gzip or base64 encoded data). Read offsets and limits then refer to
+// the transformed data.
+//
+// Instance names contained in resource names are normalized using
+// instanceNameNormalizer. Keys of maximumReadDurationPerInstance and
+// readTransformsPerInstance should already be normalized.
+func NewByteStreamServer(blobAccess blobstore.BlobAccess, readChunkSize int, clock clock.Clock, maximumReadDuration time.Duration, maximumReadDurationPerInstance map[string]time.Duration, skipExistingWrites bool, instanceNameNormalizer util.InstanceNameNormalizer, readTransformsPerInstance map[string]blobstore.GetTransformingBlobAccess) bytestream.ByteStreamServer {
 	return &byteStreamServer{
-		blobAccess:    blobAccess,
-		readChunkSize: readChunkSize,
+		blobAccess:                     blobAccess,
+		readChunkSize:                  readChunkSize,
+		chunkPool:                      buffer.NewChunkPool(readChunkSize),
+		clock:                          clock,
+		maximumReadDuration:            maximumReadDuration,
+		maximumReadDurationPerInstance: maximumReadDurationPerInstance,
+		skipExistingWrites:             skipExistingWrites,
+		instanceNameNormalizer:         instanceNameNormalizer,
+		readTransformsPerInstance:      readTransformsPerInstance,
 	}
 }
 
 func (s *byteStreamServer) Read(in *bytestream.ReadRequest, out bytestream.ByteStream_ReadServer) error {
-	if in.ReadLimit != 0 {
-		return status.Error(codes.Unimplemented, "This service does not support downloading partial files")
+	if in.ReadLimit < 0 {
+		return status.Errorf(codes.InvalidArgument, "Negative read limit: %d", in.ReadLimit)
 	}
-	digest, err := util.NewDigestFromBytestreamPath(in.ResourceName)
+	digest, compressor, err := parseResourceNameRead(in.ResourceName, s.instanceNameNormalizer)
 	if err != nil {
 		return err
 	}
+	if compressor != "" && in.ReadLimit != 0 {
+		// The size of compressed data is not known in
+		// advance. REv2 therefore prohibits read limits.
+		return status.Error(codes.InvalidArgument, "Read limits are not supported for compressed blobs")
+	}
+
+	// Data is validated by the buffer layer as it is streamed.
+	// Because the checksum can only be compared after all data has
+	// been read, chunks are sent to the client before the blob as a
+	// whole is known to be valid. Clients may request that the
+	// outcome of validation is reported explicitly through trailer
+	// metadata, so that they can start processing data early and
+	// roll back in case the blob turns out to be corrupted. Clients
+	// that cannot roll back should not rely on this, and only act
+	// on data once the stream has completed successfully.
+	deferredVerification := false
+	if md, ok := metadata.FromIncomingContext(out.Context()); ok {
+		deferredVerification = len(md.Get(DeferredVerificationMetadataKey)) > 0
+	}
+
+	maximumReadDuration, ok := s.maximumReadDurationPerInstance[digest.GetInstance()]
+	if !ok {
+		maximumReadDuration = s.maximumReadDuration
+	}
+	ctx := out.Context()
+	if maximumReadDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = s.clock.NewContextWithTimeout(ctx, maximumReadDuration)
+		defer cancel()
+	}
 
-	r := s.blobAccess.Get(out.Context(), digest).ToChunkReader(in.ReadOffset, s.readChunkSize)
+	// Data is sent from this goroutine, as the stream may not be
+	// used after returning. A call to Send() that is blocked on a
+	// client that is not consuming any data can therefore not be
+	// interrupted. Exceeding the maximum duration does cause the
+	// backend to be canceled, and causes the stream to be aborted
+	// as soon as Send() returns.
+	verificationResult, err := s.read(ctx, digest, compressor, in.ReadOffset, in.ReadLimit, out)
+	if err != nil && ctx.Err() != nil && out.Context().Err() == nil {
+		err = status.Errorf(codes.DeadlineExceeded, "Read did not complete within %s", maximumReadDuration)
+	}
+	if deferredVerification && verificationResult != "" {
+		out.SetTrailer(metadata.Pairs(VerificationResultTrailerKey, verificationResult))
+	}
+	return err
+}
+
+// read streams the contents of a blob to the client. If readLimit is
+// positive, at most readLimit bytes are sent. It returns the outcome of
+// integrity verification that should be reported to the client, if
+// any.
+func (s *byteStreamServer) read(ctx context.Context, digest *util.Digest, compressor string, readOffset int64, readLimit int64, out bytestream.ByteStream_ReadServer) (string, error) {
+	var r buffer.ChunkReader
+	if compressor == compressorZstd {
+		r = newZstdCompressingChunkReader(s.blobAccess.Get(ctx, digest).ToChunkReader(readOffset, s.readChunkSize), s.readChunkSize)
+	} else if transformingBlobAccess, ok := s.readTransformsPerInstance[digest.GetInstance()]; ok {
+		r = newTransformedChunkReader(transformingBlobAccess.GetTransformed(ctx, digest), readOffset, s.readChunkSize)
+	} else {
+		// Chunks are only valid until the next call to Read().
+		// grpc-go does not permit modifying a message after
+		// Send() returns, as stats handlers may access it
+		// lazily. The stats handlers used by this codebase only
+		// inspect payload sizes, which gRPC computes while
+		// serializing. Reusing chunks is therefore safe, as long
+		// as no handlers that retain message contents are
+		// installed.
+		r = buffer.ToPooledChunkReader(
+			s.blobAccess.Get(ctx, digest),
+			readOffset,
+			s.chunkPool,
+			getReadChunkSize(digest.GetSizeBytes()-readOffset, readLimit, s.readChunkSize))
+	}
 	defer r.Close()
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return "", util.StatusFromContext(ctx)
+		}
 		readBuf, readErr := r.Read()
 		if readErr == io.EOF {
-			return nil
+			return "verified", nil
 		}
 		if readErr != nil {
-			return readErr
+			return "unverified", readErr
+		}
+		if readLimit > 0 && int64(len(readBuf)) >= readLimit {
+			// Reached the end of the requested range. As
+			// the remainder of the blob is not read, its
+			// integrity cannot be verified.
+			if writeErr := out.Send(&bytestream.ReadResponse{Data: readBuf[:readLimit]}); writeErr != nil {
+				return "", writeErr
+			}
+			return "unverified", nil
 		}
 		if writeErr := out.Send(&bytestream.ReadResponse{Data: readBuf}); writeErr != nil {
-			return writeErr
+			return "", writeErr
+		}
+		readLimit -= int64(len(readBuf))
+	}
+}
+
+// transformedChunkReader is a ChunkReader that yields data read from
+// an io.ReadCloser that returns the contents of a blob with a
+// transformation applied. The read offset refers to the transformed
+// data.
+type transformedChunkReader struct {
+	r          io.ReadCloser
+	readOffset int64
+	chunkSize  int
+}
+
+func newTransformedChunkReader(r io.ReadCloser, readOffset int64, chunkSize int) buffer.ChunkReader {
+	return &transformedChunkReader{
+		r:          r,
+		readOffset: readOffset,
+		chunkSize:  chunkSize,
+	}
+}
+
+func (r *transformedChunkReader) Read() ([]byte, error) {
+	if r.readOffset > 0 {
+		readOffset := r.readOffset
+		r.readOffset = 0
+		if _, err := io.CopyN(ioutil.Discard, r.r, readOffset); err == io.EOF {
+			return nil, status.Errorf(codes.OutOfRange, "Read offset %d exceeds the size of the transformed blob", readOffset)
+		} else if err != nil {
+			return nil, err
 		}
 	}
+
+	chunk := make([]byte, r.chunkSize)
+	n, err := io.ReadFull(r.r, chunk)
+	if err == io.ErrUnexpectedEOF {
+		return chunk[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+func (r *transformedChunkReader) Close() {
+	r.r.Close()
+}
+
+// getReadChunkSize computes the size of the chunks in which Read()
+// returns a range of a blob. Instead of always using the maximum chunk
+// size, the range is split up into chunks of equal size. This prevents
+// the last message of a stream from being disproportionally small. For
+// example, a blob that is one byte larger than the maximum chunk size
+// is sent as two messages of roughly half the maximum size, as opposed
+// to a full message followed by one containing a single byte.
+func getReadChunkSize(sizeBytes int64, readLimit int64, maximumChunkSize int) int {
+	if readLimit > 0 && readLimit < sizeBytes {
+		sizeBytes = readLimit
+	}
+	if sizeBytes <= 0 {
+		return maximumChunkSize
+	}
+	chunks := (sizeBytes + int64(maximumChunkSize) - 1) / int64(maximumChunkSize)
+	return int((sizeBytes + chunks - 1) / chunks)
 }
 
 type byteStreamWriteServerChunkReader struct {
-	stream        bytestream.ByteStream_WriteServer
-	writeOffset   int64
-	data          []byte
-	finishedWrite bool
+	stream bytestream.ByteStream_WriteServer
+	// Size of the blob as stated in the resource name, or -1 if
+	// the amount of data received does not correspond to the
+	// size of the blob (e.g., due to compression).
+	expectedSizeBytes int64
+	writeOffset       int64
+	data              []byte
+	finishedWrite     bool
+	err               error
 }
 
 func (r *byteStreamWriteServerChunkReader) setRequest(request *bytestream.WriteRequest) error {
@@ -101,22 +390,44 @@ func (r *byteStreamWriteServerChunkReader) setRequest(request *bytestream.WriteR
 	}
 
 	r.writeOffset += int64(len(request.Data))
+	if request.FinishWrite && r.expectedSizeBytes >= 0 && r.writeOffset != r.expectedSizeBytes {
+		// Report truncated uploads explicitly, as opposed to
+		// letting them fail with a checksum mismatch.
+		return status.Errorf(codes.InvalidArgument, "Client finished write after %d bytes, while the blob is %d bytes in size", r.writeOffset, r.expectedSizeBytes)
+	}
 	r.data = request.Data
 	r.finishedWrite = request.FinishWrite
 	return nil
 }
 
+func (r *byteStreamWriteServerChunkReader) receive() error {
+	request, err := r.stream.Recv()
+	if err != nil {
+		if ctx := r.stream.Context(); ctx.Err() != nil {
+			// The client canceled the write. Report this
+			// explicitly, so that the backend aborts the
+			// write as opposed to retaining partial data.
+			return util.StatusFromContext(ctx)
+		}
+		if err == io.EOF && !r.finishedWrite {
+			return status.Error(codes.InvalidArgument, "Client closed stream without finishing write")
+		}
+		return err
+	}
+	return r.setRequest(request)
+}
+
 func (r *byteStreamWriteServerChunkReader) Read() ([]byte, error) {
+	// Return errors from previous iterations. This prevents
+	// resumption of a write after it has been aborted.
+	if r.err != nil {
+		return nil, r.err
+	}
+
 	// Read next chunk if no data is present.
 	if len(r.data) == 0 {
-		request, err := r.stream.Recv()
-		if err != nil {
-			if err == io.EOF && !r.finishedWrite {
-				return nil, status.Error(codes.InvalidArgument, "Client closed stream without finishing write")
-			}
-			return nil, err
-		}
-		if err := r.setRequest(request); err != nil {
+		if err := r.receive(); err != nil {
+			r.err = err
 			return nil, err
 		}
 	}
@@ -126,21 +437,68 @@ func (r *byteStreamWriteServerChunkReader) Read() ([]byte, error) {
 	return data, nil
 }
 
-func (r *byteStreamWriteServerChunkReader) Close() {}
+func (r *byteStreamWriteServerChunkReader) Close() {
+	// Discard any data that has not been consumed, so that no
+	// further data is read from the stream.
+	r.data = nil
+	if r.err == nil {
+		r.err = status.Error(codes.FailedPrecondition, "Write has already been closed")
+	}
+}
 
 func (s *byteStreamServer) Write(stream bytestream.ByteStream_WriteServer) error {
 	request, err := stream.Recv()
 	if err != nil {
 		return err
 	}
-	digest, err := parseResourceNameWrite(request.ResourceName)
+	digest, compressor, err := parseResourceNameWrite(request.ResourceName, s.instanceNameNormalizer)
 	if err != nil {
 		return err
 	}
-	r := &byteStreamWriteServerChunkReader{stream: stream}
+	r := &byteStreamWriteServerChunkReader{
+		stream:            stream,
+		expectedSizeBytes: digest.GetSizeBytes(),
+	}
+	if compressor == compressorZstd {
+		r.expectedSizeBytes = -1
+	}
 	if err := r.setRequest(request); err != nil {
 		return err
 	}
+	if s.skipExistingWrites && compressor == "" {
+		missing, err := s.blobAccess.FindMissing(stream.Context(), []*util.Digest{digest})
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			// The blob is already present. Let the client
+			// know that no further data needs to be sent.
+			// This is not done for compressed writes, as
+			// the committed size would need to refer to
+			// the amount of compressed data.
+			return stream.SendAndClose(&bytestream.WriteResponse{
+				CommittedSize: digest.GetSizeBytes(),
+			})
+		}
+	}
+	if compressor == compressorZstd {
+		// Data is validated against the digest after
+		// decompression. The committed size refers to the
+		// amount of compressed data received.
+		decompressingReader, err := newZstdDecompressingReader(r)
+		if err != nil {
+			return err
+		}
+		if err := s.blobAccess.Put(
+			stream.Context(),
+			digest,
+			buffer.NewCASBufferFromReader(digest, decompressingReader, buffer.UserProvided)); err != nil {
+			return err
+		}
+		return stream.SendAndClose(&bytestream.WriteResponse{
+			CommittedSize: r.writeOffset,
+		})
+	}
 	if err := s.blobAccess.Put(
 		stream.Context(),
 		digest,
@@ -153,5 +511,23 @@ func (s *byteStreamServer) Write(stream bytestream.ByteStream_WriteServer) error
 }
 
 func (s *byteStreamServer) QueryWriteStatus(ctx context.Context, in *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "This service does not support querying write status")
+	digest, _, err := parseResourceNameWrite(in.ResourceName, s.instanceNameNormalizer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Partial writes are not retained. Clients can therefore only
+	// skip uploading blobs that have been written completely,
+	// either by themselves or by another client.
+	missing, err := s.blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return &bytestream.QueryWriteStatusResponse{}, nil
+	}
+	return &bytestream.QueryWriteStatusResponse{
+		CommittedSize: digest.GetSizeBytes(),
+		Complete:      true,
+	}, nil
 }
@@ -1,23 +1,29 @@
 package cas_test
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"io/ioutil"
 	"net"
 	"testing"
 	"time"
 
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/local"
 	"github.com/buildbarn/bb-storage/pkg/cas"
 	"github.com/buildbarn/bb-storage/pkg/util"
 	"github.com/golang/mock/gomock"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
 
 	"google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 )
@@ -30,7 +36,12 @@ func TestByteStreamServer(t *testing.T) {
 	l := bufconn.Listen(1 << 20)
 	server := grpc.NewServer()
 	blobAccess := mock.NewMockBlobAccess(ctrl)
-	bytestream.RegisterByteStreamServer(server, cas.NewByteStreamServer(blobAccess, 10))
+	clock := mock.NewMockClock(ctrl)
+	bytestream.RegisterByteStreamServer(server, cas.NewByteStreamServer(blobAccess, 10, clock, 0, map[string]time.Duration{
+		"slow": time.Minute,
+	}, false, util.NewInstanceNameNormalizer(true, false, nil), map[string]blobstore.GetTransformingBlobAccess{
+		"legacy": blobstore.NewGetTransformingBlobAccess(blobAccess, blobstore.Base64GetTransform),
+	}))
 	go func() {
 		require.NoError(t, server.Serve(l))
 	}()
@@ -69,7 +80,7 @@ func TestByteStreamServer(t *testing.T) {
 		})
 		require.NoError(t, err)
 		_, err = req.Recv()
-		require.Equal(t, status.Error(codes.InvalidArgument, "Non-hexadecimal character in digest hash: U+0044 'D'"), err)
+		require.Equal(t, status.Error(codes.InvalidArgument, "Uppercase hexadecimal character in digest hash: U+0044 'D'"), err)
 	})
 
 	t.Run("ReadNegativeSizeInDigest", func(t *testing.T) {
@@ -100,6 +111,31 @@ func TestByteStreamServer(t *testing.T) {
 		require.Equal(t, io.EOF, err)
 	})
 
+	t.Run("ReadTransformed", func(t *testing.T) {
+		// Blobs belonging to instance names for which a
+		// transformation is configured should be returned with
+		// the transformation applied. The read offset refers to
+		// the transformed data.
+		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("legacy", &remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})).Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+
+		req, err := client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: "legacy/blobs/3e25960a79dbc69b674cd4ec67a72c62/11",
+			ReadOffset:   2,
+		})
+		require.NoError(t, err)
+		readResponse, err := req.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("VsbG8gd29y"), readResponse.Data)
+		readResponse, err = req.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("bGQ="), readResponse.Data)
+		_, err = req.Recv()
+		require.Equal(t, io.EOF, err)
+	})
+
 	t.Run("ReadSuccessNonEmptyInstance", func(t *testing.T) {
 		// Attempt to fetch the large blob with an instance name.
 		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("debian8", &remoteexecution.Digest{
@@ -113,17 +149,98 @@ func TestByteStreamServer(t *testing.T) {
 		require.NoError(t, err)
 		readResponse, err := req.Recv()
 		require.NoError(t, err)
-		require.Equal(t, []byte("This is a "), readResponse.Data)
+		require.Equal(t, []byte("This is "), readResponse.Data)
 		readResponse, err = req.Recv()
 		require.NoError(t, err)
-		require.Equal(t, []byte("long messa"), readResponse.Data)
+		require.Equal(t, []byte("a long m"), readResponse.Data)
 		readResponse, err = req.Recv()
 		require.NoError(t, err)
-		require.Equal(t, []byte("ge"), readResponse.Data)
+		require.Equal(t, []byte("essage"), readResponse.Data)
 		_, err = req.Recv()
 		require.Equal(t, io.EOF, err)
 	})
 
+	t.Run("ReadUnsupportedCompressor", func(t *testing.T) {
+		req, err := client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: "compressed-blobs/lz4/09f7e02f1290be211da707a266f153b3/5",
+		})
+		require.NoError(t, err)
+		_, err = req.Recv()
+		require.Equal(t, status.Error(codes.InvalidArgument, "Unsupported compressor \"lz4\""), err)
+	})
+
+	t.Run("ReadSuccessZstd", func(t *testing.T) {
+		// Data should be compressed before being sent. The
+		// digest refers to the uncompressed data.
+		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "3538d378083b9afa5ffad767f7269509",
+			SizeBytes: 22,
+		})).Return(buffer.NewValidatedBufferFromByteSlice([]byte("This is a long message")))
+
+		req, err := client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: "debian8/compressed-blobs/zstd/3538d378083b9afa5ffad767f7269509/22",
+		})
+		require.NoError(t, err)
+		var compressed []byte
+		for {
+			readResponse, err := req.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(readResponse.Data), 10)
+			compressed = append(compressed, readResponse.Data...)
+		}
+		decoder, err := zstd.NewReader(nil)
+		require.NoError(t, err)
+		defer decoder.Close()
+		data, err := decoder.DecodeAll(compressed, nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("This is a long message"), data)
+	})
+
+	t.Run("ReadOffsetZstd", func(t *testing.T) {
+		// Read offsets of compressed blobs apply to the
+		// uncompressed data.
+		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "3538d378083b9afa5ffad767f7269509",
+			SizeBytes: 22,
+		})).Return(buffer.NewValidatedBufferFromByteSlice([]byte("This is a long message")))
+
+		req, err := client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: "debian8/compressed-blobs/zstd/3538d378083b9afa5ffad767f7269509/22",
+			ReadOffset:   10,
+		})
+		require.NoError(t, err)
+		var compressed []byte
+		for {
+			readResponse, err := req.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			compressed = append(compressed, readResponse.Data...)
+		}
+		decoder, err := zstd.NewReader(nil)
+		require.NoError(t, err)
+		defer decoder.Close()
+		data, err := decoder.DecodeAll(compressed, nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("long message"), data)
+	})
+
+	t.Run("ReadLimitZstd", func(t *testing.T) {
+		// The size of the compressed data is not known in
+		// advance, meaning read limits cannot be honoured.
+		req, err := client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: "debian8/compressed-blobs/zstd/3538d378083b9afa5ffad767f7269509/22",
+			ReadLimit:    5,
+		})
+		require.NoError(t, err)
+		_, err = req.Recv()
+		require.Equal(t, status.Error(codes.InvalidArgument, "Read limits are not supported for compressed blobs"), err)
+	})
+
 	t.Run("ReadNegativeReadOffset", func(t *testing.T) {
 		// Attempt to fetch a blob with a negative offset.
 		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
@@ -139,6 +256,61 @@ func TestByteStreamServer(t *testing.T) {
 		require.Equal(t, status.Error(codes.InvalidArgument, "Negative read offset: -4"), err)
 	})
 
+	t.Run("ReadNegativeReadLimit", func(t *testing.T) {
+		req, err := client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: "ubuntu1804/blobs/6fc422233a40a75a1f028e11c3cd1140/7",
+			ReadLimit:    -4,
+		})
+		require.NoError(t, err)
+		_, err = req.Recv()
+		require.Equal(t, status.Error(codes.InvalidArgument, "Negative read limit: -4"), err)
+	})
+
+	t.Run("ReadOffsetAndLimit", func(t *testing.T) {
+		// Request a range spanning multiple chunks. The range
+		// should be split up into chunks of equal size.
+		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "3538d378083b9afa5ffad767f7269509",
+			SizeBytes: 22,
+		})).Return(buffer.NewValidatedBufferFromByteSlice([]byte("This is a long message")))
+
+		req, err := client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: "debian8/blobs/3538d378083b9afa5ffad767f7269509/22",
+			ReadOffset:   5,
+			ReadLimit:    12,
+		})
+		require.NoError(t, err)
+		readResponse, err := req.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("is a l"), readResponse.Data)
+		readResponse, err = req.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("ong me"), readResponse.Data)
+		_, err = req.Recv()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("ReadLimitBeyondEnd", func(t *testing.T) {
+		// Limits exceeding the size of the blob should cause
+		// the remainder of the blob to be returned.
+		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "3538d378083b9afa5ffad767f7269509",
+			SizeBytes: 22,
+		})).Return(buffer.NewValidatedBufferFromByteSlice([]byte("This is a long message")))
+
+		req, err := client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: "debian8/blobs/3538d378083b9afa5ffad767f7269509/22",
+			ReadOffset:   15,
+			ReadLimit:    100,
+		})
+		require.NoError(t, err)
+		readResponse, err := req.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("message"), readResponse.Data)
+		_, err = req.Recv()
+		require.Equal(t, io.EOF, err)
+	})
+
 	t.Run("ReadOffsetBeyondEnd", func(t *testing.T) {
 		// Attempt to fetch a blob with a offset beyond the size
 		// of the blob.
@@ -169,10 +341,10 @@ func TestByteStreamServer(t *testing.T) {
 		require.NoError(t, err)
 		readResponse, err := req.Recv()
 		require.NoError(t, err)
-		require.Equal(t, []byte(" offset me"), readResponse.Data)
+		require.Equal(t, []byte(" offset "), readResponse.Data)
 		readResponse, err = req.Recv()
 		require.NoError(t, err)
-		require.Equal(t, []byte("ssage"), readResponse.Data)
+		require.Equal(t, []byte("message"), readResponse.Data)
 		_, err = req.Recv()
 		require.Equal(t, io.EOF, err)
 	})
@@ -192,6 +364,109 @@ func TestByteStreamServer(t *testing.T) {
 		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
 	})
 
+	t.Run("ReadDeferredVerificationSuccess", func(t *testing.T) {
+		// Clients may request that the outcome of integrity
+		// verification is reported through trailer metadata.
+		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "3538d378083b9afa5ffad767f7269509",
+			SizeBytes: 22,
+		})).Return(buffer.NewValidatedBufferFromByteSlice([]byte("This is a long message")))
+
+		req, err := client.Read(
+			metadata.AppendToOutgoingContext(ctx, cas.DeferredVerificationMetadataKey, "1"),
+			&bytestream.ReadRequest{
+				ResourceName: "debian8/blobs/3538d378083b9afa5ffad767f7269509/22",
+			})
+		require.NoError(t, err)
+		var data []byte
+		for {
+			readResponse, err := req.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			data = append(data, readResponse.Data...)
+		}
+		require.Equal(t, []byte("This is a long message"), data)
+		require.Equal(t, []string{"verified"}, req.Trailer().Get(cas.VerificationResultTrailerKey))
+	})
+
+	t.Run("ReadDeferredVerificationCorrupted", func(t *testing.T) {
+		// Data is streamed prior to it being validated. The
+		// trailer should report that validation failed.
+		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "3538d378083b9afa5ffad767f7269509",
+			SizeBytes: 22,
+		})).Return(buffer.NewCASBufferFromReader(
+			util.MustNewDigest("debian8", &remoteexecution.Digest{
+				Hash:      "3538d378083b9afa5ffad767f7269509",
+				SizeBytes: 22,
+			}),
+			ioutil.NopCloser(bytes.NewBufferString("This is a long messagX")),
+			buffer.UserProvided))
+
+		req, err := client.Read(
+			metadata.AppendToOutgoingContext(ctx, cas.DeferredVerificationMetadataKey, "1"),
+			&bytestream.ReadRequest{
+				ResourceName: "debian8/blobs/3538d378083b9afa5ffad767f7269509/22",
+			})
+		require.NoError(t, err)
+		readResponse, err := req.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("This is "), readResponse.Data)
+		readResponse, err = req.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("a long m"), readResponse.Data)
+		_, err = req.Recv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+		require.Equal(t, []string{"unverified"}, req.Trailer().Get(cas.VerificationResultTrailerKey))
+	})
+
+	t.Run("ReadMaximumDurationExceeded", func(t *testing.T) {
+		// A client that stops consuming data should not be able
+		// to keep the stream and the backend buffer open
+		// indefinitely. The instance name should be normalized
+		// before looking up the maximum duration.
+		timeoutCancels := make(chan context.CancelFunc, 1)
+		clock.EXPECT().NewContextWithTimeout(gomock.Any(), time.Minute).DoAndReturn(
+			func(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(parent)
+				timeoutCancels <- cancel
+				return ctx, cancel
+			})
+		digest := util.MustNewDigest("slow", &remoteexecution.Digest{
+			Hash:      "09f34d28e9c8bb445ec996388968a9e8",
+			SizeBytes: 1 << 30,
+		})
+		reader := mock.NewMockReadCloser(ctrl)
+		reader.EXPECT().Read(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+			return len(p), nil
+		}).AnyTimes()
+		closed := make(chan struct{})
+		reader.EXPECT().Close().DoAndReturn(func() error {
+			close(closed)
+			return nil
+		})
+		blobAccess.EXPECT().Get(gomock.Any(), digest).Return(buffer.NewCASBufferFromReader(digest, reader, buffer.UserProvided))
+
+		req, err := client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: "Slow/blobs/09f34d28e9c8bb445ec996388968a9e8/1073741824",
+		})
+		require.NoError(t, err)
+		_, err = req.Recv()
+		require.NoError(t, err)
+
+		// Let the maximum duration expire while the client is
+		// not reading. The client should observe the error
+		// after consuming the data that was already sent.
+		(<-timeoutCancels)()
+		for err == nil {
+			_, err = req.Recv()
+		}
+		require.Equal(t, status.Error(codes.DeadlineExceeded, "Read did not complete within 1m0s"), err)
+		<-closed
+	})
+
 	t.Run("WriteBadResourceName", func(t *testing.T) {
 		// Attempt to write to a bad resource name.
 		stream, err := client.Write(ctx)
@@ -204,6 +479,25 @@ func TestByteStreamServer(t *testing.T) {
 		require.Equal(t, status.Error(codes.InvalidArgument, "Invalid resource naming scheme"), err)
 	})
 
+	t.Run("WriteInvalidDigestHash", func(t *testing.T) {
+		// Malformed hashes in upload resource names should be
+		// rejected before any data is passed to the backend.
+		for resourceName, expectedErr := range map[string]error{
+			"uploads/7de747e1-b7d4-4a4c-8d05-6c9e4c5f8a3b/blobs/581C1053F832A1C719FB6528A588CCFD/12": status.Error(codes.InvalidArgument, "Uppercase hexadecimal character in digest hash: U+0043 'C'"),
+			"uploads/7de747e1-b7d4-4a4c-8d05-6c9e4c5f8a3b/blobs/581c1053f832a1c719fb6528a588ccf/12":  status.Error(codes.InvalidArgument, "Unknown digest hash length: 31 characters"),
+			"uploads/7de747e1-b7d4-4a4c-8d05-6c9e4c5f8a3b/blobs/581c1053f832a1c719fb6528a588ccfg/12": status.Error(codes.InvalidArgument, "Non-hexadecimal character in digest hash: U+0067 'g'"),
+		} {
+			stream, err := client.Write(ctx)
+			require.NoError(t, err)
+			require.NoError(t, stream.Send(&bytestream.WriteRequest{
+				ResourceName: resourceName,
+				Data:         []byte("Bleep bloop!"),
+			}))
+			_, err = stream.CloseAndRecv()
+			require.Equal(t, expectedErr, err)
+		}
+	})
+
 	t.Run("WriteSuccessEmptyInstance", func(t *testing.T) {
 		// Attempt to write a blob without an instance name.
 		blobAccess.EXPECT().Put(gomock.Any(), util.MustNewDigest("", &remoteexecution.Digest{
@@ -232,6 +526,40 @@ func TestByteStreamServer(t *testing.T) {
 		require.Equal(t, int64(14), response.CommittedSize)
 	})
 
+	t.Run("WriteSuccessZstd", func(t *testing.T) {
+		// Compressed data should be decompressed before being
+		// validated against the digest and stored.
+		blobAccess.EXPECT().Put(gomock.Any(), util.MustNewDigest("", &remoteexecution.Digest{
+			Hash:      "581c1053f832a1c719fb6528a588ccfd",
+			SizeBytes: 14,
+		}), gomock.Any()).DoAndReturn(func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+			data, err := b.ToByteSlice(100)
+			require.NoError(t, err)
+			require.Equal(t, []byte("LaputanMachine"), data)
+			return nil
+		})
+
+		encoder, err := zstd.NewWriter(nil)
+		require.NoError(t, err)
+		compressed := encoder.EncodeAll([]byte("LaputanMachine"), nil)
+		require.NoError(t, encoder.Close())
+
+		stream, err := client.Write(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&bytestream.WriteRequest{
+			ResourceName: "uploads/7de747e0-ab6b-4d83-90cb-11989f84c473/compressed-blobs/zstd/581c1053f832a1c719fb6528a588ccfd/14",
+			Data:         compressed[:5],
+		}))
+		require.NoError(t, stream.Send(&bytestream.WriteRequest{
+			Data:        compressed[5:],
+			WriteOffset: 5,
+			FinishWrite: true,
+		}))
+		response, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		require.Equal(t, int64(len(compressed)), response.CommittedSize)
+	})
+
 	t.Run("WriteSuccessWithoutFinish", func(t *testing.T) {
 		// Attempt to write without finishing properly.
 		blobAccess.EXPECT().Put(gomock.Any(), util.MustNewDigest("", &remoteexecution.Digest{
@@ -253,6 +581,33 @@ func TestByteStreamServer(t *testing.T) {
 		require.Equal(t, status.Error(codes.InvalidArgument, "Client closed stream without finishing write"), err)
 	})
 
+	t.Run("WriteFailTruncated", func(t *testing.T) {
+		// Finishing a write before all data has been sent
+		// should be reported explicitly.
+		blobAccess.EXPECT().Put(gomock.Any(), util.MustNewDigest("", &remoteexecution.Digest{
+			Hash:      "581c1053f832a1c719fb6528a588ccfd",
+			SizeBytes: 14,
+		}), gomock.Any()).DoAndReturn(func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+			_, err := b.ToByteSlice(100)
+			require.Equal(t, status.Error(codes.InvalidArgument, "Client finished write after 10 bytes, while the blob is 14 bytes in size"), err)
+			return err
+		})
+
+		stream, err := client.Write(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&bytestream.WriteRequest{
+			ResourceName: "uploads/5d9ad5d4-3a5c-4e3c-92a5-3b6b0e8c2a41/blobs/581c1053f832a1c719fb6528a588ccfd/14",
+			Data:         []byte("Laputan"),
+		}))
+		require.NoError(t, stream.Send(&bytestream.WriteRequest{
+			Data:        []byte("Mac"),
+			WriteOffset: 7,
+			FinishWrite: true,
+		}))
+		_, err = stream.CloseAndRecv()
+		require.Equal(t, status.Error(codes.InvalidArgument, "Client finished write after 10 bytes, while the blob is 14 bytes in size"), err)
+	})
+
 	t.Run("WriteFailFinishTwice", func(t *testing.T) {
 		// Attempted to write while finishing twice.
 		blobAccess.EXPECT().Put(gomock.Any(), util.MustNewDigest("fedora28", &remoteexecution.Digest{
@@ -306,10 +661,168 @@ func TestByteStreamServer(t *testing.T) {
 		require.Equal(t, status.Error(codes.InvalidArgument, "Attempted to write at offset 4, while 5 was expected"), err)
 	})
 
-	t.Run("QueryWriteStatus", func(t *testing.T) {
+	t.Run("WriteCanceled", func(t *testing.T) {
+		// Cancel a write after sending the first chunk. The
+		// backend should observe the cancelation, causing no
+		// partial data to be retained.
+		digest := util.MustNewDigest("", &remoteexecution.Digest{
+			Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+			SizeBytes: 11,
+		})
+		storage := local.NewInMemoryBlobAccess(blobstore.CASStorageType, 1024*1024)
+		putStarted := make(chan struct{})
+		putDone := make(chan struct{})
+		blobAccess.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+			close(putStarted)
+			err := storage.Put(ctx, digest, b)
+			require.Equal(t, codes.Canceled, status.Code(err))
+			close(putDone)
+			return err
+		})
+
+		writeCtx, cancel := context.WithCancel(ctx)
+		stream, err := client.Write(writeCtx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&bytestream.WriteRequest{
+			ResourceName: "uploads/f2a4e3c6-3b0f-4b5a-8c1e-2f0c6d4b8e21/blobs/3e25960a79dbc69b674cd4ec67a72c62/11",
+			Data:         []byte("Hello"),
+		}))
+		<-putStarted
+		cancel()
+		_, err = stream.CloseAndRecv()
+		require.Equal(t, codes.Canceled, status.Code(err))
+		<-putDone
+
+		missing, err := storage.FindMissing(ctx, []*util.Digest{digest})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest}, missing)
+	})
+
+	t.Run("QueryWriteStatusBadResourceName", func(t *testing.T) {
 		_, err := client.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+			ResourceName: "windows10/blobs/68e109f0f40ca72a15e05cc22786f8e6/10",
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Invalid resource naming scheme"), err)
+	})
+
+	queryWriteStatusDigest := util.MustNewDigest("windows10", &remoteexecution.Digest{
+		Hash:      "68e109f0f40ca72a15e05cc22786f8e6",
+		SizeBytes: 10,
+	})
+
+	t.Run("QueryWriteStatusPresent", func(t *testing.T) {
+		// Blobs that are already present should be reported as
+		// being written completely, so that the client can skip
+		// uploading them.
+		blobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{queryWriteStatusDigest}).Return(nil, nil)
+
+		response, err := client.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+			ResourceName: "windows10/uploads/d834d9c2-f3c9-4f30-a698-75fd4be9470d/blobs/68e109f0f40ca72a15e05cc22786f8e6/10",
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(10), response.CommittedSize)
+		require.True(t, response.Complete)
+	})
+
+	t.Run("QueryWriteStatusMissing", func(t *testing.T) {
+		// Partial writes are not retained, meaning that the
+		// client needs to upload missing blobs from the start.
+		blobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{queryWriteStatusDigest}).Return([]*util.Digest{queryWriteStatusDigest}, nil)
+
+		response, err := client.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
 			ResourceName: "windows10/uploads/d834d9c2-f3c9-4f30-a698-75fd4be9470d/blobs/68e109f0f40ca72a15e05cc22786f8e6/10",
 		})
-		require.Equal(t, status.Error(codes.Unimplemented, "This service does not support querying write status"), err)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), response.CommittedSize)
+		require.False(t, response.Complete)
+	})
+
+	t.Run("QueryWriteStatusBackendFailure", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{queryWriteStatusDigest}).Return(nil, status.Error(codes.Internal, "Storage on fire"))
+
+		_, err := client.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+			ResourceName: "windows10/uploads/d834d9c2-f3c9-4f30-a698-75fd4be9470d/blobs/68e109f0f40ca72a15e05cc22786f8e6/10",
+		})
+		require.Equal(t, status.Error(codes.Internal, "Storage on fire"), err)
+	})
+}
+
+func TestByteStreamServerSkipExistingWrites(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	l := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	clock := mock.NewMockClock(ctrl)
+	bytestream.RegisterByteStreamServer(server, cas.NewByteStreamServer(blobAccess, 10, clock, 0, nil, true, util.IdentityInstanceNameNormalizer, nil))
+	go func() {
+		require.NoError(t, server.Serve(l))
+	}()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer server.Stop()
+	defer conn.Close()
+	client := bytestream.NewByteStreamClient(conn)
+
+	digest := util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      "581c1053f832a1c719fb6528a588ccfd",
+		SizeBytes: 14,
+	})
+
+	t.Run("Present", func(t *testing.T) {
+		// The blob is already present, meaning the write
+		// should complete without storing any data.
+		blobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{digest}).Return(nil, nil)
+
+		stream, err := client.Write(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&bytestream.WriteRequest{
+			ResourceName: "uploads/0d8ef6a2-6f3e-4ba0-8b5d-3a7dbc2cf1b9/blobs/581c1053f832a1c719fb6528a588ccfd/14",
+			Data:         []byte("Laputan"),
+		}))
+		response, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		require.Equal(t, int64(14), response.CommittedSize)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{digest}).Return([]*util.Digest{digest}, nil)
+		blobAccess.EXPECT().Put(gomock.Any(), digest, gomock.Any()).DoAndReturn(func(ctx context.Context, digest *util.Digest, b buffer.Buffer) error {
+			data, err := b.ToByteSlice(100)
+			require.NoError(t, err)
+			require.Equal(t, []byte("LaputanMachine"), data)
+			return nil
+		})
+
+		stream, err := client.Write(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&bytestream.WriteRequest{
+			ResourceName: "uploads/0d8ef6a2-6f3e-4ba0-8b5d-3a7dbc2cf1b9/blobs/581c1053f832a1c719fb6528a588ccfd/14",
+			Data:         []byte("Laputan"),
+		}))
+		require.NoError(t, stream.Send(&bytestream.WriteRequest{
+			Data:        []byte("Machine"),
+			WriteOffset: 7,
+			FinishWrite: true,
+		}))
+		response, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		require.Equal(t, int64(14), response.CommittedSize)
+	})
+
+	t.Run("BackendFailure", func(t *testing.T) {
+		blobAccess.EXPECT().FindMissing(gomock.Any(), []*util.Digest{digest}).Return(nil, status.Error(codes.Internal, "Storage backend offline"))
+
+		stream, err := client.Write(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&bytestream.WriteRequest{
+			ResourceName: "uploads/0d8ef6a2-6f3e-4ba0-8b5d-3a7dbc2cf1b9/blobs/581c1053f832a1c719fb6528a588ccfd/14",
+			Data:         []byte("Laputan"),
+		}))
+		_, err = stream.CloseAndRecv()
+		require.Equal(t, status.Error(codes.Internal, "Storage backend offline"), err)
 	})
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
 	"github.com/buildbarn/bb-storage/pkg/filesystem"
 	cas_proto "github.com/buildbarn/bb-storage/pkg/proto/cas"
 	"github.com/buildbarn/bb-storage/pkg/util"
@@ -19,8 +20,22 @@ type ContentAddressableStorage interface {
 	GetTree(ctx context.Context, digest *util.Digest) (*remoteexecution.Tree, error)
 	GetUncachedActionResult(ctx context.Context, digest *util.Digest) (*cas_proto.UncachedActionResult, error)
 
+	// Peek returns at most the first n bytes of a blob. This may be
+	// used to inspect the type of a blob without downloading it in
+	// its entirety. As only part of the blob is read, its contents
+	// are not validated against the digest.
+	Peek(ctx context.Context, digest *util.Digest, n int) ([]byte, error)
+
 	PutFile(ctx context.Context, directory filesystem.Directory, name string, parentDigest *util.Digest) (*util.Digest, error)
 	PutLog(ctx context.Context, log []byte, parentDigest *util.Digest) (*util.Digest, error)
 	PutTree(ctx context.Context, tree *remoteexecution.Tree, parentDigest *util.Digest) (*util.Digest, error)
 	PutUncachedActionResult(ctx context.Context, uncachedActionResult *cas_proto.UncachedActionResult, parentDigest *util.Digest) (*util.Digest, error)
+
+	// PutDryRun computes the digest of the data contained in a
+	// buffer and reports whether an object with that digest is
+	// already present in the CAS, without storing any data. This
+	// may be used to determine ahead of time whether uploads are
+	// necessary, or to validate digests provided by clients. The
+	// buffer is always fully consumed.
+	PutDryRun(ctx context.Context, b buffer.Buffer, parentDigest *util.Digest) (*util.Digest, bool, error)
 }
@@ -2,38 +2,80 @@ package cas
 
 import (
 	"context"
+	"encoding/base64"
+	"sync"
 
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/buildbarn/bb-storage/pkg/blobstore"
 	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	cas_proto "github.com/buildbarn/bb-storage/pkg/proto/cas"
 	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/proto"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// getTreeDefaultPageSize is the maximum number of directories
+	// returned by GetTree() if the client does not provide a page
+	// size, or provides a page size that is larger.
+	getTreeDefaultPageSize = 10000
+
+	// getTreeResponseOverheadBytes is the amount of space reserved
+	// in GetTreeResponse messages for the framing of the
+	// directories and the page token.
+	getTreeResponseOverheadBytes = 1024
+
+	// batchReadBlobsConcurrency is the maximum number of blobs
+	// that BatchReadBlobs() reads from storage concurrently.
+	batchReadBlobsConcurrency = 100
+)
+
 type contentAddressableStorageServer struct {
 	contentAddressableStorage blobstore.BlobAccess
+	maximumMessageSizeBytes   int
+	directoryFetcher          ContentAddressableStorage
+	instanceNameNormalizer    util.InstanceNameNormalizer
 }
 
 // NewContentAddressableStorageServer creates a GRPC service for serving
 // the contents of a Bazel Content Addressable Storage (CAS) to Bazel.
-func NewContentAddressableStorageServer(contentAddressableStorage blobstore.BlobAccess) remoteexecution.ContentAddressableStorageServer {
+//
+// BatchReadBlobs() rejects requests for which the size of the response,
+// including the blobs requested and the framing of the responses of
+// the individual blobs, exceeds maximumMessageSizeBytes, as the
+// response would not fit in a single gRPC message.
+//
+// GetTree() returns directories in depth-first order. Page tokens
+// contain the state of the traversal, namely the directories that
+// still need to be traversed. This permits resuming the traversal
+// without fetching the directories of previous pages once more. To
+// keep page tokens small, directories are only deduplicated within a
+// single page. Directories referenced multiple times may thus be
+// returned on more than one page.
+//
+// Instance names provided by clients are normalized using
+// instanceNameNormalizer.
+func NewContentAddressableStorageServer(contentAddressableStorage blobstore.BlobAccess, maximumMessageSizeBytes int, instanceNameNormalizer util.InstanceNameNormalizer) remoteexecution.ContentAddressableStorageServer {
 	return &contentAddressableStorageServer{
 		contentAddressableStorage: contentAddressableStorage,
+		maximumMessageSizeBytes:   maximumMessageSizeBytes,
+		directoryFetcher:          NewBlobAccessContentAddressableStorage(contentAddressableStorage, maximumMessageSizeBytes),
+		instanceNameNormalizer:    instanceNameNormalizer,
 	}
 }
 
 func (s *contentAddressableStorageServer) FindMissingBlobs(ctx context.Context, in *remoteexecution.FindMissingBlobsRequest) (*remoteexecution.FindMissingBlobsResponse, error) {
 	inDigests := make([]*util.Digest, 0, len(in.BlobDigests))
 	for _, partialDigest := range in.BlobDigests {
-		digest, err := util.NewDigest(in.InstanceName, partialDigest)
+		digest, err := util.NewDigest(s.instanceNameNormalizer(in.InstanceName), partialDigest)
 		if err != nil {
 			return nil, err
 		}
 		inDigests = append(inDigests, digest)
 	}
-	outDigests, err := s.contentAddressableStorage.FindMissing(ctx, inDigests)
+	outDigests, err := s.contentAddressableStorage.FindMissing(ctx, util.RemoveDuplicateDigests(inDigests))
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +89,58 @@ func (s *contentAddressableStorageServer) FindMissingBlobs(ctx context.Context,
 }
 
 func (s *contentAddressableStorageServer) BatchReadBlobs(ctx context.Context, in *remoteexecution.BatchReadBlobsRequest) (*remoteexecution.BatchReadBlobsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "This service does not support batched reading of blobs")
+	// Reject requests whose response would not fit in a single
+	// message. Clients should use ByteStream for such blobs.
+	var totalSizeBytes int64
+	for _, partialDigest := range in.Digests {
+		totalSizeBytes += getBatchReadBlobsResponseSizeBytes(partialDigest)
+	}
+	if totalSizeBytes > int64(s.maximumMessageSizeBytes) {
+		return nil, status.Errorf(codes.InvalidArgument, "Response would be %d bytes in size, while a maximum of %d bytes is permitted", totalSizeBytes, s.maximumMessageSizeBytes)
+	}
+
+	// Asynchronously call Get() for every blob, while bounding the
+	// number of concurrent calls. Failures are reported on a
+	// per-blob basis.
+	response := remoteexecution.BatchReadBlobsResponse{
+		Responses: make([]*remoteexecution.BatchReadBlobsResponse_Response, len(in.Digests)),
+	}
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, batchReadBlobsConcurrency)
+	for i, partialDigest := range in.Digests {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int, partialDigest *remoteexecution.Digest) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			var data []byte
+			digest, err := util.NewDigest(s.instanceNameNormalizer(in.InstanceName), partialDigest)
+			if err == nil {
+				data, err = s.contentAddressableStorage.Get(ctx, digest).ToByteSlice(s.maximumMessageSizeBytes)
+			}
+			response.Responses[i] = &remoteexecution.BatchReadBlobsResponse_Response{
+				Digest: partialDigest,
+				Data:   data,
+				Status: status.Convert(err).Proto(),
+			}
+		}(i, partialDigest)
+	}
+	wg.Wait()
+	return &response, nil
+}
+
+// getBatchReadBlobsResponseSizeBytes returns the number of bytes that
+// the response for a single blob contributes to the size of a
+// BatchReadBlobsResponse, assuming the blob is read successfully.
+func getBatchReadBlobsResponseSizeBytes(partialDigest *remoteexecution.Digest) int64 {
+	dataSizeBytes := partialDigest.GetSizeBytes()
+	responseSizeBytes := int64(proto.Size(&remoteexecution.BatchReadBlobsResponse_Response{
+		Digest: partialDigest,
+		Status: status.Convert(nil).Proto(),
+	})) + 1 + int64(proto.SizeVarint(uint64(dataSizeBytes))) + dataSizeBytes
+	return 1 + int64(proto.SizeVarint(uint64(responseSizeBytes))) + responseSizeBytes
 }
 
 func (s *contentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context, in *remoteexecution.BatchUpdateBlobsRequest) (*remoteexecution.BatchUpdateBlobsResponse, error) {
@@ -55,7 +148,7 @@ func (s *contentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 	responsesChan := make(chan *remoteexecution.BatchUpdateBlobsResponse_Response, len(in.Requests))
 	for _, request := range in.Requests {
 		go func(request *remoteexecution.BatchUpdateBlobsRequest_Request) {
-			digest, err := util.NewDigest(in.InstanceName, request.Digest)
+			digest, err := util.NewDigest(s.instanceNameNormalizer(in.InstanceName), request.Digest)
 			if err == nil {
 				err = s.contentAddressableStorage.Put(
 					ctx,
@@ -78,5 +171,174 @@ func (s *contentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 }
 
 func (s *contentAddressableStorageServer) GetTree(in *remoteexecution.GetTreeRequest, stream remoteexecution.ContentAddressableStorage_GetTreeServer) error {
-	return status.Error(codes.Unimplemented, "This service does not support downloading directory trees")
+	rootDigest, err := util.NewDigest(s.instanceNameNormalizer(in.InstanceName), in.RootDigest)
+	if err != nil {
+		return err
+	}
+	if in.PageSize < 0 {
+		return status.Errorf(codes.InvalidArgument, "Negative page size: %d", in.PageSize)
+	}
+	pageSize := getTreeDefaultPageSize
+	if in.PageSize > 0 && in.PageSize < getTreeDefaultPageSize {
+		pageSize = int(in.PageSize)
+	}
+
+	// Resume the traversal from where the previous page ended, or
+	// start at the root directory.
+	w := getTreeWalker{
+		rootDigest: rootDigest,
+		returned:   map[string]struct{}{},
+	}
+	if in.PageToken == "" {
+		w.pending = []*util.Digest{rootDigest}
+	} else if err := w.loadPageToken(in.PageToken); err != nil {
+		return err
+	}
+
+	// Traverse the directory hierarchy in depth-first order.
+	// Directories are sent in batches that fit in a single message.
+	ctx := stream.Context()
+	var response remoteexecution.GetTreeResponse
+	responseSizeBytes := 0
+	for directoriesReturned := 0; directoriesReturned < pageSize; directoriesReturned++ {
+		digest, ok := w.popPending()
+		if !ok {
+			return stream.Send(&response)
+		}
+		directory, err := s.directoryFetcher.GetDirectory(ctx, digest)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to obtain directory %s", digest)
+		}
+		if err := w.pushChildren(digest, directory); err != nil {
+			return err
+		}
+
+		directorySizeBytes := proto.Size(directory)
+		entrySizeBytes := 1 + proto.SizeVarint(uint64(directorySizeBytes)) + directorySizeBytes
+		if len(response.Directories) > 0 && responseSizeBytes+entrySizeBytes > s.maximumMessageSizeBytes-getTreeResponseOverheadBytes {
+			if err := stream.Send(&response); err != nil {
+				return err
+			}
+			response = remoteexecution.GetTreeResponse{}
+			responseSizeBytes = 0
+		}
+		response.Directories = append(response.Directories, directory)
+		responseSizeBytes += entrySizeBytes
+	}
+
+	// The page is full. Only provide a page token if directories
+	// remain that have not been returned.
+	if w.hasPending() {
+		pageToken, err := w.savePageToken()
+		if err != nil {
+			return err
+		}
+		// The page token grows with the number of directories
+		// pending traversal. Send it separately if it doesn't
+		// fit.
+		if len(response.Directories) > 0 && responseSizeBytes+len(pageToken) > s.maximumMessageSizeBytes-getTreeResponseOverheadBytes {
+			if err := stream.Send(&response); err != nil {
+				return err
+			}
+			response = remoteexecution.GetTreeResponse{}
+		}
+		response.NextPageToken = pageToken
+	}
+	return stream.Send(&response)
+}
+
+// getTreeWalker holds the state of a depth-first traversal of a
+// directory hierarchy stored in the Content Addressable Storage. Every
+// directory is returned once per page, even if it is referenced
+// multiple times. The directories pending traversal can be stored in a
+// page token, so that the traversal can be resumed by a subsequent
+// GetTree() call.
+type getTreeWalker struct {
+	rootDigest *util.Digest
+
+	// Directories that still need to be traversed, with the one
+	// to be traversed first stored last.
+	pending []*util.Digest
+	// Directories that have already been returned as part of the
+	// current page.
+	returned map[string]struct{}
+}
+
+func (w *getTreeWalker) isReturned(digest *util.Digest) bool {
+	_, ok := w.returned[digest.GetKey(util.DigestKeyWithoutInstance)]
+	return ok
+}
+
+func (w *getTreeWalker) markReturned(digest *util.Digest) {
+	w.returned[digest.GetKey(util.DigestKeyWithoutInstance)] = struct{}{}
+}
+
+// hasPending returns whether any directories remain that have not been
+// returned. Directories that have been returned in the meantime are
+// discarded.
+func (w *getTreeWalker) hasPending() bool {
+	for len(w.pending) > 0 && w.isReturned(w.pending[len(w.pending)-1]) {
+		w.pending = w.pending[:len(w.pending)-1]
+	}
+	return len(w.pending) > 0
+}
+
+// popPending returns the next directory that needs to be returned,
+// marking it as returned.
+func (w *getTreeWalker) popPending() (*util.Digest, bool) {
+	if !w.hasPending() {
+		return nil, false
+	}
+	digest := w.pending[len(w.pending)-1]
+	w.pending = w.pending[:len(w.pending)-1]
+	w.markReturned(digest)
+	return digest, true
+}
+
+// pushChildren schedules the children of a directory for traversal,
+// so that they are traversed in the order in which they are listed.
+func (w *getTreeWalker) pushChildren(digest *util.Digest, directory *remoteexecution.Directory) error {
+	for i := len(directory.Directories) - 1; i >= 0; i-- {
+		child := directory.Directories[i]
+		childDigest, err := digest.NewDerivedDigest(child.Digest)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to extract digest for child directory %#v of directory %s", child.Name, digest)
+		}
+		if !w.isReturned(childDigest) {
+			w.pending = append(w.pending, childDigest)
+		}
+	}
+	return nil
+}
+
+func (w *getTreeWalker) loadPageToken(pageToken string) error {
+	invalidPageToken := status.Errorf(codes.InvalidArgument, "Invalid page token %#v", pageToken)
+	data, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return invalidPageToken
+	}
+	var token cas_proto.GetTreePageToken
+	if err := proto.Unmarshal(data, &token); err != nil {
+		return invalidPageToken
+	}
+	for _, partialDigest := range token.PendingDirectoryDigests {
+		digest, err := w.rootDigest.NewDerivedDigest(partialDigest)
+		if err != nil {
+			return invalidPageToken
+		}
+		w.pending = append(w.pending, digest)
+	}
+	return nil
+}
+
+func (w *getTreeWalker) savePageToken() (string, error) {
+	var token cas_proto.GetTreePageToken
+	for _, digest := range w.pending {
+		token.PendingDirectoryDigests = append(token.PendingDirectoryDigests, digest.GetPartialDigest())
+	}
+	data, err := proto.Marshal(&token)
+	if err != nil {
+		return "", util.StatusWrapWithCode(err, codes.Internal, "Failed to marshal page token")
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
 }
@@ -0,0 +1,315 @@
+package cas_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/buildbarn/bb-storage/internal/mock"
+	"github.com/buildbarn/bb-storage/pkg/blobstore"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/buildbarn/bb-storage/pkg/blobstore/local"
+	"github.com/buildbarn/bb-storage/pkg/cas"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContentAddressableStorageServerFindMissingBlobsDuplicates(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	server := cas.NewContentAddressableStorageServer(blobAccess, 1<<20, util.IdentityInstanceNameNormalizer)
+	partialDigest1 := &remoteexecution.Digest{
+		Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+		SizeBytes: 11,
+	}
+	partialDigest2 := &remoteexecution.Digest{
+		Hash:      "09f7e02f1290be211da707a266f153b3",
+		SizeBytes: 5,
+	}
+	digest1 := util.MustNewDigest("default", partialDigest1)
+	digest2 := util.MustNewDigest("default", partialDigest2)
+
+	// Duplicate digests should only be passed to the backend once,
+	// retaining the order in which they first occur. The response
+	// should therefore not contain any duplicates either.
+	blobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest2, digest1}).Return([]*util.Digest{digest2, digest1}, nil)
+
+	response, err := server.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{
+		InstanceName: "default",
+		BlobDigests: []*remoteexecution.Digest{
+			partialDigest2,
+			partialDigest1,
+			partialDigest2,
+			partialDigest2,
+			partialDigest1,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, &remoteexecution.FindMissingBlobsResponse{
+		MissingBlobDigests: []*remoteexecution.Digest{
+			partialDigest2,
+			partialDigest1,
+		},
+	}, response)
+}
+
+func TestContentAddressableStorageServerFindMissingBlobsNormalized(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Instance names provided by clients should be normalized
+	// before being used to access storage.
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	server := cas.NewContentAddressableStorageServer(blobAccess, 1<<20, util.NewInstanceNameNormalizer(true, true, nil))
+	partialDigest := &remoteexecution.Digest{
+		Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+		SizeBytes: 11,
+	}
+	digest := util.MustNewDigest("default", partialDigest)
+	blobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+
+	response, err := server.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{
+		InstanceName: "/Default/",
+		BlobDigests:  []*remoteexecution.Digest{partialDigest},
+	})
+	require.NoError(t, err)
+	require.Equal(t, &remoteexecution.FindMissingBlobsResponse{
+		MissingBlobDigests: []*remoteexecution.Digest{},
+	}, response)
+}
+
+func TestContentAddressableStorageServerBatchReadBlobs(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	server := cas.NewContentAddressableStorageServer(blobAccess, 100, util.IdentityInstanceNameNormalizer)
+	partialDigest1 := &remoteexecution.Digest{
+		Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+		SizeBytes: 11,
+	}
+	partialDigest2 := &remoteexecution.Digest{
+		Hash:      "09f7e02f1290be211da707a266f153b3",
+		SizeBytes: 5,
+	}
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// The total size of the blobs, including the framing of
+		// the responses, exceeds the maximum message size. The
+		// response for partialDigest1 takes up 53 bytes.
+		_, err := server.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{
+			InstanceName: "default",
+			Digests:      []*remoteexecution.Digest{partialDigest1, partialDigest1},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Response would be 106 bytes in size, while a maximum of 100 bytes is permitted"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		// Failures to read individual blobs should be reported
+		// in the response for that blob. The response for
+		// partialDigest2 takes up 47 bytes, meaning the response
+		// is exactly as large as permitted.
+		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("default", partialDigest1)).
+			Return(buffer.NewValidatedBufferFromByteSlice([]byte("Hello world")))
+		blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("default", partialDigest2)).
+			Return(buffer.NewBufferFromError(status.Error(codes.NotFound, "Blob not found")))
+
+		response, err := server.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{
+			InstanceName: "default",
+			Digests:      []*remoteexecution.Digest{partialDigest1, partialDigest2},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &remoteexecution.BatchReadBlobsResponse{
+			Responses: []*remoteexecution.BatchReadBlobsResponse_Response{
+				{
+					Digest: partialDigest1,
+					Data:   []byte("Hello world"),
+					Status: status.New(codes.OK, "").Proto(),
+				},
+				{
+					Digest: partialDigest2,
+					Status: status.New(codes.NotFound, "Blob not found").Proto(),
+				},
+			},
+		}, response)
+	})
+}
+
+// getTreeServer is a fake implementation of the server side of the
+// GetTree() stream that captures all responses.
+type getTreeServer struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses []*remoteexecution.GetTreeResponse
+}
+
+func (s *getTreeServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *getTreeServer) Send(response *remoteexecution.GetTreeResponse) error {
+	s.responses = append(s.responses, response)
+	return nil
+}
+
+func TestContentAddressableStorageServerGetTree(t *testing.T) {
+	ctx := context.Background()
+
+	blobAccess := local.NewInMemoryBlobAccess(blobstore.CASStorageType, 1<<20)
+	server := cas.NewContentAddressableStorageServer(blobAccess, 1<<20, util.IdentityInstanceNameNormalizer)
+	putDirectory := func(directory *remoteexecution.Directory) *remoteexecution.Digest {
+		data, err := proto.Marshal(directory)
+		require.NoError(t, err)
+		hash := sha256.Sum256(data)
+		partialDigest := &remoteexecution.Digest{
+			Hash:      hex.EncodeToString(hash[:]),
+			SizeBytes: int64(len(data)),
+		}
+		require.NoError(t, blobAccess.Put(ctx, util.MustNewDigest("default", partialDigest), buffer.NewValidatedBufferFromByteSlice(data)))
+		return partialDigest
+	}
+
+	// Create a directory hierarchy in which directory "shared" is
+	// referenced three times. It should only be returned once per
+	// page.
+	shared := &remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "file",
+				Digest: &remoteexecution.Digest{
+					Hash:      "3e25960a79dbc69b674cd4ec67a72c62",
+					SizeBytes: 11,
+				},
+			},
+		},
+	}
+	sharedDigest := putDirectory(shared)
+	a := &remoteexecution.Directory{
+		Directories: []*remoteexecution.DirectoryNode{
+			{Name: "shared", Digest: sharedDigest},
+		},
+	}
+	aDigest := putDirectory(a)
+	b := &remoteexecution.Directory{
+		Directories: []*remoteexecution.DirectoryNode{
+			{Name: "shared1", Digest: sharedDigest},
+			{Name: "shared2", Digest: sharedDigest},
+		},
+	}
+	bDigest := putDirectory(b)
+	root := &remoteexecution.Directory{
+		Directories: []*remoteexecution.DirectoryNode{
+			{Name: "a", Digest: aDigest},
+			{Name: "b", Digest: bDigest},
+		},
+	}
+	rootDigest := putDirectory(root)
+
+	t.Run("SinglePage", func(t *testing.T) {
+		stream := &getTreeServer{ctx: ctx}
+		require.NoError(t, server.GetTree(&remoteexecution.GetTreeRequest{
+			InstanceName: "default",
+			RootDigest:   rootDigest,
+		}, stream))
+		require.Len(t, stream.responses, 1)
+		require.True(t, proto.Equal(&remoteexecution.GetTreeResponse{
+			Directories: []*remoteexecution.Directory{root, a, shared, b},
+		}, stream.responses[0]))
+	})
+
+	t.Run("Paginated", func(t *testing.T) {
+		stream := &getTreeServer{ctx: ctx}
+		require.NoError(t, server.GetTree(&remoteexecution.GetTreeRequest{
+			InstanceName: "default",
+			RootDigest:   rootDigest,
+			PageSize:     3,
+		}, stream))
+		require.Len(t, stream.responses, 1)
+		pageToken := stream.responses[0].NextPageToken
+		require.NotEmpty(t, pageToken)
+		require.True(t, proto.Equal(&remoteexecution.GetTreeResponse{
+			Directories:   []*remoteexecution.Directory{root, a, shared},
+			NextPageToken: pageToken,
+		}, stream.responses[0]))
+
+		// The page token contains the state of the traversal.
+		// Requesting the next page should not cause the
+		// directories returned previously to be fetched again.
+		// Use a separate server that only has access to the
+		// remaining directories to test this. As directories
+		// are only deduplicated within a page, "shared" is
+		// returned once more.
+		remainingBlobAccess := local.NewInMemoryBlobAccess(blobstore.CASStorageType, 1<<20)
+		remainingServer := cas.NewContentAddressableStorageServer(remainingBlobAccess, 1<<20, util.IdentityInstanceNameNormalizer)
+		data, err := proto.Marshal(b)
+		require.NoError(t, err)
+		require.NoError(t, remainingBlobAccess.Put(ctx, util.MustNewDigest("default", bDigest), buffer.NewValidatedBufferFromByteSlice(data)))
+		data, err = proto.Marshal(shared)
+		require.NoError(t, err)
+		require.NoError(t, remainingBlobAccess.Put(ctx, util.MustNewDigest("default", sharedDigest), buffer.NewValidatedBufferFromByteSlice(data)))
+
+		stream = &getTreeServer{ctx: ctx}
+		require.NoError(t, remainingServer.GetTree(&remoteexecution.GetTreeRequest{
+			InstanceName: "default",
+			RootDigest:   rootDigest,
+			PageSize:     3,
+			PageToken:    pageToken,
+		}, stream))
+		require.Len(t, stream.responses, 1)
+		require.True(t, proto.Equal(&remoteexecution.GetTreeResponse{
+			Directories: []*remoteexecution.Directory{b, shared},
+		}, stream.responses[0]))
+	})
+
+	t.Run("PageSizeMatchesTree", func(t *testing.T) {
+		// No page token should be returned if the page ends
+		// exactly at the end of the tree.
+		stream := &getTreeServer{ctx: ctx}
+		require.NoError(t, server.GetTree(&remoteexecution.GetTreeRequest{
+			InstanceName: "default",
+			RootDigest:   rootDigest,
+			PageSize:     4,
+		}, stream))
+		require.Len(t, stream.responses, 1)
+		require.True(t, proto.Equal(&remoteexecution.GetTreeResponse{
+			Directories: []*remoteexecution.Directory{root, a, shared, b},
+		}, stream.responses[0]))
+	})
+
+	t.Run("InvalidPageToken", func(t *testing.T) {
+		err := server.GetTree(&remoteexecution.GetTreeRequest{
+			InstanceName: "default",
+			RootDigest:   rootDigest,
+			PageToken:    "hello",
+		}, &getTreeServer{ctx: ctx})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Invalid page token \"hello\""), err)
+	})
+
+	t.Run("MissingChild", func(t *testing.T) {
+		missingDigest := &remoteexecution.Digest{
+			Hash:      "0000000000000000000000000000000000000000000000000000000000000000",
+			SizeBytes: 42,
+		}
+		parentDigest := putDirectory(&remoteexecution.Directory{
+			Directories: []*remoteexecution.DirectoryNode{
+				{Name: "missing", Digest: missingDigest},
+			},
+		})
+		err := server.GetTree(&remoteexecution.GetTreeRequest{
+			InstanceName: "default",
+			RootDigest:   parentDigest,
+		}, &getTreeServer{ctx: ctx})
+		require.Equal(t, codes.NotFound, status.Code(err))
+		require.Contains(t, status.Convert(err).Message(), "Failed to obtain directory 0000000000000000000000000000000000000000000000000000000000000000-42-default")
+	})
+}
@@ -0,0 +1,108 @@
+package cas
+
+import (
+	"io"
+
+	"github.com/buildbarn/bb-storage/pkg/blobstore/buffer"
+	"github.com/klauspost/compress/zstd"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunkReaderReader is an adapter for ChunkReader that implements
+// io.Reader.
+type chunkReaderReader struct {
+	r    buffer.ChunkReader
+	data []byte
+}
+
+func (r *chunkReaderReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		data, err := r.r.Read()
+		if err != nil {
+			return 0, err
+		}
+		r.data = data
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// zstdDecompressingReader decompresses Zstandard compressed data
+// obtained from a ChunkReader. It is used by Write() to process
+// uploads of compressed blobs.
+type zstdDecompressingReader struct {
+	*zstd.Decoder
+	r buffer.ChunkReader
+}
+
+func newZstdDecompressingReader(r buffer.ChunkReader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(&chunkReaderReader{r: r}, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		r.Close()
+		return nil, status.Errorf(codes.Internal, "Failed to create Zstandard decoder: %s", err)
+	}
+	return &zstdDecompressingReader{
+		Decoder: decoder,
+		r:       r,
+	}, nil
+}
+
+func (r *zstdDecompressingReader) Close() error {
+	r.Decoder.Close()
+	r.r.Close()
+	return nil
+}
+
+// zstdCompressingChunkReader is a ChunkReader that yields a Zstandard
+// compressed copy of the data read from another ChunkReader. It is used
+// by Read() to serve downloads of compressed blobs. Compression is
+// performed in a separate goroutine.
+//
+// Read offsets of compressed blobs refer to the uncompressed data. The
+// provided ChunkReader should therefore already start at the requested
+// offset.
+type zstdCompressingChunkReader struct {
+	pr        *io.PipeReader
+	chunkSize int
+}
+
+func newZstdCompressingChunkReader(r buffer.ChunkReader, chunkSize int) buffer.ChunkReader {
+	pr, pw := io.Pipe()
+	go func() {
+		encoder, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			r.Close()
+			pw.CloseWithError(status.Errorf(codes.Internal, "Failed to create Zstandard encoder: %s", err))
+			return
+		}
+		_, err = io.Copy(encoder, &chunkReaderReader{r: r})
+		r.Close()
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return &zstdCompressingChunkReader{
+		pr:        pr,
+		chunkSize: chunkSize,
+	}
+}
+
+func (r *zstdCompressingChunkReader) Read() ([]byte, error) {
+	chunk := make([]byte, r.chunkSize)
+	n, err := io.ReadFull(r.pr, chunk)
+	if err == io.ErrUnexpectedEOF {
+		return chunk[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+func (r *zstdCompressingChunkReader) Close() {
+	r.pr.Close()
+}
@@ -0,0 +1,122 @@
+package grpc
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// gzipCompressor is an implementation of gRPC's encoding.Compressor
+// that uses gzip. gRPC ships with an identical implementation, but it
+// is only registered when imported explicitly. This implementation is
+// registered unconditionally, as gRPC does not permit registering
+// compressors on a per-server basis. Servers only accept messages
+// compressed using gzip if enabled through the interceptors created
+// by NewCompressorEnforcingUnaryInterceptor() and
+// NewCompressorEnforcingStreamInterceptor().
+type gzipCompressor struct {
+	writers sync.Pool
+}
+
+func (c *gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if z, ok := c.writers.Get().(*gzipWriter); ok {
+		z.Writer.Reset(w)
+		return z, nil
+	}
+	return &gzipWriter{
+		Writer:     gzip.NewWriter(w),
+		compressor: c,
+	}, nil
+}
+
+func (c *gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (c *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+type gzipWriter struct {
+	*gzip.Writer
+	compressor *gzipCompressor
+}
+
+func (z *gzipWriter) Close() error {
+	// Return the writer to the pool, so that its internal buffers
+	// can be reused by successive messages.
+	defer z.compressor.writers.Put(z)
+	return z.Writer.Close()
+}
+
+func init() {
+	// Register the compressor at startup, as opposed to when
+	// servers are created. gRPC does not permit registering
+	// compressors once servers are running.
+	encoding.RegisterCompressor(&gzipCompressor{})
+}
+
+// receivedCompressorGetter is implemented by the stream objects that
+// gRPC attaches to the context of incoming calls. It yields the name of
+// the compressor the client used to compress its messages.
+type receivedCompressorGetter interface {
+	RecvCompress() string
+}
+
+func checkCompressor(ctx context.Context, enabledCompressors map[string]bool) error {
+	stream, ok := grpc.ServerTransportStreamFromContext(ctx).(receivedCompressorGetter)
+	if !ok {
+		return nil
+	}
+	if compressor := stream.RecvCompress(); compressor != "" && compressor != "identity" && !enabledCompressors[compressor] {
+		return status.Errorf(codes.Unimplemented, "Compressor %#v is not enabled on this server", compressor)
+	}
+	return nil
+}
+
+func newCompressorSet(enabledCompressors []string) map[string]bool {
+	compressorSet := make(map[string]bool, len(enabledCompressors))
+	for _, compressor := range enabledCompressors {
+		compressorSet[compressor] = true
+	}
+	return compressorSet
+}
+
+// NewCompressorEnforcingUnaryInterceptor creates a gRPC request
+// interceptor for unary calls that rejects requests that are
+// compressed using a compressor that is not part of a list of enabled
+// compressors. As compressors are registered globally, this permits
+// enabling compression on a per-server basis.
+func NewCompressorEnforcingUnaryInterceptor(enabledCompressors []string) grpc.UnaryServerInterceptor {
+	compressorSet := newCompressorSet(enabledCompressors)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := checkCompressor(ctx, compressorSet); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// NewCompressorEnforcingStreamInterceptor creates a gRPC request
+// interceptor for streaming calls that rejects requests that are
+// compressed using a compressor that is not part of a list of enabled
+// compressors.
+func NewCompressorEnforcingStreamInterceptor(enabledCompressors []string) grpc.StreamServerInterceptor {
+	compressorSet := newCompressorSet(enabledCompressors)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkCompressor(ss.Context(), compressorSet); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
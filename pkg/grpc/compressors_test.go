@@ -0,0 +1,112 @@
+package grpc_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	bb_grpc "github.com/buildbarn/bb-storage/pkg/grpc"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGzipCompressor(t *testing.T) {
+	compressor := encoding.GetCompressor("gzip")
+	require.NotNil(t, compressor)
+	require.Equal(t, "gzip", compressor.Name())
+
+	// Compress and decompress multiple messages, so that writers
+	// returned to the pool are reused.
+	for _, message := range []string{"Hello world", "", "Goodbye world"} {
+		var compressed bytes.Buffer
+		w, err := compressor.Compress(&compressed)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(message))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		r, err := compressor.Decompress(&compressed)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, message, string(data))
+	}
+
+	t.Run("MalformedData", func(t *testing.T) {
+		_, err := compressor.Decompress(bytes.NewBufferString("This is not gzip"))
+		require.Error(t, err)
+	})
+}
+
+func TestCompressorEnforcingInterceptors(t *testing.T) {
+	ctx := context.Background()
+
+	newClient := func(t *testing.T, enabledCompressors []string) (bytestream.ByteStreamClient, func()) {
+		l := bufconn.Listen(1 << 20)
+		server := grpc.NewServer(
+			grpc.UnaryInterceptor(bb_grpc.NewCompressorEnforcingUnaryInterceptor(enabledCompressors)),
+			grpc.StreamInterceptor(bb_grpc.NewCompressorEnforcingStreamInterceptor(enabledCompressors)))
+		bytestream.RegisterByteStreamServer(server, sizeReportingByteStreamServer{})
+		go server.Serve(l)
+		conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return l.Dial()
+		}), grpc.WithInsecure())
+		require.NoError(t, err)
+		return bytestream.NewByteStreamClient(conn), func() {
+			conn.Close()
+			server.Stop()
+		}
+	}
+
+	write := func(t *testing.T, client bytestream.ByteStreamClient, opts ...grpc.CallOption) (*bytestream.WriteResponse, error) {
+		stream, err := client.Write(ctx, opts...)
+		require.NoError(t, err)
+		stream.Send(&bytestream.WriteRequest{
+			ResourceName: "default/uploads/7de747e4-1b1b-4a2a-9d1c-7b0f6c3a6d3e/blobs/8b1a9953c4611296a827abf8c47804d7/5",
+			FinishWrite:  true,
+			Data:         []byte("Hello"),
+		})
+		return stream.CloseAndRecv()
+	}
+
+	t.Run("Uncompressed", func(t *testing.T) {
+		// Uncompressed requests should always be accepted.
+		client, cleanup := newClient(t, nil)
+		defer cleanup()
+
+		response, err := write(t, client)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), response.CommittedSize)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		// Even though gzip is registered globally, requests
+		// using it should be rejected if not enabled.
+		client, cleanup := newClient(t, nil)
+		defer cleanup()
+
+		_, err := write(t, client, grpc.UseCompressor("gzip"))
+		require.Equal(t, status.Error(codes.Unimplemented, "Compressor \"gzip\" is not enabled on this server"), err)
+
+		_, err = client.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{}, grpc.UseCompressor("gzip"))
+		require.Equal(t, status.Error(codes.Unimplemented, "Compressor \"gzip\" is not enabled on this server"), err)
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		client, cleanup := newClient(t, []string{"gzip"})
+		defer cleanup()
+
+		response, err := write(t, client, grpc.UseCompressor("gzip"))
+		require.NoError(t, err)
+		require.Equal(t, int64(5), response.CommittedSize)
+	})
+}
@@ -48,7 +48,11 @@ func NewGRPCClientFromConfiguration(configuration *configuration.GRPCClientConfi
 // servers based on a configuration stored in a list of Protobuf
 // messages. In then lets all of these gRPC servers listen on the
 // network addresses of UNIX socket paths provided.
-func NewGRPCServersFromConfigurationAndServe(configurations []*configuration.GRPCServerConfiguration, registrationFunc func(*grpc.Server)) error {
+//
+// Additional server options may be provided that apply to all of the
+// gRPC servers (e.g., ones created by NewMessageSizeServerOptions()).
+// Options stored in the configuration take precedence over these.
+func NewGRPCServersFromConfigurationAndServe(configurations []*configuration.GRPCServerConfiguration, registrationFunc func(*grpc.Server), additionalServerOptions ...grpc.ServerOption) error {
 	serveErrors := make(chan error)
 
 	if len(configurations) == 0 {
@@ -66,12 +70,15 @@ func NewGRPCServersFromConfigurationAndServe(configurations []*configuration.GRP
 		serverOptions := []grpc.ServerOption{
 			grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
 				grpc_prometheus.UnaryServerInterceptor,
-				NewAuthenticatingUnaryInterceptor(authenticator))),
+				NewAuthenticatingUnaryInterceptor(authenticator),
+				NewCompressorEnforcingUnaryInterceptor(configuration.EnabledCompressors))),
 			grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
 				grpc_prometheus.StreamServerInterceptor,
-				NewAuthenticatingStreamInterceptor(authenticator))),
+				NewAuthenticatingStreamInterceptor(authenticator),
+				NewCompressorEnforcingStreamInterceptor(configuration.EnabledCompressors))),
 			grpc.StatsHandler(&ocgrpc.ServerHandler{}),
 		}
+		serverOptions = append(serverOptions, additionalServerOptions...)
 
 		// Enable TLS if provided.
 		if tlsConfig, err := util.NewTLSConfigFromServerConfiguration(configuration.Tls); err != nil {
@@ -84,6 +91,12 @@ func NewGRPCServersFromConfigurationAndServe(configurations []*configuration.GRP
 			serverOptions = append(serverOptions, grpc.MaxRecvMsgSize(int(maxRecvMsgSize)))
 		}
 
+		keepaliveOptions, err := NewKeepaliveEnforcementPolicyServerOptions(configuration.KeepaliveEnforcementPolicy)
+		if err != nil {
+			return err
+		}
+		serverOptions = append(serverOptions, keepaliveOptions...)
+
 		// Create server.
 		s := grpc.NewServer(serverOptions...)
 		registrationFunc(s)
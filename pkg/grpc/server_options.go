@@ -0,0 +1,49 @@
+package grpc
+
+import (
+	configuration "github.com/buildbarn/bb-storage/pkg/proto/configuration/grpc"
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/golang/protobuf/ptypes"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// messageFramingOverheadBytes is the amount of space reserved on top
+// of the maximum message size for the fields that surround the payload
+// of a request or response (e.g., digests and resource names in
+// BatchUpdateBlobs() and ByteStream Write() calls).
+const messageFramingOverheadBytes = 1 << 16
+
+// NewMessageSizeServerOptions creates options for a gRPC server that
+// permit it to send and receive messages containing payloads of up to
+// maximumMessageSizeBytes in size. Without these options, gRPC rejects
+// any message larger than 4 MiB.
+func NewMessageSizeServerOptions(maximumMessageSizeBytes int) []grpc.ServerOption {
+	maximumFramedMessageSizeBytes := maximumMessageSizeBytes + messageFramingOverheadBytes
+	return []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maximumFramedMessageSizeBytes),
+		grpc.MaxSendMsgSize(maximumFramedMessageSizeBytes),
+	}
+}
+
+// NewKeepaliveEnforcementPolicyServerOptions creates options for a
+// gRPC server that control how frequently clients may send keepalive
+// pings, based on a configuration stored in a Protobuf message.
+func NewKeepaliveEnforcementPolicyServerOptions(policy *configuration.ServerKeepaliveEnforcementPolicy) ([]grpc.ServerOption, error) {
+	if policy == nil {
+		return nil, nil
+	}
+
+	enforcementPolicy := keepalive.EnforcementPolicy{
+		PermitWithoutStream: policy.PermitWithoutStream,
+	}
+	if policy.MinimumTime != nil {
+		minimumTime, err := ptypes.Duration(policy.MinimumTime)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to parse keepalive enforcement policy minimum time")
+		}
+		enforcementPolicy.MinTime = minimumTime
+	}
+	return []grpc.ServerOption{grpc.KeepaliveEnforcementPolicy(enforcementPolicy)}, nil
+}
@@ -0,0 +1,133 @@
+package grpc_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	bb_grpc "github.com/buildbarn/bb-storage/pkg/grpc"
+	configuration "github.com/buildbarn/bb-storage/pkg/proto/configuration/grpc"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// sizeReportingByteStreamServer is a trivial implementation of the
+// ByteStream service, whose Write() method reports the size of the
+// data contained in the first request.
+type sizeReportingByteStreamServer struct{}
+
+func (sizeReportingByteStreamServer) Read(in *bytestream.ReadRequest, out bytestream.ByteStream_ReadServer) error {
+	return status.Error(codes.Unimplemented, "Read() is not implemented")
+}
+
+func (sizeReportingByteStreamServer) Write(stream bytestream.ByteStream_WriteServer) error {
+	request, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&bytestream.WriteResponse{
+		CommittedSize: int64(len(request.Data)),
+	})
+}
+
+func (sizeReportingByteStreamServer) QueryWriteStatus(ctx context.Context, in *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "QueryWriteStatus() is not implemented")
+}
+
+func TestNewMessageSizeServerOptions(t *testing.T) {
+	ctx := context.Background()
+
+	l := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(bb_grpc.NewMessageSizeServerOptions(8 * 1024 * 1024)...)
+	bytestream.RegisterByteStreamServer(server, sizeReportingByteStreamServer{})
+	go func() {
+		require.NoError(t, server.Serve(l))
+	}()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure(), grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(16*1024*1024)))
+	require.NoError(t, err)
+	defer server.Stop()
+	defer conn.Close()
+	client := bytestream.NewByteStreamClient(conn)
+
+	write := func(dataSizeBytes int) (*bytestream.WriteResponse, error) {
+		stream, err := client.Write(ctx)
+		require.NoError(t, err)
+		if err := stream.Send(&bytestream.WriteRequest{
+			ResourceName: "default/uploads/7de747e4-1b1b-4a2a-9d1c-7b0f6c3a6d3e/blobs/8b1a9953c4611296a827abf8c47804d7/8388608",
+			FinishWrite:  true,
+			Data:         make([]byte, dataSizeBytes),
+		}); err != io.EOF {
+			require.NoError(t, err)
+		}
+		return stream.CloseAndRecv()
+	}
+
+	t.Run("MaximumSize", func(t *testing.T) {
+		// Payloads of exactly the maximum message size should be
+		// accepted, even though the resource name causes the
+		// message as a whole to be larger than that.
+		response, err := write(8 * 1024 * 1024)
+		require.NoError(t, err)
+		require.Equal(t, int64(8*1024*1024), response.CommittedSize)
+	})
+
+	t.Run("WithinOverhead", func(t *testing.T) {
+		// The space reserved for framing is 64 KiB. Messages
+		// may use all of it.
+		response, err := write(8*1024*1024 + 32*1024)
+		require.NoError(t, err)
+		require.Equal(t, int64(8*1024*1024+32*1024), response.CommittedSize)
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// Messages exceeding both the maximum message size and
+		// the overhead should be rejected.
+		_, err := write(8*1024*1024 + 64*1024)
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+}
+
+func TestNewKeepaliveEnforcementPolicyServerOptions(t *testing.T) {
+	t.Run("Nil", func(t *testing.T) {
+		// Not providing a policy should cause gRPC's defaults to
+		// be left intact.
+		options, err := bb_grpc.NewKeepaliveEnforcementPolicyServerOptions(nil)
+		require.NoError(t, err)
+		require.Empty(t, options)
+	})
+
+	t.Run("NoMinimumTime", func(t *testing.T) {
+		options, err := bb_grpc.NewKeepaliveEnforcementPolicyServerOptions(&configuration.ServerKeepaliveEnforcementPolicy{
+			PermitWithoutStream: true,
+		})
+		require.NoError(t, err)
+		require.Len(t, options, 1)
+	})
+
+	t.Run("ZeroMinimumTime", func(t *testing.T) {
+		options, err := bb_grpc.NewKeepaliveEnforcementPolicyServerOptions(&configuration.ServerKeepaliveEnforcementPolicy{
+			MinimumTime: ptypes.DurationProto(0),
+		})
+		require.NoError(t, err)
+		require.Len(t, options, 1)
+	})
+
+	t.Run("InvalidMinimumTime", func(t *testing.T) {
+		_, err := bb_grpc.NewKeepaliveEnforcementPolicyServerOptions(&configuration.ServerKeepaliveEnforcementPolicy{
+			MinimumTime: &duration.Duration{Seconds: 1, Nanos: -1},
+		})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "Failed to parse keepalive enforcement policy minimum time: ")
+	})
+}
@@ -0,0 +1,44 @@
+package opentelemetry
+
+import (
+	"log"
+
+	pb "github.com/buildbarn/bb-storage/pkg/proto/configuration/bb_storage"
+	"github.com/buildbarn/bb-storage/pkg/tracing"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/exporters/trace/jaeger"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Initialize sets up OpenTelemetry tracing with a Jaeger exporter. It
+// causes all spans created through the tracing package to be emitted
+// using OpenTelemetry instead of OpenCensus. The function that is
+// returned flushes spans that have not been exported yet. It should be
+// called before the process terminates.
+func Initialize(configuration *pb.OpenTelemetryConfiguration) func() {
+	var sampler sdktrace.Sampler
+	if configuration.AlwaysSample {
+		sampler = sdktrace.AlwaysSample()
+	} else {
+		samplingProbability := configuration.SamplingProbability
+		if samplingProbability == 0 {
+			samplingProbability = 1e-4
+		} else if samplingProbability < 0 || samplingProbability > 1 {
+			log.Fatal("Sampling probability must be between 0 and 1")
+		}
+		sampler = sdktrace.ProbabilitySampler(samplingProbability)
+	}
+	_, flush, err := jaeger.NewExportPipeline(
+		jaeger.WithCollectorEndpoint(configuration.CollectorEndpoint),
+		jaeger.WithProcess(jaeger.Process{
+			ServiceName: configuration.ServiceName,
+		}),
+		jaeger.RegisterAsGlobal(),
+		jaeger.WithSDK(&sdktrace.Config{DefaultSampler: sampler}),
+	)
+	if err != nil {
+		log.Fatal("Failed to create the Jaeger exporter: ", err)
+	}
+	tracing.SetTracer(tracing.NewOpenTelemetryTracer(global.Tracer("github.com/buildbarn/bb-storage")))
+	return flush
+}
@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opencensus.io/trace"
+)
+
+type openCensusTracer struct{}
+
+// NewOpenCensusTracer creates a Tracer that creates spans using
+// OpenCensus.
+func NewOpenCensusTracer() Tracer {
+	return openCensusTracer{}
+}
+
+func (openCensusTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := trace.StartSpan(ctx, name)
+	return ctx, openCensusSpan{span: span}
+}
+
+type openCensusSpan struct {
+	span *trace.Span
+}
+
+func convertOpenCensusAttributes(attributes []Attribute) []trace.Attribute {
+	if len(attributes) == 0 {
+		return nil
+	}
+	converted := make([]trace.Attribute, 0, len(attributes))
+	for _, attribute := range attributes {
+		switch v := attribute.value.(type) {
+		case bool:
+			converted = append(converted, trace.BoolAttribute(attribute.key, v))
+		case int64:
+			converted = append(converted, trace.Int64Attribute(attribute.key, v))
+		case string:
+			converted = append(converted, trace.StringAttribute(attribute.key, v))
+		default:
+			converted = append(converted, trace.StringAttribute(attribute.key, fmt.Sprint(v)))
+		}
+	}
+	return converted
+}
+
+func (s openCensusSpan) Annotate(attributes []Attribute, message string) {
+	s.span.Annotate(convertOpenCensusAttributes(attributes), message)
+}
+
+func (s openCensusSpan) Annotatef(attributes []Attribute, format string, args ...interface{}) {
+	s.span.Annotatef(convertOpenCensusAttributes(attributes), format, args...)
+}
+
+func (s openCensusSpan) End() {
+	s.span.End()
+}
@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	octrace "go.opencensus.io/trace"
+	"go.opentelemetry.io/otel/api/core"
+	"go.opentelemetry.io/otel/api/key"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+type openTelemetryTracer struct {
+	tracer trace.Tracer
+}
+
+// NewOpenTelemetryTracer creates a Tracer that creates spans using
+// OpenTelemetry. Span names and annotations are identical to the ones
+// created by the OpenCensus Tracer. Annotations are converted to span
+// events.
+//
+// Instrumentation of gRPC is still provided by OpenCensus. To prevent
+// spans from being detached from the requests they belong to, spans
+// created by OpenCensus are used as the remote parent of spans created
+// by this Tracer.
+func NewOpenTelemetryTracer(tracer trace.Tracer) Tracer {
+	return openTelemetryTracer{tracer: tracer}
+}
+
+func (t openTelemetryTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() && !trace.RemoteSpanContextFromContext(ctx).IsValid() {
+		if parent := octrace.FromContext(ctx); parent != nil {
+			parentSpanContext := parent.SpanContext()
+			var traceFlags byte
+			if parentSpanContext.IsSampled() {
+				traceFlags = core.TraceFlagsSampled
+			}
+			ctx = trace.ContextWithRemoteSpanContext(ctx, core.SpanContext{
+				TraceID:    core.ID(parentSpanContext.TraceID),
+				SpanID:     core.SpanID(parentSpanContext.SpanID),
+				TraceFlags: traceFlags,
+			})
+		}
+	}
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, openTelemetrySpan{ctx: ctx, span: span}
+}
+
+type openTelemetrySpan struct {
+	ctx  context.Context
+	span trace.Span
+}
+
+func convertOpenTelemetryAttributes(attributes []Attribute) []core.KeyValue {
+	if len(attributes) == 0 {
+		return nil
+	}
+	converted := make([]core.KeyValue, 0, len(attributes))
+	for _, attribute := range attributes {
+		switch v := attribute.value.(type) {
+		case bool:
+			converted = append(converted, key.Bool(attribute.key, v))
+		case int64:
+			converted = append(converted, key.Int64(attribute.key, v))
+		case string:
+			converted = append(converted, key.String(attribute.key, v))
+		default:
+			converted = append(converted, key.String(attribute.key, fmt.Sprint(v)))
+		}
+	}
+	return converted
+}
+
+func (s openTelemetrySpan) Annotate(attributes []Attribute, message string) {
+	s.span.AddEvent(s.ctx, message, convertOpenTelemetryAttributes(attributes)...)
+}
+
+func (s openTelemetrySpan) Annotatef(attributes []Attribute, format string, args ...interface{}) {
+	s.Annotate(attributes, fmt.Sprintf(format, args...))
+}
+
+func (s openTelemetrySpan) End() {
+	s.span.End()
+}
@@ -0,0 +1,60 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbarn/bb-storage/pkg/tracing"
+	"github.com/stretchr/testify/require"
+
+	octrace "go.opencensus.io/trace"
+	"go.opentelemetry.io/otel/api/core"
+	"go.opentelemetry.io/otel/api/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestOpenTelemetryTracer(t *testing.T) {
+	provider, err := sdktrace.NewProvider(sdktrace.WithConfig(sdktrace.Config{
+		DefaultSampler: sdktrace.AlwaysSample(),
+	}))
+	require.NoError(t, err)
+	tracer := tracing.NewOpenTelemetryTracer(provider.Tracer("test"))
+
+	t.Run("OpenCensusParent", func(t *testing.T) {
+		// Spans created by OpenCensus (e.g., by ocgrpc) should
+		// act as the parent of spans created through
+		// OpenTelemetry, so that they are part of the same
+		// trace.
+		ctx, parent := octrace.StartSpan(context.Background(), "grpc", octrace.WithSampler(octrace.AlwaysSample()))
+		defer parent.End()
+
+		ctx, span := tracer.StartSpan(ctx, "circularBlobAccess.Get")
+		defer span.End()
+		require.Equal(
+			t,
+			core.ID(parent.SpanContext().TraceID),
+			trace.SpanFromContext(ctx).SpanContext().TraceID)
+	})
+
+	t.Run("OpenTelemetryParent", func(t *testing.T) {
+		// Spans created through OpenTelemetry should take
+		// precedence over ones created by OpenCensus.
+		ctx, ocParent := octrace.StartSpan(context.Background(), "grpc", octrace.WithSampler(octrace.AlwaysSample()))
+		defer ocParent.End()
+		ctx, parent := tracer.StartSpan(ctx, "parent")
+		defer parent.End()
+		parentSpanContext := trace.SpanFromContext(ctx).SpanContext()
+
+		ctx, span := tracer.StartSpan(ctx, "circularBlobAccess.Get")
+		defer span.End()
+		require.Equal(t, parentSpanContext.TraceID, trace.SpanFromContext(ctx).SpanContext().TraceID)
+		require.NotEqual(t, parentSpanContext.SpanID, trace.SpanFromContext(ctx).SpanContext().SpanID)
+	})
+
+	t.Run("NoParent", func(t *testing.T) {
+		// Without any parent, a new trace should be started.
+		ctx, span := tracer.StartSpan(context.Background(), "circularBlobAccess.Get")
+		defer span.End()
+		require.True(t, trace.SpanFromContext(ctx).SpanContext().IsValid())
+	})
+}
@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+)
+
+// Attribute of a span annotation, consisting of a key and a value.
+type Attribute struct {
+	key   string
+	value interface{}
+}
+
+// BoolAttribute creates an Attribute containing a boolean value.
+func BoolAttribute(key string, value bool) Attribute {
+	return Attribute{key: key, value: value}
+}
+
+// Int64Attribute creates an Attribute containing an integer value.
+func Int64Attribute(key string, value int64) Attribute {
+	return Attribute{key: key, value: value}
+}
+
+// StringAttribute creates an Attribute containing a string value.
+func StringAttribute(key string, value string) Attribute {
+	return Attribute{key: key, value: value}
+}
+
+// Span of a trace that is currently being recorded.
+type Span interface {
+	Annotate(attributes []Attribute, message string)
+	Annotatef(attributes []Attribute, format string, args ...interface{})
+	End()
+}
+
+// Tracer is a small abstraction on top of tracing libraries such as
+// OpenCensus and OpenTelemetry. It allows code to create spans without
+// depending on a specific library, so that it remains possible to
+// switch between them while migrating.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+var (
+	tracerLock sync.RWMutex
+	tracer     Tracer = NewOpenCensusTracer()
+)
+
+// SetTracer sets the Tracer that is used by StartSpan(). Passing nil
+// restores the default behaviour, where spans are created using
+// OpenCensus.
+func SetTracer(t Tracer) {
+	if t == nil {
+		t = NewOpenCensusTracer()
+	}
+	tracerLock.Lock()
+	tracer = t
+	tracerLock.Unlock()
+}
+
+// StartSpan creates a new span using the Tracer that is currently in
+// use.
+func StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	tracerLock.RLock()
+	t := tracer
+	tracerLock.RUnlock()
+	return t.StartSpan(ctx, name)
+}
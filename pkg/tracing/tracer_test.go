@@ -0,0 +1,44 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbarn/bb-storage/pkg/tracing"
+	"github.com/stretchr/testify/require"
+
+	octrace "go.opencensus.io/trace"
+)
+
+type recordingTracer struct {
+	names []string
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, tracing.Span) {
+	t.names = append(t.names, name)
+	return tracing.NewOpenCensusTracer().StartSpan(ctx, name)
+}
+
+func TestSetTracer(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Custom", func(t *testing.T) {
+		// Spans should be created using the Tracer that is
+		// currently installed.
+		tracer := &recordingTracer{}
+		tracing.SetTracer(tracer)
+		defer tracing.SetTracer(nil)
+
+		_, span := tracing.StartSpan(ctx, "circularBlobAccess.Get")
+		span.End()
+		require.Equal(t, []string{"circularBlobAccess.Get"}, tracer.names)
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		// By default, spans should be created using
+		// OpenCensus.
+		ctx, span := tracing.StartSpan(ctx, "circularBlobAccess.Put")
+		defer span.End()
+		require.NotNil(t, octrace.FromContext(ctx))
+	})
+}
@@ -69,6 +69,9 @@ func NewDigest(instance string, partialDigest *remoteexecution.Digest) (*Digest,
 		return nil, status.Errorf(codes.InvalidArgument, "Unknown digest hash length: %d characters", l)
 	}
 	for _, c := range partialDigest.Hash {
+		if c >= 'A' && c <= 'F' {
+			return nil, status.Errorf(codes.InvalidArgument, "Uppercase hexadecimal character in digest hash: %#U", c)
+		}
 		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
 			return nil, status.Errorf(codes.InvalidArgument, "Non-hexadecimal character in digest hash: %#U", c)
 		}
@@ -202,37 +205,121 @@ func (d *Digest) String() string {
 	return d.GetKey(DigestKeyWithInstance)
 }
 
+// RemoveDuplicateDigests returns a list of digests in which every
+// digest occurs at most once, retaining the order in which digests
+// first occur. This may be used to sanitize lists of digests provided
+// by clients, so that storage backends don't perform redundant work.
+func RemoveDuplicateDigests(digests []*Digest) []*Digest {
+	seen := make(map[string]struct{}, len(digests))
+	uniqueDigests := make([]*Digest, 0, len(digests))
+	for _, digest := range digests {
+		key := digest.GetKey(DigestKeyWithInstance)
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			uniqueDigests = append(uniqueDigests, digest)
+		}
+	}
+	return uniqueDigests
+}
+
+// GetDigestFunction returns the digest function that was used to
+// compute the hash of the digest, based on the length of the hash.
+func (d *Digest) GetDigestFunction() remoteexecution.DigestFunction_Value {
+	switch len(d.hash) {
+	case md5.Size * 2:
+		return remoteexecution.DigestFunction_MD5
+	case sha1.Size * 2:
+		return remoteexecution.DigestFunction_SHA1
+	case sha256.Size * 2:
+		return remoteexecution.DigestFunction_SHA256
+	case sha512.Size384 * 2:
+		return remoteexecution.DigestFunction_SHA384
+	case sha512.Size * 2:
+		return remoteexecution.DigestFunction_SHA512
+	case vsoHashSize * 2:
+		return remoteexecution.DigestFunction_VSO
+	default:
+		log.Fatal("Digest hash is of unknown type")
+		return remoteexecution.DigestFunction_UNKNOWN
+	}
+}
+
 // NewHasher creates a standard hash.Hash object that may be used to
 // compute a checksum of data. The hash.Hash object uses the same
 // algorithm as the one that was used to create the digest, making it
 // possible to validate data against a digest.
 func (d *Digest) NewHasher() hash.Hash {
+	h, ok := d.newHasher()
+	if !ok {
+		log.Fatal("Digest hash is of unknown type")
+	}
+	return h
+}
+
+// NewHasherForDigestFunction creates a standard hash.Hash object for
+// one of the digest functions listed in SupportedDigestFunctions. This
+// may be used to validate data in case the digest function is known,
+// but no Digest object is available.
+func NewHasherForDigestFunction(digestFunction remoteexecution.DigestFunction_Value) (hash.Hash, bool) {
+	switch digestFunction {
+	case remoteexecution.DigestFunction_MD5:
+		return md5.New(), true
+	case remoteexecution.DigestFunction_SHA1:
+		return sha1.New(), true
+	case remoteexecution.DigestFunction_SHA256:
+		return sha256.New(), true
+	case remoteexecution.DigestFunction_SHA384:
+		return sha512.New384(), true
+	case remoteexecution.DigestFunction_SHA512:
+		return sha512.New(), true
+	case remoteexecution.DigestFunction_VSO:
+		return newVSOHasher(), true
+	default:
+		return nil, false
+	}
+}
+
+func (d *Digest) newHasher() (hash.Hash, bool) {
 	switch len(d.hash) {
 	case md5.Size * 2:
-		return md5.New()
+		return md5.New(), true
 	case sha1.Size * 2:
-		return sha1.New()
+		return sha1.New(), true
 	case sha256.Size * 2:
-		return sha256.New()
+		return sha256.New(), true
 	case sha512.Size384 * 2:
-		return sha512.New384()
+		return sha512.New384(), true
 	case sha512.Size * 2:
-		return sha512.New()
+		return sha512.New(), true
 	case vsoHashSize * 2:
-		return newVSOHasher()
+		return newVSOHasher(), true
 	default:
-		log.Fatal("Digest hash is of unknown type")
-		return nil
+		return nil, false
 	}
 }
 
+// IsEmptyBlob returns whether the digest corresponds to the empty blob.
+// As the hash of the empty blob differs between hashing algorithms,
+// it is computed using the algorithm that was used to create the
+// digest.
+func (d *Digest) IsEmptyBlob() bool {
+	return d.sizeBytes == 0 && d.hash == hex.EncodeToString(d.NewHasher().Sum(nil))
+}
+
 // NewDigestGenerator creates a writer that may be used to compute
-// digests of newly created files.
-func (d *Digest) NewDigestGenerator() *DigestGenerator {
+// digests of newly created files. The digest function of the digest on
+// which this method is called is used. Digests not obtained through
+// NewDigest() may lack a digest function, in which case an error is
+// returned.
+func (d *Digest) NewDigestGenerator() (*DigestGenerator, error) {
+	partialHash, ok := d.newHasher()
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Digest %#v does not have a known digest function", d.String())
+	}
 	return &DigestGenerator{
 		instance:    d.instance,
-		partialHash: d.NewHasher(),
-	}
+		partialHash: partialHash,
+	}, nil
 }
 
 // DigestGenerator is a writer that may be used to compute digests of
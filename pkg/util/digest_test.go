@@ -0,0 +1,44 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewDigestFromBytestreamPath(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		for _, hash := range []string{
+			"8b1a9953c4611296a827abf8c47804d7",
+			"a54d88e06612d820bc3be72877c74f257b561b19",
+			"185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969",
+			"3615f80c9d293ed7402687f94b22d58e529b8cc7916f8fac7fddf7fbd5af4cf777d3d795a7a00a16bf7e7f3fb9561ee9",
+			"3615f80c9d293ed7402687f94b22d58e529b8cc7916f8fac7fddf7fbd5af4cf777d3d795a7a00a16bf7e7f3fb9561ee93615f80c9d293ed7402687f94b22d58e",
+		} {
+			digest, err := util.NewDigestFromBytestreamPath("hello/blobs/" + hash + "/5")
+			require.NoError(t, err)
+			require.Equal(t, "hello", digest.GetInstance())
+			require.Equal(t, hash, digest.GetHashString())
+			require.Equal(t, int64(5), digest.GetSizeBytes())
+		}
+	})
+
+	t.Run("UppercaseHash", func(t *testing.T) {
+		_, err := util.NewDigestFromBytestreamPath("blobs/8B1A9953C4611296A827ABF8C47804D7/5")
+		require.Equal(t, status.Error(codes.InvalidArgument, "Uppercase hexadecimal character in digest hash: U+0042 'B'"), err)
+	})
+
+	t.Run("OddLengthHash", func(t *testing.T) {
+		_, err := util.NewDigestFromBytestreamPath("blobs/8b1a9953c4611296a827abf8c47804d/5")
+		require.Equal(t, status.Error(codes.InvalidArgument, "Unknown digest hash length: 31 characters"), err)
+	})
+
+	t.Run("NonHexadecimalHash", func(t *testing.T) {
+		_, err := util.NewDigestFromBytestreamPath("blobs/8b1a9953c4611296a827abf8c47804dz/5")
+		require.Equal(t, status.Error(codes.InvalidArgument, "Non-hexadecimal character in digest hash: U+007A 'z'"), err)
+	})
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"strings"
+)
+
+// InstanceNameNormalizer is a function that is applied to instance
+// names provided by clients, before they are used as part of digests.
+// It can be used to let multiple spellings of an instance name refer
+// to the same data in storage.
+//
+// Instance names that are part of the configuration (e.g., ones for
+// which Action Cache updates are permitted) should be normalized
+// using the same InstanceNameNormalizer, so that they match the
+// instance names stored in digests.
+type InstanceNameNormalizer func(instance string) string
+
+// NewInstanceNameNormalizer creates an InstanceNameNormalizer that
+// optionally converts instance names to lowercase and strips leading
+// and trailing slashes. After these transformations have been applied,
+// the instance name is looked up in a map of aliases. Alias targets
+// are used literally; they are not normalized or looked up again.
+func NewInstanceNameNormalizer(lowercase bool, trimSlashes bool, aliases map[string]string) InstanceNameNormalizer {
+	return func(instance string) string {
+		if lowercase {
+			instance = strings.ToLower(instance)
+		}
+		if trimSlashes {
+			instance = strings.Trim(instance, "/")
+		}
+		if alias, ok := aliases[instance]; ok {
+			return alias
+		}
+		return instance
+	}
+}
+
+// IdentityInstanceNameNormalizer is an InstanceNameNormalizer that
+// returns instance names as is.
+func IdentityInstanceNameNormalizer(instance string) string {
+	return instance
+}
@@ -0,0 +1,36 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/buildbarn/bb-storage/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceNameNormalizer(t *testing.T) {
+	t.Run("Identity", func(t *testing.T) {
+		require.Equal(t, "MyInstance/", util.IdentityInstanceNameNormalizer("MyInstance/"))
+
+		normalizer := util.NewInstanceNameNormalizer(false, false, nil)
+		require.Equal(t, "MyInstance/", normalizer("MyInstance/"))
+	})
+
+	t.Run("Normalized", func(t *testing.T) {
+		normalizer := util.NewInstanceNameNormalizer(true, true, nil)
+		require.Equal(t, "myinstance", normalizer("MyInstance/"))
+		require.Equal(t, "my/instance", normalizer("/My/Instance/"))
+		require.Equal(t, "", normalizer("/"))
+	})
+
+	t.Run("Aliases", func(t *testing.T) {
+		// Alias targets should be used literally. They should
+		// not be normalized or looked up again.
+		normalizer := util.NewInstanceNameNormalizer(true, false, map[string]string{
+			"legacy": "main",
+			"main":   "Other",
+		})
+		require.Equal(t, "main", normalizer("Legacy"))
+		require.Equal(t, "Other", normalizer("MAIN"))
+		require.Equal(t, "unrelated", normalizer("Unrelated"))
+	})
+}
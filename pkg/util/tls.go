@@ -3,6 +3,7 @@ package util
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"net/http"
 
 	configuration "github.com/buildbarn/bb-storage/pkg/proto/configuration/tls"
 
@@ -42,6 +43,24 @@ func NewTLSConfigFromClientConfiguration(configuration *configuration.TLSClientC
 	return &tlsConfig, nil
 }
 
+// NewHTTPTransportFromTLSClientConfiguration creates an HTTP transport
+// that uses a TLS configuration specified in a Protobuf message. This
+// permits HTTP clients to present client certificates (mutual TLS) and
+// to validate servers against private certificate authorities. The
+// default transport is returned when no configuration is provided.
+func NewHTTPTransportFromTLSClientConfiguration(configuration *configuration.TLSClientConfiguration) (http.RoundTripper, error) {
+	if configuration == nil {
+		return http.DefaultTransport, nil
+	}
+	tlsConfig, err := NewTLSConfigFromClientConfiguration(configuration)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
 // NewTLSConfigFromServerConfiguration creates a TLS configuration
 // object based on parameters specified in a Protobuf message for use
 // with a TLS server. This Protobuf message is embedded in Buildbarn